@@ -9,15 +9,18 @@ require (
 	github.com/google/go-cmp v0.3.1 // indirect
 	github.com/gorilla/mux v1.7.3
 	github.com/kr/pretty v0.1.0 // indirect
+	github.com/mozilla-services/guardian-vpn-windows/tunnel v0.0.0-00010101000000-000000000000
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/crypto v0.0.0-20191029031824-8986dd9e96cf // indirect
-	golang.org/x/net v0.0.0-20191101175033-0deb6923b6d9
-	golang.org/x/sys v0.0.0-20191104094858-e8c54fb511f6
+	golang.org/x/crypto v0.0.0-20191227163750-53104e6ec876 // indirect
+	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
+	golang.org/x/sys v0.0.0-20200107162124-548cf772de50
 	golang.org/x/text v0.3.2
-	golang.zx2c4.com/wireguard v0.0.20191013-0.20191022095125-f7d0edd2ecf5
-	golang.zx2c4.com/wireguard/windows v0.0.35
+	golang.zx2c4.com/wireguard v0.0.20191013-0.20200107164045-4fa2ea6a2dab
+	golang.zx2c4.com/wireguard/windows v0.0.38
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/yaml.v2 v2.2.5 // indirect
 	gotest.tools v2.2.0+incompatible
 )
+
+replace github.com/mozilla-services/guardian-vpn-windows/tunnel => ../tunnel
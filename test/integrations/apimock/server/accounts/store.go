@@ -0,0 +1,141 @@
+package accounts
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+)
+
+// DefaultToken is the API token of requests without an Authorization header,
+// so that the test harness has an account of its own.
+const DefaultToken = "verification_token_sample"
+
+// NewVerificationToken returns a random token for the verification URL of a
+// login.
+func NewVerificationToken() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return "token-" + hex.EncodeToString(b[:])
+}
+
+// LoginToken returns the API token that the login with a verification token
+// gets. It is derived from the verification token, so that polls of the same
+// login get the same account, and other logins get their own.
+func LoginToken(verificationToken string) string {
+	hash := sha256.Sum256([]byte("apimock login " + verificationToken))
+	return "login-" + hex.EncodeToString(hash[:12])
+}
+
+// TokenFromRequest returns the bearer token of a request, or DefaultToken.
+func TokenFromRequest(r *http.Request) string {
+	header := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		if token := strings.TrimSpace(header[len("Bearer "):]); token != "" {
+			return token
+		}
+	}
+	return DefaultToken
+}
+
+// NewAccount returns the account every token starts with: an active
+// subscription and two devices.
+func NewAccount() models.AccountDetails {
+	return models.AccountDetails{
+		Email:       "johndoe@example.com",
+		DisplayName: "John Doe",
+		Avatar:      "https://example.com/avatar.jpg",
+		Subscriptions: models.AccountDetailsSubscriptions{
+			Vpn: models.AccountDetailsSubscriptionsVpn{
+				Active:    true,
+				CreatedAt: "2019-08-01T10:22:16.853Z",
+				RenewsOn:  "2019-08-01T10:22:16.853Z",
+			},
+		},
+		Devices: []models.GuardianDevice{
+			{
+				Name:        "Windows-4242",
+				Pubkey:      "123456",
+				Ipv4Address: "10.99.0.1/32",
+				Ipv6Address: "fc00:bbbb:bbbb:bb01::1/128",
+				CreatedAt:   "2019-08-01T10:22:16.853Z",
+			},
+			{
+				Name:        "Android-2424",
+				Pubkey:      "987654",
+				Ipv4Address: "10.99.0.1/32",
+				Ipv6Address: "fc00:bbbb:bbbb:bb01::1/128",
+				CreatedAt:   "2019-08-01T10:22:16.853Z",
+			},
+		},
+		MaxDevices: 5,
+	}
+}
+
+// Store keeps an account per API token. Accounts are created on first use,
+// so simulated users only need distinct tokens.
+type Store struct {
+	mutex    sync.Mutex
+	accounts map[string]*models.AccountDetails
+}
+
+// NewStore returns an empty store.
+func NewStore() *Store {
+	return &Store{accounts: make(map[string]*models.AccountDetails)}
+}
+
+func clone(account *models.AccountDetails) models.AccountDetails {
+	copied := *account
+	copied.Devices = append([]models.GuardianDevice(nil), account.Devices...)
+	return copied
+}
+
+// account returns the account of a token, creating it. The mutex is held.
+func (s *Store) account(token string) *models.AccountDetails {
+	account := s.accounts[token]
+	if account == nil {
+		created := NewAccount()
+		account = &created
+		s.accounts[token] = account
+	}
+	return account
+}
+
+// Get returns a copy of the account of a token.
+func (s *Store) Get(token string) models.AccountDetails {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return clone(s.account(token))
+}
+
+// Update changes the account of a token under the lock, and returns a copy
+// of the result. Changes are dropped if update returns an error.
+func (s *Store) Update(token string, update func(account *models.AccountDetails) error) (models.AccountDetails, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	account := s.account(token)
+	changed := clone(account)
+	if err := update(&changed); err != nil {
+		return clone(account), err
+	}
+	*account = changed
+	return clone(account), nil
+}
+
+// Len returns the number of accounts.
+func (s *Store) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.accounts)
+}
+
+// Reset forgets all accounts.
+func (s *Store) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.accounts = make(map[string]*models.AccountDetails)
+}
@@ -0,0 +1,146 @@
+package accounts
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenFromRequest(t *testing.T) {
+	tests := map[string]string{
+		"":                 "verification_token_sample",
+		"Bearer abc":       "abc",
+		"bearer  abc ":     "abc",
+		"Bearer ":          "verification_token_sample",
+		"Basic dXNlcjpwdw": "verification_token_sample",
+	}
+	for header, expected := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/vpn/account", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		assert.Equal(t, expected, TokenFromRequest(r), header)
+	}
+}
+
+func TestAccountsAreIsolated(t *testing.T) {
+	s := NewStore()
+	_, err := s.Update("alice", func(account *models.AccountDetails) error {
+		account.Subscriptions.Vpn.Active = false
+		account.Devices = append(account.Devices, models.GuardianDevice{Pubkey: "alice-key"})
+		return nil
+	})
+	assert.NoError(t, err)
+
+	alice, bob := s.Get("alice"), s.Get("bob")
+	assert.False(t, alice.Subscriptions.Vpn.Active)
+	assert.Len(t, alice.Devices, 3)
+	assert.True(t, bob.Subscriptions.Vpn.Active)
+	assert.Len(t, bob.Devices, 2)
+	assert.Equal(t, 2, s.Len())
+
+	// Copies do not share devices with the store
+	alice.Devices[0].Pubkey = "changed"
+	assert.Equal(t, "123456", s.Get("alice").Devices[0].Pubkey)
+
+	// Failed updates are dropped
+	_, err = s.Update("bob", func(account *models.AccountDetails) error {
+		account.Devices = nil
+		return fmt.Errorf("Rejected")
+	})
+	assert.Error(t, err)
+	assert.Len(t, s.Get("bob").Devices, 2)
+
+	s.Reset()
+	assert.Equal(t, 0, s.Len())
+	assert.True(t, s.Get("alice").Subscriptions.Vpn.Active)
+}
+
+func TestLoginToken(t *testing.T) {
+	assert.Equal(t, LoginToken("active"), LoginToken("active"))
+	assert.NotEqual(t, LoginToken("active"), LoginToken("inactive"))
+	assert.NotEqual(t, DefaultToken, LoginToken(DefaultToken))
+	assert.NotEqual(t, NewVerificationToken(), NewVerificationToken())
+}
+
+func TestConcurrentAccounts(t *testing.T) {
+	const users, devices = 16, 50
+	s := NewStore()
+	var wg sync.WaitGroup
+	for u := 0; u < users; u++ {
+		token := fmt.Sprintf("user-%d", u)
+		for d := 0; d < devices; d++ {
+			wg.Add(2)
+			pubkey := fmt.Sprintf("%s-device-%d", token, d)
+			go func() {
+				defer wg.Done()
+				s.Update(token, func(account *models.AccountDetails) error {
+					account.Devices = append(account.Devices, models.GuardianDevice{Pubkey: pubkey})
+					return nil
+				})
+			}()
+			go func() {
+				defer wg.Done()
+				account := s.Get(token)
+				for _, device := range account.Devices {
+					_ = device.Pubkey
+				}
+			}()
+		}
+
+		// Every user also flips their subscription, which others must not see
+		wg.Add(1)
+		go func(u int) {
+			defer wg.Done()
+			s.Update(token, func(account *models.AccountDetails) error {
+				account.Subscriptions.Vpn.Active = u%2 == 0
+				return nil
+			})
+		}(u)
+	}
+	wg.Wait()
+
+	assert.Equal(t, users, s.Len())
+	for u := 0; u < users; u++ {
+		account := s.Get(fmt.Sprintf("user-%d", u))
+		assert.Len(t, account.Devices, devices+2)
+		assert.Equal(t, u%2 == 0, account.Subscriptions.Vpn.Active)
+		seen := make(map[string]bool)
+		for _, device := range account.Devices {
+			assert.False(t, seen[device.Pubkey], "Duplicate device %s", device.Pubkey)
+			seen[device.Pubkey] = true
+		}
+	}
+}
+
+func TestConcurrentAddRemove(t *testing.T) {
+	s := NewStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pubkey := fmt.Sprintf("device-%d", i)
+			s.Update(DefaultToken, func(account *models.AccountDetails) error {
+				account.Devices = append(account.Devices, models.GuardianDevice{Pubkey: pubkey})
+				return nil
+			})
+			s.Update(DefaultToken, func(account *models.AccountDetails) error {
+				var kept []models.GuardianDevice
+				for _, device := range account.Devices {
+					if device.Pubkey != pubkey {
+						kept = append(kept, device)
+					}
+				}
+				account.Devices = kept
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, s.Get(DefaultToken).Devices, 2)
+}
@@ -10,68 +10,29 @@
 package server
 
 import (
-	"crypto/sha512"
-	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/accounts"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/balrog"
 	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
 )
 
-var subscriptionStatus = true
-var devices = []models.GuardianDevice{
-	models.GuardianDevice{
-		Name:        "Windows-4242",
-		Pubkey:      "123456",
-		Ipv4Address: "10.99.0.1/32",
-		Ipv6Address: "fc00:bbbb:bbbb:bb01::1/128",
-		CreatedAt:   "2019-08-01T10:22:16.853Z",
-	},
-	models.GuardianDevice{
-		Name:        "Android-2424",
-		Pubkey:      "987654",
-		Ipv4Address: "10.99.0.1/32",
-		Ipv6Address: "fc00:bbbb:bbbb:bb01::1/128",
-		CreatedAt:   "2019-08-01T10:22:16.853Z",
-	},
-}
-var subcriptionVpn = models.AccountDetailsSubscriptionsVpn{
-	Active:    subscriptionStatus,
-	CreatedAt: "2019-08-01T10:22:16.853Z",
-	RenewsOn:  "2019-08-01T10:22:16.853Z",
-}
-var accountDetailsSubscriptions = models.AccountDetailsSubscriptions{
-	Vpn: subcriptionVpn,
-}
-var accountDetails = models.AccountDetails{
-	Email:         "johndoe@example.com",
-	DisplayName:   "John Doe",
-	Avatar:        "https://example.com/avatar.jpg",
-	Subscriptions: accountDetailsSubscriptions,
-	MaxDevices:    5,
-}
-var expiredAccountDetails = models.ErrorSchema{
-	Code:  401,
-	Errno: 120,
-	Error: "User doesn't have an active subscription",
-}
-
 // ApiV1VpnAccountGet - Account Information
 func (router *Router) ApiV1VpnAccountGet(w http.ResponseWriter, r *http.Request) {
-	if subscriptionStatus {
+	account := router.accounts.Get(accounts.TokenFromRequest(r))
+	if account.Subscriptions.Vpn.Active {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusOK)
-		accountDetails.Devices = devices
-		accountDetails.Subscriptions.Vpn.Active = subscriptionStatus
 
-		js, err := json.Marshal(accountDetails)
+		js, err := json.Marshal(account)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -92,56 +53,135 @@ func (router *Router) ApiV1VpnAccountGet(w http.ResponseWriter, r *http.Request)
 
 // ApiV1VpnDevicePost - Add Device
 func (router *Router) ApiV1VpnDevicePost(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
 	decoder := json.NewDecoder(r.Body)
 	var t models.GuardianDevice
-	err := decoder.Decode(&t)
-
-	if err != nil {
-		panic(err)
+	if err := decoder.Decode(&t); err != nil || t.Name == "" {
+		writeError(w, errMalformedBody)
+		return
+	}
+	if key, err := keys.NewKeyFromString(t.Pubkey); err != nil || key.IsZero() {
+		writeError(w, errInvalidKey)
+		return
 	}
-	allowedIP, _ := router.wg.AddClient(t.Pubkey)
-	var device = models.GuardianDevice{
+
+	// The slot is reserved under the lock of the store, so concurrent
+	// requests cannot go over the limit, and the peer is added outside it
+	token := accounts.TokenFromRequest(r)
+	device := models.GuardianDevice{
 		Name:        t.Name,
 		Pubkey:      t.Pubkey,
-		Ipv4Address: allowedIP,
 		Ipv6Address: "fc00:bbbb:bbbb:bb01::1/128",
 		CreatedAt:   "2019-08-01T10:22:16.853Z",
 	}
-	devices = append(devices, device)
+	var failure *models.ErrorSchema
+	_, err := router.accounts.Update(token, func(account *models.AccountDetails) error {
+		for _, existing := range account.Devices {
+			if existing.Pubkey == t.Pubkey {
+				failure = &errDuplicateDevice
+				return errors.New(failure.Error)
+			}
+		}
+		if len(account.Devices) >= account.MaxDevices {
+			failure = &errDeviceLimit
+			return errors.New(failure.Error)
+		}
+		account.Devices = append(account.Devices, device)
+		return nil
+	})
+	if err != nil {
+		writeError(w, *failure)
+		return
+	}
+
+	device.Ipv4Address, err = router.wg.AddClient(t.Pubkey)
+	if err != nil {
+		log.Printf("Unable to add client %s: %v", t.Pubkey, err)
+		router.accounts.Update(token, func(account *models.AccountDetails) error {
+			account.Devices = withoutDevice(account.Devices, t.Pubkey)
+			return nil
+		})
+		writeError(w, errWireGuard)
+		return
+	}
+	_, err = router.accounts.Update(token, func(account *models.AccountDetails) error {
+		for i := range account.Devices {
+			if account.Devices[i].Pubkey == t.Pubkey {
+				account.Devices[i].Ipv4Address = device.Ipv4Address
+				return nil
+			}
+		}
+		return errors.New(errUnknownDevice.Error)
+	})
+	if err != nil {
+		// The device was removed before its peer was added
+		if err := router.wg.RemoveClient(t.Pubkey); err != nil {
+			log.Printf("Unable to remove client %s: %v", t.Pubkey, err)
+		}
+		writeError(w, errUnknownDevice)
+		return
+	}
+
 	js, err := json.Marshal(device)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
 	w.Write(js)
 }
 
 // ApiV1VpnDevicePubkeyDelete - Remove Device
 func (router *Router) ApiV1VpnDevicePubkeyDelete(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	pubKey := vars["pubkey"]
+	pubKey, err := url.PathUnescape(vars["pubkey"])
+	if err != nil {
+		writeError(w, errUnknownDevice)
+		return
+	}
+
+	_, err = router.accounts.Update(accounts.TokenFromRequest(r), func(account *models.AccountDetails) error {
+		newDevices := withoutDevice(account.Devices, pubKey)
+		if len(newDevices) == len(account.Devices) {
+			return errors.New(errUnknownDevice.Error)
+		}
+		account.Devices = newDevices
+		return nil
+	})
+	if err != nil {
+		writeError(w, errUnknownDevice)
+		return
+	}
 
+	// The sample devices are not on the WireGuard server
+	if _, err := keys.NewKeyFromString(pubKey); err == nil {
+		if err := router.wg.RemoveClient(pubKey); err != nil {
+			log.Printf("Unable to remove client %s: %v", pubKey, err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// withoutDevice returns the devices but the one with a public key.
+func withoutDevice(devices []models.GuardianDevice, pubkey string) []models.GuardianDevice {
 	var newDevices []models.GuardianDevice
 	for _, device := range devices {
-		if device.Pubkey != pubKey {
+		if device.Pubkey != pubkey {
 			newDevices = append(newDevices, device)
 		}
 	}
-	devices = newDevices
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusNoContent)
+	return newDevices
 }
 
 // ApiV1VpnLoginPost - Token-based authentication flow.
 func (router *Router) ApiV1VpnLoginPost(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
+	token := accounts.NewVerificationToken()
 	var loginResponse = models.LoginResponse{
-		LoginUrl:        "https://guardian-dev.herokuapp.com/oauth/client/login/token-1234567890",
-		VerificationUrl: "http://localhost:8080/v1/vpn/login/verify/token-1234567890",
+		LoginUrl:        "https://guardian-dev.herokuapp.com/oauth/client/login/" + token,
+		VerificationUrl: "http://localhost:8080/v1/vpn/login/verify/" + token,
 		ExpiresOn:       "2099-08-01T10:22:16.853Z",
 		PollInterval:    20,
 	}
@@ -235,18 +275,22 @@ func (router *Router) ApiV1VpnVersionsGet(w http.ResponseWriter, r *http.Request
 	w.Write(js)
 }
 
-// V1VpnLoginVerifyTokenGet - Check authentication status.
+// V1VpnLoginVerifyTokenGet - Check authentication status. Each verification
+// token logs in to an account of its own, whose subscription is inactive when
+// the verification token contains "inactive".
 func (router *Router) V1VpnLoginVerifyTokenGet(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 	vars := mux.Vars(r)
-	token := vars["token"]
-	accountDetails.Devices = devices
-	subscriptionStatus = !strings.Contains(token, "inactive")
-	accountDetails.Subscriptions.Vpn.Active = subscriptionStatus
+	verificationToken := vars["token"]
+	token := accounts.LoginToken(verificationToken)
+	account, _ := router.accounts.Update(token, func(account *models.AccountDetails) error {
+		account.Subscriptions.Vpn.Active = !strings.Contains(verificationToken, "inactive")
+		return nil
+	})
 	var response = models.VerifyTokenResponse{
-		User:  accountDetails,
-		Token: "verification_token_sample",
+		User:  account,
+		Token: token,
 	}
 	js, err := json.Marshal(response)
 	if err != nil {
@@ -256,52 +300,49 @@ func (router *Router) V1VpnLoginVerifyTokenGet(w http.ResponseWriter, r *http.Re
 	w.Write(js)
 }
 
+// BalrogVersionGet - The update of the scenario of the client version
 func (router *Router) BalrogVersionGet(w http.ResponseWriter, r *http.Request) {
-	var reqHost = r.Host
-	mockMSIHashValue := getHashValue()
-	stuffToSign := []byte(fmt.Sprintf(`{"version": "0.5.1.1", "url": "http://localhost:8080/downloads/vpn/MozillaVPN.msi", "required": true, "hashFunction": "sha512", "hashValue": "%s"}`, mockMSIHashValue))
-	signedStuff, err := router.chain.Sign(stuffToSign)
+	scenario := router.scenarios.Select(mux.Vars(r)["version"])
+	chain, err := router.scenarios.Chain(scenario.Name, router.chain)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "Error: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	vars := mux.Vars(r)
-	version := vars["version"]
-	missingSignature := false
-	contentSignature := ""
-	switch version {
-	case "0.0.0.0":
-		missingSignature = true
-	case "0.0.0.1":
-		signedStuff[3] ^= 1
-	case "0.0.0.2":
-		wrongHashValue := generateHashValue("wronghash")
-		stuffToSign = []byte(fmt.Sprintf(`{"version": "0.5.1.1", "url": "http://localhost:8080/downloads/vpn/MozillaVPN.msi", "required": true, "hashFunction": "sha512", "hashValue": "%s"}`, wrongHashValue))
-		signedStuff, _ = router.chain.Sign(stuffToSign)
-	case "0.0.0.3":
-		stuffToSign = []byte(`{"version": "0.5.1.1", "url": "http://localhost:8080/downloads/vpn/MozillaVPN.msi", "required": true, "hashFunction": "sha512", "hashValue": ""}`)
-		signedStuff, _ = router.chain.Sign(stuffToSign)
-	case "0.0.0.4":
-		stuffToSign = []byte(`{"version": "0.5.1.1", whatever}`)
-		signedStuff, _ = router.chain.Sign(stuffToSign)
-	}
-	if !missingSignature {
-		contentSignature = fmt.Sprintf("; p384ecdsa=%s", base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(signedStuff))
+	update, err := scenario.Render(r.Host, chain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	w.Header().Set("alt-svc", "Clear")
 	w.Header().Set("content-security-policy", "default-src 'none'; frame-ancestors 'none'")
 	w.Header().Set("content-type", "application/json")
-	w.Header().Set("content-signature", fmt.Sprintf("x5u=http://%s/chains/sigtest.chain%s", reqHost, contentSignature))
-	w.Write(stuffToSign)
+	if update.ContentSignature != "" {
+		w.Header().Set("content-signature", update.ContentSignature)
+	}
+	w.Write(update.Body)
+}
+
+// scenarioChain returns the chain of the scenario query parameter.
+func (router *Router) scenarioChain(w http.ResponseWriter, r *http.Request) *balrog.Chain {
+	chain, err := router.scenarios.Chain(r.URL.Query().Get("scenario"), router.chain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return chain
 }
 
 func (router *Router) BalrogRootSignatureGet(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, router.chain.RootCertificateSignature)
+	if chain := router.scenarioChain(w, r); chain != nil {
+		fmt.Fprintf(w, chain.RootCertificateSignature)
+	}
 }
 
 func (router *Router) BalrogSigtestChainGet(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("content-type", "pem-certificate-chain")
-	fmt.Fprintf(w, router.chain.String())
+	if chain := router.scenarioChain(w, r); chain != nil {
+		w.Header().Set("content-type", "pem-certificate-chain")
+		fmt.Fprintf(w, chain.String())
+	}
 }
 func (router *Router) BalrogRegenerateCertPost(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
@@ -333,7 +374,10 @@ func (router *Router) UpdateSubscriptionStatusPost(w http.ResponseWriter, r *htt
 	if err != nil {
 		panic(err)
 	}
-	subscriptionStatus = t.Active
+	router.accounts.Update(accounts.TokenFromRequest(r), func(account *models.AccountDetails) error {
+		account.Subscriptions.Vpn.Active = t.Active
+		return nil
+	})
 	js, err := json.Marshal(t)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -343,26 +387,12 @@ func (router *Router) UpdateSubscriptionStatusPost(w http.ResponseWriter, r *htt
 	w.Write(js)
 }
 
+// DownloadMSI - The MSI of the scenario query parameter, or of the active or
+// default scenario
 func (router *Router) DownloadMSI(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "../mockinstaller/x64/MozillaMockVPN.msi")
-}
-
-func getHashValue() string {
-	f, err := os.Open("../mockinstaller/x64/MozillaMockVPN.msi")
-	if err != nil {
-		log.Fatal(err)
+	scenario, ok := router.scenarios.Named(r.URL.Query().Get("scenario"))
+	if !ok {
+		scenario = router.scenarios.Select("")
 	}
-	defer f.Close()
-
-	h := sha512.New()
-	if _, err := io.Copy(h, f); err != nil {
-		log.Fatal(err)
-	}
-	return hex.EncodeToString(h.Sum(nil))
-}
-
-func generateHashValue(text string) string {
-	h := sha512.New()
-	h.Write([]byte(text))
-	return hex.EncodeToString(h.Sum(nil))
+	scenario.MSI.ServeHTTP(w, r)
 }
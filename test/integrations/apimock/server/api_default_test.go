@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/accounts"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/fakewg"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/routes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRouter(t *testing.T) (*Router, *mux.Router) {
+	wg, err := fakewg.NewServerWithRoutes(routes.NewFakeTable())
+	require.NoError(t, err)
+	router := &Router{wg: wg, accounts: accounts.NewStore()}
+	return router, router.handler()
+}
+
+func newPublicKey(t *testing.T) string {
+	key, err := keys.NewPrivateKey()
+	require.NoError(t, err)
+	return key.Public().String()
+}
+
+func do(m http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, r)
+	return w
+}
+
+func addDevice(m http.Handler, token, name, pubkey string) *httptest.ResponseRecorder {
+	return do(m, "POST", "/api/v1/vpn/device", token, fmt.Sprintf(`{"name": %q, "pubkey": %q}`, name, pubkey))
+}
+
+func assertError(t *testing.T, w *httptest.ResponseRecorder, expected models.ErrorSchema) {
+	var e models.ErrorSchema
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &e), w.Body.String())
+	assert.Equal(t, int(expected.Code), w.Code)
+	assert.Equal(t, expected, e)
+}
+
+func TestAddDevice(t *testing.T) {
+	router, m := newTestRouter(t)
+	defer router.wg.Close()
+
+	pubkey := newPublicKey(t)
+	w := addDevice(m, "alice", "Windows-1", pubkey)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var device models.GuardianDevice
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &device))
+	assert.Equal(t, pubkey, device.Pubkey)
+	assert.NotEmpty(t, device.Ipv4Address)
+
+	clients, err := router.wg.Clients()
+	require.NoError(t, err)
+	assert.Len(t, clients, 1)
+
+	assertError(t, addDevice(m, "alice", "Windows-2", pubkey), errDuplicateDevice)
+	assert.Len(t, router.accounts.Get("alice").Devices, 3)
+
+	// Other accounts are not affected
+	assert.Len(t, router.accounts.Get("bob").Devices, 2)
+}
+
+func TestAddDeviceErrors(t *testing.T) {
+	router, m := newTestRouter(t)
+	defer router.wg.Close()
+
+	tests := []struct {
+		name string
+		body string
+		err  models.ErrorSchema
+	}{
+		{"Not JSON", `{"name": `, errMalformedBody},
+		{"Wrong type", `{"name": 42, "pubkey": "x"}`, errMalformedBody},
+		{"Missing name", fmt.Sprintf(`{"pubkey": %q}`, newPublicKey(t)), errMalformedBody},
+		{"Missing key", `{"name": "Windows"}`, errInvalidKey},
+		{"Invalid key", `{"name": "Windows", "pubkey": "TestAddDevice"}`, errInvalidKey},
+		{"Zero key", `{"name": "Windows", "pubkey": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`, errInvalidKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertError(t, do(m, "POST", "/api/v1/vpn/device", "", test.body), test.err)
+		})
+	}
+	assert.Len(t, router.accounts.Get(accounts.DefaultToken).Devices, 2)
+}
+
+func TestDeviceLimit(t *testing.T) {
+	router, m := newTestRouter(t)
+	defer router.wg.Close()
+
+	// The sample devices count towards the limit of 5
+	for i := 0; i < 3; i++ {
+		w := addDevice(m, "", fmt.Sprintf("Windows-%d", i), newPublicKey(t))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	assertError(t, addDevice(m, "", "Windows-4", newPublicKey(t)), errDeviceLimit)
+
+	// Removing a device makes room again
+	w := do(m, "DELETE", "/api/v1/vpn/device/123456", "", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = addDevice(m, "", "Windows-5", newPublicKey(t))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestRemoveDevice(t *testing.T) {
+	router, m := newTestRouter(t)
+	defer router.wg.Close()
+
+	pubkey := newPublicKey(t)
+	require.Equal(t, http.StatusOK, addDevice(m, "alice", "Windows", pubkey).Code)
+
+	// Devices can only be removed from their own account
+	assertError(t, do(m, "DELETE", "/api/v1/vpn/device/"+url.PathEscape(pubkey), "bob", ""), errUnknownDevice)
+
+	w := do(m, "DELETE", "/api/v1/vpn/device/"+url.PathEscape(pubkey), "alice", "")
+	assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	clients, err := router.wg.Clients()
+	require.NoError(t, err)
+	assert.Len(t, clients, 0)
+
+	assertError(t, do(m, "DELETE", "/api/v1/vpn/device/unknown", "alice", ""), errUnknownDevice)
+}
+
+func TestAccountGet(t *testing.T) {
+	router, m := newTestRouter(t)
+	defer router.wg.Close()
+
+	router.accounts.Update("expired", func(account *models.AccountDetails) error {
+		account.Subscriptions.Vpn.Active = false
+		return nil
+	})
+	assertError(t, do(m, "GET", "/api/v1/vpn/account", "expired", ""), expiredAccountDetails)
+
+	w := do(m, "GET", "/api/v1/vpn/account", "active", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var account models.AccountDetails
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &account))
+	assert.Len(t, account.Devices, 2)
+}
+
+func TestLoginVerify(t *testing.T) {
+	router, m := newTestRouter(t)
+	defer router.wg.Close()
+
+	verify := func(verificationToken string) models.VerifyTokenResponse {
+		w := do(m, "GET", "/v1/vpn/login/verify/"+verificationToken, "", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response models.VerifyTokenResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	// Logins get tokens of their own, and keep them while polling
+	var login models.LoginResponse
+	require.NoError(t, json.Unmarshal(do(m, "POST", "/api/v1/vpn/login", "", "").Body.Bytes(), &login))
+	verificationToken := login.VerificationUrl[strings.LastIndex(login.VerificationUrl, "/")+1:]
+	active := verify(verificationToken)
+	assert.True(t, active.User.Subscriptions.Vpn.Active)
+	assert.NotEqual(t, accounts.DefaultToken, active.Token)
+	assert.Equal(t, active.Token, verify(verificationToken).Token)
+
+	require.NoError(t, json.Unmarshal(do(m, "POST", "/api/v1/vpn/login", "", "").Body.Bytes(), &login))
+	assert.NotContains(t, login.VerificationUrl, verificationToken)
+
+	// The subscription state belongs to the account of the login
+	inactive := verify("inactive-" + verificationToken)
+	assert.False(t, inactive.User.Subscriptions.Vpn.Active)
+	assert.NotEqual(t, active.Token, inactive.Token)
+	assert.True(t, router.accounts.Get(active.Token).Subscriptions.Vpn.Active)
+	assert.False(t, router.accounts.Get(inactive.Token).Subscriptions.Vpn.Active)
+	assert.True(t, router.accounts.Get(accounts.DefaultToken).Subscriptions.Vpn.Active)
+
+	w := do(m, "GET", "/api/v1/vpn/account", inactive.Token, "")
+	var account models.AccountDetails
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &account))
+	assert.False(t, account.Subscriptions.Vpn.Active)
+}
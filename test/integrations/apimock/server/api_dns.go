@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/dnsauth"
+)
+
+type dnsQueriesResponse struct {
+	Zone    string                     `json:"zone"`
+	Address string                     `json:"address"`
+	Queries map[string][]dnsauth.Query `json:"queries"`
+}
+
+// DNSQueriesGet - Where the DNS leak test zone is served, and the queries it received
+func (router *Router) DNSQueriesGet(w http.ResponseWriter, r *http.Request) {
+	js, err := json.Marshal(dnsQueriesResponse{
+		Zone:    router.dns.Zone(),
+		Address: router.dns.Addr().String(),
+		Queries: router.dns.AllQueries(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+// DNSLabelQueriesGet - The queries for a name in the DNS leak test zone
+func (router *Router) DNSLabelQueriesGet(w http.ResponseWriter, r *http.Request) {
+	queries := router.dns.Queries(mux.Vars(r)["label"])
+	if queries == nil {
+		queries = []dnsauth.Query{}
+	}
+	js, err := json.Marshal(queries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+// DNSQueriesDelete - Forget the queries of the DNS leak test zone
+func (router *Router) DNSQueriesDelete(w http.ResponseWriter, r *http.Request) {
+	router.dns.Reset()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+)
+
+// The errors of the mock, with the HTTP status and errno of the Guardian API
+var (
+	errMalformedBody = models.ErrorSchema{
+		Code:  http.StatusBadRequest,
+		Errno: 100,
+		Error: "Request body is not valid JSON, or is missing required fields",
+	}
+	errInvalidKey = models.ErrorSchema{
+		Code:  http.StatusBadRequest,
+		Errno: 101,
+		Error: "Public key must be a base64 encoded 32 byte WireGuard key",
+	}
+	errDeviceLimit = models.ErrorSchema{
+		Code:  http.StatusBadRequest,
+		Errno: 102,
+		Error: "Account has reached its device limit",
+	}
+	errDuplicateDevice = models.ErrorSchema{
+		Code:  http.StatusConflict,
+		Errno: 103,
+		Error: "A device with this public key already exists",
+	}
+	errUnknownDevice = models.ErrorSchema{
+		Code:  http.StatusNotFound,
+		Errno: 104,
+		Error: "No device with this public key",
+	}
+	errWireGuard = models.ErrorSchema{
+		Code:  http.StatusInternalServerError,
+		Errno: 105,
+		Error: "Unable to add the device to the WireGuard server",
+	}
+	expiredAccountDetails = models.ErrorSchema{
+		Code:  http.StatusUnauthorized,
+		Errno: 120,
+		Error: "User doesn't have an active subscription",
+	}
+)
+
+// writeError writes an ErrorSchema body with its HTTP status.
+func writeError(w http.ResponseWriter, e models.ErrorSchema) {
+	js, err := json.Marshal(e)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(int(e.Code))
+	w.Write(js)
+}
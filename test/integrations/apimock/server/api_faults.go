@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/faults"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+)
+
+func writeFaultError(w http.ResponseWriter, status int, err error) {
+	writeError(w, models.ErrorSchema{Code: int32(status), Errno: 110, Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// FaultsGet - The faults attached to routes
+func (router *Router) FaultsGet(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, router.faults.List())
+}
+
+// FaultsPost - Attach a fault to a route
+func (router *Router) FaultsPost(w http.ResponseWriter, r *http.Request) {
+	var fault faults.Fault
+	if err := json.NewDecoder(r.Body).Decode(&fault); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+	fault, err := router.faults.Add(fault)
+	if err != nil {
+		writeFaultError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, fault)
+}
+
+// FaultsDelete - Remove the faults of the scope query parameter, or all faults
+func (router *Router) FaultsDelete(w http.ResponseWriter, r *http.Request) {
+	var removed int
+	if scope, ok := r.URL.Query()["scope"]; ok {
+		removed = router.faults.Reset(scope[0], false)
+	} else {
+		removed = router.faults.Reset("", true)
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+}
+
+// FaultDelete - Remove a fault
+func (router *Router) FaultDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err == nil {
+		err = router.faults.Remove(id)
+	}
+	if err != nil {
+		writeFaultError(w, http.StatusNotFound, faults.ErrNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/faults"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultsAdmin(t *testing.T) {
+	router, m := newTestRouter(t)
+	defer router.wg.Close()
+
+	w := do(m, "POST", "/__admin/faults", "", `{"route": "ApiV1VpnAccountGet", "status": 503, "scope": "alice", "times": 1}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var fault faults.Fault
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &fault))
+	assert.Equal(t, 1, fault.ID)
+
+	assertError(t, do(m, "GET", "/api/v1/vpn/account", "alice", ""), *fault.Error)
+	assert.Equal(t, http.StatusOK, do(m, "GET", "/api/v1/vpn/account", "alice", "").Code)
+	assert.Equal(t, http.StatusOK, do(m, "GET", "/api/v1/vpn/account", "bob", "").Code)
+
+	w = do(m, "GET", "/__admin/faults", "", "")
+	var list []faults.Fault
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, 1, list[0].Hits)
+
+	assertError(t, do(m, "POST", "/__admin/faults", "", `{"route": "Missing", "status": 500}`), models.ErrorSchema{Code: 400, Errno: 110, Error: faults.ErrUnknownRoute.Error()})
+	assertError(t, do(m, "POST", "/__admin/faults", "", `{"route":`), errMalformedBody)
+	assertError(t, do(m, "POST", "/__admin/faults", "", `{"route": "DNSQueriesGet", "status": 500}`), models.ErrorSchema{Code: 400, Errno: 110, Error: faults.ErrUnknownRoute.Error()})
+
+	w = do(m, "POST", "/__admin/faults", "", `{"route": "ApiV1VpnAccountGet", "status": 500, "scope": "bob"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, `{"removed":1}`, do(m, "DELETE", "/__admin/faults?scope=alice", "", "").Body.String())
+	assert.Equal(t, http.StatusInternalServerError, do(m, "GET", "/api/v1/vpn/account", "bob", "").Code)
+	assert.Equal(t, http.StatusNoContent, do(m, "DELETE", "/__admin/faults/2", "", "").Code)
+	assertError(t, do(m, "DELETE", "/__admin/faults/2", "", ""), models.ErrorSchema{Code: 404, Errno: 110, Error: faults.ErrNotFound.Error()})
+	assert.Equal(t, http.StatusOK, do(m, "GET", "/api/v1/vpn/account", "bob", "").Code)
+
+	do(m, "POST", "/__admin/faults", "", `{"route": "ApiV1VpnAccountGet", "latency_ms": 1}`)
+	assert.Equal(t, `{"removed":1}`, do(m, "DELETE", "/__admin/faults", "", "").Body.String())
+}
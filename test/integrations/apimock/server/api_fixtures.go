@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/fixtures"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+)
+
+// Environment variables of the record and replay modes
+const (
+	// ModeEnv is "record" to forward to the upstream APIs and record
+	// fixtures, or "replay" to serve the fixtures. Otherwise the mock serves
+	// its own handlers.
+	ModeEnv = "APIMOCK_MODE"
+
+	// FixturesEnv is the fixture directory.
+	FixturesEnv = "APIMOCK_FIXTURES"
+
+	// GuardianEnv and BalrogEnv are the upstream base URLs to record.
+	GuardianEnv = "APIMOCK_GUARDIAN_URL"
+	BalrogEnv   = "APIMOCK_BALROG_URL"
+)
+
+const (
+	ModeRecord = "record"
+	ModeReplay = "replay"
+)
+
+var (
+	ErrUnknownMode = errors.New("APIMOCK_MODE must be record or replay")
+	ErrNoFixtures  = errors.New("APIMOCK_FIXTURES must name the fixture directory")
+)
+
+// newFixtureRouter returns a router that records or replays all requests,
+// but the admin ones.
+func newFixtureRouter(mode string) (*mux.Router, error) {
+	dir := os.Getenv(FixturesEnv)
+	if dir == "" {
+		return nil, ErrNoFixtures
+	}
+
+	var handler http.HandlerFunc
+	var rewind http.HandlerFunc
+	switch mode {
+	case ModeRecord:
+		recorder, err := fixtures.NewRecorder(dir)
+		if err != nil {
+			return nil, err
+		}
+		proxy, err := fixtures.NewProxy(os.Getenv(GuardianEnv), os.Getenv(BalrogEnv), recorder)
+		if err != nil {
+			return nil, err
+		}
+		handler = proxyHandler(proxy)
+	case ModeReplay:
+		recorded, err := fixtures.Load(dir)
+		if err != nil {
+			return nil, err
+		}
+		replayer := fixtures.NewReplayer(recorded)
+		handler = replayHandler(replayer)
+		rewind = func(w http.ResponseWriter, r *http.Request) {
+			replayer.Rewind()
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		return nil, ErrUnknownMode
+	}
+
+	router := mux.NewRouter().UseEncodedPath()
+	if rewind != nil {
+		router.Methods("DELETE").Path("/__admin/fixtures/served").Name("FixturesRewind").Handler(Logger(rewind, "FixturesRewind"))
+	}
+	router.PathPrefix("/").Name(mode).Handler(Logger(handler, mode))
+	return router, nil
+}
+
+// proxyHandler forwards requests upstream and records them.
+func proxyHandler(proxy *fixtures.Proxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response, err := proxy.Forward(r)
+		if err != nil {
+			writeError(w, models.ErrorSchema{Code: http.StatusBadGateway, Errno: 112, Error: err.Error()})
+			return
+		}
+		response.Write(w)
+	}
+}
+
+// replayHandler serves the fixtures that match requests.
+func replayHandler(replayer *fixtures.Replayer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response, err := replayer.Match(r)
+		if err != nil {
+			writeError(w, models.ErrorSchema{Code: http.StatusNotFound, Errno: 112, Error: err.Error()})
+			return
+		}
+		response.Write(w)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/fixtures"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setenv(t *testing.T, values map[string]string) func() {
+	for name, value := range values {
+		require.NoError(t, os.Setenv(name, value))
+	}
+	return func() {
+		for name := range values {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestFixtureModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"path": "` + r.URL.Path + `", "token": "secret"}`))
+	}))
+	defer upstream.Close()
+
+	unset := setenv(t, map[string]string{ModeEnv: ModeRecord, FixturesEnv: dir, GuardianEnv: upstream.URL, BalrogEnv: upstream.URL})
+	router, err := NewRouter()
+	unset()
+	require.NoError(t, err)
+	w := do(router, "GET", "/api/v1/vpn/account", "token", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"path": "/api/v1/vpn/account", "token": "secret"}`, w.Body.String())
+
+	unset = setenv(t, map[string]string{ModeEnv: ModeReplay, FixturesEnv: dir})
+	router, err = NewRouter()
+	unset()
+	require.NoError(t, err)
+	upstream.Close()
+	w = do(router, "GET", "/api/v1/vpn/account", "other", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"path":"/api/v1/vpn/account","token":"scrubbed"}`, w.Body.String())
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assertError(t, do(router, "GET", "/api/v1/vpn/servers", "", ""), models.ErrorSchema{Code: 404, Errno: 112, Error: fixtures.ErrNoFixture.Error()})
+	assert.Equal(t, http.StatusNoContent, do(router, "DELETE", "/__admin/fixtures/served", "", "").Code)
+
+	unset = setenv(t, map[string]string{ModeEnv: "proxy", FixturesEnv: dir})
+	_, err = NewRouter()
+	unset()
+	assert.Equal(t, ErrUnknownMode, err)
+	unset = setenv(t, map[string]string{ModeEnv: ModeReplay})
+	_, err = NewRouter()
+	unset()
+	assert.Equal(t, ErrNoFixtures, err)
+	unset = setenv(t, map[string]string{ModeEnv: ModeRecord, FixturesEnv: dir, GuardianEnv: upstream.URL})
+	_, err = NewRouter()
+	unset()
+	assert.Equal(t, fixtures.ErrInvalidUpstream, err)
+}
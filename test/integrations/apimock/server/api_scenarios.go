@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/balrog"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+)
+
+// ScenariosEnv names the environment variable with the path of a Balrog
+// scenario file, which replaces the default scenarios.
+const ScenariosEnv = "APIMOCK_BALROG_SCENARIOS"
+
+func writeScenarioError(w http.ResponseWriter, status int, err error) {
+	writeError(w, models.ErrorSchema{Code: int32(status), Errno: 111, Error: err.Error()})
+}
+
+// ScenariosGet - The Balrog scenarios
+func (router *Router) ScenariosGet(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, router.scenarios.Get())
+}
+
+// ScenariosPut - Replace the Balrog scenarios, in the scenario file format
+func (router *Router) ScenariosPut(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+	set, err := balrog.DecodeScenarios(body)
+	if err == nil {
+		err = router.scenarios.Set(set)
+	}
+	if err != nil {
+		writeScenarioError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, router.scenarios.Get())
+}
+
+// ScenariosPost - Add a Balrog scenario, or replace the one with its name
+func (router *Router) ScenariosPost(w http.ResponseWriter, r *http.Request) {
+	var scenario balrog.Scenario
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&scenario); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+	if err := router.scenarios.Put(scenario); err != nil {
+		writeScenarioError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, scenario)
+}
+
+// ScenariosDelete - Return to the scenarios the server started with
+func (router *Router) ScenariosDelete(w http.ResponseWriter, r *http.Request) {
+	router.scenarios.Reset()
+	writeJSON(w, http.StatusOK, router.scenarios.Get())
+}
+
+// ScenarioActivePut - Make a scenario answer all client versions, or match
+// scenarios by version again when the name is empty
+func (router *Router) ScenarioActivePut(w http.ResponseWriter, r *http.Request) {
+	var active struct {
+		Active string `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&active); err != nil {
+		writeError(w, errMalformedBody)
+		return
+	}
+	if err := router.scenarios.Activate(active.Active); err != nil {
+		writeScenarioError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, router.scenarios.Get())
+}
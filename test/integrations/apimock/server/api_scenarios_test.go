@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/balrog"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/contentsig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newScenarioServer(t *testing.T) (*Router, *httptest.Server) {
+	chain, err := balrog.NewChain()
+	require.NoError(t, err)
+	set := balrog.DefaultScenarios()
+	for i := range set.Scenarios {
+		set.Scenarios[i].MSI.Content = "mock msi"
+	}
+	scenarios, err := balrog.NewScenarios(set)
+	require.NoError(t, err)
+	router := &Router{chain: chain, scenarios: scenarios}
+	return router, httptest.NewServer(router.handler())
+}
+
+// checkUpdate fetches the update of a version, and verifies it like the
+// client does.
+func checkUpdate(t *testing.T, server *httptest.Server, version string) ([]byte, error) {
+	res, err := http.Get(server.URL + "/json/1/FirefoxVPN/" + version + "/WINNT_x86_64/release/update.json")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	root, err := http.Get(server.URL + "/rootsig")
+	require.NoError(t, err)
+	defer root.Body.Close()
+	fingerprint, err := ioutil.ReadAll(root.Body)
+	require.NoError(t, err)
+	verifier := &contentsig.Verifier{RootFingerprint: string(fingerprint)}
+	return body, verifier.Verify(body, res.Header.Get("content-signature"), nil)
+}
+
+func TestBalrogVersionScenarios(t *testing.T) {
+	_, server := newScenarioServer(t)
+	defer server.Close()
+
+	body, err := checkUpdate(t, server, "0.5.0.0")
+	require.NoError(t, err)
+	var manifest models.BalrogVersionResponse
+	require.NoError(t, json.Unmarshal(body, &manifest))
+	res, err := http.Get(manifest.URL)
+	require.NoError(t, err)
+	msi, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "mock msi", string(msi))
+
+	_, err = checkUpdate(t, server, "0.0.0.0")
+	assert.Equal(t, contentsig.ErrMissingSignature, err)
+	_, err = checkUpdate(t, server, "0.0.0.1")
+	assert.Equal(t, contentsig.ErrBadSignature, err)
+	body, err = checkUpdate(t, server, "0.0.0.3")
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `"hashValue":""`)
+	body, err = checkUpdate(t, server, "0.0.0.4")
+	assert.NoError(t, err)
+	assert.Error(t, json.Unmarshal(body, &manifest))
+}
+
+func TestScenariosAdmin(t *testing.T) {
+	_, server := newScenarioServer(t)
+	defer server.Close()
+	h := server.Config.Handler
+
+	w := do(h, "POST", "/__admin/balrog/scenarios", "", `{"name": "unsigned", "version": "9.9", "header": "absent", "msi": {"content": "other msi", "corrupt": true}}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	_, err := checkUpdate(t, server, "9.9")
+	assert.Error(t, err)
+	msi := do(h, "GET", "/downloads/vpn/MozillaVPN.msi?scenario=unsigned", "", "").Body.String()
+	assert.Len(t, msi, len("other msi"))
+	assert.NotEqual(t, "other msi", msi)
+
+	w = do(h, "PUT", "/__admin/balrog/active", "", `{"active": "unsigned"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, err = checkUpdate(t, server, "0.5.0.0")
+	assert.Error(t, err)
+	assertError(t, do(h, "PUT", "/__admin/balrog/active", "", `{"active": "missing"}`), models.ErrorSchema{Code: 404, Errno: 111, Error: balrog.ErrUnknownScenario.Error()})
+	assertError(t, do(h, "PUT", "/__admin/balrog/active", "", `{"active":`), errMalformedBody)
+
+	w = do(h, "DELETE", "/__admin/balrog/scenarios", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	_, err = checkUpdate(t, server, "0.5.0.0")
+	assert.NoError(t, err)
+
+	w = do(h, "PUT", "/__admin/balrog/scenarios", "", `{"scenarios": [{"name": "only", "signature": "flip-bit", "msi": {"content": "mock msi"}}]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var set balrog.ScenarioSet
+	require.NoError(t, json.Unmarshal(do(h, "GET", "/__admin/balrog/scenarios", "", "").Body.Bytes(), &set))
+	require.Len(t, set.Scenarios, 1)
+	assert.Equal(t, "only", set.Scenarios[0].Name)
+	_, err = checkUpdate(t, server, "0.0.0.0")
+	assert.Equal(t, contentsig.ErrBadSignature, err)
+
+	w = do(h, "PUT", "/__admin/balrog/scenarios", "", `{"scenarios": [{"name": "a", "signature": "wrong"}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = do(h, "POST", "/__admin/balrog/scenarios", "", `{"name": "a", "unknown": true}`)
+	assertError(t, w, errMalformedBody)
+}
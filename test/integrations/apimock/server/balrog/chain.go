@@ -25,9 +25,9 @@ type Chain struct {
 	RootCertificateSignature string
 }
 
-func NewChain() (*Chain, error) {
-	newChain := new(Chain)
-	certificateModel := &models.BalrogCertificate{
+// DefaultCertificate returns the certificate model of a valid chain.
+func DefaultCertificate() *models.BalrogCertificate {
+	return &models.BalrogCertificate{
 		AuthorityKeyID:                           []byte{1, 3, 6, 1, 5, 5, 7, 3, 3},
 		NotBefore:                                time.Now().Add(time.Hour * 24 * 10 * -1),
 		Subject:                                  "aus.content-signature.mozilla.org",
@@ -37,7 +37,11 @@ func NewChain() (*Chain, error) {
 		AdditionalIrrelevantIntermediate:         false,
 		AdditionalIrrelevantIntermediateTopOrBot: false,
 	}
-	err := newChain.Regenerate(certificateModel)
+}
+
+func NewChain() (*Chain, error) {
+	newChain := new(Chain)
+	err := newChain.Regenerate(DefaultCertificate())
 	if err != nil {
 		return nil, err
 	}
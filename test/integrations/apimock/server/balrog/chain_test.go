@@ -0,0 +1,127 @@
+package balrog
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/contentsig"
+	"github.com/stretchr/testify/assert"
+)
+
+var updateJSON = []byte(`{"version": "0.5.1.1", "url": "http://localhost:8080/downloads/vpn/MozillaVPN.msi", "required": true, "hashFunction": "sha512", "hashValue": ""}`)
+
+func correctCertificateModel() models.BalrogCertificate {
+	return models.BalrogCertificate{
+		AuthorityKeyID: []byte{1, 3, 6, 1, 5, 5, 7, 3, 3},
+		NotBefore:      time.Now().Add(time.Hour * 24 * 10 * -1),
+		Subject:        "aus.content-signature.mozilla.org",
+	}
+}
+
+func signatureHeader(t *testing.T, c *Chain, x5u string, body []byte) string {
+	signed, err := c.Sign(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "x5u=" + x5u + "; p384ecdsa=" + base64.RawURLEncoding.EncodeToString(signed)
+}
+
+func TestContentSignatureChains(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*models.BalrogCertificate)
+		subject string
+		err     error
+	}{
+		{"Root, intermediate, leaf", func(m *models.BalrogCertificate) {}, "", nil},
+		{"Wrong expiration date of one of the intermediates", func(m *models.BalrogCertificate) {
+			m.NotBefore = time.Now().Add(time.Hour * 24 * 10)
+		}, "", contentsig.ErrExpired},
+		{"Wrong certificate subject", func(m *models.BalrogCertificate) {
+			m.Subject = "whatever"
+		}, "", contentsig.ErrSubject},
+		{"Subject outside of the name constraints", func(m *models.BalrogCertificate) {
+			m.Subject = "aus.example.com"
+		}, "aus.example.com", contentsig.ErrNameConstraints},
+		{"Root, intermediate, intermediate, leaf", func(m *models.BalrogCertificate) {
+			m.AdditionalIntermediate = true
+		}, "", nil},
+		{"Irrelevant root, root, intermediate, intermediate, leaf", func(m *models.BalrogCertificate) {
+			m.AdditionalIntermediate = true
+			m.AdditionalRoot = true
+		}, "", contentsig.ErrChainOrder},
+		{"Root, irrelevant root, intermediate, intermediate, leaf", func(m *models.BalrogCertificate) {
+			m.AdditionalIntermediate = true
+			m.AdditionalRoot = true
+			m.AdditionalRootTopOrBot = true
+		}, "", contentsig.ErrChainOrder},
+		{"Root, irrelevant intermediate, intermediate, intermediate, leaf", func(m *models.BalrogCertificate) {
+			m.AdditionalIntermediate = true
+			m.AdditionalIrrelevantIntermediate = true
+		}, "", contentsig.ErrChainOrder},
+		{"Root, intermediate, irrelevant intermediate, intermediate, leaf", func(m *models.BalrogCertificate) {
+			m.AdditionalIntermediate = true
+			m.AdditionalIrrelevantIntermediate = true
+			m.AdditionalIrrelevantIntermediateTopOrBot = true
+		}, "", contentsig.ErrChainOrder},
+	}
+
+	c := new(Chain)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			certificateModel := correctCertificateModel()
+			test.modify(&certificateModel)
+			if err := c.Regenerate(&certificateModel); err != nil {
+				t.Fatal(err)
+			}
+			verifier := &contentsig.Verifier{RootFingerprint: c.RootCertificateSignature, Subject: test.subject}
+			err := verifier.Verify(updateJSON, signatureHeader(t, c, "http://localhost/chains/sigtest.chain", updateJSON), []byte(c.String()))
+			assert.Equal(t, test.err, err)
+		})
+	}
+}
+
+func TestContentSignature(t *testing.T) {
+	c, err := NewChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "pem-certificate-chain")
+		w.Write([]byte(c.String()))
+	}))
+	defer server.Close()
+	verifier := &contentsig.Verifier{RootFingerprint: c.RootCertificateSignature}
+	header := signatureHeader(t, c, server.URL, updateJSON)
+
+	t.Run("Chain fetched from x5u", func(t *testing.T) {
+		assert.NoError(t, verifier.Verify(updateJSON, header, nil))
+	})
+	t.Run("Missing both p384 and p256 signatures", func(t *testing.T) {
+		assert.Equal(t, contentsig.ErrMissingSignature, verifier.Verify(updateJSON, "x5u="+server.URL, nil))
+	})
+	t.Run("JSON signature is wrong", func(t *testing.T) {
+		signed, _ := c.Sign(updateJSON)
+		signed[3] ^= 1
+		flipped := "x5u=" + server.URL + "; p384ecdsa=" + base64.RawURLEncoding.EncodeToString(signed)
+		assert.Equal(t, contentsig.ErrBadSignature, verifier.Verify(updateJSON, flipped, nil))
+	})
+	t.Run("Body was modified", func(t *testing.T) {
+		assert.Equal(t, contentsig.ErrBadSignature, verifier.Verify([]byte(`{"version": "0.5.1.1", whatever}`), header, nil))
+	})
+	t.Run("Root fingerprint is not pinned", func(t *testing.T) {
+		other := &contentsig.Verifier{RootFingerprint: "97:E8:BA:9C:F1:2F:B3:DE:53:CC:42:A4:E6:57:7E:D6:4D:F4:93:C2:47:B4:14:FE:A0:36:81:8D:38:23:56:0E"}
+		assert.Equal(t, contentsig.ErrUntrustedRoot, other.Verify(updateJSON, header, nil))
+	})
+	t.Run("Leaf has expired", func(t *testing.T) {
+		expired := &contentsig.Verifier{
+			RootFingerprint: c.RootCertificateSignature,
+			Now:             func() time.Time { return time.Now().Add(time.Hour * 24 * 366) },
+		}
+		assert.Equal(t, contentsig.ErrExpired, expired.Verify(updateJSON, header, nil))
+	})
+}
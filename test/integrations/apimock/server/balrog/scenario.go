@@ -0,0 +1,458 @@
+package balrog
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+)
+
+// DefaultMSIPath is the MSI served for updates, relative to the integration
+// tests.
+const DefaultMSIPath = "../mockinstaller/x64/MozillaMockVPN.msi"
+
+// Signature mutations
+const (
+	// SignatureValid signs the served body.
+	SignatureValid = ""
+
+	// SignatureFlipBit flips a bit of the signature of the served body.
+	SignatureFlipBit = "flip-bit"
+
+	// SignatureOtherContent signs a body other than the served one.
+	SignatureOtherContent = "other-content"
+
+	// SignatureTruncated drops the second half of the signature.
+	SignatureTruncated = "truncated"
+)
+
+// Content-Signature header shapes
+const (
+	// HeaderStandard has the x5u chain URL and the p384ecdsa signature.
+	HeaderStandard = ""
+
+	// HeaderX5UOnly has the chain URL but no signature.
+	HeaderX5UOnly = "x5u-only"
+
+	// HeaderSignatureOnly has the signature but no chain URL.
+	HeaderSignatureOnly = "signature-only"
+
+	// HeaderAbsent leaves the Content-Signature header out.
+	HeaderAbsent = "absent"
+)
+
+var (
+	ErrInvalidScenario = errors.New("Scenarios need a unique name and version, and a known signature and header")
+	ErrUnknownScenario = errors.New("No scenario has this name")
+)
+
+// Payload is the MSI served for the update of a scenario.
+type Payload struct {
+	// Path is the MSI file, DefaultMSIPath when empty.
+	Path string `json:"path,omitempty"`
+
+	// Content, when set, is served instead of a file.
+	Content string `json:"content,omitempty"`
+
+	// Corrupt flips a bit of the served payload, so that it no longer
+	// matches the hash of the manifest.
+	Corrupt bool `json:"corrupt,omitempty"`
+}
+
+// Bytes returns the payload, before corruption.
+func (p *Payload) Bytes() ([]byte, error) {
+	if p.Content != "" {
+		return []byte(p.Content), nil
+	}
+	path := p.Path
+	if path == "" {
+		path = DefaultMSIPath
+	}
+	return ioutil.ReadFile(path)
+}
+
+// Hash returns the SHA-512 of the payload, in hex.
+func (p *Payload) Hash() (string, error) {
+	payload, err := p.Bytes()
+	if err != nil {
+		return "", err
+	}
+	hash := sha512.Sum512(payload)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// ServeHTTP serves the payload as a download.
+func (p *Payload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, err := p.Bytes()
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p.Corrupt && len(payload) > 0 {
+		payload[len(payload)/2] ^= 1
+	}
+	w.Header().Set("content-type", "application/octet-stream")
+	http.ServeContent(w, r, "MozillaVPN.msi", time.Time{}, bytes.NewReader(payload))
+}
+
+// Scenario describes the update served to a client version.
+type Scenario struct {
+	Name string `json:"name"`
+
+	// Version is the client version the scenario answers. The scenario
+	// without a version answers all other versions.
+	Version string `json:"version,omitempty"`
+
+	// Manifest overrides fields of the default manifest. A null value
+	// removes the field.
+	Manifest map[string]interface{} `json:"manifest,omitempty"`
+
+	// Body, when set, is served instead of the manifest, for manifests
+	// that are not valid JSON.
+	Body string `json:"body,omitempty"`
+
+	Signature string `json:"signature,omitempty"`
+	Header    string `json:"header,omitempty"`
+
+	// Chain, when set, signs with a chain of its own instead of the chain
+	// shared by all scenarios.
+	Chain *models.BalrogCertificate `json:"chain,omitempty"`
+
+	MSI Payload `json:"msi"`
+}
+
+// ScenarioSet is the format of scenario files and of the admin API.
+type ScenarioSet struct {
+	// Active, when set, names the scenario that answers all versions.
+	Active string `json:"active,omitempty"`
+
+	Scenarios []Scenario `json:"scenarios"`
+}
+
+// DefaultScenarios returns a valid update for all versions, and the update
+// path failures of the integration tests.
+func DefaultScenarios() ScenarioSet {
+	wrongHash := sha512.Sum512([]byte("wronghash"))
+	return ScenarioSet{Scenarios: []Scenario{
+		{Name: "valid"},
+		{Name: "missing-signature", Version: "0.0.0.0", Header: HeaderX5UOnly},
+		{Name: "flipped-signature", Version: "0.0.0.1", Signature: SignatureFlipBit},
+		{Name: "wrong-hash", Version: "0.0.0.2", Manifest: map[string]interface{}{"hashValue": hex.EncodeToString(wrongHash[:])}},
+		{Name: "empty-hash", Version: "0.0.0.3", Manifest: map[string]interface{}{"hashValue": ""}},
+		{Name: "invalid-json", Version: "0.0.0.4", Body: `{"version": "0.5.1.1", whatever}`},
+	}}
+}
+
+// DecodeScenarios decodes a scenario set, and rejects unknown fields so that
+// typos do not silently change a scenario.
+func DecodeScenarios(data []byte) (ScenarioSet, error) {
+	var set ScenarioSet
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&set); err != nil {
+		return ScenarioSet{}, err
+	}
+	return set, set.Validate()
+}
+
+// LoadScenarios reads a scenario file.
+func LoadScenarios(path string) (ScenarioSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ScenarioSet{}, err
+	}
+	return DecodeScenarios(data)
+}
+
+func (s *Scenario) validate() error {
+	if s.Name == "" {
+		return ErrInvalidScenario
+	}
+	switch s.Signature {
+	case SignatureValid, SignatureFlipBit, SignatureOtherContent, SignatureTruncated:
+	default:
+		return ErrInvalidScenario
+	}
+	switch s.Header {
+	case HeaderStandard, HeaderX5UOnly, HeaderSignatureOnly, HeaderAbsent:
+	default:
+		return ErrInvalidScenario
+	}
+	return nil
+}
+
+// Validate checks the scenarios, and that no two of them have the same name
+// or version.
+func (set *ScenarioSet) Validate() error {
+	names := make(map[string]bool)
+	versions := make(map[string]bool)
+	for _, scenario := range set.Scenarios {
+		if err := scenario.validate(); err != nil {
+			return fmt.Errorf("%q: %w", scenario.Name, err)
+		}
+		if names[scenario.Name] || versions[scenario.Version] {
+			return fmt.Errorf("%q: %w", scenario.Name, ErrInvalidScenario)
+		}
+		names[scenario.Name] = true
+		versions[scenario.Version] = true
+	}
+	if set.Active != "" && !names[set.Active] {
+		return ErrUnknownScenario
+	}
+	return nil
+}
+
+// Scenarios keeps the scenarios of a server, and the chains of the scenarios
+// with a chain of their own.
+type Scenarios struct {
+	initial ScenarioSet
+
+	mutex  sync.Mutex
+	set    ScenarioSet
+	chains map[string]*Chain
+}
+
+// NewScenarios returns the scenarios of a set, which Reset returns to.
+func NewScenarios(set ScenarioSet) (*Scenarios, error) {
+	if err := set.Validate(); err != nil {
+		return nil, err
+	}
+	s := &Scenarios{initial: set}
+	s.Reset()
+	return s, nil
+}
+
+// Get returns the scenario set.
+func (s *Scenarios) Get() ScenarioSet {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return ScenarioSet{Active: s.set.Active, Scenarios: append([]Scenario(nil), s.set.Scenarios...)}
+}
+
+// Set replaces all scenarios.
+func (s *Scenarios) Set(set ScenarioSet) error {
+	if err := set.Validate(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.set = ScenarioSet{Active: set.Active, Scenarios: append([]Scenario(nil), set.Scenarios...)}
+	s.chains = make(map[string]*Chain)
+	return nil
+}
+
+// Put adds a scenario, or replaces the scenario with its name.
+func (s *Scenarios) Put(scenario Scenario) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	set := ScenarioSet{Active: s.set.Active, Scenarios: append([]Scenario(nil), s.set.Scenarios...)}
+	replaced := false
+	for i := range set.Scenarios {
+		if set.Scenarios[i].Name == scenario.Name {
+			set.Scenarios[i] = scenario
+			replaced = true
+		}
+	}
+	if !replaced {
+		set.Scenarios = append(set.Scenarios, scenario)
+	}
+	if err := set.Validate(); err != nil {
+		return err
+	}
+	s.set.Scenarios = set.Scenarios
+	delete(s.chains, scenario.Name)
+	return nil
+}
+
+// Activate makes a scenario answer all versions, or restores matching by
+// version when the name is empty.
+func (s *Scenarios) Activate(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if name != "" {
+		if _, ok := s.namedLocked(name); !ok {
+			return ErrUnknownScenario
+		}
+	}
+	s.set.Active = name
+	return nil
+}
+
+// Reset returns to the initial scenarios.
+func (s *Scenarios) Reset() {
+	s.Set(s.initial)
+}
+
+func (s *Scenarios) namedLocked(name string) (Scenario, bool) {
+	for _, scenario := range s.set.Scenarios {
+		if scenario.Name == name {
+			return scenario, true
+		}
+	}
+	return Scenario{}, false
+}
+
+// Named returns the scenario with a name.
+func (s *Scenarios) Named(name string) (Scenario, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.namedLocked(name)
+}
+
+// Select returns the active scenario, or else the scenario of the version, or
+// else the scenario without a version. Without any, it returns a valid update.
+func (s *Scenarios) Select(version string) Scenario {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.set.Active != "" {
+		scenario, _ := s.namedLocked(s.set.Active)
+		return scenario
+	}
+	fallback := Scenario{Name: "valid"}
+	for _, scenario := range s.set.Scenarios {
+		if scenario.Version == version {
+			return scenario
+		}
+		if scenario.Version == "" {
+			fallback = scenario
+		}
+	}
+	return fallback
+}
+
+// Chain returns the chain a scenario signs with, generating it on first use.
+func (s *Scenarios) Chain(name string, shared *Chain) (*Chain, error) {
+	s.mutex.Lock()
+	scenario, ok := s.namedLocked(name)
+	chain := s.chains[name]
+	s.mutex.Unlock()
+	if !ok || scenario.Chain == nil {
+		return shared, nil
+	}
+	if chain != nil {
+		return chain, nil
+	}
+
+	certificateModel := DefaultCertificate()
+	if scenario.Chain.AuthorityKeyID != nil {
+		certificateModel.AuthorityKeyID = scenario.Chain.AuthorityKeyID
+	}
+	if !scenario.Chain.NotBefore.IsZero() {
+		certificateModel.NotBefore = scenario.Chain.NotBefore
+	}
+	if scenario.Chain.Subject != "" {
+		certificateModel.Subject = scenario.Chain.Subject
+	}
+	certificateModel.AdditionalIntermediate = scenario.Chain.AdditionalIntermediate
+	certificateModel.AdditionalRoot = scenario.Chain.AdditionalRoot
+	certificateModel.AdditionalRootTopOrBot = scenario.Chain.AdditionalRootTopOrBot
+	certificateModel.AdditionalIrrelevantIntermediate = scenario.Chain.AdditionalIrrelevantIntermediate
+	certificateModel.AdditionalIrrelevantIntermediateTopOrBot = scenario.Chain.AdditionalIrrelevantIntermediateTopOrBot
+	chain = new(Chain)
+	if err := chain.Regenerate(certificateModel); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if existing := s.chains[name]; existing != nil {
+		return existing, nil
+	}
+	s.chains[name] = chain
+	return chain, nil
+}
+
+// Update is the response of a scenario.
+type Update struct {
+	// ContentSignature is the Content-Signature header, or empty when the
+	// header is absent.
+	ContentSignature string
+	Body             []byte
+}
+
+// scenarioURL returns the URL of a path on host, for a scenario.
+func scenarioURL(host, path string, scenario *Scenario) string {
+	return "http://" + host + path + "?scenario=" + url.QueryEscape(scenario.Name)
+}
+
+// manifest returns the default manifest with the fields of the scenario.
+func (s *Scenario) manifest(host string) ([]byte, error) {
+	hash, err := s.MSI.Hash()
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{
+		"version":      "0.5.1.1",
+		"url":          scenarioURL(host, "/downloads/vpn/MozillaVPN.msi", s),
+		"required":     true,
+		"hashFunction": "sha512",
+		"hashValue":    hash,
+	}
+	for field, value := range s.Manifest {
+		if value == nil {
+			delete(fields, field)
+		} else {
+			fields[field] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// Render returns the response of a scenario served from host, signed with
+// chain.
+func (s *Scenario) Render(host string, chain *Chain) (*Update, error) {
+	update := new(Update)
+	if s.Body != "" {
+		update.Body = []byte(s.Body)
+	} else {
+		body, err := s.manifest(host)
+		if err != nil {
+			return nil, err
+		}
+		update.Body = body
+	}
+
+	signed := update.Body
+	if s.Signature == SignatureOtherContent {
+		signed = append([]byte("{}"), signed...)
+	}
+	signature, err := chain.Sign(signed)
+	if err != nil {
+		return nil, err
+	}
+	switch s.Signature {
+	case SignatureFlipBit:
+		signature[3] ^= 1
+	case SignatureTruncated:
+		signature = signature[:len(signature)/2]
+	}
+
+	x5u := "x5u=http://" + host + "/chains/sigtest.chain"
+	if s.Chain != nil {
+		x5u = "x5u=" + scenarioURL(host, "/chains/sigtest.chain", s)
+	}
+	p384ecdsa := "p384ecdsa=" + base64.RawURLEncoding.EncodeToString(signature)
+	switch s.Header {
+	case HeaderStandard:
+		update.ContentSignature = x5u + "; " + p384ecdsa
+	case HeaderX5UOnly:
+		update.ContentSignature = x5u
+	case HeaderSignatureOnly:
+		update.ContentSignature = p384ecdsa
+	}
+	return update, nil
+}
@@ -0,0 +1,218 @@
+package balrog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/contentsig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testPayload = Payload{Content: "mock msi"}
+
+func TestScenarioSignatures(t *testing.T) {
+	c, err := NewChain()
+	require.NoError(t, err)
+	verifier := &contentsig.Verifier{RootFingerprint: c.RootCertificateSignature}
+
+	tests := []struct {
+		scenario Scenario
+		err      error
+	}{
+		{Scenario{Name: "valid"}, nil},
+		{Scenario{Name: "flip-bit", Signature: SignatureFlipBit}, contentsig.ErrBadSignature},
+		{Scenario{Name: "other-content", Signature: SignatureOtherContent}, contentsig.ErrBadSignature},
+		{Scenario{Name: "x5u-only", Header: HeaderX5UOnly}, contentsig.ErrMissingSignature},
+		{Scenario{Name: "signature-only", Header: HeaderSignatureOnly}, contentsig.ErrMissingX5U},
+	}
+	for _, test := range tests {
+		t.Run(test.scenario.Name, func(t *testing.T) {
+			test.scenario.MSI = testPayload
+			update, err := test.scenario.Render("localhost:8080", c)
+			require.NoError(t, err)
+			assert.Equal(t, test.err, verifier.Verify(update.Body, update.ContentSignature, []byte(c.String())))
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		scenario := Scenario{Name: "truncated", Signature: SignatureTruncated, MSI: testPayload}
+		update, err := scenario.Render("localhost:8080", c)
+		require.NoError(t, err)
+		assert.Error(t, verifier.Verify(update.Body, update.ContentSignature, []byte(c.String())))
+	})
+	t.Run("absent", func(t *testing.T) {
+		scenario := Scenario{Name: "absent", Header: HeaderAbsent, MSI: testPayload}
+		update, err := scenario.Render("localhost:8080", c)
+		require.NoError(t, err)
+		assert.Empty(t, update.ContentSignature)
+	})
+}
+
+func TestScenarioManifest(t *testing.T) {
+	c, err := NewChain()
+	require.NoError(t, err)
+	hash, err := testPayload.Hash()
+	require.NoError(t, err)
+
+	scenario := Scenario{Name: "valid", MSI: testPayload}
+	update, err := scenario.Render("localhost:8080", c)
+	require.NoError(t, err)
+	var manifest models.BalrogVersionResponse
+	require.NoError(t, json.Unmarshal(update.Body, &manifest))
+	assert.Equal(t, models.BalrogVersionResponse{
+		Version:      "0.5.1.1",
+		URL:          "http://localhost:8080/downloads/vpn/MozillaVPN.msi?scenario=valid",
+		Required:     true,
+		HashFunction: "sha512",
+		HashValue:    hash,
+	}, manifest)
+
+	scenario.Manifest = map[string]interface{}{"version": "9.0", "required": false, "hashFunction": nil}
+	update, err = scenario.Render("localhost:8080", c)
+	require.NoError(t, err)
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(update.Body, &fields))
+	assert.Equal(t, "9.0", fields["version"])
+	assert.Equal(t, false, fields["required"])
+	assert.NotContains(t, fields, "hashFunction")
+
+	scenario = Scenario{Name: "invalid", Body: `{"version": whatever}`}
+	update, err = scenario.Render("localhost:8080", c)
+	require.NoError(t, err)
+	assert.Equal(t, `{"version": whatever}`, string(update.Body))
+}
+
+func TestScenarioChain(t *testing.T) {
+	shared, err := NewChain()
+	require.NoError(t, err)
+	scenarios, err := NewScenarios(ScenarioSet{Scenarios: []Scenario{
+		{Name: "valid", MSI: testPayload},
+		{Name: "extra-root", Version: "1.0", Chain: &models.BalrogCertificate{AdditionalIntermediate: true, AdditionalRoot: true}, MSI: testPayload},
+	}})
+	require.NoError(t, err)
+
+	chain, err := scenarios.Chain("valid", shared)
+	require.NoError(t, err)
+	assert.Equal(t, shared, chain)
+	chain, err = scenarios.Chain("extra-root", shared)
+	require.NoError(t, err)
+	assert.NotEqual(t, shared, chain)
+	cached, err := scenarios.Chain("extra-root", shared)
+	require.NoError(t, err)
+	assert.Equal(t, chain, cached)
+
+	scenario := scenarios.Select("1.0")
+	update, err := scenario.Render("localhost:8080", chain)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(update.ContentSignature, "x5u=http://localhost:8080/chains/sigtest.chain?scenario=extra-root;"), update.ContentSignature)
+	verifier := &contentsig.Verifier{RootFingerprint: chain.RootCertificateSignature}
+	assert.Equal(t, contentsig.ErrChainOrder, verifier.Verify(update.Body, update.ContentSignature, []byte(chain.String())))
+}
+
+func TestSelect(t *testing.T) {
+	scenarios, err := NewScenarios(DefaultScenarios())
+	require.NoError(t, err)
+	assert.Equal(t, "valid", scenarios.Select("0.5.0.0").Name)
+	assert.Equal(t, "missing-signature", scenarios.Select("0.0.0.0").Name)
+	assert.Equal(t, "invalid-json", scenarios.Select("0.0.0.4").Name)
+
+	assert.NoError(t, scenarios.Activate("wrong-hash"))
+	assert.Equal(t, "wrong-hash", scenarios.Select("0.5.0.0").Name)
+	assert.Equal(t, "wrong-hash", scenarios.Select("0.0.0.0").Name)
+	assert.Equal(t, ErrUnknownScenario, scenarios.Activate("missing"))
+	assert.NoError(t, scenarios.Activate(""))
+	assert.Equal(t, "valid", scenarios.Select("0.5.0.0").Name)
+
+	assert.NoError(t, scenarios.Put(Scenario{Name: "valid", Header: HeaderAbsent}))
+	assert.NoError(t, scenarios.Put(Scenario{Name: "new", Version: "2.0"}))
+	assert.Equal(t, HeaderAbsent, scenarios.Select("0.5.0.0").Header)
+	assert.Equal(t, "new", scenarios.Select("2.0").Name)
+	assert.Len(t, scenarios.Get().Scenarios, 7)
+
+	scenarios.Reset()
+	assert.Equal(t, DefaultScenarios(), scenarios.Get())
+
+	require.NoError(t, scenarios.Set(ScenarioSet{Scenarios: []Scenario{{Name: "only", Version: "1.0"}}}))
+	assert.Equal(t, "valid", scenarios.Select("0.5.0.0").Name)
+	assert.Equal(t, "only", scenarios.Select("1.0").Name)
+}
+
+func TestScenarioValidation(t *testing.T) {
+	invalid := map[string]string{
+		"no name":            `{"scenarios": [{"version": "1.0"}]}`,
+		"duplicate name":     `{"scenarios": [{"name": "a"}, {"name": "a", "version": "1.0"}]}`,
+		"duplicate version":  `{"scenarios": [{"name": "a"}, {"name": "b"}]}`,
+		"unknown signature":  `{"scenarios": [{"name": "a", "signature": "wrong"}]}`,
+		"unknown header":     `{"scenarios": [{"name": "a", "header": "wrong"}]}`,
+		"unknown active":     `{"active": "b", "scenarios": [{"name": "a"}]}`,
+		"unknown field":      `{"scenarios": [{"name": "a", "signatur": "flip-bit"}]}`,
+		"invalid JSON":       `{"scenarios": [`,
+		"wrong field type":   `{"scenarios": [{"name": "a", "msi": {"corrupt": "yes"}}]}`,
+		"scenarios not list": `{"scenarios": {"name": "a"}}`,
+	}
+	for name, data := range invalid {
+		_, err := DecodeScenarios([]byte(data))
+		assert.Error(t, err, name)
+	}
+
+	scenarios, err := NewScenarios(DefaultScenarios())
+	require.NoError(t, err)
+	assert.Error(t, scenarios.Put(Scenario{Name: "other", Version: "0.0.0.1"}))
+	assert.Error(t, scenarios.Set(ScenarioSet{Scenarios: []Scenario{{Name: "a", Header: "wrong"}}}))
+	assert.Equal(t, DefaultScenarios(), scenarios.Get())
+}
+
+func TestLoadScenarios(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scenarios")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "scenarios.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{
+		"active": "corrupt-msi",
+		"scenarios": [
+			{"name": "corrupt-msi", "msi": {"content": "mock msi", "corrupt": true}},
+			{"name": "old-chain", "version": "1.0", "chain": {"notbefore": "2019-01-01T00:00:00Z"}, "header": "x5u-only"}
+		]
+	}`), 0600))
+
+	set, err := LoadScenarios(path)
+	require.NoError(t, err)
+	assert.Equal(t, "corrupt-msi", set.Active)
+	require.Len(t, set.Scenarios, 2)
+	assert.Equal(t, Payload{Content: "mock msi", Corrupt: true}, set.Scenarios[0].MSI)
+	assert.Equal(t, 2019, set.Scenarios[1].Chain.NotBefore.Year())
+	assert.Equal(t, HeaderX5UOnly, set.Scenarios[1].Header)
+
+	_, err = LoadScenarios(filepath.Join(dir, "missing.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPayload(t *testing.T) {
+	serve := func(p Payload) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/downloads/vpn/MozillaVPN.msi", nil))
+		return w
+	}
+
+	w := serve(testPayload)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "mock msi", w.Body.String())
+
+	w = serve(Payload{Content: "mock msi", Corrupt: true})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, w.Body.String(), len("mock msi"))
+	assert.NotEqual(t, "mock msi", w.Body.String())
+
+	w = serve(Payload{Path: "missing.msi"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	_, err := (&Payload{Path: "missing.msi"}).Hash()
+	assert.Error(t, err)
+}
@@ -0,0 +1,189 @@
+// Package dnsauth is an authoritative stand-in for the zone of DNS leak
+// tests. It answers TXT queries with the address they came from, and records
+// which addresses queried each name.
+package dnsauth
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultZone is the zone of the mock API. It is not delegated, so only
+// resolvers configured to forward it to the server reach it.
+const DefaultZone = "dnsleak.test."
+
+var ErrInvalidZone = errors.New("invalid zone")
+
+// Query is a query the server received.
+type Query struct {
+	Name string    `json:"name"`
+	Type string    `json:"type"`
+	From string    `json:"from"`
+	Time time.Time `json:"time"`
+}
+
+type Server struct {
+	zone string
+	conn *net.UDPConn
+	wg   sync.WaitGroup
+
+	mutex   sync.Mutex
+	queries map[string][]Query
+}
+
+// NewServer serves zone on a UDP address, such as "127.0.0.1:0".
+func NewServer(zone string, address string) (*Server, error) {
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	if zone == "" {
+		return nil, ErrInvalidZone
+	}
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		zone:    zone + ".",
+		conn:    conn,
+		queries: make(map[string][]Query),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) Zone() string {
+	return s.zone
+}
+
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Queries returns the queries for label, the part of a name below the zone.
+func (s *Server) Queries(label string) []Query {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Query(nil), s.queries[strings.ToLower(label)]...)
+}
+
+// AllQueries returns the queries for every label.
+func (s *Server) AllQueries() map[string][]Query {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	all := make(map[string][]Query, len(s.queries))
+	for label, queries := range s.queries {
+		all[label] = append([]Query(nil), queries...)
+	}
+	return all
+}
+
+// Reset forgets the queries received so far.
+func (s *Server) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queries = make(map[string][]Query)
+}
+
+func (s *Server) Close() error {
+	err := s.conn.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	buf := make([]byte, 1232)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if response := s.handle(buf[:n], addr.IP); response != nil {
+			s.conn.WriteToUDP(response, addr)
+		}
+	}
+}
+
+// label returns the part of name below the zone, and whether name is in the
+// zone.
+func (s *Server) label(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if name == s.zone {
+		return "", true
+	}
+	if !strings.HasSuffix(name, "."+s.zone) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, "."+s.zone), true
+}
+
+func (s *Server) handle(msg []byte, from net.IP) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               header.ID,
+			Response:         true,
+			OpCode:           header.OpCode,
+			RecursionDesired: header.RecursionDesired,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+	label, ok := s.label(question.Name.String())
+	switch {
+	case header.OpCode != 0:
+		response.RCode = dnsmessage.RCodeNotImplemented
+	case !ok || question.Class != dnsmessage.ClassINET:
+		response.RCode = dnsmessage.RCodeRefused
+	default:
+		response.Authoritative = true
+		if label != "" {
+			s.record(label, Query{
+				Name: question.Name.String(),
+				Type: strings.TrimPrefix(question.Type.String(), "Type"),
+				From: from.String(),
+				Time: time.Now(),
+			})
+		}
+		// Other types get an empty answer, as the names exist
+		if question.Type == dnsmessage.TypeTXT {
+			response.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{
+					Name:  question.Name,
+					Type:  dnsmessage.TypeTXT,
+					Class: dnsmessage.ClassINET,
+				},
+				Body: &dnsmessage.TXTResource{TXT: []string{from.String()}},
+			}}
+		}
+	}
+
+	packed, err := response.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
+
+func (s *Server) record(label string, query Query) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queries[label] = append(s.queries[label], query)
+}
@@ -0,0 +1,75 @@
+package dnsauth
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/dnsleak"
+	"github.com/stretchr/testify/assert"
+)
+
+func resolverFor(s *Server, local string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialer := net.Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP(local)}}
+			return dialer.DialContext(ctx, "udp", s.Addr().String())
+		},
+	}
+}
+
+func TestLeakCheck(t *testing.T) {
+	s, err := NewServer(DefaultZone, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	checker := &dnsleak.Checker{Zone: s.Zone(), Resolver: resolverFor(s, "127.0.0.2"), Queries: 2}
+	report, err := checker.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"127.0.0.2"}, report.Resolvers)
+
+	for _, query := range report.Queries {
+		label := strings.TrimSuffix(query.Name, "."+DefaultZone)
+		queries := s.Queries(label)
+		if assert.Len(t, queries, 1) {
+			assert.Equal(t, "127.0.0.2", queries[0].From)
+			assert.Equal(t, "TXT", queries[0].Type)
+			assert.Equal(t, query.Name, queries[0].Name)
+		}
+	}
+	assert.Len(t, s.AllQueries(), 2)
+
+	s.Reset()
+	assert.Empty(t, s.AllQueries())
+}
+
+func TestRecordTypes(t *testing.T) {
+	s, err := NewServer("Example.Test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	resolver := resolverFor(s, "127.0.0.1")
+
+	// Names in the zone exist, without addresses
+	_, err = resolver.LookupIPAddr(context.Background(), "Host.EXAMPLE.test.")
+	assert.Error(t, err)
+	queries := s.Queries("host")
+	if assert.NotEmpty(t, queries) {
+		assert.Equal(t, "127.0.0.1", queries[0].From)
+	}
+
+	// Other zones are refused, and not recorded
+	_, err = resolver.LookupTXT(context.Background(), "leak.other.test.")
+	assert.Error(t, err)
+	assert.Len(t, s.AllQueries(), 1)
+
+	_, err = NewServer(".", "127.0.0.1:0")
+	assert.Equal(t, ErrInvalidZone, err)
+}
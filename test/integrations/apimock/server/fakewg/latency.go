@@ -0,0 +1,137 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package fakewg
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// LatencyRelay forwards UDP datagrams to a server on this machine, delaying
+// them so that it looks far away. Half of the latency is added each way.
+type LatencyRelay struct {
+	conn    *net.UDPConn
+	target  *net.UDPAddr
+	latency time.Duration
+
+	mu       sync.Mutex
+	closed   bool
+	upstream map[string]*net.UDPConn
+	wg       sync.WaitGroup
+}
+
+// NewLatencyRelay relays to the server on the loopback address.
+func (s *Server) NewLatencyRelay(latency time.Duration) (*LatencyRelay, error) {
+	return NewLatencyRelay(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(s.listenPort)}, latency)
+}
+
+// NewLatencyRelay relays to target, adding latency to the round trip.
+func NewLatencyRelay(target *net.UDPAddr, latency time.Duration) (*LatencyRelay, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	r := &LatencyRelay{
+		conn:     conn,
+		target:   target,
+		latency:  latency,
+		upstream: make(map[string]*net.UDPConn),
+	}
+	r.wg.Add(1)
+	go r.serve()
+	return r, nil
+}
+
+// Endpoint returns the address of the relay, as host:port.
+func (r *LatencyRelay) Endpoint() string {
+	return r.conn.LocalAddr().String()
+}
+
+// Host returns the IP address of the relay.
+func (r *LatencyRelay) Host() string {
+	return r.conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// Port returns the port of the relay.
+func (r *LatencyRelay) Port() uint16 {
+	return uint16(r.conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// Close stops relaying.
+func (r *LatencyRelay) Close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	r.conn.Close()
+	for _, upstream := range r.upstream {
+		upstream.Close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+func (r *LatencyRelay) serve() {
+	defer r.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		upstream, err := r.upstreamFor(client)
+		if err != nil {
+			continue
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		time.AfterFunc(r.latency/2, func() { upstream.Write(packet) })
+	}
+}
+
+// upstreamFor returns the connection to the target for a client, so that
+// replies go back to it.
+func (r *LatencyRelay) upstreamFor(client *net.UDPAddr) (*net.UDPConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, fmt.Errorf("Relay is closed")
+	}
+	if upstream := r.upstream[client.String()]; upstream != nil {
+		return upstream, nil
+	}
+	upstream, err := net.DialUDP("udp4", nil, r.target)
+	if err != nil {
+		return nil, err
+	}
+	r.upstream[client.String()] = upstream
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		buf := make([]byte, 65535)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				if _, closed := err.(*net.OpError); closed && r.isClosed() {
+					return
+				}
+				continue
+			}
+			packet := append([]byte(nil), buf[:n]...)
+			time.AfterFunc(r.latency/2, func() { r.conn.WriteToUDP(packet, client) })
+		}
+	}()
+	return upstream, nil
+}
+
+func (r *LatencyRelay) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
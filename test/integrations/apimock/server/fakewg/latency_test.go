@@ -0,0 +1,71 @@
+package fakewg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/guardian"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/latency"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/routes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyRanking(t *testing.T) {
+	key, err := keys.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var targets []latency.Target
+	for _, test := range []struct {
+		hostname string
+		latency  time.Duration
+		known    bool
+	}{
+		{"slow", 150 * time.Millisecond, true},
+		{"unregistered", 0, false},
+		{"fast", 10 * time.Millisecond, true},
+		{"medium", 60 * time.Millisecond, true},
+	} {
+		s, err := NewServerWithRoutes(routes.NewFakeTable())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if test.known {
+			if _, err := s.AddClient(key.Public().String()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		relay, err := s.NewLatencyRelay(test.latency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer relay.Close()
+
+		target, err := latency.TargetFromServer(&guardian.Server{
+			Hostname:   test.hostname,
+			Ipv4AddrIn: relay.Host(),
+			PublicKey:  s.PublicKey(),
+			PortRanges: [][]int{{int(relay.Port()), int(relay.Port())}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, target)
+	}
+
+	prober := &latency.Prober{PrivateKey: key, Concurrency: 2, Timeout: time.Second}
+	results := prober.Probe(context.Background(), targets)
+
+	var ranked []string
+	for _, result := range results {
+		ranked = append(ranked, result.Hostname)
+	}
+	assert.Equal(t, []string{"fast", "medium", "slow", "unregistered"}, ranked)
+	assert.True(t, results[0].RTT >= 10*time.Millisecond)
+	assert.True(t, results[2].RTT >= 150*time.Millisecond)
+	assert.Equal(t, latency.ErrNoReply, results[3].Err)
+}
@@ -6,22 +6,22 @@
 package fakewg
 
 import (
-	"bufio"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"os"
 	"runtime"
-	"strings"
+	"sync"
 	"sync/atomic"
 
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/routes"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/uapi"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
-	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun"
-	"golang.zx2c4.com/wireguard/windows/conf"
-	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 )
 
 type dummyTun struct {
@@ -34,11 +34,13 @@ type dummyTun struct {
 type Server struct {
 	closed     int32
 	device     *device.Device
+	mutex      sync.Mutex
 	nextIp     int
 	listenPort uint16
 	pubkey     string
 	gatewayA   uint8
 	gatewayB   uint8
+	routes     routes.Table
 	log        *log.Logger
 }
 
@@ -116,116 +118,116 @@ func (t *dummyTun) Events() chan tun.Event {
 
 func (t *dummyTun) Close() error {
 	close(t.close)
+	close(t.events)
 	return nil
 }
 
-func defaultRouteAdapterIpAddress() (*net.IP, error) {
-	r, err := winipcfg.GetIPForwardTable2(windows.AF_INET)
-	if err != nil {
-		return nil, err
-	}
-	lowestMetric := ^uint32(0)
-	luid := winipcfg.LUID(0)
-	for i := range r {
-		if r[i].DestinationPrefix.PrefixLength != 0 {
-			continue
-		}
-		ifrow, err := r[i].InterfaceLUID.Interface()
-		if err != nil || ifrow.OperStatus != winipcfg.IfOperStatusUp {
-			continue
-		}
-		if r[i].Metric < lowestMetric {
-			lowestMetric = r[i].Metric
-			luid = r[i].InterfaceLUID
-		}
-	}
-	if luid == 0 {
-		return nil, windows.ERROR_FILE_NOT_FOUND
-	}
-	addrs, err := winipcfg.GetUnicastIPAddressTable(windows.AF_INET)
-	if err != nil {
-		return nil, err
-	}
-	for _, addr := range addrs {
-		if addr.InterfaceLUID == luid {
-			ip := addr.Address.IP()
-			return &ip, nil
-		}
-	}
-	return nil, windows.ERROR_FILE_NOT_FOUND
+// listenPorts counts the servers of this process, so that several servers
+// get different ports.
+var listenPorts = rand.Uint32()
+
+func nextListenPort() uint16 {
+	return uint16((atomic.AddUint32(&listenPorts, 1) % 128) + 51820)
 }
 
+// NewServer creates a server whose endpoint is the physical default route
+// address of this machine.
 func NewServer() (*Server, error) {
-	key, err := conf.NewPrivateKey()
+	return NewServerWithRoutes(routes.NewTable())
+}
+
+// NewServerWithRoutes creates a server whose endpoint is the physical default
+// route address found in table.
+func NewServerWithRoutes(table routes.Table) (*Server, error) {
+	key, err := keys.NewPrivateKey()
 	if err != nil {
 		return nil, err
 	}
+	defer key.Zero()
 	s := &Server{
-		listenPort: uint16((rand.Uint32() % 128) + 51820),
+		listenPort: nextListenPort(),
 		gatewayA:   uint8(rand.Uint32() % 256),
 		gatewayB:   uint8(rand.Uint32() % 256),
 		pubkey:     key.Public().String(),
-	}
-	uapi, err := (&conf.Config{
-		Interface: conf.Interface{
-			PrivateKey: *key,
-			ListenPort: s.listenPort,
-		},
-	}).ToUAPI()
-	if err != nil {
-		return nil, err
+		routes:     table,
 	}
 
 	runtime.SetFinalizer(s, func(f *Server) { f.Close() })
 
 	s.log = log.New(os.Stderr, "[FakeWG] ", 0)
-	s.device = device.NewDevice(newDummyTun(s), &device.Logger{s.log, s.log, s.log})
-	ipcErr := s.device.IpcSetOperation(bufio.NewReader(strings.NewReader(uapi)))
-	if ipcErr != nil {
-		return nil, ipcErr
+	s.device = device.NewDevice(newDummyTun(s), &device.Logger{Debug: s.log, Info: s.log, Error: s.log})
+	err = s.UAPI().Set(&uapi.Config{
+		PrivateKey: key,
+		ListenPort: &s.listenPort,
+	})
+	if err != nil {
+		s.device.Close()
+		return nil, err
 	}
 	s.device.Up()
 
 	return s, nil
 }
 
+// UAPI returns a client of the UAPI handler of the device.
+func (s *Server) UAPI() *uapi.Client {
+	return &uapi.Client{Dial: func() (io.ReadWriteCloser, error) {
+		client, server := net.Pipe()
+		go s.device.IpcHandle(server)
+		return client, nil
+	}}
+}
+
 func (s *Server) AddClient(publicKeyBase64 string) (allocatedIP string, err error) {
-	key, err := conf.NewPrivateKeyFromString(publicKeyBase64)
+	key, err := keys.NewKeyFromString(publicKeyBase64)
 	if err != nil {
 		return
 	}
+	s.mutex.Lock()
 	ip := net.IPv4(10, s.gatewayA, s.gatewayB, byte(s.nextIp%252)+2)
 	s.nextIp++
+	s.mutex.Unlock()
 
-	uapi, err := (&conf.Config{
-		Peers: []conf.Peer{{
-			PublicKey:  *key,
-			AllowedIPs: []conf.IPCidr{{IP: ip, Cidr: 32}}},
-		},
-	}).ToUAPI()
+	err = s.UAPI().AddPeer(uapi.PeerConfig{
+		PublicKey:  *key,
+		AllowedIPs: []uapi.AllowedIP{{IPNet: net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}}},
+	})
 	if err != nil {
 		return
 	}
-	uapi = strings.ReplaceAll(uapi, "replace_peers=true\n", "")
-	uapi = uapi[strings.IndexByte(uapi, '\n')+1:]
-	ipcErr := s.device.IpcSetOperation(bufio.NewReader(strings.NewReader(uapi)))
-	if ipcErr != nil {
-		return "", ipcErr
-	}
 	return ip.String(), nil
 }
 
+// RemoveClient removes the peer of a client added by AddClient.
+func (s *Server) RemoveClient(publicKeyBase64 string) error {
+	key, err := keys.NewKeyFromString(publicKeyBase64)
+	if err != nil {
+		return err
+	}
+	return s.UAPI().RemovePeer(key)
+}
+
+// Clients returns the peers of the device.
+func (s *Server) Clients() ([]uapi.Peer, error) {
+	state, err := s.UAPI().Get()
+	if err != nil {
+		return nil, err
+	}
+	state.Zero()
+	return state.Peers, nil
+}
+
 func (s *Server) Close() {
 	if s == nil || !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
 		return
 	}
 	if s.device != nil {
-		s.Close()
+		s.device.Close()
 	}
 }
 
 func (s *Server) Endpoint() (string, uint16, error) {
-	ourIp, err := defaultRouteAdapterIpAddress()
+	ourIp, err := routes.DefaultRouteAddress(s.routes, routes.IPv4)
 	if err != nil {
 		return "", 0, err
 	}
@@ -0,0 +1,50 @@
+package fakewg
+
+import (
+	"testing"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/routes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClients(t *testing.T) {
+	s, err := NewServerWithRoutes(routes.NewFakeTable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	state, err := s.UAPI().Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, s.listenPort, state.ListenPort)
+	assert.Equal(t, s.PublicKey(), state.PrivateKey.Public().String())
+
+	key, err := keys.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey := key.Public().String()
+	ip, err := s.AddClient(pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients, err := s.Clients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, clients, 1) {
+		assert.Equal(t, pubkey, clients[0].PublicKey.String())
+		assert.Equal(t, ip+"/32", clients[0].AllowedIPs[0].String())
+	}
+
+	_, err = s.AddClient("not a key")
+	assert.Error(t, err)
+
+	assert.NoError(t, s.RemoveClient(pubkey))
+	clients, err = s.Clients()
+	assert.NoError(t, err)
+	assert.Empty(t, clients)
+}
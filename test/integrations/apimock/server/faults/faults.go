@@ -0,0 +1,265 @@
+package faults
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/accounts"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+)
+
+// ScopeHeader names the scope of a request. Requests without it are in the
+// scope of their API token, so each simulated user is its own scope.
+const ScopeHeader = "X-Mock-Scope"
+
+// Body faults
+const (
+	// BodyTruncated cuts the response of the route in half.
+	BodyTruncated = "truncated"
+
+	// BodyInvalid replaces the response of the route with invalid JSON.
+	BodyInvalid = "invalid"
+)
+
+// invalidBody is the body of BodyInvalid faults.
+const invalidBody = `{"error": <html>Bad Gateway</html>`
+
+var (
+	ErrUnknownRoute = errors.New("No route has this name")
+	ErrInvalidFault = errors.New("Faults need a route, and a status of 400 to 599, a body of truncated or invalid, and positive durations")
+	ErrNotFound     = errors.New("No fault has this ID")
+)
+
+// Fault changes the responses of a route. Latency applies first, then the
+// first of Hang, Status and Body that is set.
+type Fault struct {
+	ID    int    `json:"id"`
+	Route string `json:"route"`
+
+	// Scope limits the fault to requests of a scope. Faults without one
+	// apply to all requests.
+	Scope string `json:"scope,omitempty"`
+
+	// LatencyMs delays responses, by up to JitterMs more at random.
+	LatencyMs int `json:"latency_ms,omitempty"`
+	JitterMs  int `json:"jitter_ms,omitempty"`
+
+	// Hang holds requests until the client gives up or the fault is
+	// removed.
+	Hang bool `json:"hang,omitempty"`
+
+	// Status replaces the response with Error, or with an ErrorSchema for the
+	// status when Error is not set.
+	Status int                 `json:"status,omitempty"`
+	Error  *models.ErrorSchema `json:"error,omitempty"`
+
+	Body string `json:"body,omitempty"`
+
+	// Times is how many requests fail before the route succeeds again. Zero
+	// fails all requests.
+	Times int `json:"times,omitempty"`
+
+	// Hits counts the requests the fault applied to.
+	Hits int `json:"hits"`
+}
+
+type fault struct {
+	Fault
+	removed chan struct{}
+}
+
+// Registry keeps the faults of the routes of a router.
+type Registry struct {
+	routes map[string]bool
+
+	mutex  sync.Mutex
+	faults map[int]*fault
+	nextID int
+}
+
+// NewRegistry returns a registry for the named routes.
+func NewRegistry(routes []string) *Registry {
+	r := &Registry{routes: make(map[string]bool), faults: make(map[int]*fault), nextID: 1}
+	for _, route := range routes {
+		r.routes[route] = true
+	}
+	return r
+}
+
+func (f *Fault) validate() error {
+	if f.LatencyMs < 0 || f.JitterMs < 0 || f.Times < 0 {
+		return ErrInvalidFault
+	}
+	if f.Status != 0 && (f.Status < 400 || f.Status > 599) {
+		return ErrInvalidFault
+	}
+	if f.Body != "" && f.Body != BodyTruncated && f.Body != BodyInvalid {
+		return ErrInvalidFault
+	}
+	if f.LatencyMs == 0 && f.JitterMs == 0 && !f.Hang && f.Status == 0 && f.Body == "" {
+		return ErrInvalidFault
+	}
+	return nil
+}
+
+// Add adds a fault, and returns it with its ID.
+func (r *Registry) Add(f Fault) (Fault, error) {
+	if !r.routes[f.Route] {
+		return Fault{}, ErrUnknownRoute
+	}
+	if err := f.validate(); err != nil {
+		return Fault{}, err
+	}
+	if f.Status != 0 && f.Error == nil {
+		f.Error = &models.ErrorSchema{Code: int32(f.Status), Errno: 999, Error: http.StatusText(f.Status)}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f.ID = r.nextID
+	f.Hits = 0
+	r.nextID++
+	r.faults[f.ID] = &fault{Fault: f, removed: make(chan struct{})}
+	return f, nil
+}
+
+// List returns the faults, in the order they were added.
+func (r *Registry) List() []Fault {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	faults := make([]Fault, 0, len(r.faults))
+	for _, f := range r.faults {
+		faults = append(faults, f.Fault)
+	}
+	sort.Slice(faults, func(i, j int) bool { return faults[i].ID < faults[j].ID })
+	return faults
+}
+
+// removeLocked removes a fault, and releases the requests it holds.
+func (r *Registry) removeLocked(id int) {
+	close(r.faults[id].removed)
+	delete(r.faults, id)
+}
+
+// Remove removes a fault.
+func (r *Registry) Remove(id int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.faults[id] == nil {
+		return ErrNotFound
+	}
+	r.removeLocked(id)
+	return nil
+}
+
+// Reset removes the faults of a scope, or all faults when all is set.
+func (r *Registry) Reset(scope string, all bool) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	removed := 0
+	for id, f := range r.faults {
+		if all || f.Scope == scope {
+			r.removeLocked(id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// RequestScope returns the scope of a request.
+func RequestScope(req *http.Request) string {
+	if scope := req.Header.Get(ScopeHeader); scope != "" {
+		return scope
+	}
+	return accounts.TokenFromRequest(req)
+}
+
+func precedes(a, b *fault) bool {
+	if (a.Scope != "") != (b.Scope != "") {
+		return a.Scope != ""
+	}
+	return a.ID < b.ID
+}
+
+// match returns a copy of the fault for a request, and counts the hit.
+// Faults of the scope of the request come before faults of all scopes.
+func (r *Registry) match(route string, scope string) (*Fault, <-chan struct{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var found *fault
+	for _, f := range r.faults {
+		if f.Route != route || (f.Scope != "" && f.Scope != scope) || (f.Times > 0 && f.Hits >= f.Times) {
+			continue
+		}
+		if found == nil || precedes(f, found) {
+			found = f
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	found.Hits++
+	matched := found.Fault
+	return &matched, found.removed
+}
+
+// Wrap applies the faults of a route to its handler.
+func (r *Registry) Wrap(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f, removed := r.match(route, RequestScope(req))
+		if f == nil {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		latency := time.Duration(f.LatencyMs) * time.Millisecond
+		if f.JitterMs > 0 {
+			latency += time.Duration(rand.Intn(f.JitterMs)) * time.Millisecond
+		}
+		if latency > 0 {
+			timer := time.NewTimer(latency)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+
+		switch {
+		case f.Hang:
+			select {
+			case <-req.Context().Done():
+			case <-removed:
+				handler.ServeHTTP(w, req)
+			}
+		case f.Status != 0:
+			js, _ := json.Marshal(f.Error)
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(f.Status)
+			w.Write(js)
+		case f.Body != "":
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			body := recorder.Body.Bytes()
+			if f.Body == BodyTruncated {
+				body = body[:len(body)/2]
+			} else {
+				body = []byte(invalidBody)
+			}
+			for key, values := range recorder.Header() {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(recorder.Code)
+			w.Write(body)
+		default:
+			handler.ServeHTTP(w, req)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package faults
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
+	"github.com/stretchr/testify/assert"
+)
+
+const okBody = `{"status":"ok"}`
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(okBody))
+})
+
+func serve(r *Registry, req *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	r.Wrap("AccountGet", okHandler).ServeHTTP(recorder, req)
+	return recorder
+}
+
+func get(r *Registry, scope string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/v1/vpn/account", nil)
+	if scope != "" {
+		req.Header.Set(ScopeHeader, scope)
+	}
+	return serve(r, req)
+}
+
+func TestNoFault(t *testing.T) {
+	r := NewRegistry([]string{"AccountGet"})
+	res := get(r, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, okBody, res.Body.String())
+}
+
+func TestAddValidates(t *testing.T) {
+	r := NewRegistry([]string{"AccountGet"})
+	_, err := r.Add(Fault{Route: "Missing", Status: 500})
+	assert.Equal(t, ErrUnknownRoute, err)
+
+	invalid := []Fault{
+		{Route: "AccountGet"},
+		{Route: "AccountGet", Status: 200},
+		{Route: "AccountGet", Status: 600},
+		{Route: "AccountGet", Body: "empty"},
+		{Route: "AccountGet", LatencyMs: -1},
+		{Route: "AccountGet", Status: 500, Times: -1},
+	}
+	for _, f := range invalid {
+		_, err := r.Add(f)
+		assert.Equal(t, ErrInvalidFault, err, "%+v", f)
+	}
+	assert.Empty(t, r.List())
+}
+
+func TestLatency(t *testing.T) {
+	r := NewRegistry([]string{"AccountGet"})
+	_, err := r.Add(Fault{Route: "AccountGet", LatencyMs: 50, JitterMs: 20})
+	assert.NoError(t, err)
+
+	start := time.Now()
+	res := get(r, "")
+	elapsed := time.Since(start)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, okBody, res.Body.String())
+	assert.True(t, elapsed >= 50*time.Millisecond, elapsed)
+}
+
+func TestLatencyCancelled(t *testing.T) {
+	r := NewRegistry([]string{"AccountGet"})
+	_, err := r.Add(Fault{Route: "AccountGet", LatencyMs: 10000})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	res := serve(r, httptest.NewRequest("GET", "/api/v1/vpn/account", nil).WithContext(ctx))
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Empty(t, res.Body.String())
+}
+
+func TestStatus(t *testing.T) {
+	r := NewRegistry([]string{"AccountGet"})
+	f, err := r.Add(Fault{Route: "AccountGet", Status: 503})
+	assert.NoError(t, err)
+	assert.Equal(t, &models.ErrorSchema{Code: 503, Errno: 999, Error: "Service Unavailable"}, f.Error)
+
+	res := get(r, "")
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	var body models.ErrorSchema
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &body))
+	assert.Equal(t, *f.Error, body)
+
+	custom := &models.ErrorSchema{Code: 401, Errno: 120, Error: "Subscription expired"}
+	assert.NoError(t, r.Remove(f.ID))
+	_, err = r.Add(Fault{Route: "AccountGet", Status: 401, Error: custom})
+	assert.NoError(t, err)
+	res = get(r, "")
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &body))
+	assert.Equal(t, *custom, body)
+}
+
+func TestBody(t *testing.T) {
+	r := NewRegistry([]string{"AccountGet"})
+	f, err := r.Add(Fault{Route: "AccountGet", Body: BodyTruncated})
+	assert.NoError(t, err)
+	res := get(r, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, okBody[:len(okBody)/2], res.Body.String())
+	assert.Equal(t, "application/json; charset=UTF-8", res.Header().Get("Content-Type"))
+
+	assert.NoError(t, r.Remove(f.ID))
+	_, err = r.Add(Fault{Route: "AccountGet", Body: BodyInvalid})
+	assert.NoError(t, err)
+	res = get(r, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	var v interface{}
+	assert.Error(t, json.Unmarshal(res.Body.Bytes(), &v))
+}
+
+func TestHang(t *testing.T) {
+	r := NewRegistry([]string{"AccountGet"})
+	_, err := r.Add(Fault{Route: "AccountGet", Hang: true, Scope: "hang"})
+	assert.NoError(t, err)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- get(r, "hang")
+	}()
+	select {
+	case <-done:
+		t.Fatal("Request did not hang")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, 1, r.Reset("hang", false))
+	select {
+	case res := <-done:
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, okBody, res.Body.String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reset did not release the request")
+	}
+}
+
+func TestHangCancelled(t *testing.T) {
+	r := NewRegistry([]string{"AccountGet"})
+	_, err := r.Add(Fault{Route: "AccountGet", Hang: true})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	res := serve(r, httptest.NewRequest("GET", "/api/v1/vpn/account", nil).WithContext(ctx))
+	assert.Empty(t, res.Body.String())
+}
+
+func TestTimes(t *testing.T) {
+	r := NewRegistry([]string{"AccountGet"})
+	_, err := r.Add(Fault{Route: "AccountGet", Status: 500, Times: 2})
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusInternalServerError, get(r, "").Code)
+	assert.Equal(t, http.StatusInternalServerError, get(r, "").Code)
+	assert.Equal(t, http.StatusOK, get(r, "").Code)
+	assert.Equal(t, 2, r.List()[0].Hits)
+}
+
+func TestScopes(t *testing.T) {
+	r := NewRegistry([]string{"AccountGet"})
+	_, err := r.Add(Fault{Route: "AccountGet", Status: 500, Scope: "test-a"})
+	assert.NoError(t, err)
+	_, err = r.Add(Fault{Route: "AccountGet", Status: 502, Scope: "token-b"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusInternalServerError, get(r, "test-a").Code)
+	assert.Equal(t, http.StatusOK, get(r, "test-c").Code)
+	assert.Equal(t, http.StatusOK, get(r, "").Code)
+
+	req := httptest.NewRequest("GET", "/api/v1/vpn/account", nil)
+	req.Header.Set("Authorization", "Bearer token-b")
+	assert.Equal(t, http.StatusBadGateway, serve(r, req).Code)
+
+	// Scoped faults come before faults of all scopes
+	_, err = r.Add(Fault{Route: "AccountGet", Status: 503})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, get(r, "test-a").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, get(r, "test-c").Code)
+
+	assert.Equal(t, 1, r.Reset("test-a", false))
+	assert.Equal(t, http.StatusServiceUnavailable, get(r, "test-a").Code)
+	assert.Len(t, r.List(), 2)
+	assert.Equal(t, 2, r.Reset("", true))
+	assert.Empty(t, r.List())
+}
+
+func TestRemove(t *testing.T) {
+	r := NewRegistry([]string{"AccountGet"})
+	f, err := r.Add(Fault{Route: "AccountGet", Status: 500})
+	assert.NoError(t, err)
+	assert.NoError(t, r.Remove(f.ID))
+	assert.Equal(t, ErrNotFound, r.Remove(f.ID))
+	assert.Equal(t, http.StatusOK, get(r, "").Code)
+}
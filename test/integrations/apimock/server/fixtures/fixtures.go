@@ -0,0 +1,322 @@
+// Package fixtures records the responses of the real Guardian and Balrog APIs
+// into fixture files, and replays them offline, so that the mock serves the
+// response shapes of production.
+package fixtures
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// BalrogPrefix is the path prefix of the requests forwarded to Balrog.
+// Other requests are forwarded to Guardian.
+const BalrogPrefix = "/json/"
+
+const extension = ".json"
+
+var (
+	ErrNoFixture       = errors.New("No fixture matches the request")
+	ErrInvalidUpstream = errors.New("Upstream must be an absolute http or https URL")
+)
+
+// Request is the part of a request that fixtures are matched on. Request
+// headers are neither recorded nor matched, so that tokens never reach
+// fixtures.
+type Request struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Query  string `json:"query,omitempty"`
+	Body   string `json:"body,omitempty"`
+}
+
+// Response is a recorded response.
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+
+	// Base64 is set when the body is not UTF-8, and is encoded.
+	Base64 bool `json:"base64,omitempty"`
+}
+
+// Fixture is a recorded request and response pair.
+type Fixture struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// hopHeaders are not recorded or forwarded. Content-Length is recomputed,
+// and Accept-Encoding is left to the transport, so that bodies are recorded
+// uncompressed.
+var hopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Content-Length":      true,
+	"Accept-Encoding":     true,
+	"Set-Cookie":          true,
+	"Date":                true,
+}
+
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		if !hopHeaders[http.CanonicalHeaderKey(name)] {
+			dst[name] = append([]string(nil), values...)
+		}
+	}
+}
+
+// scrubbedHeaders are the response headers whose URLs are scrubbed.
+var scrubbedHeaders = []string{"Location", "Content-Location"}
+
+// newResponse scrubs a response for recording. Bodies that are not UTF-8,
+// such as installers, are recorded as they are, as scrubbing would corrupt
+// them.
+func newResponse(status int, header http.Header, body []byte) Response {
+	response := Response{Status: status, Header: make(http.Header)}
+	copyHeader(response.Header, header)
+	for _, name := range scrubbedHeaders {
+		for i, value := range response.Header[name] {
+			response.Header[name][i] = recording.text(value)
+		}
+	}
+	if utf8.Valid(body) {
+		response.Body = string(recording.body(body))
+	} else {
+		response.Body = base64.StdEncoding.EncodeToString(body)
+		response.Base64 = true
+	}
+	return response
+}
+
+// Bytes returns the body of the response.
+func (r *Response) Bytes() ([]byte, error) {
+	if r.Base64 {
+		return base64.StdEncoding.DecodeString(r.Body)
+	}
+	return []byte(r.Body), nil
+}
+
+// Write writes the response.
+func (r *Response) Write(w http.ResponseWriter) error {
+	body, err := r.Bytes()
+	if err != nil {
+		return err
+	}
+	copyHeader(w.Header(), r.Header)
+	w.WriteHeader(r.Status)
+	_, err = w.Write(body)
+	return err
+}
+
+// Load reads the fixtures of a directory, in the order they were recorded.
+func Load(dir string) ([]Fixture, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+extension))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	fixtures := make([]Fixture, 0, len(names))
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var fixture Fixture
+		if err := json.Unmarshal(data, &fixture); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(name), err)
+		}
+		fixtures = append(fixtures, fixture)
+	}
+	return fixtures, nil
+}
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// Recorder writes fixtures to a directory, one file per fixture, named by
+// their order and request.
+type Recorder struct {
+	Dir string
+
+	mutex sync.Mutex
+	next  int
+}
+
+// NewRecorder returns a recorder that adds to the fixtures of dir.
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	fixtures, err := filepath.Glob(filepath.Join(dir, "*"+extension))
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{Dir: dir, next: len(fixtures) + 1}, nil
+}
+
+// Record writes a fixture.
+func (r *Recorder) Record(fixture Fixture) error {
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The path is scrubbed already, so that names have no secrets either
+	slug := strings.Trim(unsafeName.ReplaceAllString(fixture.Request.Path, "-"), "-")
+	if len(slug) > 64 {
+		slug = slug[:64]
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for {
+		name := filepath.Join(r.Dir, fmt.Sprintf("%04d-%s-%s%s", r.next, strings.ToLower(fixture.Request.Method), slug, extension))
+		r.next++
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		_, err = file.Write(append(data, '\n'))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+}
+
+// Proxy forwards requests to the upstream APIs, and records them.
+type Proxy struct {
+	Guardian *url.URL
+	Balrog   *url.URL
+	Client   *http.Client
+	Recorder *Recorder
+}
+
+// NewProxy returns a proxy to the Guardian and Balrog base URLs.
+func NewProxy(guardian, balrog string, recorder *Recorder) (*Proxy, error) {
+	p := &Proxy{Client: &http.Client{}, Recorder: recorder}
+	for _, upstream := range []struct {
+		raw string
+		url **url.URL
+	}{{guardian, &p.Guardian}, {balrog, &p.Balrog}} {
+		u, err := url.Parse(upstream.raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, ErrInvalidUpstream
+		}
+		*upstream.url = u
+	}
+	return p, nil
+}
+
+// Forward sends a request upstream, records it, and returns the response.
+func (p *Proxy) Forward(req *http.Request) (*Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	upstream := p.Guardian
+	if strings.HasPrefix(req.URL.Path, BalrogPrefix) {
+		upstream = p.Balrog
+	}
+	target, err := url.Parse(strings.TrimSuffix(upstream.String(), "/") + req.URL.RequestURI())
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := http.NewRequest(req.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	out = out.WithContext(req.Context())
+	copyHeader(out.Header, req.Header)
+	res, err := p.Client.Do(out)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(io.LimitReader(res.Body, 64<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	// Clients get the response as it is, and fixtures get it scrubbed
+	response := &Response{Status: res.StatusCode, Header: res.Header, Body: string(resBody)}
+	fixture := Fixture{
+		Request:  recording.request(req.Method, req.URL, body),
+		Response: newResponse(res.StatusCode, res.Header, resBody),
+	}
+	if err := p.Recorder.Record(fixture); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Replayer serves fixtures. Requests match the fixtures with the same
+// method, path, query and body, with keys and secrets ignored. Fixtures that
+// match the same requests are served in the order they were recorded, and
+// the last one is repeated.
+type Replayer struct {
+	fixtures map[Request][]Response
+
+	mutex  sync.Mutex
+	served map[Request]int
+}
+
+// NewReplayer returns a replayer of fixtures.
+func NewReplayer(fixtures []Fixture) *Replayer {
+	r := &Replayer{fixtures: make(map[Request][]Response), served: make(map[Request]int)}
+	for _, fixture := range fixtures {
+		request := fixture.Request
+		key := matching.request(request.Method, &url.URL{Path: request.Path, RawQuery: request.Query}, []byte(request.Body))
+		r.fixtures[key] = append(r.fixtures[key], fixture.Response)
+	}
+	return r
+}
+
+// Match returns the response of the fixture that matches a request.
+func (r *Replayer) Match(req *http.Request) (*Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	key := matching.request(req.Method, req.URL, body)
+	responses := r.fixtures[key]
+	if len(responses) == 0 {
+		return nil, ErrNoFixture
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	i := r.served[key]
+	if i < len(responses)-1 {
+		r.served[key]++
+	}
+	return &responses[i], nil
+}
+
+// Rewind serves all fixtures again from the first one.
+func (r *Replayer) Rewind() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.served = make(map[Request]int)
+}
@@ -0,0 +1,232 @@
+package fixtures
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	deviceKey = "cfj07ej4hYHZRSBlrZ1E3EupS3prs7euVrLVkaexCVM="
+	otherKey  = "pGKzGQb3ggPnIF/qbAqdo0PzNy5iFaW3ZSpotMx7xVU="
+	token     = "6d7b3a5e2c1f"
+
+	verifyToken = "token-9f86d081884c7d65"
+	verifyURL   = "https://vpn.example.com/api/v1/vpn/login/verify/" + verifyToken
+)
+
+func TestFakeKey(t *testing.T) {
+	fake := fakeKey(deviceKey)
+	assert.Equal(t, fake, fakeKey(deviceKey))
+	assert.NotEqual(t, fake, fakeKey(otherKey))
+	assert.True(t, keyPattern.MatchString(fake))
+	decoded, err := base64.StdEncoding.DecodeString(fake)
+	require.NoError(t, err)
+	assert.Len(t, decoded, 32)
+}
+
+func TestScrub(t *testing.T) {
+	body := []byte(`{"token": "` + token + `", "user": {"devices": [{"pubkey": "` + deviceKey + `", "id": 12345678901234567890}]}}`)
+	scrubbed := string(recording.body(body))
+	assert.NotContains(t, scrubbed, token)
+	assert.NotContains(t, scrubbed, deviceKey)
+	assert.Contains(t, scrubbed, `"token":"scrubbed"`)
+	assert.Contains(t, scrubbed, fakeKey(deviceKey))
+	assert.Contains(t, scrubbed, "12345678901234567890")
+
+	unchanged := []byte(`{"version": "0.5.1.1",  "required": true}`)
+	assert.Equal(t, unchanged, recording.body(unchanged))
+	assert.Equal(t, `{"required":true,"version":"0.5.1.1"}`, string(matching.body(unchanged)))
+
+	assert.Equal(t, "key "+fakeKey(deviceKey), string(recording.body([]byte("key "+deviceKey))))
+	assert.Equal(t, "a=%3Ckey%3E&code=%3Cscrubbed%3E", matching.query("code="+token+"&a="+url.QueryEscape(deviceKey)))
+
+	// Login URLs embed tokens in their path and query
+	login := []byte(`{"login_url": "` + verifyURL + `", "verification_url": "` + verifyURL + `?code=` + token + `&lang=en", "poll_interval": 5}`)
+	scrubbed = string(recording.body(login))
+	assert.NotContains(t, scrubbed, verifyToken)
+	assert.NotContains(t, scrubbed, token)
+	assert.Contains(t, scrubbed, `"login_url":"https://vpn.example.com/api/v1/vpn/login/verify/scrubbed"`)
+	assert.Contains(t, scrubbed, `"verification_url":"https://vpn.example.com/api/v1/vpn/login/verify/scrubbed?code=scrubbed\u0026lang=en"`)
+	assert.Equal(t, Request{Method: "GET", Path: "/v1/vpn/login/verify/<scrubbed>"}, matching.request("GET", &url.URL{Path: "/v1/vpn/login/verify/" + verifyToken}, nil))
+}
+
+func TestResponseBody(t *testing.T) {
+	binary := []byte{0xff, 0xfe, 0x00, 0x01}
+	response := newResponse(http.StatusOK, http.Header{"Content-Length": {"4"}, "Content-Type": {"application/octet-stream"}}, binary)
+	assert.True(t, response.Base64)
+	assert.Equal(t, http.Header{"Content-Type": {"application/octet-stream"}}, response.Header)
+
+	w := httptest.NewRecorder()
+	require.NoError(t, response.Write(w))
+	assert.Equal(t, binary, w.Body.Bytes())
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+
+	// Binary bodies are not scrubbed, even when they happen to hold a key
+	binary = append([]byte{0xff, 0xfe}, deviceKey...)
+	response = newResponse(http.StatusOK, http.Header{}, binary)
+	decoded, err := response.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, binary, decoded)
+
+	response = newResponse(http.StatusFound, http.Header{"Location": {verifyURL}}, nil)
+	assert.Equal(t, "https://vpn.example.com/api/v1/vpn/login/verify/scrubbed", response.Header.Get("Location"))
+}
+
+// upstream returns a server that answers with its name, the path and body of
+// requests, a count of requests, and a key and token.
+func upstream(t *testing.T, name string) *httptest.Server {
+	var count int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "Bearer "+token, r.Header.Get("Authorization"))
+		assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+		js, err := json.Marshal(map[string]interface{}{
+			"upstream": name,
+			"path":     r.URL.Path,
+			"request":  string(body),
+			"count":    atomic.AddInt32(&count, 1),
+			"token":    token,
+			"pubkey":   otherKey,
+
+			"login_url":        verifyURL,
+			"verification_url": verifyURL + "?code=" + token,
+		})
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session="+token)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(js)
+	}))
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	guardian := upstream(t, "guardian")
+	defer guardian.Close()
+	balrog := upstream(t, "balrog")
+	defer balrog.Close()
+
+	recorder, err := NewRecorder(dir)
+	require.NoError(t, err)
+	proxy, err := NewProxy(guardian.URL, balrog.URL+"/", recorder)
+	require.NoError(t, err)
+
+	forward := func(method, target, body string) *Response {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set("Accept-Encoding", "br")
+		response, err := proxy.Forward(r)
+		require.NoError(t, err)
+		return response
+	}
+
+	// Clients of the proxy get the upstream responses as they are
+	response := forward("POST", "/api/v1/vpn/device", `{"name": "laptop", "pubkey": "`+deviceKey+`"}`)
+	assert.Equal(t, http.StatusCreated, response.Status)
+	assert.Contains(t, response.Body, `"upstream":"guardian"`)
+	assert.Contains(t, response.Body, token)
+	assert.Contains(t, response.Body, otherKey)
+	response = forward("GET", "/json/1/FirefoxVPN/0.5.0.0/WINNT_x86_64/release/update.json", "")
+	assert.Contains(t, response.Body, `"upstream":"balrog"`)
+	forward("DELETE", "/api/v1/vpn/device/"+url.PathEscape(deviceKey), "")
+	forward("GET", "/api/v1/vpn/account?first=1", "")
+	forward("GET", "/api/v1/vpn/account?first=0", "")
+	response = forward("GET", "/v1/vpn/login/verify/"+verifyToken, "")
+	assert.Contains(t, response.Body, verifyToken)
+	forward("GET", "/api/v1/vpn/servers", "")
+	forward("GET", "/api/v1/vpn/servers", "")
+
+	// Fixtures have no tokens or keys
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	require.NoError(t, err)
+	require.Len(t, names, 8)
+	assert.Equal(t, "0001-post-api-v1-vpn-device.json", filepath.Base(names[0]))
+	assert.Equal(t, "0006-get-v1-vpn-login-verify-scrubbed.json", filepath.Base(names[5]))
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		assert.NotContains(t, name, verifyToken)
+		assert.NotContains(t, string(data), verifyToken, name)
+		assert.NotContains(t, string(data), token, name)
+		assert.NotContains(t, string(data), deviceKey, name)
+		assert.NotContains(t, string(data), otherKey, name)
+	}
+
+	// Recording again adds to the fixtures
+	recorder, err = NewRecorder(dir)
+	require.NoError(t, err)
+	proxy.Recorder = recorder
+	forward("GET", "/api/v1/vpn/servers", "")
+
+	recorded, err := Load(dir)
+	require.NoError(t, err)
+	require.Len(t, recorded, 9)
+	assert.Equal(t, Request{Method: "DELETE", Path: "/api/v1/vpn/device/" + fakeKey(deviceKey)}, recorded[2].Request)
+	assert.Equal(t, "first=1", recorded[3].Request.Query)
+	assert.Equal(t, Request{Method: "GET", Path: "/v1/vpn/login/verify/scrubbed"}, recorded[5].Request)
+
+	replayer := NewReplayer(recorded)
+	match := func(method, target, body string) (*Response, error) {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer another")
+		return replayer.Match(r)
+	}
+
+	// Requests match whatever their keys and body formatting
+	response, err = match("POST", "/api/v1/vpn/device", `{"pubkey":"`+otherKey+`","name":"laptop"}`)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, response.Status)
+	assert.Contains(t, response.Body, `"upstream":"guardian"`)
+	assert.Contains(t, response.Body, fakeKey(otherKey))
+	_, err = match("DELETE", "/api/v1/vpn/device/"+url.PathEscape(otherKey), "")
+	assert.NoError(t, err)
+	_, err = match("POST", "/api/v1/vpn/device", `{"pubkey":"`+otherKey+`","name":"desktop"}`)
+	assert.Equal(t, ErrNoFixture, err)
+	_, err = match("GET", "/api/v1/vpn/account?first=2", "")
+	assert.Equal(t, ErrNoFixture, err)
+	response, err = match("GET", "/v1/vpn/login/verify/token-0123456789abcdef", "")
+	require.NoError(t, err)
+	assert.Equal(t, &recorded[5].Response, response)
+
+	// Fixtures of the same requests are served in order, and the last one
+	// repeats
+	for _, i := range []int{6, 7} {
+		response, err = match("GET", "/api/v1/vpn/servers", "")
+		require.NoError(t, err)
+		assert.Equal(t, &recorded[i].Response, response)
+	}
+	for i := 0; i < 3; i++ {
+		response, err = match("GET", "/api/v1/vpn/servers", "")
+		require.NoError(t, err)
+		assert.Equal(t, &recorded[8].Response, response)
+	}
+	replayer.Rewind()
+	response, err = match("GET", "/api/v1/vpn/servers", "")
+	require.NoError(t, err)
+	assert.Equal(t, &recorded[6].Response, response)
+}
+
+func TestNewProxy(t *testing.T) {
+	recorder := &Recorder{}
+	for _, upstream := range []string{"", "localhost:8080", "ftp://example.com", "http://"} {
+		_, err := NewProxy(upstream, "https://aus5.mozilla.org", recorder)
+		assert.Equal(t, ErrInvalidUpstream, err, upstream)
+	}
+	_, err := NewProxy("https://vpn.mozilla.org", "https://aus5.mozilla.org", recorder)
+	assert.NoError(t, err)
+}
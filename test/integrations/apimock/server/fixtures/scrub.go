@@ -0,0 +1,185 @@
+package fixtures
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// keyPattern matches base64 WireGuard keys.
+var keyPattern = regexp.MustCompile(`[A-Za-z0-9+/]{42}[AEIMQUYcgkosw048]=`)
+
+// SecretFields are the JSON fields and query parameters, in lower case,
+// whose values are scrubbed.
+var SecretFields = map[string]bool{
+	"token":              true,
+	"access_token":       true,
+	"refresh_token":      true,
+	"id_token":           true,
+	"session_token":      true,
+	"verification_token": true,
+	"code":               true,
+	"private_key":        true,
+	"privatekey":         true,
+}
+
+// SecretPaths are the path prefixes whose next segment is a secret, in
+// request paths and in the URLs of bodies.
+var SecretPaths = []string{
+	"/v1/vpn/login/verify/",
+}
+
+// urlParamPattern matches the parameters of URLs in text.
+var urlParamPattern = regexp.MustCompile(`[?&]([A-Za-z_]+)=([^&#"'\s]*)`)
+
+// scrubber replaces keys and the values of secret fields.
+type scrubber struct {
+	key    func(string) string
+	secret string
+
+	// canonical formats all JSON bodies the same way.
+	canonical bool
+}
+
+// fakeKey returns a valid key derived from a key, so that fixtures keep the
+// same fake key wherever the real one was.
+func fakeKey(key string) string {
+	fake := sha256.Sum256([]byte("apimock fixture " + key))
+	return base64.StdEncoding.EncodeToString(fake[:])
+}
+
+var (
+	// recording scrubs what is written to fixtures.
+	recording = scrubber{key: fakeKey, secret: "scrubbed"}
+
+	// matching scrubs requests before they are compared, so that requests
+	// match fixtures whatever their keys and secrets.
+	matching = scrubber{key: func(string) string { return "<key>" }, secret: "<scrubbed>", canonical: true}
+)
+
+// text scrubs the keys of text, and the secrets of the paths and URLs in it.
+func (s scrubber) text(text string) string {
+	for _, prefix := range SecretPaths {
+		text = s.segments(text, prefix)
+	}
+	text = urlParamPattern.ReplaceAllStringFunc(text, func(param string) string {
+		match := urlParamPattern.FindStringSubmatch(param)
+		if !SecretFields[strings.ToLower(match[1])] || match[2] == "" {
+			return param
+		}
+		return strings.TrimSuffix(param, match[2]) + s.secret
+	})
+	return keyPattern.ReplaceAllStringFunc(text, s.key)
+}
+
+// segments scrubs the path segments that follow prefix in text.
+func (s scrubber) segments(text, prefix string) string {
+	var out strings.Builder
+	for {
+		i := strings.Index(text, prefix)
+		if i < 0 {
+			break
+		}
+		i += len(prefix)
+		end := strings.IndexAny(text[i:], "/?#&\"' \t\r\n")
+		if end < 0 {
+			end = len(text) - i
+		}
+		out.WriteString(text[:i])
+		if end > 0 {
+			out.WriteString(s.secret)
+		}
+		text = text[i+end:]
+	}
+	out.WriteString(text)
+	return out.String()
+}
+
+func (s scrubber) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return s.text(v)
+	case []interface{}:
+		scrubbed := make([]interface{}, len(v))
+		for i := range v {
+			scrubbed[i] = s.value(v[i])
+		}
+		return scrubbed
+	case map[string]interface{}:
+		scrubbed := make(map[string]interface{}, len(v))
+		for field, value := range v {
+			if _, ok := value.(string); ok && SecretFields[strings.ToLower(field)] {
+				scrubbed[field] = s.secret
+			} else {
+				scrubbed[field] = s.value(value)
+			}
+		}
+		return scrubbed
+	}
+	return v
+}
+
+// body scrubs a JSON body, or the keys of any other body. Unless canonical,
+// bodies without anything to scrub are returned as they are, so that signed
+// responses stay valid.
+func (s scrubber) body(body []byte) []byte {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil || decoder.More() {
+		return []byte(s.text(string(body)))
+	}
+	scrubbed := s.value(v)
+	if !s.canonical && reflect.DeepEqual(v, scrubbed) {
+		return body
+	}
+	out, err := json.Marshal(scrubbed)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// query scrubs a raw query, and sorts its parameters.
+func (s scrubber) query(rawQuery string) string {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return s.text(rawQuery)
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var query []string
+	for _, name := range names {
+		for _, value := range values[name] {
+			if SecretFields[strings.ToLower(name)] {
+				value = s.secret
+			} else {
+				value = s.text(value)
+			}
+			query = append(query, url.QueryEscape(name)+"="+url.QueryEscape(value))
+		}
+	}
+	return strings.Join(query, "&")
+}
+
+// request scrubs the parts of a request that are recorded and matched.
+func (s scrubber) request(method string, u *url.URL, body []byte) Request {
+	request := Request{
+		Method: method,
+		Path:   s.text(u.Path),
+		Query:  s.query(u.RawQuery),
+	}
+	if len(body) > 0 {
+		request.Body = string(s.body(body))
+	}
+	return request
+}
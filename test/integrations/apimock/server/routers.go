@@ -12,11 +12,15 @@ package server
 import (
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/accounts"
 	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/balrog"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/dnsauth"
 	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/fakewg"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/faults"
 )
 
 type Route struct {
@@ -27,24 +31,55 @@ type Route struct {
 }
 
 type Router struct {
-	wg    *fakewg.Server
-	chain *balrog.Chain
+	wg        *fakewg.Server
+	chain     *balrog.Chain
+	scenarios *balrog.Scenarios
+	dns       *dnsauth.Server
+	accounts  *accounts.Store
+	faults    *faults.Registry
 }
 type Routes []Route
 
 func NewRouter() (*mux.Router, error) {
-	router := mux.NewRouter().StrictSlash(true)
-	r := new(Router)
+	if mode := os.Getenv(ModeEnv); mode != "" {
+		return newFixtureRouter(mode)
+	}
+
+	r := &Router{accounts: accounts.NewStore()}
 	var err error
 	r.wg, err = fakewg.NewServer()
+	if err != nil {
+		return nil, err
+	}
 	r.chain, err = balrog.NewChain()
 	if err != nil {
 		return nil, err
 	}
+	scenarios := balrog.DefaultScenarios()
+	if path := os.Getenv(ScenariosEnv); path != "" {
+		scenarios, err = balrog.LoadScenarios(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.scenarios, err = balrog.NewScenarios(scenarios)
+	if err != nil {
+		return nil, err
+	}
+	r.dns, err = dnsauth.NewServer(dnsauth.DefaultZone, "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return r.handler(), nil
+}
+
+// routes returns the routes of the mock, served by the handlers of r.
+func (r *Router) routes() Routes {
 	GET := strings.ToUpper("get")
 	POST := strings.ToUpper("post")
 	DELETE := strings.ToUpper("delete")
-	var routes = Routes{
+	PUT := strings.ToUpper("put")
+	return Routes{
 		{
 			"Index",
 			GET,
@@ -139,10 +174,101 @@ func NewRouter() (*mux.Router, error) {
 			"/downloads/vpn/MozillaVPN.msi",
 			r.DownloadMSI,
 		},
+		{
+			"DNSQueriesGet",
+			GET,
+			"/__admin/dns",
+			r.DNSQueriesGet,
+		},
+		{
+			"DNSLabelQueriesGet",
+			GET,
+			"/__admin/dns/{label}",
+			r.DNSLabelQueriesGet,
+		},
+		{
+			"DNSQueriesDelete",
+			DELETE,
+			"/__admin/dns",
+			r.DNSQueriesDelete,
+		},
+		{
+			"FaultsGet",
+			GET,
+			"/__admin/faults",
+			r.FaultsGet,
+		},
+		{
+			"FaultsPost",
+			POST,
+			"/__admin/faults",
+			r.FaultsPost,
+		},
+		{
+			"FaultsDelete",
+			DELETE,
+			"/__admin/faults",
+			r.FaultsDelete,
+		},
+		{
+			"FaultDelete",
+			DELETE,
+			"/__admin/faults/{id}",
+			r.FaultDelete,
+		},
+		{
+			"ScenariosGet",
+			GET,
+			"/__admin/balrog/scenarios",
+			r.ScenariosGet,
+		},
+		{
+			"ScenariosPut",
+			PUT,
+			"/__admin/balrog/scenarios",
+			r.ScenariosPut,
+		},
+		{
+			"ScenariosPost",
+			POST,
+			"/__admin/balrog/scenarios",
+			r.ScenariosPost,
+		},
+		{
+			"ScenariosDelete",
+			DELETE,
+			"/__admin/balrog/scenarios",
+			r.ScenariosDelete,
+		},
+		{
+			"ScenarioActivePut",
+			PUT,
+			"/__admin/balrog/active",
+			r.ScenarioActivePut,
+		},
 	}
+}
+
+// handler returns a mux of the routes of r. Faults can be attached to any
+// route but the admin ones.
+func (r *Router) handler() *mux.Router {
+	routes := r.routes()
+	var names []string
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Pattern, "/__admin/") {
+			names = append(names, route.Name)
+		}
+	}
+	r.faults = faults.NewRegistry(names)
+
+	// Base64 public keys in paths have their slashes escaped
+	router := mux.NewRouter().StrictSlash(true).UseEncodedPath()
 	for _, route := range routes {
 		var handler http.Handler
 		handler = route.HandlerFunc
+		if !strings.HasPrefix(route.Pattern, "/__admin/") {
+			handler = r.faults.Wrap(route.Name, handler)
+		}
 		handler = Logger(handler, route.Name)
 
 		router.
@@ -151,8 +277,7 @@ func NewRouter() (*mux.Router, error) {
 			Name(route.Name).
 			Handler(handler)
 	}
-
-	return router, nil
+	return router
 }
 
 func Index(w http.ResponseWriter, r *http.Request) {
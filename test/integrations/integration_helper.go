@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/bitly/go-simplejson"
+	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/accounts"
 	"github.com/mozilla-services/guardian-vpn-windows/test/integrations/apimock/server/models"
 	"github.com/stretchr/testify/assert"
 )
@@ -148,13 +149,17 @@ func ListDevices(t *testing.T) {
 	assert.Equal(t, true, len(devices) >= 1)
 }
 
+// testDevicePublicKey is a valid WireGuard key, as the mock API rejects
+// others, without characters that need escaping in the remove device URL.
+const testDevicePublicKey = "cfj07ej4hYHZRSBlrZ1E3EupS3prs7euVrLVkaexCVM="
+
 func AddDevice(t *testing.T) {
 	noOfDevicesBeforeAdd := getNumberOfCurrentDevices()
 	assert.Equal(t, true, noOfDevicesBeforeAdd >= 0)
 
 	body := simplejson.New()
 	body.Set("deviceName", "TestAddDevice")
-	body.Set("publicKey", "TestAddDevice")
+	body.Set("publicKey", testDevicePublicKey)
 	command := BASEURL + "/AddDevice"
 	marshaled, err := body.MarshalJSON()
 	if err != nil {
@@ -180,7 +185,7 @@ func RemoveDevice(t *testing.T) {
 
 	url := BASEURL + "/RemoveDevice"
 
-	payload := strings.NewReader("{\"publicKey\": \"TestAddDevice\"}")
+	payload := strings.NewReader(fmt.Sprintf("{\"publicKey\": %q}", testDevicePublicKey))
 
 	res := deleteJson(url, payload)
 
@@ -337,7 +342,8 @@ func UpdateSubscriptionStatus(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	res := postJson(command, marshaled)
+	// Update the account that the client logged in to
+	res := postJsonWithToken(command, accounts.LoginToken("active"), marshaled)
 	active := res.Get("active").MustBool()
 
 	t.Log("UpdateSubscriptionStatus Response active: ", active)
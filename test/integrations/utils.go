@@ -47,7 +47,19 @@ func getJson(url string) *simplejson.Json {
 }
 
 func postJson(url string, reqBody []byte) *simplejson.Json {
-	res, err := http.Post(url, "application/json", bytes.NewBuffer(reqBody))
+	return postJsonWithToken(url, "", reqBody)
+}
+
+func postJsonWithToken(url string, token string, reqBody []byte) *simplejson.Json {
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -0,0 +1,271 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package cidr computes minimal lists of address prefixes, such as the
+// AllowedIPs of a tunnel that routes everything except some networks.
+package cidr
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidPrefix = errors.New("Invalid address prefix")
+
+// All is every IPv4 and IPv6 address.
+var All = MustParse("0.0.0.0/0, ::/0")
+
+// LocalNetworks are the private and link-local networks of RFC 1918, RFC
+// 3927, RFC 4193 and RFC 4291, which "allow local network access" keeps out
+// of the tunnel.
+var LocalNetworks = MustParse("10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16, 169.254.0.0/16, fc00::/7, fe80::/10")
+
+// prefix is an address prefix in a form that is easy to split. IPv4
+// addresses use the first 4 bytes of addr.
+type prefix struct {
+	addr [net.IPv6len]byte
+	bits int
+	ipv4 bool
+}
+
+func fromIPNet(ipnet net.IPNet) (prefix, bool) {
+	ones, size := ipnet.Mask.Size()
+	var p prefix
+	switch {
+	case size == 8*net.IPv4len && ipnet.IP.To4() != nil:
+		copy(p.addr[:], ipnet.IP.To4())
+		p.ipv4 = true
+	case size == 8*net.IPv6len && len(ipnet.IP) == net.IPv6len:
+		copy(p.addr[:], ipnet.IP)
+	default:
+		return p, false
+	}
+	p.bits = ones
+	p.clearHostBits()
+	return p, true
+}
+
+func (p prefix) size() int {
+	if p.ipv4 {
+		return 8 * net.IPv4len
+	}
+	return 8 * net.IPv6len
+}
+
+func (p prefix) bit(i int) bool {
+	return p.addr[i/8]&(0x80>>uint(i%8)) != 0
+}
+
+func (p *prefix) clearHostBits() {
+	for i := p.bits; i < p.size(); i++ {
+		p.addr[i/8] &^= 0x80 >> uint(i%8)
+	}
+}
+
+func (p prefix) toIPNet() net.IPNet {
+	if p.ipv4 {
+		return net.IPNet{IP: net.IP(append([]byte(nil), p.addr[:net.IPv4len]...)), Mask: net.CIDRMask(p.bits, p.size())}
+	}
+	return net.IPNet{IP: net.IP(append([]byte(nil), p.addr[:]...)), Mask: net.CIDRMask(p.bits, p.size())}
+}
+
+// contains is whether q is within p.
+func (p prefix) contains(q prefix) bool {
+	if p.ipv4 != q.ipv4 || p.bits > q.bits {
+		return false
+	}
+	for i := 0; i < p.bits; i++ {
+		if p.bit(i) != q.bit(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// halves splits p into its two halves.
+func (p prefix) halves() (prefix, prefix) {
+	low, high := p, p
+	low.bits++
+	high.bits++
+	high.addr[p.bits/8] |= 0x80 >> uint(p.bits%8)
+	return low, high
+}
+
+// parent returns the prefix one bit shorter than p.
+func (p prefix) parent() prefix {
+	parent := p
+	parent.bits--
+	parent.clearHostBits()
+	return parent
+}
+
+func less(p, q prefix) bool {
+	if p.ipv4 != q.ipv4 {
+		return p.ipv4
+	}
+	if c := bytes.Compare(p.addr[:], q.addr[:]); c != 0 {
+		return c < 0
+	}
+	return p.bits < q.bits
+}
+
+// subtract returns p without e, split into as few prefixes as possible.
+func subtract(p, e prefix) []prefix {
+	if e.contains(p) {
+		return nil
+	}
+	if !p.contains(e) {
+		return []prefix{p}
+	}
+	low, high := p.halves()
+	return append(subtract(low, e), subtract(high, e)...)
+}
+
+// normalize sorts prefixes, drops the ones covered by others, and merges
+// halves into their parent until no more can be merged. The result is the
+// unique shortest list of prefixes covering the same addresses.
+func normalize(prefixes []prefix) []prefix {
+	for {
+		sort.Slice(prefixes, func(i, j int) bool { return less(prefixes[i], prefixes[j]) })
+		var out []prefix
+		for _, p := range prefixes {
+			if len(out) > 0 && out[len(out)-1].contains(p) {
+				continue
+			}
+			out = append(out, p)
+		}
+
+		merged := false
+		prefixes = prefixes[:0]
+		for i := 0; i < len(out); i++ {
+			p := out[i]
+			if i+1 < len(out) && p.bits > 0 && p.bits == out[i+1].bits && p.parent() == out[i+1].parent() {
+				prefixes = append(prefixes, p.parent())
+				merged = true
+				i++
+				continue
+			}
+			prefixes = append(prefixes, p)
+		}
+		if !merged {
+			return prefixes
+		}
+	}
+}
+
+func toPrefixes(ipnets []net.IPNet) ([]prefix, error) {
+	prefixes := make([]prefix, 0, len(ipnets))
+	for _, ipnet := range ipnets {
+		p, ok := fromIPNet(ipnet)
+		if !ok {
+			return nil, ErrInvalidPrefix
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+func toIPNets(prefixes []prefix) []net.IPNet {
+	ipnets := make([]net.IPNet, len(prefixes))
+	for i, p := range prefixes {
+		ipnets[i] = p.toIPNet()
+	}
+	return ipnets
+}
+
+// Subtract returns the shortest list of prefixes covering the addresses of
+// include that are not in exclude. IPv4 prefixes come first, each family
+// sorted by address.
+func Subtract(include, exclude []net.IPNet) ([]net.IPNet, error) {
+	remaining, err := toPrefixes(include)
+	if err != nil {
+		return nil, err
+	}
+	excluded, err := toPrefixes(exclude)
+	if err != nil {
+		return nil, err
+	}
+	remaining = normalize(remaining)
+	for _, e := range normalize(excluded) {
+		var next []prefix
+		for _, p := range remaining {
+			next = append(next, subtract(p, e)...)
+		}
+		remaining = next
+	}
+	return toIPNets(normalize(remaining)), nil
+}
+
+// AllowedIPs returns the shortest list of prefixes covering every IPv4 and
+// IPv6 address except the excluded ones.
+func AllowedIPs(exclude []net.IPNet) ([]net.IPNet, error) {
+	return Subtract(All, exclude)
+}
+
+// Normalize returns the shortest list of prefixes covering the same
+// addresses as ipnets.
+func Normalize(ipnets []net.IPNet) ([]net.IPNet, error) {
+	prefixes, err := toPrefixes(ipnets)
+	if err != nil {
+		return nil, err
+	}
+	return toIPNets(normalize(prefixes)), nil
+}
+
+// Parse parses a comma separated list of prefixes. Addresses without a
+// prefix length are single hosts, such as the endpoint of a server.
+func Parse(s string) ([]net.IPNet, error) {
+	var ipnets []net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, ErrInvalidPrefix
+			}
+			ipnets = append(ipnets, HostPrefix(ip))
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, ErrInvalidPrefix
+		}
+		ipnets = append(ipnets, *ipnet)
+	}
+	return ipnets, nil
+}
+
+// MustParse is like Parse, but panics on errors.
+func MustParse(s string) []net.IPNet {
+	ipnets, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipnets
+}
+
+// HostPrefix returns the single address prefix covering ip.
+func HostPrefix(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// Join formats prefixes as a comma separated list, as in the AllowedIPs of
+// a configuration.
+func Join(ipnets []net.IPNet) string {
+	strs := make([]string, len(ipnets))
+	for i := range ipnets {
+		strs[i] = ipnets[i].String()
+	}
+	return strings.Join(strs, ", ")
+}
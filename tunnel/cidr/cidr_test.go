@@ -0,0 +1,265 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package cidr
+
+import (
+	"math/big"
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// randomPrefixes are a few prefixes of random lengths in both families,
+// biased toward prefixes near each other so that they overlap and touch.
+type randomPrefixes []net.IPNet
+
+func randomIP(r *rand.Rand, ipv4 bool) net.IP {
+	if ipv4 {
+		ip := make(net.IP, net.IPv4len)
+		r.Read(ip)
+		// Half of the addresses are in 10.0.0.0/8
+		if r.Intn(2) == 0 {
+			ip[0] = 10
+		}
+		return ip
+	}
+	ip := make(net.IP, net.IPv6len)
+	r.Read(ip)
+	if r.Intn(2) == 0 {
+		copy(ip, []byte{0xfd, 0x00})
+	}
+	return ip
+}
+
+func (randomPrefixes) Generate(r *rand.Rand, size int) reflect.Value {
+	prefixes := make(randomPrefixes, r.Intn(8))
+	for i := range prefixes {
+		ipv4 := r.Intn(2) == 0
+		bits := 8 * net.IPv6len
+		if ipv4 {
+			bits = 8 * net.IPv4len
+		}
+		ip := randomIP(r, ipv4)
+		mask := net.CIDRMask(r.Intn(bits+1), bits)
+		prefixes[i] = net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	return reflect.ValueOf(prefixes)
+}
+
+func containsIP(ipnets []net.IPNet, ip net.IP) bool {
+	for _, ipnet := range ipnets {
+		// net.IPNet.Contains matches IPv4 addresses in ::/0
+		_, bits := ipnet.Mask.Size()
+		if (bits == 8*net.IPv4len) == (ip.To4() != nil) && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addresses returns the number of addresses of a family in disjoint
+// prefixes.
+func addresses(ipnets []net.IPNet, size int) *big.Int {
+	total := new(big.Int)
+	for _, ipnet := range ipnets {
+		ones, bits := ipnet.Mask.Size()
+		if bits == size {
+			total.Add(total, new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)))
+		}
+	}
+	return total
+}
+
+func overlaps(a, b net.IPNet) bool {
+	_, abits := a.Mask.Size()
+	_, bbits := b.Mask.Size()
+	return abits == bbits && (a.Contains(b.IP) || b.Contains(a.IP))
+}
+
+func TestAllowedIPsProperties(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	config := &quick.Config{MaxCount: 500, Rand: r}
+
+	// An address is allowed exactly when no excluded prefix contains it
+	complement := func(exclude randomPrefixes, probes randomPrefixes) bool {
+		allowed, err := AllowedIPs(exclude)
+		if err != nil {
+			return false
+		}
+		for _, ipnet := range append(append(randomPrefixes(nil), exclude...), probes...) {
+			for _, ip := range []net.IP{ipnet.IP, lastIP(ipnet), randomIP(r, ipnet.IP.To4() != nil)} {
+				if containsIP(allowed, ip) == containsIP(exclude, ip) {
+					t.Logf("%v: allowed %v, excluded %v", ip, Join(allowed), Join(exclude))
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if err := quick.Check(complement, config); err != nil {
+		t.Error(err)
+	}
+
+	// The prefixes are disjoint, canonical, sorted, and no two of them can
+	// be merged
+	minimal := func(exclude randomPrefixes) bool {
+		allowed, err := AllowedIPs(exclude)
+		if err != nil {
+			return false
+		}
+		for i := range allowed {
+			if !allowed[i].IP.Equal(allowed[i].IP.Mask(allowed[i].Mask)) {
+				return false
+			}
+			for j := range allowed {
+				if i != j && overlaps(allowed[i], allowed[j]) {
+					return false
+				}
+			}
+		}
+		prefixes, _ := toPrefixes(allowed)
+		for i := 1; i < len(prefixes); i++ {
+			if !less(prefixes[i-1], prefixes[i]) {
+				return false
+			}
+			if prefixes[i].bits > 0 && prefixes[i].bits == prefixes[i-1].bits && prefixes[i].parent() == prefixes[i-1].parent() {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(minimal, config); err != nil {
+		t.Error(err)
+	}
+
+	// The allowed and excluded addresses add up to the whole address space
+	total := func(exclude randomPrefixes) bool {
+		allowed, err := AllowedIPs(exclude)
+		if err != nil {
+			return false
+		}
+		excluded, err := Normalize(exclude)
+		if err != nil {
+			return false
+		}
+		for _, size := range []int{8 * net.IPv4len, 8 * net.IPv6len} {
+			sum := new(big.Int).Add(addresses(allowed, size), addresses(excluded, size))
+			if sum.Cmp(new(big.Int).Lsh(big.NewInt(1), uint(size))) != 0 {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(total, config); err != nil {
+		t.Error(err)
+	}
+
+	// The order of the excluded prefixes does not matter
+	order := func(exclude randomPrefixes) bool {
+		allowed, _ := AllowedIPs(exclude)
+		reversed := make([]net.IPNet, len(exclude))
+		for i := range exclude {
+			reversed[len(exclude)-1-i] = exclude[i]
+		}
+		allowedReversed, _ := AllowedIPs(reversed)
+		return Join(allowed) == Join(allowedReversed)
+	}
+	if err := quick.Check(order, config); err != nil {
+		t.Error(err)
+	}
+}
+
+func lastIP(ipnet net.IPNet) net.IP {
+	ip := make(net.IP, len(ipnet.Mask))
+	copy(ip, ipnet.IP.To16()[net.IPv6len-len(ipnet.Mask):])
+	for i := range ip {
+		ip[i] |= ^ipnet.Mask[i]
+	}
+	return ip
+}
+
+func TestAllowedIPs(t *testing.T) {
+	tests := []struct {
+		name     string
+		exclude  string
+		expected string
+	}{
+		{"Nothing", "", "0.0.0.0/0, ::/0"},
+		{"Everything", "0.0.0.0/0, ::/0", ""},
+		{"IPv4 only", "::/0", "0.0.0.0/0"},
+		{"Half", "128.0.0.0/1", "0.0.0.0/1, ::/0"},
+		{"Host", "255.255.255.255", "0.0.0.0/1, 128.0.0.0/2, 192.0.0.0/3, 224.0.0.0/4, 240.0.0.0/5, 248.0.0.0/6, 252.0.0.0/7, 254.0.0.0/8, 255.0.0.0/9, 255.128.0.0/10, 255.192.0.0/11, 255.224.0.0/12, 255.240.0.0/13, 255.248.0.0/14, 255.252.0.0/15, 255.254.0.0/16, 255.255.0.0/17, 255.255.128.0/18, 255.255.192.0/19, 255.255.224.0/20, 255.255.240.0/21, 255.255.248.0/22, 255.255.252.0/23, 255.255.254.0/24, 255.255.255.0/25, 255.255.255.128/26, 255.255.255.192/27, 255.255.255.224/28, 255.255.255.240/29, 255.255.255.248/30, 255.255.255.252/31, 255.255.255.254/32, ::/0"},
+		{"Touching halves", "0.0.0.0/2, 64.0.0.0/2", "128.0.0.0/1, ::/0"},
+		{"Nested", "10.1.0.0/16, 10.0.0.0/8", "0.0.0.0/5, 8.0.0.0/7, 11.0.0.0/8, 12.0.0.0/6, 16.0.0.0/4, 32.0.0.0/3, 64.0.0.0/2, 128.0.0.0/1, ::/0"},
+		{"IPv6", "8000::/1, 4000::/2", "::/2, 0.0.0.0/0"},
+		{"Host bits", "10.1.2.3/8", "0.0.0.0/5, 8.0.0.0/7, 11.0.0.0/8, 12.0.0.0/6, 16.0.0.0/4, 32.0.0.0/3, 64.0.0.0/2, 128.0.0.0/1, ::/0"},
+	}
+	for _, test := range tests {
+		exclude, err := Parse(test.exclude)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		allowed, err := AllowedIPs(exclude)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		expected := MustParse(test.expected)
+		normalized, _ := Normalize(expected)
+		if Join(allowed) != Join(normalized) {
+			t.Errorf("%s: expected %s, got %s", test.name, Join(normalized), Join(allowed))
+		}
+	}
+}
+
+func TestLocalNetworks(t *testing.T) {
+	allowed, err := AllowedIPs(append(LocalNetworks, MustParse("192.0.2.1")...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"10.0.0.1", "172.31.255.255", "192.168.1.20", "169.254.1.1", "fd00::1", "fe80::1", "192.0.2.1"} {
+		if containsIP(allowed, net.ParseIP(ip)) {
+			t.Errorf("Expected %s to be excluded", ip)
+		}
+	}
+	for _, ip := range []string{"9.255.255.255", "172.32.0.0", "192.0.2.2", "8.8.8.8", "2001:db8::1", "fec0::1"} {
+		if !containsIP(allowed, net.ParseIP(ip)) {
+			t.Errorf("Expected %s to be allowed", ip)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	ipnets, err := Parse(" 10.0.0.0/8,192.0.2.1, 2001:db8::1 ,, ::/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := Join(ipnets); s != "10.0.0.0/8, 192.0.2.1/32, 2001:db8::1/128, ::/0" {
+		t.Fatalf("Unexpected prefixes %s", s)
+	}
+	for _, s := range []string{"10.0.0.0/33", "example.com", "10.0.0/8"} {
+		if _, err := Parse(s); err != ErrInvalidPrefix {
+			t.Errorf("Expected ErrInvalidPrefix for %q, got %v", s, err)
+		}
+	}
+	if _, err := AllowedIPs([]net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.IPMask{0xff, 0}}}); err != ErrInvalidPrefix {
+		t.Fatalf("Expected ErrInvalidPrefix for a non-canonical mask, got %v", err)
+	}
+}
+
+func TestHostPrefix(t *testing.T) {
+	for address, expected := range map[string]string{
+		"192.0.2.1":      "192.0.2.1/32",
+		"::ffff:1.2.3.4": "1.2.3.4/32",
+		"2001:db8::1":    "2001:db8::1/128",
+	} {
+		prefix := HostPrefix(net.ParseIP(address))
+		if prefix.String() != expected {
+			t.Fatalf("Expected %s, got %s", expected, prefix.String())
+		}
+	}
+}
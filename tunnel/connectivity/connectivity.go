@@ -0,0 +1,259 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package connectivity probes whether the internet is reachable outside of
+// the tunnel, and whether a captive portal is in the way.
+package connectivity
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Code is the outcome of a connectivity probe. The values are stable, as
+// they are returned as-is through tunnel.dll.
+type Code int32
+
+const (
+	Connected Code = iota
+	RouteFailure
+	RequestFailure
+	DNSFailure
+	ConnectFailure
+	Timeout
+	TLSFailure
+	Redirected
+	BodyMismatch
+	Cancelled
+)
+
+// Legacy connectivity values, as returned by TestOutsideConnectivity.
+const (
+	LegacyNoConnectivity int32 = -1
+	LegacyCaptivePortal  int32 = 0
+	LegacyConnected      int32 = 1
+)
+
+// Stages at which a probe can fail.
+const (
+	StageRoute    = "route"
+	StageRequest  = "request"
+	StageConnect  = "connect"
+	StageResponse = "response"
+	StageBody     = "body"
+)
+
+const maxBodySize = 1024 * 1024
+
+// Probe describes a single captive portal detection request. URL is a format
+// string that receives IP, and Host is sent as the Host header. IP may hold
+// several comma separated IPv4 and IPv6 addresses, which are tried in turn. A
+// NoContent probe expects an empty 204 response instead of the Expected body.
+type Probe struct {
+	IP        string `json:"ip"`
+	Host      string `json:"host"`
+	URL       string `json:"url"`
+	Expected  string `json:"expected,omitempty"`
+	NoContent bool   `json:"no_content,omitempty"`
+}
+
+// Result is the detailed outcome of a probe.
+type Result struct {
+	Code      Code   `json:"code"`
+	IP        string `json:"ip,omitempty"`
+	Stage     string `json:"stage,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	Location  string `json:"location,omitempty"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Legacy maps the result onto the -1, 0, 1 values of TestOutsideConnectivity.
+func (r *Result) Legacy() int32 {
+	switch r.Code {
+	case Connected:
+		return LegacyConnected
+	case Redirected, BodyMismatch:
+		return LegacyCaptivePortal
+	default:
+		return LegacyNoConnectivity
+	}
+}
+
+// JSON returns the result as a JSON object.
+func (r *Result) JSON() string {
+	js, _ := json.Marshal(r)
+	return string(js)
+}
+
+// RouteTable installs temporary host routes via the physical default route
+// of the address family of ip, so that probes bypass the tunnel.
+type RouteTable interface {
+	// AddHostRoute adds a route to ip and returns a function removing it.
+	AddHostRoute(ip net.IP) (remove func(), err error)
+}
+
+// ParseAddresses parses a comma separated list of addresses and orders them
+// for fallback: IPv6 before IPv4 as preferred by RFC 6724, keeping the given
+// order within each family.
+func ParseAddresses(list string) ([]net.IP, error) {
+	var ipv6, ipv4 []net.IP
+	for _, address := range strings.Split(list, ",") {
+		ip := net.ParseIP(strings.TrimSpace(address))
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP address %q", address)
+		}
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		} else {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+	return append(ipv6, ipv4...), nil
+}
+
+// Prober runs probes using a route table and an HTTP transport.
+type Prober struct {
+	Routes    RouteTable
+	Transport http.RoundTripper
+}
+
+// Test runs a probe. Letting the deadline of ctx pass yields a Timeout result,
+// cancelling ctx yields a Cancelled result. When the probe has several
+// addresses, the next one is tried as long as no connectivity was found, and
+// each attempt gets an equal share of the time left until the deadline.
+func (p *Prober) Test(ctx context.Context, probe Probe) *Result {
+	start := time.Now()
+	ips, err := ParseAddresses(probe.IP)
+	if err != nil {
+		return failure(RouteFailure, StageRoute, err)
+	}
+
+	var result *Result
+	for i, ip := range ips {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			attemptCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(ips)-i))
+		}
+		result = p.test(attemptCtx, probe, ip)
+		cancel()
+		result.IP = ip.String()
+		if result.Legacy() != LegacyNoConnectivity || ctx.Err() != nil {
+			break
+		}
+	}
+	result.ElapsedMs = int64(time.Since(start) / time.Millisecond)
+	return result
+}
+
+func (p *Prober) test(ctx context.Context, probe Probe, ip net.IP) *Result {
+	// Route the probe outside of the tunnel
+	remove, err := p.Routes.AddHostRoute(ip)
+	if err != nil {
+		return failure(RouteFailure, StageRoute, err)
+	}
+	defer remove()
+
+	host := ip.String()
+	if ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf(probe.URL, host), nil)
+	if err != nil {
+		return failure(RequestFailure, StageRequest, err)
+	}
+	req = req.WithContext(ctx)
+	req.Host = probe.Host
+
+	// Redirects should be treated as an assumption that a captive portal is available
+	var redirect *http.Response
+	client := &http.Client{
+		Transport: p.Transport,
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			redirect = r.Response
+			return errors.New("Redirect detected.")
+		},
+	}
+	resp, err := client.Do(req)
+	if redirect != nil {
+		return &Result{
+			Code:     Redirected,
+			Stage:    StageResponse,
+			Status:   redirect.StatusCode,
+			Location: redirect.Header.Get("Location"),
+		}
+	}
+	if err != nil {
+		return classify(ctx, err, StageConnect)
+	}
+	defer resp.Body.Close()
+
+	text, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		result := classify(ctx, err, StageBody)
+		result.Status = resp.StatusCode
+		return result
+	}
+
+	if probe.NoContent {
+		if resp.StatusCode != http.StatusNoContent || len(text) != 0 {
+			return &Result{Code: BodyMismatch, Stage: StageBody, Status: resp.StatusCode}
+		}
+		return &Result{Code: Connected, Status: resp.StatusCode}
+	}
+
+	// Compare retrieved body contents to expected contents
+	compareTestResult := strings.ReplaceAll(strings.ReplaceAll(string(text), "\n", ""), "\r", "")
+	if compareTestResult != probe.Expected {
+		return &Result{Code: BodyMismatch, Stage: StageBody, Status: resp.StatusCode}
+	}
+	return &Result{Code: Connected, Status: resp.StatusCode}
+}
+
+func failure(code Code, stage string, err error) *Result {
+	return &Result{Code: code, Stage: stage, Error: err.Error()}
+}
+
+// classify maps a transport error onto a result code.
+func classify(ctx context.Context, err error, stage string) *Result {
+	cause := err
+	if urlErr, ok := cause.(*url.Error); ok {
+		cause = urlErr.Err
+	}
+
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var opErr *net.OpError
+	switch {
+	case errors.As(cause, &dnsErr):
+		return failure(DNSFailure, StageConnect, err)
+	case ctx.Err() == context.Canceled:
+		return failure(Cancelled, stage, err)
+	case ctx.Err() != nil || errors.Is(cause, context.DeadlineExceeded) || (errors.As(cause, &netErr) && netErr.Timeout()):
+		return failure(Timeout, stage, err)
+	case errors.As(cause, &recordErr) || errors.As(cause, &unknownAuthorityErr) || errors.As(cause, &hostnameErr) ||
+		errors.As(cause, &invalidErr) || strings.HasPrefix(cause.Error(), "tls:"):
+		return failure(TLSFailure, stage, err)
+	case errors.As(cause, &opErr) && opErr.Op == "dial":
+		return failure(ConnectFailure, StageConnect, err)
+	default:
+		return failure(RequestFailure, stage, err)
+	}
+}
@@ -0,0 +1,240 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package connectivity
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeRouteTable struct {
+	sync.Mutex
+	err    error
+	added  []string
+	active map[string]int
+}
+
+func (f *fakeRouteTable) AddHostRoute(ip net.IP) (func(), error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.active == nil {
+		f.active = make(map[string]int)
+	}
+	f.added = append(f.added, ip.String())
+	f.active[ip.String()]++
+	return func() {
+		f.Lock()
+		defer f.Unlock()
+		if f.active[ip.String()]--; f.active[ip.String()] == 0 {
+			delete(f.active, ip.String())
+		}
+	}, nil
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func serverProbe(t *testing.T, handler http.HandlerFunc) (Probe, func()) {
+	server := httptest.NewServer(handler)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Probe{
+		IP:       host,
+		Host:     "detectportal.firefox.com",
+		URL:      "http://%s:" + port + "/success.txt",
+		Expected: "success",
+	}, server.Close
+}
+
+func TestProber(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		code     Code
+		legacy   int32
+		status   int
+		location string
+	}{
+		{"Connected", func(w http.ResponseWriter, r *http.Request) {
+			if r.Host != "detectportal.firefox.com" {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			w.Write([]byte("success\r\n"))
+		}, Connected, LegacyConnected, http.StatusOK, ""},
+		{"Body mismatch", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("<html>Please log in</html>"))
+		}, BodyMismatch, LegacyCaptivePortal, http.StatusOK, ""},
+		{"Redirected", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "http://portal.example.com/login", http.StatusFound)
+		}, Redirected, LegacyCaptivePortal, http.StatusFound, "http://portal.example.com/login"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			probe, closeServer := serverProbe(t, test.handler)
+			defer closeServer()
+			routes := &fakeRouteTable{}
+			result := (&Prober{Routes: routes}).Test(context.Background(), probe)
+			if result.Code != test.code || result.Legacy() != test.legacy {
+				t.Fatalf("Expected code %d, got %s", test.code, result.JSON())
+			}
+			if result.Status != test.status || result.Location != test.location {
+				t.Fatalf("Unexpected status or location: %s", result.JSON())
+			}
+			if len(routes.added) != 1 || routes.added[0] != probe.IP || len(routes.active) != 0 {
+				t.Fatalf("Host route was not added and removed: %v %v", routes.added, routes.active)
+			}
+		})
+	}
+}
+
+func TestProberFailures(t *testing.T) {
+	probe := Probe{IP: "192.0.2.1", Host: "detectportal.firefox.com", URL: "http://%s/success.txt", Expected: "success"}
+	transportError := func(err error) http.RoundTripper {
+		return roundTripperFunc(func(*http.Request) (*http.Response, error) { return nil, err })
+	}
+	tests := []struct {
+		name      string
+		routes    *fakeRouteTable
+		transport http.RoundTripper
+		probe     Probe
+		code      Code
+		stage     string
+	}{
+		{"Route failure", &fakeRouteTable{err: errors.New("Unable to find default route")}, nil, probe, RouteFailure, StageRoute},
+		{"Invalid IP", &fakeRouteTable{}, nil, Probe{IP: "not an ip"}, RouteFailure, StageRoute},
+		{"Invalid URL", &fakeRouteTable{}, nil, Probe{IP: "192.0.2.1", URL: "http://%s/\x7f"}, RequestFailure, StageRequest},
+		{"DNS failure", &fakeRouteTable{}, transportError(&net.DNSError{Err: "no such host", Name: "example.com"}), probe, DNSFailure, StageConnect},
+		{"Connect failure", &fakeRouteTable{}, transportError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), probe, ConnectFailure, StageConnect},
+		{"TLS failure", &fakeRouteTable{}, transportError(errors.New("tls: handshake failure")), probe, TLSFailure, StageConnect},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := (&Prober{Routes: test.routes, Transport: test.transport}).Test(context.Background(), test.probe)
+			if result.Code != test.code || result.Stage != test.stage || result.Legacy() != LegacyNoConnectivity {
+				t.Fatalf("Expected code %d at %s, got %s", test.code, test.stage, result.JSON())
+			}
+			if len(test.routes.active) != 0 {
+				t.Fatal("Host route was not removed")
+			}
+		})
+	}
+}
+
+func TestProberTimeout(t *testing.T) {
+	block := make(chan struct{})
+	probe, closeServer := serverProbe(t, func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	})
+	defer closeServer()
+	defer close(block)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	result := (&Prober{Routes: &fakeRouteTable{}}).Test(ctx, probe)
+	if result.Code != Timeout {
+		t.Fatalf("Expected timeout, got %s", result.JSON())
+	}
+	if result.ElapsedMs < 50 {
+		t.Fatalf("Elapsed time was not recorded: %s", result.JSON())
+	}
+}
+
+func TestProberTLSFailure(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("success"))
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "https://"))
+
+	result := (&Prober{Routes: &fakeRouteTable{}}).Test(context.Background(), Probe{IP: host, URL: "https://%s:" + port + "/", Expected: "success"})
+	if result.Code != TLSFailure {
+		t.Fatalf("Expected TLS failure, got %s", result.JSON())
+	}
+}
+
+func TestParseAddresses(t *testing.T) {
+	ips, err := ParseAddresses("192.0.2.1, 2001:db8::1,192.0.2.2,2001:db8::2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, ip := range ips {
+		order = append(order, ip.String())
+	}
+	if strings.Join(order, ",") != "2001:db8::1,2001:db8::2,192.0.2.1,192.0.2.2" {
+		t.Fatalf("Unexpected fallback order %v", order)
+	}
+	if _, err := ParseAddresses("192.0.2.1,"); err == nil {
+		t.Fatal("Expected an empty address to be rejected")
+	}
+}
+
+func TestProberFallback(t *testing.T) {
+	respond := func(body string) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	}
+	tests := []struct {
+		name      string
+		ips       string
+		responses map[string]string
+		code      Code
+		ip        string
+		requested []string
+	}{
+		{"IPv6 only", "2001:db8::1", map[string]string{"[2001:db8::1]": "success"},
+			Connected, "2001:db8::1", []string{"[2001:db8::1]"}},
+		{"Dual stack prefers IPv6", "192.0.2.1,2001:db8::1", map[string]string{"[2001:db8::1]": "success", "192.0.2.1": "success"},
+			Connected, "2001:db8::1", []string{"[2001:db8::1]"}},
+		{"Broken IPv6 falls back to IPv4", "192.0.2.1,2001:db8::1", map[string]string{"192.0.2.1": "success"},
+			Connected, "192.0.2.1", []string{"[2001:db8::1]", "192.0.2.1"}},
+		{"Captive portal stops fallback", "192.0.2.1,2001:db8::1", map[string]string{"[2001:db8::1]": "login", "192.0.2.1": "success"},
+			BodyMismatch, "2001:db8::1", []string{"[2001:db8::1]"}},
+		{"No connectivity on either family", "192.0.2.1,2001:db8::1", map[string]string{},
+			ConnectFailure, "192.0.2.1", []string{"[2001:db8::1]", "192.0.2.1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requested []string
+			transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				requested = append(requested, r.URL.Host)
+				if body, ok := test.responses[r.URL.Host]; ok {
+					return respond(body)
+				}
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("network is unreachable")}
+			})
+			routes := &fakeRouteTable{}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			probe := Probe{IP: test.ips, URL: "http://%s/success.txt", Expected: "success"}
+			result := (&Prober{Routes: routes, Transport: transport}).Test(ctx, probe)
+			if result.Code != test.code || result.IP != test.ip {
+				t.Fatalf("Expected code %d from %s, got %s", test.code, test.ip, result.JSON())
+			}
+			if strings.Join(requested, " ") != strings.Join(test.requested, " ") {
+				t.Fatalf("Unexpected requests %v", requested)
+			}
+			if len(routes.active) != 0 {
+				t.Fatalf("Host routes were not removed: %v", routes.active)
+			}
+		})
+	}
+}
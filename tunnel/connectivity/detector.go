@@ -0,0 +1,108 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package connectivity
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// DefaultProbeTimeout bounds a probe whose target does not set a timeout.
+const DefaultProbeTimeout = 10 * time.Second
+
+// Target is a probe with its own deadline.
+type Target struct {
+	Probe
+	TimeoutMs int64 `json:"timeout_ms,omitempty"`
+}
+
+func (t *Target) timeout() time.Duration {
+	if t.TimeoutMs <= 0 {
+		return DefaultProbeTimeout
+	}
+	return time.Duration(t.TimeoutMs) * time.Millisecond
+}
+
+// Verdict is the outcome of running several targets. Status holds one of the
+// legacy connectivity values, and Results holds one result per target, in
+// target order. Probes that were cancelled once the verdict was certain
+// report Cancelled.
+type Verdict struct {
+	Status  int32     `json:"status"`
+	Quorum  bool      `json:"quorum"`
+	Results []*Result `json:"results"`
+}
+
+// JSON returns the verdict as a JSON object.
+func (v *Verdict) JSON() string {
+	js, _ := json.Marshal(v)
+	return string(js)
+}
+
+// Detector runs several targets in parallel and decides by quorum.
+type Detector struct {
+	Prober  *Prober
+	Targets []Target
+
+	// Quorum is the number of targets that must agree on a legacy status for
+	// it to become the verdict. It defaults to a majority of the targets.
+	Quorum int
+}
+
+// Detect runs all targets and returns as soon as a status has reached the
+// quorum, cancelling the probes that are still running. If no status reaches
+// the quorum, the most common status wins, with ties going to the captive
+// portal, then to connectivity.
+func (d *Detector) Detect(ctx context.Context) *Verdict {
+	quorum := d.Quorum
+	if quorum <= 0 || quorum > len(d.Targets) {
+		quorum = len(d.Targets)/2 + 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type indexedResult struct {
+		index  int
+		result *Result
+	}
+	results := make(chan indexedResult, len(d.Targets))
+	for i := range d.Targets {
+		go func(i int) {
+			probeCtx, probeCancel := context.WithTimeout(ctx, d.Targets[i].timeout())
+			defer probeCancel()
+			results <- indexedResult{i, d.Prober.Test(probeCtx, d.Targets[i].Probe)}
+		}(i)
+	}
+
+	verdict := &Verdict{Status: LegacyNoConnectivity, Results: make([]*Result, len(d.Targets))}
+	votes := make(map[int32]int)
+	for range d.Targets {
+		r := <-results
+		verdict.Results[r.index] = r.result
+		if verdict.Quorum || r.result.Code == Cancelled {
+			continue
+		}
+		status := r.result.Legacy()
+		votes[status]++
+		if votes[status] >= quorum {
+			verdict.Status = status
+			verdict.Quorum = true
+			cancel()
+		}
+	}
+	if !verdict.Quorum {
+		best := 0
+		for _, status := range []int32{LegacyCaptivePortal, LegacyConnected, LegacyNoConnectivity} {
+			if votes[status] > best {
+				best = votes[status]
+				verdict.Status = status
+			}
+		}
+	}
+	return verdict
+}
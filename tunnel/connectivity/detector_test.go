@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package connectivity
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func successHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("success\n"))
+}
+
+func noContentHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func portalHandler(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "http://portal.example.com/login", http.StatusFound)
+}
+
+func TestDetector(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	blockingHandler := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}
+
+	tests := []struct {
+		name      string
+		handlers  []http.HandlerFunc
+		noContent []bool
+		timeoutMs int64
+		quorum    int
+		status    int32
+		reached   bool
+		codes     []Code
+	}{
+		{"Quorum cancels slow probe", []http.HandlerFunc{successHandler, blockingHandler, successHandler}, nil, 5000, 2,
+			LegacyConnected, true, []Code{Connected, Cancelled, Connected}},
+		{"Captive portal majority", []http.HandlerFunc{portalHandler, successHandler, portalHandler}, nil, 5000, 0,
+			LegacyCaptivePortal, true, nil},
+		{"204 style probes", []http.HandlerFunc{noContentHandler, successHandler, noContentHandler}, []bool{true, true, true}, 5000, 2,
+			LegacyConnected, true, nil},
+		{"Every probe times out", []http.HandlerFunc{blockingHandler, blockingHandler}, nil, 50, 0,
+			LegacyNoConnectivity, true, []Code{Timeout, Timeout}},
+		{"Tie without quorum prefers captive portal", []http.HandlerFunc{successHandler, portalHandler, blockingHandler}, nil, 50, 3,
+			LegacyCaptivePortal, false, []Code{Connected, Redirected, Timeout}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			routes := &fakeRouteTable{}
+			detector := &Detector{Prober: &Prober{Routes: routes}, Quorum: test.quorum}
+			for i, handler := range test.handlers {
+				probe, closeServer := serverProbe(t, handler)
+				defer closeServer()
+				probe.NoContent = test.noContent != nil && test.noContent[i]
+				detector.Targets = append(detector.Targets, Target{Probe: probe, TimeoutMs: test.timeoutMs})
+			}
+
+			start := time.Now()
+			verdict := detector.Detect(context.Background())
+			if time.Since(start) > time.Second {
+				t.Fatalf("Detection took %v", time.Since(start))
+			}
+			if verdict.Status != test.status || verdict.Quorum != test.reached {
+				t.Fatalf("Unexpected verdict %s", verdict.JSON())
+			}
+			for i, code := range test.codes {
+				if verdict.Results[i].Code != code {
+					t.Fatalf("Unexpected result %d in %s", i, verdict.JSON())
+				}
+			}
+			if len(routes.active) != 0 {
+				t.Fatalf("Host routes were not removed: %v", routes.active)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package connectivity
+
+import (
+	"net"
+	"sync"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/cidr"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/routes"
+)
+
+type physicalRouteTable struct {
+	table routes.Table
+
+	mutex      sync.Mutex
+	hostRoutes map[string]*hostRoute
+}
+
+// hostRoute is a host route in use by probes.
+type hostRoute struct {
+	luid        uint64
+	destination net.IPNet
+	nextHop     net.IP
+	users       int
+
+	// added is set when the table added the route, rather than finding it
+	// in place.
+	added bool
+}
+
+// NewRouteTable returns a RouteTable that adds host routes to table via its
+// physical default route. Concurrent probes of the same address share its
+// route, which is removed once the last of them is done.
+func NewRouteTable(table routes.Table) RouteTable {
+	return &physicalRouteTable{table: table, hostRoutes: make(map[string]*hostRoute)}
+}
+
+func (p *physicalRouteTable) AddHostRoute(ip net.IP) (func(), error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	destination := cidr.HostPrefix(ip)
+	key := destination.String()
+	hr := p.hostRoutes[key]
+	if hr == nil {
+		// Attempt to locate a default route of the same address family
+		route, err := routes.DefaultRoute(p.table, routes.FamilyOf(ip))
+		if err != nil {
+			return nil, err
+		}
+
+		// A route that already exists belongs to someone else, so it is left
+		// in place
+		err = p.table.AddRoute(route.LUID, destination, route.NextHop)
+		if err != nil && err != routes.ErrExists {
+			return nil, err
+		}
+		hr = &hostRoute{luid: route.LUID, destination: destination, nextHop: route.NextHop, added: err == nil}
+		p.hostRoutes[key] = hr
+	}
+	hr.users++
+
+	var once sync.Once
+	return func() { once.Do(func() { p.release(key) }) }, nil
+}
+
+// release drops a user of the host route of key, and removes the route when
+// it was the last one.
+func (p *physicalRouteTable) release(key string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	hr := p.hostRoutes[key]
+	hr.users--
+	if hr.users > 0 {
+		return
+	}
+	delete(p.hostRoutes, key)
+	if hr.added {
+		p.table.DeleteRoute(hr.luid, hr.destination, hr.nextHop)
+	}
+}
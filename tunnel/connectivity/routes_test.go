@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package connectivity
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/cidr"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/routes"
+)
+
+func TestPhysicalRouteTable(t *testing.T) {
+	table := routes.NewFakeTable()
+	table.SetInterface(routes.Interface{LUID: 1, Up: true})
+	table.SetInterface(routes.Interface{LUID: 2, Up: true, Tunnel: true})
+	_, ipv4Default, _ := net.ParseCIDR("0.0.0.0/0")
+	table.AddRouteWithMetric(1, *ipv4Default, net.ParseIP("192.168.1.1"), 25)
+	table.AddRouteWithMetric(2, *ipv4Default, net.ParseIP("10.64.0.1"), 0)
+
+	ip := net.ParseIP("192.0.2.1")
+	hostRoute := cidr.HostPrefix(ip)
+	remove, err := NewRouteTable(table).AddHostRoute(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !table.HasRoute(1, hostRoute, net.ParseIP("192.168.1.1")) {
+		t.Fatal("Host route was not added via the physical default route")
+	}
+
+	// A host route that already exists is not an error, and is not removed
+	// by the second caller
+	removeExisting, err := NewRouteTable(table).AddHostRoute(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeExisting()
+	if !table.HasRoute(1, hostRoute, net.ParseIP("192.168.1.1")) {
+		t.Fatal("Host route that already existed was removed")
+	}
+
+	remove()
+	if table.HasRoute(1, hostRoute, net.ParseIP("192.168.1.1")) {
+		t.Fatal("Host route was not removed")
+	}
+
+	// Probes of the same address share its route until the last one is done
+	routeTable := NewRouteTable(table)
+	removeFirst, err := routeTable.AddHostRoute(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeSecond, err := routeTable.AddHostRoute(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeFirst()
+	removeFirst()
+	if !table.HasRoute(1, hostRoute, net.ParseIP("192.168.1.1")) {
+		t.Fatal("Host route was removed while in use")
+	}
+	removeSecond()
+	if table.HasRoute(1, hostRoute, net.ParseIP("192.168.1.1")) {
+		t.Fatal("Host route was not removed by its last user")
+	}
+
+	if _, err := NewRouteTable(table).AddHostRoute(net.ParseIP("2001:db8::1")); err != routes.ErrNoDefaultRoute {
+		t.Fatalf("Expected ErrNoDefaultRoute without an IPv6 default route, got %v", err)
+	}
+}
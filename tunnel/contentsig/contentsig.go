@@ -0,0 +1,347 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package contentsig verifies the Autograph content signatures that Balrog
+// attaches to update.json responses.
+package contentsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSubject is the common name of the Balrog leaf certificate.
+	DefaultSubject = "aus.content-signature.mozilla.org"
+
+	// ConstraintDomain is the DNS name constraint that every content
+	// signature chain must carry on at least one of its intermediates.
+	ConstraintDomain = "content-signature.mozilla.org"
+
+	signaturePrefix = "Content-Signature:\x00"
+	maxChainSize    = 1024 * 1024
+)
+
+var (
+	ErrMissingSignature = errors.New("Content signature header has no supported signature")
+	ErrMissingX5U       = errors.New("Content signature header has no x5u")
+	ErrMalformedChain   = errors.New("Certificate chain is malformed")
+	ErrChainOrder       = errors.New("Certificate chain is not in leaf to root order")
+	ErrUntrustedRoot    = errors.New("Root certificate does not match the pinned fingerprint")
+	ErrExpired          = errors.New("Certificate in chain is expired or not yet valid")
+	ErrNameConstraints  = errors.New("Leaf certificate violates the content signature name constraints")
+	ErrSubject          = errors.New("Leaf certificate subject is not the expected subject")
+	ErrKeyUsage         = errors.New("Certificate in chain is not valid for code signing")
+	ErrBadSignature     = errors.New("Content signature does not match the body")
+)
+
+var algorithms = map[string]struct {
+	curve elliptic.Curve
+	hash  crypto.Hash
+}{
+	"p384ecdsa": {elliptic.P384(), crypto.SHA384},
+	"p256ecdsa": {elliptic.P256(), crypto.SHA256},
+}
+
+// Signature is a parsed Content-Signature header.
+type Signature struct {
+	X5U       string
+	Algorithm string
+	Blob      []byte
+}
+
+// ParseHeader parses a header of the form "x5u=<url>; p384ecdsa=<sig>".
+func ParseHeader(header string) (*Signature, error) {
+	sig := &Signature{}
+	for _, element := range strings.Split(header, ";") {
+		element = strings.TrimSpace(element)
+		i := strings.IndexByte(element, '=')
+		if i < 0 {
+			continue
+		}
+		key, value := element[:i], strings.TrimSpace(element[i+1:])
+		if key == "x5u" {
+			sig.X5U = value
+			continue
+		}
+		if _, ok := algorithms[key]; !ok || len(value) == 0 || sig.Algorithm == "p384ecdsa" {
+			continue
+		}
+		blob, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode %s signature: %v", key, err)
+		}
+		sig.Algorithm = key
+		sig.Blob = blob
+	}
+	if len(sig.Algorithm) == 0 {
+		return nil, ErrMissingSignature
+	}
+	if len(sig.X5U) == 0 {
+		return nil, ErrMissingX5U
+	}
+	return sig, nil
+}
+
+// Verify checks the signature against body using the leaf public key.
+func (sig *Signature) Verify(leaf *x509.Certificate, body []byte) error {
+	algorithm := algorithms[sig.Algorithm]
+	publicKey, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok || publicKey.Curve != algorithm.curve {
+		return fmt.Errorf("Leaf key is not suitable for %s", sig.Algorithm)
+	}
+	size := (algorithm.curve.Params().BitSize + 7) / 8
+	if len(sig.Blob) != size*2 {
+		return ErrBadSignature
+	}
+	r := new(big.Int).SetBytes(sig.Blob[:size])
+	s := new(big.Int).SetBytes(sig.Blob[size:])
+
+	hasher := algorithm.hash.New()
+	hasher.Write([]byte(signaturePrefix))
+	hasher.Write(body)
+	if !ecdsa.Verify(publicKey, hasher.Sum(nil), r, s) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// ParseChain decodes a PEM certificate chain as served from an x5u URL.
+func ParseChain(chain []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, chain = pem.Decode(chain)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, ErrMalformedChain
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(bytes.TrimSpace(chain)) != 0 || len(certs) < 2 {
+		return nil, ErrMalformedChain
+	}
+	return certs, nil
+}
+
+// Fingerprint formats the SHA256 hash of a certificate the way Balrog root
+// pins are written, as colon separated upper case hex.
+func Fingerprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(hash))
+	for i := range hash {
+		parts[i] = strings.ToUpper(hex.EncodeToString(hash[i : i+1]))
+	}
+	return strings.Join(parts, ":")
+}
+
+// Verifier checks update.json bodies against a pinned root certificate.
+type Verifier struct {
+	// RootFingerprint is the pinned root in the format returned by Fingerprint.
+	RootFingerprint string
+
+	// Subject overrides DefaultSubject when set.
+	Subject string
+
+	// Client is used to fetch x5u chains; a client with a 30 second timeout
+	// is used when nil.
+	Client *http.Client
+
+	// Now overrides time.Now when checking validity dates.
+	Now func() time.Time
+}
+
+// Verify checks body against its Content-Signature header. When chain is
+// empty, the chain is fetched from the header's x5u URL.
+func (v *Verifier) Verify(body []byte, header string, chain []byte) error {
+	sig, err := ParseHeader(header)
+	if err != nil {
+		return err
+	}
+	if len(chain) == 0 {
+		chain, err = v.FetchChain(sig.X5U)
+		if err != nil {
+			return err
+		}
+	}
+	certs, err := ParseChain(chain)
+	if err != nil {
+		return err
+	}
+	leaf, err := v.VerifyChain(certs)
+	if err != nil {
+		return err
+	}
+	return sig.Verify(leaf, body)
+}
+
+// FetchChain downloads the PEM chain referenced by an x5u URL.
+func (v *Verifier) FetchChain(x5u string) ([]byte, error) {
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Get(x5u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unable to fetch certificate chain: %s", resp.Status)
+	}
+	chain, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxChainSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) > maxChainSize {
+		return nil, ErrMalformedChain
+	}
+	return chain, nil
+}
+
+// VerifyChain checks that certs, in file order, form a single path from the
+// leaf to the pinned root, and returns the leaf. Every certificate in the file
+// must be part of that path, the leaf must come first and the root last.
+func (v *Verifier) VerifyChain(certs []*x509.Certificate) (*x509.Certificate, error) {
+	if len(certs) < 2 {
+		return nil, ErrMalformedChain
+	}
+	leaf, root := certs[0], certs[len(certs)-1]
+	if leaf.IsCA || !isSelfSigned(root) {
+		return nil, ErrChainOrder
+	}
+
+	path := []*x509.Certificate{leaf}
+	used := make([]bool, len(certs))
+	used[0] = true
+	for current := leaf; current != root; {
+		next := -1
+		for i, cert := range certs {
+			if !used[i] && bytes.Equal(current.RawIssuer, cert.RawSubject) && current.CheckSignatureFrom(cert) == nil {
+				next = i
+				break
+			}
+		}
+		if next < 0 || isSelfSigned(current) {
+			return nil, ErrChainOrder
+		}
+		used[next] = true
+		current = certs[next]
+		path = append(path, current)
+	}
+	for i := range used {
+		if !used[i] {
+			return nil, ErrChainOrder
+		}
+	}
+
+	if !strings.EqualFold(strings.Replace(Fingerprint(root), ":", "", -1), strings.Replace(v.RootFingerprint, ":", "", -1)) {
+		return nil, ErrUntrustedRoot
+	}
+
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+	for _, cert := range path {
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return nil, ErrExpired
+		}
+		if !allowsCodeSigning(cert) {
+			return nil, ErrKeyUsage
+		}
+	}
+
+	subject := v.Subject
+	if len(subject) == 0 {
+		subject = DefaultSubject
+	}
+	if leaf.Subject.CommonName != subject {
+		return nil, ErrSubject
+	}
+	if err := checkNameConstraints(leaf, path[1:]); err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+func allowsCodeSigning(cert *x509.Certificate) bool {
+	if len(cert.ExtKeyUsage) == 0 {
+		return true
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageCodeSigning || usage == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNameConstraints applies the DNS constraints of every issuer to the
+// leaf's common name and SANs, and requires at least one issuer to pin the
+// chain to ConstraintDomain.
+func checkNameConstraints(leaf *x509.Certificate, issuers []*x509.Certificate) error {
+	names := append([]string{leaf.Subject.CommonName}, leaf.DNSNames...)
+	pinned := false
+	for _, issuer := range issuers {
+		for _, domain := range issuer.PermittedDNSDomains {
+			if strings.TrimPrefix(domain, ".") == ConstraintDomain {
+				pinned = true
+			}
+		}
+		for _, name := range names {
+			if len(issuer.PermittedDNSDomains) > 0 && !matchesAnyDomain(name, issuer.PermittedDNSDomains) {
+				return ErrNameConstraints
+			}
+			if matchesAnyDomain(name, issuer.ExcludedDNSDomains) {
+				return ErrNameConstraints
+			}
+		}
+	}
+	if !pinned {
+		return ErrNameConstraints
+	}
+	return nil
+}
+
+func matchesAnyDomain(name string, domains []string) bool {
+	name = strings.ToLower(name)
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if strings.HasPrefix(domain, ".") {
+			if strings.HasSuffix(name, domain) {
+				return true
+			}
+		} else if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
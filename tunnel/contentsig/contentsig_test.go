@@ -0,0 +1,278 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package contentsig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2020, 1, 15, 0, 0, 0, 0, time.UTC)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate from template, signed by parent, or self
+// signed when parent is nil.
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	if template.NotBefore.IsZero() {
+		template.NotBefore = testNow.Add(-24 * time.Hour)
+		template.NotAfter = testNow.Add(24 * time.Hour)
+	}
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+func newCA(name string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+}
+
+func newLeaf(name string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+}
+
+// newTestChain returns a leaf, intermediate and root chain shaped like the
+// Balrog one.
+func newTestChain(t *testing.T) []*testCert {
+	root := newTestCert(t, newCA("root"), nil)
+	intermediateTemplate := newCA("intermediate")
+	intermediateTemplate.PermittedDNSDomains = []string{"." + ConstraintDomain}
+	intermediate := newTestCert(t, intermediateTemplate, root)
+	leaf := newTestCert(t, newLeaf(DefaultSubject), intermediate)
+	return []*testCert{leaf, intermediate, root}
+}
+
+func certs(chain []*testCert) []*x509.Certificate {
+	certs := make([]*x509.Certificate, len(chain))
+	for i := range chain {
+		certs[i] = chain[i].cert
+	}
+	return certs
+}
+
+func encodeChain(chain []*testCert) []byte {
+	var out []byte
+	for _, c := range chain {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})...)
+	}
+	return out
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, body []byte) string {
+	hash := sha512.Sum384(append([]byte(signaturePrefix), body...))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := make([]byte, 96)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(blob[48-len(rBytes):48], rBytes)
+	copy(blob[96-len(sBytes):], sBytes)
+	return base64.RawURLEncoding.EncodeToString(blob)
+}
+
+func newTestVerifier(root *testCert) *Verifier {
+	return &Verifier{
+		RootFingerprint: Fingerprint(root.cert),
+		Now:             func() time.Time { return testNow },
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	blob := base64.RawURLEncoding.EncodeToString([]byte{1, 2, 3})
+	other := base64.RawURLEncoding.EncodeToString([]byte{4, 5, 6})
+
+	sig, err := ParseHeader("x5u=https://example.com/chain.pem; p384ecdsa=" + blob + "==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.X5U != "https://example.com/chain.pem" || sig.Algorithm != "p384ecdsa" || string(sig.Blob) != "\x01\x02\x03" {
+		t.Errorf("Unexpected signature %+v", sig)
+	}
+
+	// P-384 is preferred whatever the order
+	for _, header := range []string{
+		"p384ecdsa=" + blob + ";p256ecdsa=" + other + "; x5u=u",
+		"p256ecdsa=" + other + ";p384ecdsa=" + blob + "; x5u=u",
+	} {
+		sig, err = ParseHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig.Algorithm != "p384ecdsa" || string(sig.Blob) != "\x01\x02\x03" {
+			t.Errorf("Unexpected signature %+v from %q", sig, header)
+		}
+	}
+
+	for header, want := range map[string]error{
+		"":                        ErrMissingSignature,
+		"x5u=u":                   ErrMissingSignature,
+		"x5u=u; rsa=" + blob:      ErrMissingSignature,
+		"x5u=u; p384ecdsa=":       ErrMissingSignature,
+		"p384ecdsa=" + blob:       ErrMissingX5U,
+		"x5u=; p384ecdsa=" + blob: ErrMissingX5U,
+	} {
+		if _, err := ParseHeader(header); err != want {
+			t.Errorf("Expected %v for %q, got %v", want, header, err)
+		}
+	}
+	if _, err := ParseHeader("x5u=u; p384ecdsa=!!!"); err == nil {
+		t.Error("Expected an error for an undecodable signature")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	chain := newTestChain(t)
+	v := newTestVerifier(chain[2])
+	body := []byte(`{"version": "1.0"}`)
+	header := "x5u=https://example.com/chain.pem; p384ecdsa=" + sign(t, chain[0].key, body)
+
+	if err := v.Verify(body, header, encodeChain(chain)); err != nil {
+		t.Fatalf("Unable to verify a valid signature: %v", err)
+	}
+	if err := v.Verify([]byte(`{"version": "2.0"}`), header, encodeChain(chain)); err != ErrBadSignature {
+		t.Errorf("Expected %v for a modified body, got %v", ErrBadSignature, err)
+	}
+	if err := v.Verify(body, header, encodeChain(chain[:1])); err != ErrMalformedChain {
+		t.Errorf("Expected %v for a single certificate, got %v", ErrMalformedChain, err)
+	}
+}
+
+func TestVerifyChainOrder(t *testing.T) {
+	chain := newTestChain(t)
+	v := newTestVerifier(chain[2])
+	if leaf, err := v.VerifyChain(certs(chain)); err != nil || leaf != chain[0].cert {
+		t.Fatalf("Unable to verify a valid chain: %v", err)
+	}
+
+	unrelated := newTestChain(t)
+	for name, order := range map[string][]*testCert{
+		"reversed":           {chain[2], chain[1], chain[0]},
+		"root in the middle": {chain[0], chain[2], chain[1]},
+		"leaf not first":     {chain[1], chain[0], chain[2]},
+		"missing link":       {chain[0], chain[2]},
+		"unused certificate": {chain[0], chain[1], unrelated[1], chain[2]},
+		"other root":         {chain[0], chain[1], unrelated[2]},
+	} {
+		if _, err := v.VerifyChain(certs(order)); err != ErrChainOrder {
+			t.Errorf("Expected %v for a chain with %s, got %v", ErrChainOrder, name, err)
+		}
+	}
+
+	if _, err := newTestVerifier(unrelated[2]).VerifyChain(certs(chain)); err != ErrUntrustedRoot {
+		t.Errorf("Expected %v for another pinned root, got %v", ErrUntrustedRoot, err)
+	}
+}
+
+func TestVerifyChainNameConstraints(t *testing.T) {
+	root := newTestCert(t, newCA("root"), nil)
+	constrained := newCA("intermediate")
+	constrained.PermittedDNSDomains = []string{"." + ConstraintDomain}
+	intermediate := newTestCert(t, constrained, root)
+	unconstrained := newTestCert(t, newCA("intermediate"), root)
+	v := newTestVerifier(root)
+
+	// The leaf name is checked against the constraint
+	v.Subject = "aus.example.com"
+	leaf := newTestCert(t, newLeaf(v.Subject), intermediate)
+	if _, err := v.VerifyChain(certs([]*testCert{leaf, intermediate, root})); err != ErrNameConstraints {
+		t.Errorf("Expected %v for a leaf outside of the constraint, got %v", ErrNameConstraints, err)
+	}
+
+	// Some issuer must carry the constraint
+	v.Subject = ""
+	leaf = newTestCert(t, newLeaf(DefaultSubject), unconstrained)
+	if _, err := v.VerifyChain(certs([]*testCert{leaf, unconstrained, root})); err != ErrNameConstraints {
+		t.Errorf("Expected %v for a chain without the constraint, got %v", ErrNameConstraints, err)
+	}
+
+	// SANs are checked too
+	template := newLeaf(DefaultSubject)
+	template.DNSNames = []string{"aus.example.com"}
+	leaf = newTestCert(t, template, intermediate)
+	if _, err := v.VerifyChain(certs([]*testCert{leaf, intermediate, root})); err != ErrNameConstraints {
+		t.Errorf("Expected %v for a SAN outside of the constraint, got %v", ErrNameConstraints, err)
+	}
+
+	leaf = newTestCert(t, newLeaf("other."+ConstraintDomain), intermediate)
+	if _, err := v.VerifyChain(certs([]*testCert{leaf, intermediate, root})); err != ErrSubject {
+		t.Errorf("Expected %v for another subject, got %v", ErrSubject, err)
+	}
+}
+
+func TestVerifyChainExpiry(t *testing.T) {
+	chain := newTestChain(t)
+	v := newTestVerifier(chain[2])
+	for _, now := range []time.Time{testNow.Add(-48 * time.Hour), testNow.Add(48 * time.Hour)} {
+		v.Now = func() time.Time { return now }
+		if _, err := v.VerifyChain(certs(chain)); err != ErrExpired {
+			t.Errorf("Expected %v at %v, got %v", ErrExpired, now, err)
+		}
+	}
+
+	// An expired intermediate fails the chain even when the leaf is valid
+	root := newTestCert(t, newCA("root"), nil)
+	expired := newCA("intermediate")
+	expired.PermittedDNSDomains = []string{"." + ConstraintDomain}
+	expired.NotBefore = testNow.Add(-48 * time.Hour)
+	expired.NotAfter = testNow.Add(-time.Hour)
+	intermediate := newTestCert(t, expired, root)
+	leaf := newTestCert(t, newLeaf(DefaultSubject), intermediate)
+	v = newTestVerifier(root)
+	if _, err := v.VerifyChain(certs([]*testCert{leaf, intermediate, root})); err != ErrExpired {
+		t.Errorf("Expected %v for an expired intermediate, got %v", ErrExpired, err)
+	}
+}
+
+func TestVerifyChainKeyUsage(t *testing.T) {
+	root := newTestCert(t, newCA("root"), nil)
+	intermediateTemplate := newCA("intermediate")
+	intermediateTemplate.PermittedDNSDomains = []string{"." + ConstraintDomain}
+	intermediate := newTestCert(t, intermediateTemplate, root)
+	template := newLeaf(DefaultSubject)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	leaf := newTestCert(t, template, intermediate)
+	if _, err := newTestVerifier(root).VerifyChain(certs([]*testCert{leaf, intermediate, root})); err != ErrKeyUsage {
+		t.Errorf("Expected %v for a TLS leaf, got %v", ErrKeyUsage, err)
+	}
+}
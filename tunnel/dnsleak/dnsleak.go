@@ -0,0 +1,177 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package dnsleak finds out which upstream resolvers the DNS queries of the
+// system reach, to tell whether they go through the tunnel.
+//
+// Each query is for a unique name in a zone whose authoritative server
+// answers TXT queries with the address the query came from. As no resolver
+// has the name cached, the answer is the address of the resolver that asked
+// the authoritative server on behalf of the system.
+package dnsleak
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultQueries is the number of names looked up in a check.
+	DefaultQueries = 3
+
+	// MaxQueries bounds the names looked up at once in a check.
+	MaxQueries = 16
+
+	// DefaultTimeout is the time a lookup has to be answered.
+	DefaultTimeout = 5 * time.Second
+)
+
+var (
+	ErrInvalidZone = errors.New("Invalid leak test zone")
+	ErrNoAnswers   = errors.New("No query was answered by the leak test zone")
+)
+
+// Query is a lookup of a unique name, and the resolver that asked the
+// authoritative server for it.
+type Query struct {
+	Name     string `json:"name"`
+	Resolver string `json:"resolver,omitempty"`
+	Err      error  `json:"-"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Report is the result of a check.
+type Report struct {
+	Queries []Query `json:"queries"`
+
+	// Resolvers are the distinct resolvers of the queries, sorted.
+	Resolvers []string `json:"resolvers"`
+}
+
+// Checker looks up unique names in Zone.
+type Checker struct {
+	Zone string
+
+	// Resolver defaults to the system resolver.
+	Resolver *net.Resolver
+
+	// Queries and Timeout override DefaultQueries and DefaultTimeout.
+	// Queries above MaxQueries are lowered to MaxQueries.
+	Queries int
+	Timeout time.Duration
+}
+
+// NewLabel returns a random DNS label, which no resolver has cached.
+func NewLabel() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return "leak-" + hex.EncodeToString(b[:]), nil
+}
+
+// Check looks up Queries unique names at once, and reports the resolvers
+// that answered them. It only fails when no lookup succeeded.
+func (c *Checker) Check(ctx context.Context) (*Report, error) {
+	zone := strings.Trim(c.Zone, ".")
+	if zone == "" || strings.Contains(zone, "..") {
+		return nil, ErrInvalidZone
+	}
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	count := c.Queries
+	if count <= 0 {
+		count = DefaultQueries
+	} else if count > MaxQueries {
+		count = MaxQueries
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	report := &Report{Queries: make([]Query, count)}
+	for i := range report.Queries {
+		label, err := NewLabel()
+		if err != nil {
+			return nil, err
+		}
+		// The trailing dot keeps the search list out of the lookup
+		report.Queries[i].Name = label + "." + zone + "."
+	}
+
+	var wg sync.WaitGroup
+	for i := range report.Queries {
+		wg.Add(1)
+		go func(query *Query) {
+			defer wg.Done()
+			queryCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			query.Resolver, query.Err = lookup(queryCtx, resolver, query.Name)
+		}(&report.Queries[i])
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for i := range report.Queries {
+		query := &report.Queries[i]
+		if query.Err != nil {
+			query.Error = query.Err.Error()
+			continue
+		}
+		if !seen[query.Resolver] {
+			seen[query.Resolver] = true
+			report.Resolvers = append(report.Resolvers, query.Resolver)
+		}
+	}
+	if len(report.Resolvers) == 0 {
+		return report, ErrNoAnswers
+	}
+	sort.Strings(report.Resolvers)
+	return report, nil
+}
+
+func lookup(ctx context.Context, resolver *net.Resolver, name string) (string, error) {
+	txts, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	for _, txt := range txts {
+		if ip := net.ParseIP(strings.TrimSpace(txt)); ip != nil {
+			return ip.String(), nil
+		}
+	}
+	return "", ErrNoAnswers
+}
+
+// Leaks returns the resolvers of the report that are not within the trusted
+// prefixes, such as those of the resolvers behind the DNS server of the
+// tunnel.
+func (r *Report) Leaks(trusted []net.IPNet) []string {
+	var leaks []string
+	for _, resolver := range r.Resolvers {
+		ip := net.ParseIP(resolver)
+		isTrusted := false
+		for i := range trusted {
+			if trusted[i].Contains(ip) {
+				isTrusted = true
+				break
+			}
+		}
+		if !isTrusted {
+			leaks = append(leaks, resolver)
+		}
+	}
+	return leaks
+}
@@ -0,0 +1,193 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package dnsleak
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const zone = "leak.test"
+
+// authority answers TXT queries in zone with the address they came from, and
+// other queries with NXDOMAIN.
+type authority struct {
+	conn *net.UDPConn
+}
+
+func newAuthority(t *testing.T) *authority {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authority{conn: conn}
+	go a.serve()
+	return a
+}
+
+func (a *authority) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if response := answer(buf[:n], addr.IP); response != nil {
+			a.conn.WriteToUDP(response, addr)
+		}
+	}
+}
+
+func (a *authority) Close() {
+	a.conn.Close()
+}
+
+func answer(query []byte, from net.IP) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	var labels []string
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		length := int(query[end])
+		if end+1+length > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[end+1:end+1+length]))
+		end += 1 + length
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	question := query[12:end]
+	name := strings.ToLower(strings.Join(labels, "."))
+	qtype := binary.BigEndian.Uint16(question[len(question)-4:])
+
+	header := make([]byte, 12)
+	copy(header, query[:2])
+	binary.BigEndian.PutUint16(header[2:], 0x8400) // Response, authoritative
+	binary.BigEndian.PutUint16(header[4:], 1)
+	response := append(header, question...)
+	if !strings.HasSuffix(name, "."+zone) || qtype != 16 {
+		binary.BigEndian.PutUint16(response[2:], 0x8403) // NXDOMAIN
+		return response
+	}
+
+	txt := from.String()
+	binary.BigEndian.PutUint16(response[6:], 1)
+	record := []byte{0xc0, 12, 0, 16, 0, 1, 0, 0, 0, 0}
+	record = append(record, 0, byte(len(txt)+1), byte(len(txt)))
+	return append(append(response, record...), txt...)
+}
+
+// resolverFrom returns a resolver that asks the authority from each of the
+// local addresses in turn.
+func resolverFrom(a *authority, locals ...string) *net.Resolver {
+	var dials uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			local := locals[int(atomic.AddUint32(&dials, 1)-1)%len(locals)]
+			dialer := net.Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP(local)}}
+			return dialer.DialContext(ctx, "udp", a.conn.LocalAddr().String())
+		},
+	}
+}
+
+func TestCheck(t *testing.T) {
+	a := newAuthority(t)
+	defer a.Close()
+
+	checker := &Checker{Zone: zone + ".", Resolver: resolverFrom(a, "127.0.0.1"), Queries: 4}
+	report, err := checker.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Queries) != 4 || len(report.Resolvers) != 1 || report.Resolvers[0] != "127.0.0.1" {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	names := make(map[string]bool)
+	for _, query := range report.Queries {
+		if query.Err != nil || query.Resolver != "127.0.0.1" || !strings.HasSuffix(query.Name, ".leak.test.") {
+			t.Fatalf("Unexpected query %+v", query)
+		}
+		names[query.Name] = true
+	}
+	if len(names) != 4 {
+		t.Fatalf("Expected unique names, got %+v", report.Queries)
+	}
+
+	checker.Queries = MaxQueries + 1
+	report, err = checker.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Queries) != MaxQueries {
+		t.Fatalf("Expected %d queries at most, got %d", MaxQueries, len(report.Queries))
+	}
+}
+
+func TestCheckResolvers(t *testing.T) {
+	a := newAuthority(t)
+	defer a.Close()
+
+	// Queries reach the authority from two resolvers, as when some of them
+	// leak out of the tunnel
+	checker := &Checker{Zone: zone, Resolver: resolverFrom(a, "127.0.0.2", "127.0.0.1"), Queries: 6}
+	report, err := checker.Check(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(report.Resolvers, ",") != "127.0.0.1,127.0.0.2" {
+		t.Fatalf("Unexpected resolvers %v", report.Resolvers)
+	}
+
+	_, trusted, _ := net.ParseCIDR("127.0.0.1/32")
+	if leaks := report.Leaks([]net.IPNet{*trusted}); len(leaks) != 1 || leaks[0] != "127.0.0.2" {
+		t.Fatalf("Unexpected leaks %v", leaks)
+	}
+	_, trusted, _ = net.ParseCIDR("127.0.0.0/8")
+	if leaks := report.Leaks([]net.IPNet{*trusted}); len(leaks) != 0 {
+		t.Fatalf("Unexpected leaks %v", leaks)
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	a := newAuthority(t)
+	defer a.Close()
+
+	checker := &Checker{Zone: "other.test", Resolver: resolverFrom(a, "127.0.0.1"), Queries: 2}
+	report, err := checker.Check(context.Background())
+	if err != ErrNoAnswers {
+		t.Fatalf("Expected ErrNoAnswers outside the zone, got %v", err)
+	}
+	for _, query := range report.Queries {
+		if query.Err == nil || query.Error == "" {
+			t.Fatalf("Unexpected query %+v", query)
+		}
+	}
+
+	// Nothing answers on the port of a closed authority
+	closed := newAuthority(t)
+	closed.Close()
+	checker = &Checker{Zone: zone, Resolver: resolverFrom(closed, "127.0.0.1"), Timeout: 200 * time.Millisecond}
+	if _, err := checker.Check(context.Background()); err != ErrNoAnswers {
+		t.Fatalf("Expected ErrNoAnswers without an authority, got %v", err)
+	}
+
+	for _, invalid := range []string{"", ".", "a..b"} {
+		checker := &Checker{Zone: invalid}
+		if _, err := checker.Check(context.Background()); err != ErrInvalidZone {
+			t.Errorf("Expected ErrInvalidZone for %q, got %v", invalid, err)
+		}
+	}
+}
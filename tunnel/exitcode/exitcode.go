@@ -0,0 +1,144 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package exitcode maps tunnel service errors to the stable numeric codes
+// that the UI knows as WireGuardTunnelExitCodes.
+package exitcode
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Code is a tunnel service exit code. The values must not change, as they
+// are shared with the UI.
+type Code int32
+
+const (
+	ErrorSuccess Code = iota
+	ErrorRingloggerOpen
+	ErrorLoadConfiguration
+	ErrorCreateWintun
+	ErrorUAPIListen
+	ErrorDNSLookup
+	ErrorFirewall
+	ErrorDeviceSetConfig
+	ErrorBindSocketsToDefaultRoutes
+	ErrorSetNetConfig
+	ErrorDetermineExecutablePath
+	ErrorOpenNULFile
+	ErrorTrackTunnels
+	ErrorEnumerateSessions
+	ErrorDropPrivileges
+	ErrorWin32
+)
+
+var codeNames = [...]string{
+	"ErrorSuccess",
+	"ErrorRingloggerOpen",
+	"ErrorLoadConfiguration",
+	"ErrorCreateWintun",
+	"ErrorUAPIListen",
+	"ErrorDNSLookup",
+	"ErrorFirewall",
+	"ErrorDeviceSetConfig",
+	"ErrorBindSocketsToDefaultRoutes",
+	"ErrorSetNetConfig",
+	"ErrorDetermineExecutablePath",
+	"ErrorOpenNULFile",
+	"ErrorTrackTunnels",
+	"ErrorEnumerateSessions",
+	"ErrorDropPrivileges",
+	"ErrorWin32",
+}
+
+func (c Code) String() string {
+	if c < ErrorSuccess || c > ErrorWin32 {
+		return fmt.Sprintf("Code(%d)", int32(c))
+	}
+	return codeNames[c]
+}
+
+// serviceErrors maps the values of wireguard-windows services.Error to
+// codes. It is built from the services.Error constants on Windows, so that it
+// follows upstream when it renumbers its errors, and is empty elsewhere.
+var serviceErrors = map[uint32]Code{}
+
+// FromServiceError returns the code of a wireguard-windows services.Error.
+// Unknown values are ErrorWin32.
+func FromServiceError(serviceError uint32) Code {
+	if code, ok := serviceErrors[serviceError]; ok {
+		return code
+	}
+	return ErrorWin32
+}
+
+// errorServiceSpecific is ERROR_SERVICE_SPECIFIC_ERROR, the Win32 exit code
+// of a service that stopped with a service specific exit code.
+const errorServiceSpecific = 1066
+
+// FromServiceStatus returns the error that a stopped service reported in its
+// status, or nil if it stopped cleanly. The tunnel service reports its
+// services.Error as the service specific exit code, and svc.Run returns nil
+// whatever the exit code, so this is where failures of the service are read.
+func FromServiceStatus(win32ExitCode, serviceSpecificExitCode uint32) error {
+	switch {
+	case win32ExitCode == 0:
+		return nil
+	case win32ExitCode == errorServiceSpecific:
+		code := FromServiceError(serviceSpecificExitCode)
+		if code == ErrorSuccess {
+			return nil
+		}
+		return &Error{Code: code, Err: fmt.Errorf("Service stopped with service specific exit code %d", serviceSpecificExitCode)}
+	}
+	return &Error{Code: ErrorWin32, Err: syscall.Errno(win32ExitCode)}
+}
+
+// Error is an error with a known code.
+type Error struct {
+	Code Code
+	Err  error
+}
+
+// Wrap returns err with a code attached, or nil if err is nil.
+func Wrap(code Code, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Err: err}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Code, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// serviceError extracts the value of a services.Error from err. It is only
+// set on Windows.
+var serviceError func(err error) (uint32, bool)
+
+// FromError returns the code of err. Errors with a code attached come first,
+// then wireguard-windows service errors, and anything else, such as a Win32
+// error from the service control manager, is ErrorWin32.
+func FromError(err error) Code {
+	if err == nil {
+		return ErrorSuccess
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	if serviceError != nil {
+		if value, ok := serviceError(err); ok {
+			return FromServiceError(value)
+		}
+	}
+	return ErrorWin32
+}
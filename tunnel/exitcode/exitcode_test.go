@@ -0,0 +1,167 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package exitcode
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+// fakeServiceError stands in for services.Error, which only exists on Windows.
+type fakeServiceError uint32
+
+func (e fakeServiceError) Error() string {
+	return fmt.Sprintf("service error %d", uint32(e))
+}
+
+// fakeServiceErrors stands in for the services.Error constants, numbered as
+// in wireguard-windows v0.0.38. It returns a function that restores them.
+func fakeServiceErrors() func() {
+	saved := serviceErrors
+	serviceErrors = make(map[uint32]Code)
+	for code := ErrorSuccess; code <= ErrorWin32; code++ {
+		serviceErrors[uint32(code)] = code
+	}
+	return func() { serviceErrors = saved }
+}
+
+func TestFromError(t *testing.T) {
+	defer fakeServiceErrors()()
+	saved := serviceError
+	defer func() { serviceError = saved }()
+	serviceError = func(err error) (uint32, bool) {
+		var e fakeServiceError
+		if errors.As(err, &e) {
+			return uint32(e), true
+		}
+		return 0, false
+	}
+
+	loadError := errors.New("Unable to parse configuration")
+	tests := []struct {
+		name string
+		err  error
+		code Code
+	}{
+		{"No error", nil, ErrorSuccess},
+		{"Wrapped", Wrap(ErrorLoadConfiguration, loadError), ErrorLoadConfiguration},
+		{"Wrapped twice", fmt.Errorf("Tunnel service: %w", Wrap(ErrorFirewall, loadError)), ErrorFirewall},
+		{"Service error", fakeServiceError(5), ErrorDNSLookup},
+		{"Wrapped service error", fmt.Errorf("Unable to start: %w", fakeServiceError(3)), ErrorCreateWintun},
+		{"Unknown service error", fakeServiceError(100), ErrorWin32},
+		{"Win32 error", syscall.Errno(1063), ErrorWin32},
+		{"Other error", errors.New("Something else"), ErrorWin32},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := FromError(test.err); code != test.code {
+				t.Fatalf("Expected %v, got %v", test.code, code)
+			}
+		})
+	}
+}
+
+func TestFromServiceError(t *testing.T) {
+	defer fakeServiceErrors()()
+	tests := []struct {
+		serviceError uint32
+		code         Code
+	}{
+		{0, ErrorSuccess},
+		{1, ErrorRingloggerOpen},
+		{2, ErrorLoadConfiguration},
+		{3, ErrorCreateWintun},
+		{4, ErrorUAPIListen},
+		{5, ErrorDNSLookup},
+		{6, ErrorFirewall},
+		{7, ErrorDeviceSetConfig},
+		{8, ErrorBindSocketsToDefaultRoutes},
+		{9, ErrorSetNetConfig},
+		{10, ErrorDetermineExecutablePath},
+		{11, ErrorOpenNULFile},
+		{12, ErrorTrackTunnels},
+		{13, ErrorEnumerateSessions},
+		{14, ErrorDropPrivileges},
+		{15, ErrorWin32},
+		{16, ErrorWin32},
+	}
+	for _, test := range tests {
+		if code := FromServiceError(test.serviceError); code != test.code {
+			t.Errorf("FromServiceError(%d) = %v, expected %v", test.serviceError, code, test.code)
+		}
+	}
+}
+
+func TestFromServiceStatus(t *testing.T) {
+	defer fakeServiceErrors()()
+	tests := []struct {
+		name                    string
+		win32ExitCode           uint32
+		serviceSpecificExitCode uint32
+		code                    Code
+	}{
+		{"Stopped", 0, 0, ErrorSuccess},
+		{"Service specific success", errorServiceSpecific, 0, ErrorSuccess},
+		{"Service error", errorServiceSpecific, 3, ErrorCreateWintun},
+		{"Firewall", errorServiceSpecific, 6, ErrorFirewall},
+		{"Unknown service error", errorServiceSpecific, 100, ErrorWin32},
+		{"Win32 error", 5, 0, ErrorWin32},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := FromServiceStatus(test.win32ExitCode, test.serviceSpecificExitCode)
+			if (err == nil) != (test.code == ErrorSuccess) {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			// The exit code of a service that failed comes from its status,
+			// as svc.Run returns no error
+			if code := FromError(err); code != test.code {
+				t.Fatalf("Expected %v, got %v", test.code, code)
+			}
+		})
+	}
+	if err := FromServiceStatus(5, 0); !errors.Is(err, syscall.Errno(5)) {
+		t.Fatalf("Win32 exit code is not unwrapped from %v", err)
+	}
+}
+
+// The values are part of the interface with the UI's WireGuardTunnelExitCodes
+func TestCodeValues(t *testing.T) {
+	tests := []struct {
+		code  Code
+		value int32
+		name  string
+	}{
+		{ErrorSuccess, 0, "ErrorSuccess"},
+		{ErrorLoadConfiguration, 2, "ErrorLoadConfiguration"},
+		{ErrorCreateWintun, 3, "ErrorCreateWintun"},
+		{ErrorDNSLookup, 5, "ErrorDNSLookup"},
+		{ErrorFirewall, 6, "ErrorFirewall"},
+		{ErrorWin32, 15, "ErrorWin32"},
+		{Code(42), 42, "Code(42)"},
+	}
+	for _, test := range tests {
+		if int32(test.code) != test.value || test.code.String() != test.name {
+			t.Errorf("Unexpected code %d %q, expected %d %q", int32(test.code), test.code, test.value, test.name)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	if Wrap(ErrorFirewall, nil) != nil {
+		t.Fatal("Wrapping nil is not nil")
+	}
+	inner := errors.New("Access denied")
+	err := Wrap(ErrorFirewall, inner)
+	if !errors.Is(err, inner) {
+		t.Fatal("Wrapped error does not unwrap")
+	}
+	if err.Error() != "ErrorFirewall: Access denied" {
+		t.Fatalf("Unexpected message %q", err.Error())
+	}
+}
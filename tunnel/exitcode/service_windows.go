@@ -0,0 +1,66 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package exitcode
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+
+	"golang.zx2c4.com/wireguard/windows/services"
+)
+
+func init() {
+	serviceErrors = map[uint32]Code{
+		uint32(services.ErrorSuccess):                    ErrorSuccess,
+		uint32(services.ErrorRingloggerOpen):             ErrorRingloggerOpen,
+		uint32(services.ErrorLoadConfiguration):          ErrorLoadConfiguration,
+		uint32(services.ErrorCreateWintun):               ErrorCreateWintun,
+		uint32(services.ErrorUAPIListen):                 ErrorUAPIListen,
+		uint32(services.ErrorDNSLookup):                  ErrorDNSLookup,
+		uint32(services.ErrorFirewall):                   ErrorFirewall,
+		uint32(services.ErrorDeviceSetConfig):            ErrorDeviceSetConfig,
+		uint32(services.ErrorBindSocketsToDefaultRoutes): ErrorBindSocketsToDefaultRoutes,
+		uint32(services.ErrorSetNetConfig):               ErrorSetNetConfig,
+		uint32(services.ErrorDetermineExecutablePath):    ErrorDetermineExecutablePath,
+		uint32(services.ErrorOpenNULFile):                ErrorOpenNULFile,
+		uint32(services.ErrorTrackTunnels):               ErrorTrackTunnels,
+		uint32(services.ErrorEnumerateSessions):          ErrorEnumerateSessions,
+		uint32(services.ErrorDropPrivileges):             ErrorDropPrivileges,
+		uint32(services.ErrorWin32):                      ErrorWin32,
+	}
+	serviceError = func(err error) (uint32, bool) {
+		var e services.Error
+		if errors.As(err, &e) {
+			return uint32(e), true
+		}
+		return 0, false
+	}
+}
+
+// QueryServiceStatus returns the exit codes that a service last reported to
+// the service control manager, to be passed to FromServiceStatus.
+func QueryServiceStatus(serviceName string) (win32ExitCode, serviceSpecificExitCode uint32, err error) {
+	manager, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_CONNECT)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer windows.CloseServiceHandle(manager)
+	name, err := windows.UTF16PtrFromString(serviceName)
+	if err != nil {
+		return 0, 0, err
+	}
+	service, err := windows.OpenService(manager, name, windows.SERVICE_QUERY_STATUS)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer windows.CloseServiceHandle(service)
+	var status windows.SERVICE_STATUS
+	if err := windows.QueryServiceStatus(service, &status); err != nil {
+		return 0, 0, err
+	}
+	return status.Win32ExitCode, status.ServiceSpecificExitCode, nil
+}
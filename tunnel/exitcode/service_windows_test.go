@@ -0,0 +1,24 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package exitcode
+
+import (
+	"testing"
+
+	"golang.zx2c4.com/wireguard/windows/services"
+)
+
+// Errors that upstream adds must be mapped before the UI can tell them apart
+func TestServiceErrorsComplete(t *testing.T) {
+	for value := uint32(services.ErrorSuccess); value <= uint32(services.ErrorWin32); value++ {
+		if _, ok := serviceErrors[value]; !ok {
+			t.Errorf("No code for %v (%d)", services.Error(value), value)
+		}
+	}
+	if FromServiceError(uint32(services.ErrorFirewall)) != ErrorFirewall {
+		t.Errorf("Unexpected code for %v", services.ErrorFirewall)
+	}
+}
@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package guardian holds the parts of the Guardian API responses that the
+// tunnel needs.
+package guardian
+
+import "errors"
+
+var ErrInvalidPortRanges = errors.New("Server port ranges are invalid")
+
+// ServerList is the response of /api/v1/vpn/servers.
+type ServerList struct {
+	Countries []Country `json:"countries,omitempty"`
+}
+
+type Country struct {
+	Name   string `json:"name,omitempty"`
+	Code   string `json:"code,omitempty"`
+	Cities []City `json:"cities,omitempty"`
+}
+
+type City struct {
+	Name      string   `json:"name,omitempty"`
+	Code      string   `json:"code,omitempty"`
+	Latitude  float32  `json:"latitude,omitempty"`
+	Longitude float32  `json:"longitude,omitempty"`
+	Servers   []Server `json:"servers,omitempty"`
+}
+
+// Server is an entry of the /api/v1/vpn/servers server list.
+type Server struct {
+	Hostname         string  `json:"hostname,omitempty"`
+	Ipv4AddrIn       string  `json:"ipv4_addr_in,omitempty"`
+	Weight           int     `json:"weight,omitempty"`
+	IncludeInCountry bool    `json:"include_in_country,omitempty"`
+	PublicKey        string  `json:"public_key,omitempty"`
+	PortRanges       [][]int `json:"port_ranges,omitempty"`
+	Ipv4Gateway      string  `json:"ipv4_gateway,omitempty"`
+	Ipv6Gateway      string  `json:"ipv6_gateway,omitempty"`
+}
+
+// Device is a device registered with /api/v1/vpn/device.
+type Device struct {
+	Name        string `json:"name,omitempty"`
+	Pubkey      string `json:"pubkey,omitempty"`
+	Ipv4Address string `json:"ipv4_address,omitempty"`
+	Ipv6Address string `json:"ipv6_address,omitempty"`
+	CreatedAt   string `json:"created_at,omitempty"`
+}
+
+// PortRange is an inclusive range of endpoint ports.
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// Contains reports whether port is in the range.
+func (r PortRange) Contains(port int) bool {
+	return port >= int(r.From) && port <= int(r.To)
+}
+
+// Size returns the number of ports in the range.
+func (r PortRange) Size() int {
+	return int(r.To) - int(r.From) + 1
+}
+
+// Ports validates and returns the port ranges of the server. Like the UI, a
+// range may be given in either order, and a single port is a range of one.
+func (s *Server) Ports() ([]PortRange, error) {
+	if len(s.PortRanges) == 0 {
+		return nil, ErrInvalidPortRanges
+	}
+	ranges := make([]PortRange, 0, len(s.PortRanges))
+	for _, r := range s.PortRanges {
+		if len(r) == 0 || len(r) > 2 {
+			return nil, ErrInvalidPortRanges
+		}
+		from, to := r[0], r[len(r)-1]
+		if from > to {
+			from, to = to, from
+		}
+		if from < 1 || to > 65535 {
+			return nil, ErrInvalidPortRanges
+		}
+		ranges = append(ranges, PortRange{uint16(from), uint16(to)})
+	}
+	return ranges, nil
+}
@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package health
+
+import (
+	"encoding/binary"
+	"errors"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/routes"
+)
+
+const (
+	sockoptIP_UNICAST_IF   = 31
+	sockoptIPV6_UNICAST_IF = 31
+	sockoptSO_TYPE         = 0x1008
+
+	// maxSocketHandle bounds the search for the sockets of the tunnel.
+	maxSocketHandle = 1 << 20
+)
+
+var ErrNoSocket = errors.New("Unable to find the sockets of the listen port")
+
+// DefaultInterfaceBinder returns a Bind for Rebind, which binds the sockets
+// of the new listen port to the interface of the physical default route, as
+// the tunnel service does when routes change. The service does not do it
+// again for a new listen port, and unbound sockets send tunnel traffic back
+// into the tunnel.
+func DefaultInterfaceBinder(table routes.Table) func(port uint16) error {
+	return func(port uint16) error {
+		found := false
+		for _, socket := range udpSockets(port) {
+			found = true
+			iface, err := routes.DefaultInterface(table, socket.family)
+			if err == routes.ErrNoDefaultRoute {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := bindSocket(socket, iface.Index); err != nil {
+				return err
+			}
+		}
+		if !found {
+			return ErrNoSocket
+		}
+		return nil
+	}
+}
+
+type udpSocket struct {
+	handle windows.Handle
+	family routes.Family
+}
+
+// udpSockets returns the UDP sockets of the process bound to port. The
+// sockets belong to the device of wireguard-go, which keeps them to itself,
+// so they are found among the handles of the process.
+func udpSockets(port uint16) []udpSocket {
+	var sockets []udpSocket
+	for handle := windows.Handle(4); handle < maxSocketHandle; handle += 4 {
+		sa, err := windows.Getsockname(handle)
+		if err != nil {
+			continue
+		}
+		var family routes.Family
+		switch sa := sa.(type) {
+		case *windows.SockaddrInet4:
+			if sa.Port != int(port) {
+				continue
+			}
+			family = routes.IPv4
+		case *windows.SockaddrInet6:
+			if sa.Port != int(port) {
+				continue
+			}
+			family = routes.IPv6
+		default:
+			continue
+		}
+		var socketType int32
+		size := int32(unsafe.Sizeof(socketType))
+		if err := windows.Getsockopt(handle, windows.SOL_SOCKET, sockoptSO_TYPE, (*byte)(unsafe.Pointer(&socketType)), &size); err != nil || socketType != windows.SOCK_DGRAM {
+			continue
+		}
+		sockets = append(sockets, udpSocket{handle, family})
+	}
+	return sockets
+}
+
+func bindSocket(socket udpSocket, index uint32) error {
+	if socket.family == routes.IPv6 {
+		return windows.SetsockoptInt(socket.handle, windows.IPPROTO_IPV6, sockoptIPV6_UNICAST_IF, int(index))
+	}
+	// The IPv4 index is in network byte order, as wireguard-go does
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, index)
+	index = *(*uint32)(unsafe.Pointer(&bytes[0]))
+	return windows.SetsockoptInt(socket.handle, windows.IPPROTO_IP, sockoptIP_UNICAST_IF, int(index))
+}
@@ -0,0 +1,205 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package health watches whether the peer of a running tunnel still
+// handshakes and passes traffic, and tries to recover it when it stalls.
+package health
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/uapi"
+)
+
+const (
+	// DefaultInterval is how often the tunnel is checked.
+	DefaultInterval = 5 * time.Second
+
+	// DefaultDegradedAfter is the handshake age after which the peer is
+	// late. wireguard-go handshakes every 2 minutes while there is traffic,
+	// and retries for 5 seconds at a time.
+	DefaultDegradedAfter = 135 * time.Second
+
+	// DefaultStalledAfter is the handshake age after which the session
+	// keys are rejected, and no traffic passes.
+	DefaultStalledAfter = 180 * time.Second
+
+	// DefaultPingFailures is the number of pings in a row the gateway has
+	// to miss for the tunnel to be stalled.
+	DefaultPingFailures = 3
+)
+
+var ErrNoPeer = errors.New("The tunnel has no peer")
+
+// State is the health of a tunnel.
+type State int
+
+const (
+	Healthy State = iota
+	Degraded
+	Stalled
+)
+
+var stateNames = []string{"healthy", "degraded", "stalled"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[s]
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Status is the result of a check.
+type Status struct {
+	State        State         `json:"state"`
+	HandshakeAge time.Duration `json:"-"`
+	PingFailures int           `json:"ping_failures"`
+
+	// Err is why the last ping failed.
+	Err error `json:"-"`
+}
+
+// Pinger checks that a host behind the tunnel is reachable.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Monitor checks a tunnel every Interval. Zero fields take their defaults.
+type Monitor struct {
+	Client *uapi.Client
+
+	// Gateway is pinged through the tunnel. Pings are also the traffic that
+	// keeps an idle tunnel handshaking. Without a gateway, only the
+	// handshake age is checked.
+	Gateway Pinger
+
+	// Recovery is run while the tunnel is stalled. Without one, the monitor
+	// only reports states.
+	Recovery *Policy
+
+	Interval      time.Duration
+	DegradedAfter time.Duration
+	StalledAfter  time.Duration
+	PingFailures  int
+
+	// OnChange is called with the first status, and whenever the state
+	// changes.
+	OnChange func(Status)
+
+	// OnRecovery is called after each recovery action.
+	OnRecovery func(action Action, err error)
+
+	// Wake makes the monitor check right away, and start recovery over
+	// without waiting out its backoff. It is meant for network changes,
+	// after which the old endpoint and socket are likely both stale.
+	Wake <-chan struct{}
+}
+
+func (m *Monitor) withDefaults() Monitor {
+	defaults := *m
+	if defaults.Interval <= 0 {
+		defaults.Interval = DefaultInterval
+	}
+	if defaults.DegradedAfter <= 0 {
+		defaults.DegradedAfter = DefaultDegradedAfter
+	}
+	if defaults.StalledAfter <= 0 {
+		defaults.StalledAfter = DefaultStalledAfter
+	}
+	if defaults.PingFailures <= 0 {
+		defaults.PingFailures = DefaultPingFailures
+	}
+	return defaults
+}
+
+// Run checks the tunnel until ctx is done. Checks that cannot reach the
+// tunnel, such as while it starts, are skipped.
+func (m *Monitor) Run(ctx context.Context) error {
+	monitor := m.withDefaults()
+	ticker := time.NewTicker(monitor.Interval)
+	defer ticker.Stop()
+
+	started := time.Now()
+	reported := false
+	var last State
+	var failures int
+	var recovery recoveryState
+	for {
+		status, err := monitor.check(ctx, started, &failures)
+		if err == nil {
+			if !reported || status.State != last {
+				reported = true
+				last = status.State
+				if monitor.OnChange != nil {
+					monitor.OnChange(status)
+				}
+			}
+			switch status.State {
+			case Healthy:
+				recovery = recoveryState{}
+			case Stalled:
+				if monitor.Recovery != nil {
+					monitor.Recovery.step(ctx, monitor.Client, &recovery, monitor.OnRecovery)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-monitor.Wake:
+			recovery = recoveryState{}
+		}
+	}
+}
+
+// check checks the tunnel once. The handshake age of a peer that never
+// handshaked is counted from started.
+func (m *Monitor) check(ctx context.Context, started time.Time, failures *int) (Status, error) {
+	device, err := m.Client.Get()
+	if err != nil {
+		return Status{}, err
+	}
+	defer device.Zero()
+	if len(device.Peers) == 0 {
+		return Status{}, ErrNoPeer
+	}
+
+	var status Status
+	lastHandshake := device.Peers[0].LastHandshake
+	if lastHandshake.IsZero() {
+		lastHandshake = started
+	}
+	status.HandshakeAge = time.Since(lastHandshake)
+
+	if m.Gateway != nil {
+		pingCtx, cancel := context.WithTimeout(ctx, m.Interval)
+		status.Err = m.Gateway.Ping(pingCtx)
+		cancel()
+		if status.Err != nil {
+			*failures++
+		} else {
+			*failures = 0
+		}
+	}
+	status.PingFailures = *failures
+
+	switch {
+	case status.HandshakeAge > m.StalledAfter || status.PingFailures >= m.PingFailures:
+		status.State = Stalled
+	case status.HandshakeAge > m.DegradedAfter || status.PingFailures > 0:
+		status.State = Degraded
+	default:
+		status.State = Healthy
+	}
+	return status, nil
+}
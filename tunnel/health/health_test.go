@@ -0,0 +1,418 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/guardian"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/internal/wgtest"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/uapi"
+)
+
+// tunPinger pings the server through the tunnel of the client, and counts
+// the request reaching the server as an answer.
+type tunPinger struct {
+	client, server *wgtest.Device
+}
+
+func (p *tunPinger) Ping(ctx context.Context) error {
+	for len(p.server.TUN.Inbound) > 0 {
+		<-p.server.TUN.Inbound
+	}
+	select {
+	case p.client.TUN.Outbound <- wgtest.Ping(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 32):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-p.server.TUN.Inbound:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type fakePinger struct {
+	err error
+}
+
+func (p *fakePinger) Ping(ctx context.Context) error {
+	return p.err
+}
+
+func newPair(t *testing.T) (client, server *wgtest.Device) {
+	client, err := wgtest.NewDevice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = wgtest.NewDevice()
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	if err := wgtest.Connect(client, server); err != nil {
+		client.Close()
+		server.Close()
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// pause makes the server drop everything from the client, and resume undoes
+// it.
+func pause(t *testing.T, client, server *wgtest.Device) {
+	if err := server.Set(fmt.Sprintf("public_key=%s\nremove=true\n", wgtest.HexKey(client.PublicKey()))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func resume(t *testing.T, client, server *wgtest.Device) {
+	if err := server.Set(fmt.Sprintf("public_key=%s\nallowed_ip=10.0.0.1/32\n", wgtest.HexKey(client.PublicKey()))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// watch runs a monitor until stop is called, and returns its state changes
+// and recovery actions.
+func watch(m *Monitor) (states <-chan State, actions <-chan string, stop func()) {
+	stateChanges := make(chan State, 16)
+	recoveries := make(chan string, 16)
+	m.OnChange = func(status Status) { stateChanges <- status.State }
+	m.OnRecovery = func(action Action, err error) {
+		result := "ok"
+		if err != nil {
+			result = err.Error()
+		}
+		select {
+		case recoveries <- action.String() + ": " + result:
+		default:
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+	return stateChanges, recoveries, func() {
+		cancel()
+		<-done
+	}
+}
+
+func expectState(t *testing.T, states <-chan State, expected State) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case state := <-states:
+			if state == expected {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Tunnel did not become %v", expected)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	client, server := newPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	pinger := &fakePinger{}
+	m := (&Monitor{Client: &uapi.Client{Dial: client.Dial}, Gateway: pinger}).withDefaults()
+
+	// The peer never handshaked, so its age counts from the start
+	tests := []struct {
+		age      time.Duration
+		pingErr  error
+		expected State
+		failures int
+	}{
+		{0, nil, Healthy, 0},
+		{140 * time.Second, nil, Degraded, 0},
+		{200 * time.Second, nil, Stalled, 0},
+		{0, errors.New("timeout"), Degraded, 1},
+		{0, errors.New("timeout"), Degraded, 2},
+		{0, errors.New("timeout"), Stalled, 3},
+		{0, nil, Healthy, 0},
+	}
+	failures := 0
+	for i, test := range tests {
+		pinger.err = test.pingErr
+		status, err := m.check(context.Background(), time.Now().Add(-test.age), &failures)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != test.expected || status.PingFailures != test.failures || status.Err != test.pingErr {
+			t.Errorf("%d: expected %v with %d failures, got %+v", i, test.expected, test.failures, status)
+		}
+	}
+
+	if err := client.Set(fmt.Sprintf("public_key=%s\nremove=true\n", wgtest.HexKey(server.PublicKey()))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.check(context.Background(), time.Now(), &failures); err != ErrNoPeer {
+		t.Fatalf("Expected ErrNoPeer, got %v", err)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	client, server := newPair(t)
+	defer client.Close()
+	defer server.Close()
+	port := client.Port
+	bound := make(chan uint16, 1)
+	bind := func(port uint16) error {
+		select {
+		case bound <- port:
+		default:
+		}
+		return nil
+	}
+
+	states, actions, stop := watch(&Monitor{
+		Client:       &uapi.Client{Dial: client.Dial},
+		Gateway:      &tunPinger{client, server},
+		Interval:     50 * time.Millisecond,
+		PingFailures: 2,
+		Recovery: &Policy{
+			Actions:        []Action{&Rebind{Bind: bind}, &ReResolve{Host: "127.0.0.1"}},
+			InitialBackoff: 100 * time.Millisecond,
+			MaxBackoff:     400 * time.Millisecond,
+		},
+	})
+	defer stop()
+	expectState(t, states, Healthy)
+
+	pause(t, client, server)
+	expectState(t, states, Stalled)
+	if action := <-actions; action != "rebind: ok" {
+		t.Fatalf("Unexpected first action %q", action)
+	}
+	device, err := (&uapi.Client{Dial: client.Dial}).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.ListenPort == port {
+		t.Fatalf("Tunnel was not rebound from port %d", port)
+	}
+	if bound := <-bound; bound != device.ListenPort {
+		t.Fatalf("Bound port %d rather than %d", bound, device.ListenPort)
+	}
+
+	// The old session is gone from the server, so only a new handshake
+	// recovers the tunnel
+	resume(t, client, server)
+	expectState(t, states, Healthy)
+	for len(actions) > 0 {
+		if action := <-actions; strings.HasPrefix(action, "re-resolve endpoint: ok") {
+			return
+		}
+	}
+	t.Fatal("Tunnel recovered without re-resolving")
+}
+
+func TestSwitchPort(t *testing.T) {
+	client, server := newPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// Nothing listens on the port of a closed device
+	closed, err := wgtest.NewDevice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	if err := client.Set(fmt.Sprintf("public_key=%s\nendpoint=%s\n", wgtest.HexKey(server.PublicKey()), closed.Endpoint())); err != nil {
+		t.Fatal(err)
+	}
+
+	states, _, stop := watch(&Monitor{
+		Client:       &uapi.Client{Dial: client.Dial},
+		Gateway:      &tunPinger{client, server},
+		Interval:     50 * time.Millisecond,
+		PingFailures: 1,
+		Recovery: &Policy{
+			Actions: []Action{&SwitchPort{Ranges: []guardian.PortRange{
+				{From: closed.Port, To: closed.Port},
+				{From: server.Port, To: server.Port},
+			}}},
+			InitialBackoff: 100 * time.Millisecond,
+		},
+	})
+	defer stop()
+	expectState(t, states, Stalled)
+	expectState(t, states, Healthy)
+
+	device, err := (&uapi.Client{Dial: client.Dial}).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Peers[0].Endpoint != server.Endpoint() {
+		t.Fatalf("Expected endpoint %s, got %s", server.Endpoint(), device.Peers[0].Endpoint)
+	}
+
+	switchPort := &SwitchPort{Ranges: []guardian.PortRange{{From: server.Port, To: server.Port}}}
+	if err := switchPort.Recover(context.Background(), &uapi.Client{Dial: client.Dial}); err != ErrNoOtherPort {
+		t.Fatalf("Expected ErrNoOtherPort, got %v", err)
+	}
+}
+
+type countingAction struct {
+	calls int
+}
+
+func (a *countingAction) String() string { return "count" }
+
+func (a *countingAction) Recover(ctx context.Context, client *uapi.Client) error {
+	a.calls++
+	return nil
+}
+
+func TestBackoff(t *testing.T) {
+	p := &Policy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	for attempt, expected := range []time.Duration{1, 2, 4, 8, 10, 10, 10} {
+		if backoff := p.backoff(attempt); backoff != expected*time.Second {
+			t.Errorf("Attempt %d: expected %v, got %v", attempt, expected*time.Second, backoff)
+		}
+	}
+	if backoff := (&Policy{}).backoff(100); backoff != DefaultMaxBackoff {
+		t.Errorf("Expected the default cap, got %v", backoff)
+	}
+
+	action := &countingAction{}
+	p = &Policy{Actions: []Action{action}, InitialBackoff: 100 * time.Millisecond}
+	var state recoveryState
+	p.step(context.Background(), nil, &state, nil)
+	p.step(context.Background(), nil, &state, nil)
+	if action.calls != 1 {
+		t.Fatalf("Expected the second step to wait, got %d calls", action.calls)
+	}
+	time.Sleep(150 * time.Millisecond)
+	p.step(context.Background(), nil, &state, nil)
+	if action.calls != 2 || state.attempt != 2 {
+		t.Fatalf("Expected a step after the backoff, got %d calls", action.calls)
+	}
+}
+
+func TestWake(t *testing.T) {
+	client, server := newPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	wake := make(chan struct{})
+	states, actions, stop := watch(&Monitor{
+		Client:       &uapi.Client{Dial: client.Dial},
+		Gateway:      &fakePinger{err: errors.New("Unreachable")},
+		Interval:     time.Hour,
+		PingFailures: 1,
+		Recovery: &Policy{
+			Actions:        []Action{&countingAction{}},
+			InitialBackoff: time.Hour,
+		},
+		Wake: wake,
+	})
+	defer stop()
+	expectState(t, states, Stalled)
+	<-actions
+
+	// Neither the interval nor the backoff has passed, so only waking the
+	// monitor runs the action again
+	wake <- struct{}{}
+	select {
+	case <-actions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waking did not restart recovery")
+	}
+}
+
+func TestGatewayPinger(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := (&GatewayPinger{Gateway: net.IPv4(127, 0, 0, 1)}).Ping(ctx)
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("Raw sockets are not permitted")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := OptionsPath(filepath.Join(dir, "mozvpn.conf"), "mozvpn")
+	if path != filepath.Join(dir, "mozvpn.health.json") {
+		t.Fatalf("Unexpected path %s", path)
+	}
+
+	options, err := LoadOptions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := options.Monitor(nil, "192.0.2.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Recovery.Actions) != 2 || m.Recovery.Actions[0].(*ReResolve).Host != "192.0.2.1" || m.Gateway != nil {
+		t.Fatalf("Unexpected default monitor %+v", m)
+	}
+	if _, ok := m.Recovery.Actions[1].(*Rebind); !ok {
+		t.Fatalf("Unexpected default recovery %+v", m.Recovery)
+	}
+
+	options.IntervalMs = 1000
+	options.SetServer(&guardian.Server{Hostname: "us1-wireguard", Ipv4Gateway: "10.64.0.1", PortRanges: [][]int{{53, 53}, {4000, 33433}}})
+	if err := options.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if options, err = LoadOptions(path); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = options.Monitor(nil, "192.0.2.1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if m.Interval != time.Second || !m.Gateway.(*GatewayPinger).Gateway.Equal(net.IPv4(10, 64, 0, 1)) {
+		t.Fatalf("Unexpected monitor %+v", m)
+	}
+	if len(m.Recovery.Actions) != 3 || m.Recovery.Actions[0].(*ReResolve).Host != "192.0.2.1" || len(m.Recovery.Actions[2].(*SwitchPort).Ranges) != 2 {
+		t.Fatalf("Unexpected recovery %+v", m.Recovery)
+	}
+
+	js := `{"hostname": "us1.example.com", "ping_failures": 5}`
+	if err := ioutil.WriteFile(path, []byte(js), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if options, err = LoadOptions(path); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = options.Monitor(nil, "192.0.2.1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if m.PingFailures != 5 || m.Recovery.Actions[0].(*ReResolve).Host != "us1.example.com" {
+		t.Fatalf("Unexpected monitor %+v", m)
+	}
+
+	for _, invalid := range []*Options{{Gateway: "fc00::1"}, {PortRanges: [][]int{{1, 2, 3}}}} {
+		if _, err := invalid.Monitor(nil, "192.0.2.1", nil); err == nil {
+			t.Errorf("Expected an error for %+v", invalid)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/guardian"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/uapi"
+)
+
+var ErrInvalidGateway = errors.New("The gateway must be an IPv4 address")
+
+// Options configure the monitor of the tunnel service. They are read from a
+// file next to the configuration of the tunnel, as wg-quick configurations
+// have no place for them. Zero fields take their defaults.
+type Options struct {
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Gateway is the IPv4 gateway of the server, which is pinged through the
+	// tunnel. Without it, only handshakes are checked.
+	Gateway string `json:"ipv4_gateway,omitempty"`
+
+	// Hostname is looked up again by the re-resolve action. It defaults to
+	// the host of the endpoint.
+	Hostname string `json:"hostname,omitempty"`
+
+	// PortRanges enable the switch port action, in the format of the server
+	// list.
+	PortRanges [][]int `json:"port_ranges,omitempty"`
+
+	IntervalMs       int `json:"interval_ms,omitempty"`
+	DegradedAfterMs  int `json:"degraded_after_ms,omitempty"`
+	StalledAfterMs   int `json:"stalled_after_ms,omitempty"`
+	PingFailures     int `json:"ping_failures,omitempty"`
+	InitialBackoffMs int `json:"initial_backoff_ms,omitempty"`
+	MaxBackoffMs     int `json:"max_backoff_ms,omitempty"`
+}
+
+// OptionsPath returns the path of the options of the tunnel with the given
+// configuration.
+func OptionsPath(configPath string, tunnelName string) string {
+	return filepath.Join(filepath.Dir(configPath), tunnelName+".health.json")
+}
+
+// LoadOptions reads options from a file. A missing file is no options.
+func LoadOptions(path string) (*Options, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Options{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var options Options
+	if err := json.Unmarshal(data, &options); err != nil {
+		return nil, err
+	}
+	return &options, nil
+}
+
+// SetServer takes the gateway and port ranges of the tunnel from the entry of
+// its server in the server list.
+func (o *Options) SetServer(server *guardian.Server) {
+	o.Gateway = server.Ipv4Gateway
+	o.PortRanges = server.PortRanges
+}
+
+// Save writes options to a file.
+func (o *Options) Save(path string) error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func milliseconds(ms int) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Monitor returns a monitor of the tunnel behind client, whose endpoint host
+// is given, with every recovery action the options allow. bind sets up the
+// sockets of a new listen port, as in Rebind.
+func (o *Options) Monitor(client *uapi.Client, endpointHost string, bind func(port uint16) error) (*Monitor, error) {
+	var gateway Pinger
+	if o.Gateway != "" {
+		ip := net.ParseIP(o.Gateway).To4()
+		if ip == nil {
+			return nil, ErrInvalidGateway
+		}
+		gateway = &GatewayPinger{Gateway: ip}
+	}
+	hostname := endpointHost
+	if o.Hostname != "" {
+		hostname = o.Hostname
+	}
+
+	policy := &Policy{
+		Actions:        []Action{&ReResolve{Host: hostname}, &Rebind{Bind: bind}},
+		InitialBackoff: milliseconds(o.InitialBackoffMs),
+		MaxBackoff:     milliseconds(o.MaxBackoffMs),
+	}
+	if len(o.PortRanges) > 0 {
+		server := guardian.Server{PortRanges: o.PortRanges}
+		ranges, err := server.Ports()
+		if err != nil {
+			return nil, err
+		}
+		policy.Actions = append(policy.Actions, &SwitchPort{Ranges: ranges})
+	}
+
+	return &Monitor{
+		Client:        client,
+		Gateway:       gateway,
+		Recovery:      policy,
+		Interval:      milliseconds(o.IntervalMs),
+		DegradedAfter: milliseconds(o.DegradedAfterMs),
+		StalledAfter:  milliseconds(o.StalledAfterMs),
+		PingFailures:  o.PingFailures,
+	}, nil
+}
@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package health
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// GatewayPinger sends ICMP echo requests to the gateway of the tunnel. It
+// needs a raw socket, which the tunnel service is allowed to open.
+type GatewayPinger struct {
+	Gateway net.IP
+}
+
+func (p *GatewayPinger) Ping(ctx context.Context) error {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultInterval)
+	}
+	conn.SetDeadline(deadline)
+
+	id, seq := os.Getpid()&0xffff, rand.Intn(0xffff)
+	request, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("guardian health")},
+	}).Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteTo(request, &net.IPAddr{IP: p.Gateway}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(reply)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if addr, ok := peer.(*net.IPAddr); !ok || !addr.IP.Equal(p.Gateway) {
+			continue
+		}
+		msg, err := icmp.ParseMessage(1, reply[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := msg.Body.(*icmp.Echo); ok && echo.ID == id && echo.Seq == seq {
+			return nil
+		}
+	}
+}
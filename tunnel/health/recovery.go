@@ -0,0 +1,237 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package health
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/guardian"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/reconfig"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/uapi"
+)
+
+const (
+	// DefaultInitialBackoff is the wait after the first recovery action.
+	DefaultInitialBackoff = 5 * time.Second
+
+	// DefaultMaxBackoff caps the doubling wait between recovery actions.
+	DefaultMaxBackoff = 5 * time.Minute
+)
+
+var (
+	ErrNoAddress   = errors.New("The endpoint host has no address")
+	ErrNoOtherPort = errors.New("The port ranges have no other port")
+)
+
+// Action is a step to recover a stalled tunnel.
+type Action interface {
+	Recover(ctx context.Context, client *uapi.Client) error
+	String() string
+}
+
+// Policy runs its actions in turn while the tunnel is stalled, waiting twice
+// as long after each one, up to MaxBackoff. The wait starts over once the
+// tunnel is healthy.
+type Policy struct {
+	Actions []Action
+
+	// InitialBackoff and MaxBackoff override DefaultInitialBackoff and
+	// DefaultMaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+type recoveryState struct {
+	attempt int
+	next    time.Time
+}
+
+// backoff returns the wait after an attempt.
+func (p *Policy) backoff(attempt int) time.Duration {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = DefaultInitialBackoff
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	backoff := initial
+	for i := 0; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// step runs the next action when the backoff of the last one has passed.
+// The action has until the end of its backoff to finish.
+func (p *Policy) step(ctx context.Context, client *uapi.Client, state *recoveryState, report func(Action, error)) {
+	if len(p.Actions) == 0 || time.Now().Before(state.next) {
+		return
+	}
+	action := p.Actions[state.attempt%len(p.Actions)]
+	backoff := p.backoff(state.attempt)
+	state.attempt++
+
+	actionCtx, cancel := context.WithTimeout(ctx, backoff)
+	err := action.Recover(actionCtx, client)
+	cancel()
+	state.next = time.Now().Add(backoff)
+	if report != nil {
+		report(action, err)
+	}
+}
+
+// endpoint returns the host and port of the endpoint of the peer.
+func endpoint(client *uapi.Client) (string, int, error) {
+	device, err := client.Get()
+	if err != nil {
+		return "", 0, err
+	}
+	defer device.Zero()
+	if len(device.Peers) == 0 {
+		return "", 0, ErrNoPeer
+	}
+	host, port, err := net.SplitHostPort(device.Peers[0].Endpoint)
+	if err != nil {
+		return "", 0, uapi.ErrInvalidEndpoint
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, uapi.ErrInvalidEndpoint
+	}
+	return host, portNumber, nil
+}
+
+// moveEndpoint points the peer at a new endpoint, which has to handshake
+// before ctx is done, or the old one is restored.
+func moveEndpoint(ctx context.Context, client *uapi.Client, host string, port int) error {
+	reconfigurer := &reconfig.Reconfigurer{Client: client}
+	return reconfigurer.Apply(ctx, &reconfig.Change{Endpoint: net.JoinHostPort(host, strconv.Itoa(port))})
+}
+
+// ReResolve looks up Host again and handshakes with its address, as when the
+// server moved, or the tunnel roamed to an address the server cannot reach.
+// A zero Port keeps the port of the current endpoint.
+type ReResolve struct {
+	Host string
+	Port int
+
+	// Resolver defaults to the system resolver.
+	Resolver *net.Resolver
+}
+
+func (r *ReResolve) String() string { return "re-resolve endpoint" }
+
+func (r *ReResolve) Recover(ctx context.Context, client *uapi.Client) error {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, r.Host)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return ErrNoAddress
+	}
+	ip := addrs[0].IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			ip = addr.IP
+			break
+		}
+	}
+
+	port := r.Port
+	if port == 0 {
+		if _, port, err = endpoint(client); err != nil {
+			return err
+		}
+	}
+	return moveEndpoint(ctx, client, ip.String(), port)
+}
+
+// Rebind moves the tunnel to a new local port, as when a NAT dropped the
+// mapping of the old one.
+type Rebind struct {
+	// Bind is given the new port, to set up the new sockets as the old ones
+	// were, such as binding them to the default interface.
+	Bind func(port uint16) error
+}
+
+func (r *Rebind) String() string { return "rebind" }
+
+func (r *Rebind) Recover(ctx context.Context, client *uapi.Client) error {
+	var random uint16
+	if err := client.Set(&uapi.Config{ListenPort: &random}); err != nil {
+		return err
+	}
+	if r.Bind == nil {
+		return nil
+	}
+	device, err := client.Get()
+	if err != nil {
+		return err
+	}
+	defer device.Zero()
+	return r.Bind(device.ListenPort)
+}
+
+// SwitchPort handshakes with another port of the endpoint, as when a network
+// blocks the current one.
+type SwitchPort struct {
+	Ranges []guardian.PortRange
+
+	// Rand picks the port, and defaults to the global source.
+	Rand *rand.Rand
+}
+
+func (s *SwitchPort) String() string { return "switch port" }
+
+func (s *SwitchPort) Recover(ctx context.Context, client *uapi.Client) error {
+	host, current, err := endpoint(client)
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, r := range s.Ranges {
+		total += r.Size()
+		if r.Contains(current) {
+			total--
+		}
+	}
+	if total <= 0 {
+		return ErrNoOtherPort
+	}
+
+	var pick int
+	if s.Rand != nil {
+		pick = s.Rand.Intn(total)
+	} else {
+		pick = rand.Intn(total)
+	}
+	for _, r := range s.Ranges {
+		for port := int(r.From); port <= int(r.To); port++ {
+			if port == current {
+				continue
+			}
+			if pick == 0 {
+				return moveEndpoint(ctx, client, host, port)
+			}
+			pick--
+		}
+	}
+	return ErrNoOtherPort
+}
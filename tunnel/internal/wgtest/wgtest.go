@@ -0,0 +1,212 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package wgtest runs wireguard-go devices on in-memory TUNs for tests.
+package wgtest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+)
+
+// TUN is a TUN device backed by channels. Packets sent to Outbound are read
+// by the device, and packets written by the device are sent to Inbound.
+type TUN struct {
+	Inbound  chan []byte
+	Outbound chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	events    chan tun.Event
+}
+
+// NewTUN returns a TUN that is up.
+func NewTUN() *TUN {
+	t := &TUN{
+		Inbound:  make(chan []byte, 64),
+		Outbound: make(chan []byte),
+		closed:   make(chan struct{}),
+		events:   make(chan tun.Event, 1),
+	}
+	t.events <- tun.EventUp
+	return t
+}
+
+func (t *TUN) File() *os.File { return nil }
+
+func (t *TUN) Read(buf []byte, offset int) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, os.ErrClosed
+	case packet := <-t.Outbound:
+		return copy(buf[offset:], packet), nil
+	}
+}
+
+func (t *TUN) Write(buf []byte, offset int) (int, error) {
+	packet := make([]byte, len(buf)-offset)
+	copy(packet, buf[offset:])
+	select {
+	case <-t.closed:
+		return 0, os.ErrClosed
+	case t.Inbound <- packet:
+	default:
+		// Drop packets that no test is waiting for
+	}
+	return len(packet), nil
+}
+
+func (t *TUN) Flush() error           { return nil }
+func (t *TUN) MTU() (int, error)      { return device.DefaultMTU, nil }
+func (t *TUN) Name() (string, error)  { return "wgtest0", nil }
+func (t *TUN) Events() chan tun.Event { return t.events }
+
+func (t *TUN) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		close(t.events)
+	})
+	return nil
+}
+
+// Device is a wireguard-go device listening on a random UDP port.
+type Device struct {
+	*device.Device
+	TUN        *TUN
+	PrivateKey keys.Key
+	Port       uint16
+}
+
+// HexKey returns the hex encoding of a key used by UAPI.
+func HexKey(k *keys.Key) string {
+	return hex.EncodeToString(k[:])
+}
+
+// NewDevice starts a device with a new private key.
+func NewDevice() (*Device, error) {
+	key, err := keys.NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	discard := log.New(ioutil.Discard, "", 0)
+	d := &Device{TUN: NewTUN(), PrivateKey: *key}
+	d.Device = device.NewDevice(d.TUN, &device.Logger{Debug: discard, Info: discard, Error: discard})
+	d.Up()
+	if err := d.Set(fmt.Sprintf("private_key=%s\nlisten_port=0\n", HexKey(key))); err != nil {
+		d.Close()
+		return nil, err
+	}
+	get, err := d.Get()
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	for _, line := range strings.Split(get, "\n") {
+		if strings.HasPrefix(line, "listen_port=") {
+			port, _ := strconv.ParseUint(strings.TrimPrefix(line, "listen_port="), 10, 16)
+			d.Port = uint16(port)
+		}
+	}
+	if d.Port == 0 {
+		d.Close()
+		return nil, fmt.Errorf("Device did not bind a port")
+	}
+	return d, nil
+}
+
+// PublicKey returns the public key of the device.
+func (d *Device) PublicKey() *keys.Key {
+	return d.PrivateKey.Public()
+}
+
+// Endpoint returns the loopback endpoint of the device.
+func (d *Device) Endpoint() string {
+	return fmt.Sprintf("127.0.0.1:%d", d.Port)
+}
+
+// Set applies a UAPI set operation, without the set=1 line.
+func (d *Device) Set(uapi string) error {
+	if err := d.IpcSetOperation(bufio.NewReader(strings.NewReader(uapi))); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get returns the response of a UAPI get operation, without the errno line.
+func (d *Device) Get() (string, error) {
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	if err := d.IpcGetOperation(w); err != nil {
+		return "", err
+	}
+	w.Flush()
+	return b.String(), nil
+}
+
+// Dial returns a connection to the UAPI handler of the device, like the named
+// pipe or unix socket of a real tunnel.
+func (d *Device) Dial() (io.ReadWriteCloser, error) {
+	client, server := net.Pipe()
+	go d.IpcHandle(server)
+	return client, nil
+}
+
+// Connect makes a and b peers of each other over loopback, with a routing
+// 10.0.0.1 and b routing 10.0.0.2.
+func Connect(a, b *Device) error {
+	if err := a.Set(fmt.Sprintf("public_key=%s\nendpoint=%s\nallowed_ip=10.0.0.2/32\n", HexKey(b.PublicKey()), b.Endpoint())); err != nil {
+		return err
+	}
+	return b.Set(fmt.Sprintf("public_key=%s\nendpoint=%s\nallowed_ip=10.0.0.1/32\n", HexKey(a.PublicKey()), a.Endpoint()))
+}
+
+// Ping returns an ICMP echo request from src to dst with a payload of size
+// bytes.
+func Ping(src, dst net.IP, size int) []byte {
+	const headerLength = 20 + 8
+	packet := make([]byte, headerLength+size)
+	ip, icmp := packet[:20], packet[20:]
+
+	icmp[0] = 8
+	binary.BigEndian.PutUint16(icmp[2:], ^checksum(icmp))
+
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+	ip[8] = 64
+	ip[9] = 1
+	copy(ip[12:], src.To4())
+	copy(ip[16:], dst.To4())
+	binary.BigEndian.PutUint16(ip[10:], ^checksum(ip))
+	return packet
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package keys generates, derives and encodes WireGuard Curve25519 keys.
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// KeyLength is the length of WireGuard private, public and preshared keys.
+const KeyLength = 32
+
+// Key is a WireGuard private, public or preshared key.
+type Key [KeyLength]byte
+
+var ErrInvalidKey = errors.New("Keys must decode to exactly 32 bytes")
+
+var random io.Reader = rand.Reader
+
+func newRandomKey() (*Key, error) {
+	k := new(Key)
+	if _, err := io.ReadFull(random, k[:]); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// NewPrivateKey returns a new clamped private key.
+func NewPrivateKey() (*Key, error) {
+	k, err := newRandomKey()
+	if err != nil {
+		return nil, err
+	}
+	k.clamp()
+	return k, nil
+}
+
+// NewPresharedKey returns a new random preshared key.
+func NewPresharedKey() (*Key, error) {
+	return newRandomKey()
+}
+
+// NewKeyFromString decodes and validates a base64 encoded key.
+func NewKeyFromString(b64 string) (*Key, error) {
+	if len(b64) != base64.StdEncoding.EncodedLen(KeyLength) {
+		return nil, ErrInvalidKey
+	}
+	b, err := base64.StdEncoding.Strict().DecodeString(b64)
+	if err != nil || len(b) != KeyLength {
+		return nil, ErrInvalidKey
+	}
+	k := new(Key)
+	copy(k[:], b)
+	return k, nil
+}
+
+func (k *Key) clamp() {
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+}
+
+// Public derives the public key of a private key.
+func (k *Key) Public() *Key {
+	var p Key
+	curve25519.ScalarBaseMult((*[KeyLength]byte)(&p), (*[KeyLength]byte)(k))
+	return &p
+}
+
+// String returns the base64 encoding of the key.
+func (k *Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// MarshalText encodes the key as base64, so that keys are base64 in JSON.
+func (k Key) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes and validates a base64 encoded key.
+func (k *Key) UnmarshalText(text []byte) error {
+	decoded, err := NewKeyFromString(string(text))
+	if err != nil {
+		return err
+	}
+	*k = *decoded
+	decoded.Zero()
+	return nil
+}
+
+// IsZero reports whether the key is all zeros, in constant time.
+func (k *Key) IsZero() bool {
+	var zero Key
+	return subtle.ConstantTimeCompare(k[:], zero[:]) == 1
+}
+
+// Zero overwrites the key with zeros.
+func (k *Key) Zero() {
+	for i := range k {
+		k[i] = 0
+	}
+}
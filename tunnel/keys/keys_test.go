@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("Entropy source failed")
+}
+
+func hexKey(t *testing.T, s string) *Key {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != KeyLength {
+		t.Fatalf("Bad test vector %q", s)
+	}
+	k := new(Key)
+	copy(k[:], b)
+	return k
+}
+
+func TestPublic(t *testing.T) {
+	// RFC 7748, section 6.1
+	vectors := []struct{ private, public string }{
+		{"77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a", "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"},
+		{"5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb", "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"},
+	}
+	for _, vector := range vectors {
+		public := hexKey(t, vector.private).Public()
+		if *public != *hexKey(t, vector.public) {
+			t.Fatalf("Expected %s, got %x", vector.public, public[:])
+		}
+	}
+}
+
+func TestNewKeyFromString(t *testing.T) {
+	const encoded = "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="
+	k, err := NewKeyFromString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *k != *hexKey(t, "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a") || k.String() != encoded {
+		t.Fatalf("Unexpected key %x", k[:])
+	}
+
+	for _, invalid := range []string{
+		"",
+		"TestAddDevice",
+		"hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo",
+		"hSDwCYkwp1R0i33ctD73Wg2_Og0mOBr066SpjqqbTmo=",
+		"hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmp=",
+		"hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo=\n",
+		"hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmoA",
+	} {
+		if _, err := NewKeyFromString(invalid); err != ErrInvalidKey {
+			t.Fatalf("Expected %q to be rejected, got %v", invalid, err)
+		}
+	}
+}
+
+func TestNewPrivateKey(t *testing.T) {
+	k, err := NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k[0]&7 != 0 || k[31]&128 != 0 || k[31]&64 == 0 {
+		t.Fatalf("Private key is not clamped: %x", k[:])
+	}
+	if k.IsZero() || k.Public().IsZero() {
+		t.Fatal("Generated key is zero")
+	}
+	k.Zero()
+	if !k.IsZero() {
+		t.Fatal("Key was not zeroed")
+	}
+}
+
+func TestRandomFailure(t *testing.T) {
+	random = failingReader{}
+	defer func() { random = rand.Reader }()
+	if _, err := NewPrivateKey(); err == nil {
+		t.Fatal("Expected private key generation to fail")
+	}
+	if _, err := NewPresharedKey(); err == nil {
+		t.Fatal("Expected preshared key generation to fail")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var v struct {
+		Key Key `json:"key"`
+	}
+	if err := json.Unmarshal([]byte(`{"key":"hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil || string(b) != `{"key":"hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="}` {
+		t.Fatalf("Unexpected JSON %s: %v", b, err)
+	}
+	if err := json.Unmarshal([]byte(`{"key":"hSDwCYkw"}`), &v); err == nil {
+		t.Fatal("Expected an invalid key to fail")
+	}
+}
@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package keystore
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrInsecureStoreDir = errors.New("Key store directory must be owned by its user, and only give access to it and SYSTEM")
+
+// sddlSID returns how SDDL writes a string SID. SYSTEM has an alias.
+func sddlSID(sid string) string {
+	if sid == "S-1-5-18" {
+		return "SY"
+	}
+	return sid
+}
+
+// storeDirSDDL returns the security descriptor of a store directory of the
+// user of sid: owned by it, and only giving access to it and SYSTEM, with
+// nothing inherited from the parent.
+func storeDirSDDL(sid string) string {
+	user := sddlSID(sid)
+	return "O:" + user + "D:P(A;OICI;FA;;;SY)(A;OICI;FA;;;" + user + ")"
+}
+
+// checkStoreDirSDDL checks the owner and DACL of an existing store
+// directory, in SDDL form, against what storeDirSDDL creates for the user of
+// sid. Other rights and deny entries are fine, but the directory must be
+// owned by the user, must not inherit from its parent, and must not allow
+// anyone but the user and SYSTEM.
+func checkStoreDirSDDL(sddl string, sid string) error {
+	user := sddlSID(sid)
+	dacl := strings.Index(sddl, "D:")
+	if !strings.HasPrefix(sddl, "O:") || dacl < 0 || sddl[2:dacl] != user {
+		return ErrInsecureStoreDir
+	}
+	entries := sddl[dacl+2:]
+	flags := entries
+	if i := strings.IndexByte(entries, '('); i >= 0 {
+		flags, entries = entries[:i], entries[i:]
+	} else {
+		entries = ""
+	}
+	if !strings.Contains(flags, "P") || strings.Contains(flags, "NO_ACCESS_CONTROL") {
+		return ErrInsecureStoreDir
+	}
+	for entries != "" {
+		end := strings.IndexByte(entries, ')')
+		if entries[0] != '(' || end < 0 {
+			return ErrInsecureStoreDir
+		}
+		fields := strings.Split(entries[1:end], ";")
+		entries = entries[end+1:]
+		if len(fields) < 6 {
+			return ErrInsecureStoreDir
+		}
+		if fields[0] == "D" {
+			continue
+		}
+		if trustee := fields[5]; trustee != "SY" && trustee != user {
+			return ErrInsecureStoreDir
+		}
+	}
+	return nil
+}
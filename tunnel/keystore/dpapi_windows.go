@@ -0,0 +1,197 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package keystore
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	cryptProtectUIForbidden  = 0x1
+	cryptProtectLocalMachine = 0x4
+
+	sddlRevision1            = 1
+	seFileObject             = 1
+	ownerSecurityInformation = 0x1
+	daclSecurityInformation  = 0x4
+)
+
+var (
+	modcrypt32             = windows.NewLazySystemDLL("crypt32.dll")
+	procCryptProtectData   = modcrypt32.NewProc("CryptProtectData")
+	procCryptUnprotectData = modcrypt32.NewProc("CryptUnprotectData")
+
+	modadvapi32                                              = windows.NewLazySystemDLL("advapi32.dll")
+	procConvertStringSecurityDescriptorToSecurityDescriptorW = modadvapi32.NewProc("ConvertStringSecurityDescriptorToSecurityDescriptorW")
+	procConvertSecurityDescriptorToStringSecurityDescriptorW = modadvapi32.NewProc("ConvertSecurityDescriptorToStringSecurityDescriptorW")
+	procGetNamedSecurityInfoW                                = modadvapi32.NewProc("GetNamedSecurityInfoW")
+
+	modkernel32          = windows.NewLazySystemDLL("kernel32.dll")
+	procCreateDirectoryW = modkernel32.NewProc("CreateDirectoryW")
+)
+
+type dataBlob struct {
+	size uint32
+	data *byte
+}
+
+func newDataBlob(b []byte) *dataBlob {
+	if len(b) == 0 {
+		return &dataBlob{}
+	}
+	return &dataBlob{size: uint32(len(b)), data: &b[0]}
+}
+
+// bytes copies the blob out and frees it, zeroing the system copy first.
+func (b *dataBlob) bytes() []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(b.data)))
+	system := (*[1 << 30]byte)(unsafe.Pointer(b.data))[:b.size:b.size]
+	out := append([]byte(nil), system...)
+	Zero(system)
+	return out
+}
+
+// DPAPISealer seals with the Windows data protection API. Entropy, when set,
+// must also be given to open.
+type DPAPISealer struct {
+	// LocalMachine lets any account on the machine open sealed values, so
+	// that the tunnel service, which runs as SYSTEM, can load keys stored by
+	// the client. The store directory then has to be protected by its ACL.
+	LocalMachine bool
+
+	Entropy []byte
+}
+
+func (s *DPAPISealer) flags() uintptr {
+	flags := uintptr(cryptProtectUIForbidden)
+	if s.LocalMachine {
+		flags |= cryptProtectLocalMachine
+	}
+	return flags
+}
+
+func (s *DPAPISealer) Seal(plaintext []byte) ([]byte, error) {
+	description, err := windows.UTF16PtrFromString("Mozilla VPN private key")
+	if err != nil {
+		return nil, err
+	}
+	var out dataBlob
+	r, _, err := procCryptProtectData.Call(uintptr(unsafe.Pointer(newDataBlob(plaintext))), uintptr(unsafe.Pointer(description)), uintptr(unsafe.Pointer(newDataBlob(s.Entropy))), 0, 0, s.flags(), uintptr(unsafe.Pointer(&out)))
+	runtime.KeepAlive(plaintext)
+	runtime.KeepAlive(s.Entropy)
+	if r == 0 {
+		return nil, err
+	}
+	return out.bytes(), nil
+}
+
+func (s *DPAPISealer) Open(sealed []byte) ([]byte, error) {
+	var out dataBlob
+	r, _, _ := procCryptUnprotectData.Call(uintptr(unsafe.Pointer(newDataBlob(sealed))), 0, uintptr(unsafe.Pointer(newDataBlob(s.Entropy))), 0, 0, s.flags(), uintptr(unsafe.Pointer(&out)))
+	runtime.KeepAlive(sealed)
+	runtime.KeepAlive(s.Entropy)
+	if r == 0 {
+		return nil, ErrCorrupt
+	}
+	return out.bytes(), nil
+}
+
+// NewDPAPIStore returns a store in dir sealed with machine scoped DPAPI. The
+// directory must have been created by CreateDPAPIStoreDir.
+func NewDPAPIStore(dir string) *FileStore {
+	return NewFileStore(dir, &DPAPISealer{LocalMachine: true})
+}
+
+type securityAttributes struct {
+	length             uint32
+	securityDescriptor uintptr
+	inheritHandle      uint32
+}
+
+// currentUserSID returns the SID of the user of the process in string form.
+func currentUserSID() (string, error) {
+	token, err := windows.OpenCurrentProcessToken()
+	if err != nil {
+		return "", err
+	}
+	defer token.Close()
+	user, err := token.GetTokenUser()
+	if err != nil {
+		return "", err
+	}
+	var sid16 *uint16
+	if err := windows.ConvertSidToStringSid(user.User.Sid, &sid16); err != nil {
+		return "", err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(sid16)))
+	return windows.UTF16ToString((*[(1 << 30) - 1]uint16)(unsafe.Pointer(sid16))[:]), nil
+}
+
+// CreateDPAPIStoreDir creates the directory of a DPAPI store, owned by the
+// user that creates it, with a DACL that only gives access to SYSTEM, which
+// runs the tunnel service, and to that user. Machine scoped DPAPI lets any
+// account open sealed keys, so this ACL is what keeps them private. An
+// existing directory is used only if its owner and DACL are still so, and is
+// never re-ACLed, so that another user cannot take over a store.
+func CreateDPAPIStoreDir(dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return err
+	}
+	sid, err := currentUserSID()
+	if err != nil {
+		return err
+	}
+	sddl16, err := windows.UTF16PtrFromString(storeDirSDDL(sid))
+	if err != nil {
+		return err
+	}
+	var sd uintptr
+	r, _, err := procConvertStringSecurityDescriptorToSecurityDescriptorW.Call(uintptr(unsafe.Pointer(sddl16)), sddlRevision1, uintptr(unsafe.Pointer(&sd)), 0)
+	if r == 0 {
+		return err
+	}
+	defer windows.LocalFree(windows.Handle(sd))
+
+	dir16, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return err
+	}
+	sa := securityAttributes{length: uint32(unsafe.Sizeof(securityAttributes{})), securityDescriptor: sd}
+	r, _, err = procCreateDirectoryW.Call(uintptr(unsafe.Pointer(dir16)), uintptr(unsafe.Pointer(&sa)))
+	if r != 0 {
+		return nil
+	}
+	if err != windows.ERROR_ALREADY_EXISTS {
+		return err
+	}
+	existing, err := directorySDDL(dir16)
+	if err != nil {
+		return err
+	}
+	return checkStoreDirSDDL(existing, sid)
+}
+
+// directorySDDL returns the owner and DACL of a directory in SDDL form.
+func directorySDDL(dir16 *uint16) (string, error) {
+	var owner, dacl, sd uintptr
+	r, _, _ := procGetNamedSecurityInfoW.Call(uintptr(unsafe.Pointer(dir16)), seFileObject, ownerSecurityInformation|daclSecurityInformation, uintptr(unsafe.Pointer(&owner)), 0, uintptr(unsafe.Pointer(&dacl)), 0, uintptr(unsafe.Pointer(&sd)))
+	if r != 0 {
+		return "", windows.Errno(r)
+	}
+	defer windows.LocalFree(windows.Handle(sd))
+	var sddl16 *uint16
+	r, _, err := procConvertSecurityDescriptorToStringSecurityDescriptorW.Call(sd, sddlRevision1, ownerSecurityInformation|daclSecurityInformation, uintptr(unsafe.Pointer(&sddl16)), 0)
+	if r == 0 {
+		return "", err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(sddl16)))
+	return windows.UTF16ToString((*[(1 << 30) - 1]uint16)(unsafe.Pointer(sddl16))[:]), nil
+}
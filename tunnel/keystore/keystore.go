@@ -0,0 +1,248 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package keystore keeps device private keys encrypted at rest, so that the
+// tunnel can load them by reference instead of from plaintext configs.
+package keystore
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+)
+
+var (
+	ErrNotFound       = errors.New("Key is not in the store")
+	ErrInvalidRef     = errors.New("Key references must be an account, optionally followed by #version")
+	ErrInvalidAccount = errors.New("Account must not be empty")
+	ErrCorrupt        = errors.New("Stored key is corrupt or was sealed with another secret")
+)
+
+// Ref names a stored key. A zero Version is the latest version of the
+// account.
+type Ref struct {
+	Account string
+	Version int
+}
+
+// ParseRef parses a reference in the "account#version" form returned by
+// String. Without a version, it refers to the latest one.
+func ParseRef(s string) (Ref, error) {
+	account, version := s, ""
+	if i := strings.LastIndexByte(s, '#'); i >= 0 {
+		account, version = s[:i], s[i+1:]
+	}
+	ref := Ref{Account: account}
+	if version != "" || len(account) < len(s) {
+		v, err := strconv.Atoi(version)
+		if err != nil || v <= 0 {
+			return Ref{}, ErrInvalidRef
+		}
+		ref.Version = v
+	}
+	if ref.Account == "" {
+		return Ref{}, ErrInvalidRef
+	}
+	return ref, nil
+}
+
+func (r Ref) String() string {
+	if r.Version == 0 {
+		return r.Account
+	}
+	return r.Account + "#" + strconv.Itoa(r.Version)
+}
+
+// Store keeps versioned private keys per account. Putting a key for an
+// account adds a version rather than replacing the key, so that a rotation
+// can be rolled back until the old version is deleted.
+type Store interface {
+	// Put stores a copy of key as the next version of the account.
+	Put(account string, key *keys.Key) (Ref, error)
+
+	// Get returns the key of a reference. The caller zeroes it after use.
+	Get(ref Ref) (*keys.Key, error)
+
+	// Versions returns the stored versions of an account, oldest first.
+	Versions(account string) ([]int, error)
+
+	// Delete removes a version, or all versions of the account when the
+	// version is zero.
+	Delete(ref Ref) error
+}
+
+// Sealer encrypts stored keys. Sealed data must be authenticated, so that
+// Open fails on corrupt data or with the wrong secret.
+type Sealer interface {
+	Seal(plaintext []byte) ([]byte, error)
+	Open(sealed []byte) ([]byte, error)
+}
+
+// Load returns the key of a reference in the form returned by Ref.String.
+func Load(store Store, ref string) (*keys.Key, error) {
+	r, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(r)
+}
+
+// Zero overwrites a buffer with zeros.
+func Zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// FileStore keeps each version in its own file, sealed by Sealer, under
+// Dir/<account>/<version>.key. Accounts are encoded, so any name is safe.
+type FileStore struct {
+	Dir    string
+	Sealer Sealer
+}
+
+// NewFileStore returns a store in dir.
+func NewFileStore(dir string, sealer Sealer) *FileStore {
+	return &FileStore{Dir: dir, Sealer: sealer}
+}
+
+const keyExtension = ".key"
+
+func (s *FileStore) accountDir(account string) (string, error) {
+	if account == "" {
+		return "", ErrInvalidAccount
+	}
+	return filepath.Join(s.Dir, base64.RawURLEncoding.EncodeToString([]byte(account))), nil
+}
+
+func (s *FileStore) Put(account string, key *keys.Key) (Ref, error) {
+	dir, err := s.accountDir(account)
+	if err != nil {
+		return Ref{}, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return Ref{}, err
+	}
+	sealed, err := s.Sealer.Seal(key[:])
+	if err != nil {
+		return Ref{}, err
+	}
+
+	// Creating the file exclusively claims the version, so concurrent puts
+	// get different versions
+	for {
+		versions, err := s.Versions(account)
+		if err != nil {
+			return Ref{}, err
+		}
+		version := 1
+		if len(versions) > 0 {
+			version = versions[len(versions)-1] + 1
+		}
+		path := filepath.Join(dir, strconv.Itoa(version)+keyExtension)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return Ref{}, err
+		}
+		_, err = file.Write(sealed)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+			return Ref{}, err
+		}
+		return Ref{Account: account, Version: version}, nil
+	}
+}
+
+func (s *FileStore) Get(ref Ref) (*keys.Key, error) {
+	dir, err := s.accountDir(ref.Account)
+	if err != nil {
+		return nil, err
+	}
+	version := ref.Version
+	if version == 0 {
+		versions, err := s.Versions(ref.Account)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			return nil, ErrNotFound
+		}
+		version = versions[len(versions)-1]
+	}
+
+	sealed, err := ioutil.ReadFile(filepath.Join(dir, strconv.Itoa(version)+keyExtension))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	plaintext, err := s.Sealer.Open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(plaintext)
+	if len(plaintext) != keys.KeyLength {
+		return nil, ErrCorrupt
+	}
+	key := new(keys.Key)
+	copy(key[:], plaintext)
+	return key, nil
+}
+
+func (s *FileStore) Versions(account string) ([]int, error) {
+	dir, err := s.accountDir(account)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var versions []int
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, keyExtension) {
+			continue
+		}
+		version, err := strconv.Atoi(strings.TrimSuffix(name, keyExtension))
+		if err == nil && version > 0 {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+func (s *FileStore) Delete(ref Ref) error {
+	dir, err := s.accountDir(ref.Account)
+	if err != nil {
+		return err
+	}
+	if ref.Version == 0 {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return os.RemoveAll(dir)
+	}
+	err = os.Remove(filepath.Join(dir, strconv.Itoa(ref.Version)+keyExtension))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
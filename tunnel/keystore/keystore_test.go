@@ -0,0 +1,234 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package keystore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+)
+
+func init() {
+	scryptCost = 1 << 4
+}
+
+func newStore(t *testing.T, passphrase string) (*FileStore, func()) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer, err := NewPassphraseSealer([]byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFileStore(dir, sealer), func() { os.RemoveAll(dir) }
+}
+
+func newKey(t *testing.T) *keys.Key {
+	key, err := keys.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestFileStore(t *testing.T) {
+	store, cleanup := newStore(t, "correct horse")
+	defer cleanup()
+
+	first, second := newKey(t), newKey(t)
+	ref, err := store.Put("user@example.com", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != (Ref{"user@example.com", 1}) {
+		t.Fatalf("Unexpected first ref %v", ref)
+	}
+	if ref, err = store.Put("user@example.com", second); err != nil || ref.Version != 2 {
+		t.Fatalf("Unexpected second ref %v: %v", ref, err)
+	}
+	if _, err := store.Put("other@example.com", second); err != nil {
+		t.Fatal(err)
+	}
+
+	for ref, expected := range map[string]*keys.Key{
+		"user@example.com#1": first,
+		"user@example.com#2": second,
+		"user@example.com":   second,
+	} {
+		key, err := Load(store, ref)
+		if err != nil {
+			t.Fatalf("%s: %v", ref, err)
+		}
+		if *key != *expected {
+			t.Errorf("%s: wrong key", ref)
+		}
+	}
+
+	// Keys are not stored in the clear
+	err = filepath.Walk(store.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err == nil && (bytes.Contains(b, first[:]) || bytes.Contains(b, second[:])) {
+			t.Errorf("%s contains a plaintext key", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(Ref{"user@example.com", 2}); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := store.Get(Ref{Account: "user@example.com"}); err != nil || *key != *first {
+		t.Fatalf("Expected the first key to be the latest, got %v", err)
+	}
+	if _, err := store.Get(Ref{"user@example.com", 2}); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	if err := store.Delete(Ref{"user@example.com", 2}); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	if err := store.Delete(Ref{Account: "user@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err := store.Versions("user@example.com"); err != nil || len(versions) != 0 {
+		t.Fatalf("Expected no versions, got %v: %v", versions, err)
+	}
+	if _, err := store.Get(Ref{Account: "user@example.com"}); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.Put("", first); err != ErrInvalidAccount {
+		t.Fatalf("Expected ErrInvalidAccount, got %v", err)
+	}
+}
+
+func TestConcurrentPut(t *testing.T) {
+	store, cleanup := newStore(t, "correct horse")
+	defer cleanup()
+
+	key := newKey(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.Put("user@example.com", key); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	versions, err := store.Versions("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 8 || versions[0] != 1 || versions[7] != 8 {
+		t.Fatalf("Expected versions 1 to 8, got %v", versions)
+	}
+}
+
+func TestPassphraseSealer(t *testing.T) {
+	store, cleanup := newStore(t, "correct horse")
+	defer cleanup()
+	ref, err := store.Put("user@example.com", newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrong, err := NewPassphraseSealer([]byte("battery staple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStore(store.Dir, wrong).Get(ref); err != ErrCorrupt {
+		t.Fatalf("Expected ErrCorrupt with the wrong passphrase, got %v", err)
+	}
+
+	sealer := store.Sealer.(*PassphraseSealer)
+	sealed, err := sealer.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sealed {
+		tampered := append([]byte(nil), sealed...)
+		tampered[i] ^= 1
+		if _, err := sealer.Open(tampered); err != ErrCorrupt {
+			t.Fatalf("Byte %d: expected ErrCorrupt, got %v", i, err)
+		}
+	}
+	if _, err := sealer.Open(sealed[:10]); err != ErrCorrupt {
+		t.Fatalf("Expected ErrCorrupt for short data, got %v", err)
+	}
+
+	sealer.Zero()
+	if _, err := sealer.Open(sealed); err != ErrEmptyPassphrase {
+		t.Fatalf("Expected ErrEmptyPassphrase after zeroing, got %v", err)
+	}
+	if _, err := NewPassphraseSealer(nil); err != ErrEmptyPassphrase {
+		t.Fatalf("Expected ErrEmptyPassphrase, got %v", err)
+	}
+}
+
+func TestParseRef(t *testing.T) {
+	tests := []struct {
+		s   string
+		ref Ref
+		err error
+	}{
+		{"user@example.com", Ref{"user@example.com", 0}, nil},
+		{"user@example.com#3", Ref{"user@example.com", 3}, nil},
+		{"a#b#2", Ref{"a#b", 2}, nil},
+		{"", Ref{}, ErrInvalidRef},
+		{"#2", Ref{}, ErrInvalidRef},
+		{"user#", Ref{}, ErrInvalidRef},
+		{"user#0", Ref{}, ErrInvalidRef},
+		{"user#x", Ref{}, ErrInvalidRef},
+	}
+	for _, test := range tests {
+		ref, err := ParseRef(test.s)
+		if ref != test.ref || err != test.err {
+			t.Errorf("%q: expected %v, %v, got %v, %v", test.s, test.ref, test.err, ref, err)
+		}
+		if err == nil && ref.String() != test.s {
+			t.Errorf("%q: String returned %q", test.s, ref.String())
+		}
+	}
+}
+
+func TestCheckStoreDirSDDL(t *testing.T) {
+	const user = "S-1-5-21-1004336348-1177238915-682003330-1001"
+	if err := checkStoreDirSDDL(storeDirSDDL(user), user); err != nil {
+		t.Fatalf("Store directory as created is rejected: %v", err)
+	}
+	if err := checkStoreDirSDDL(storeDirSDDL("S-1-5-18"), "S-1-5-18"); err != nil {
+		t.Fatalf("Store directory of SYSTEM is rejected: %v", err)
+	}
+	for name, sddl := range map[string]string{
+		"other owner":     "O:S-1-5-21-1-2-3-1002D:P(A;OICI;FA;;;SY)(A;OICI;FA;;;" + user + ")",
+		"administrators":  "O:BAD:P(A;OICI;FA;;;SY)(A;OICI;FA;;;" + user + ")",
+		"other user":      "O:" + user + "D:P(A;OICI;FA;;;SY)(A;OICI;FA;;;S-1-5-21-1-2-3-1002)",
+		"users":           "O:" + user + "D:P(A;OICI;FA;;;SY)(A;OICI;FA;;;" + user + ")(A;OICI;FR;;;BU)",
+		"inherited":       "O:" + user + "D:AI(A;OICI;FA;;;SY)(A;OICI;FA;;;" + user + ")",
+		"null DACL":       "O:" + user + "D:NO_ACCESS_CONTROL",
+		"no DACL":         "O:" + user,
+		"malformed entry": "O:" + user + "D:P(A;OICI;FA)",
+	} {
+		if err := checkStoreDirSDDL(sddl, user); err != ErrInsecureStoreDir {
+			t.Errorf("Expected %v for a directory with %s, got %v", ErrInsecureStoreDir, name, err)
+		}
+	}
+	if err := checkStoreDirSDDL("O:"+user+"D:PAI(D;OICI;FA;;;WD)(A;OICI;FA;;;SY)(A;OICI;FR;;;"+user+")", user); err != nil {
+		t.Fatalf("Deny entries and fewer rights are rejected: %v", err)
+	}
+}
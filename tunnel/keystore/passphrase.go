@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package keystore
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+var ErrEmptyPassphrase = errors.New("Passphrase must not be empty")
+
+const (
+	passphraseFormat = 1
+	saltLength       = 16
+)
+
+// scryptCost is the scrypt N parameter, lowered by tests.
+var scryptCost = 1 << 15
+
+// PassphraseSealer seals with XChaCha20-Poly1305, under a key derived from a
+// passphrase by scrypt with a random salt per sealed value.
+type PassphraseSealer struct {
+	passphrase []byte
+}
+
+// NewPassphraseSealer copies the passphrase, which the caller can then zero.
+func NewPassphraseSealer(passphrase []byte) (*PassphraseSealer, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrEmptyPassphrase
+	}
+	return &PassphraseSealer{passphrase: append([]byte(nil), passphrase...)}, nil
+}
+
+func (s *PassphraseSealer) key(salt []byte) ([]byte, error) {
+	if len(s.passphrase) == 0 {
+		return nil, ErrEmptyPassphrase
+	}
+	return scrypt.Key(s.passphrase, salt, scryptCost, 8, 1, chacha20poly1305.KeySize)
+}
+
+// Seal returns the format, salt, nonce and ciphertext. The format and salt
+// are authenticated as additional data.
+func (s *PassphraseSealer) Seal(plaintext []byte) ([]byte, error) {
+	header := make([]byte, 1+saltLength+chacha20poly1305.NonceSizeX)
+	header[0] = passphraseFormat
+	if _, err := io.ReadFull(rand.Reader, header[1:]); err != nil {
+		return nil, err
+	}
+	salt, nonce := header[1:1+saltLength], header[1+saltLength:]
+
+	key, err := s.key(salt)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, nonce, plaintext, header[:1+saltLength]), nil
+}
+
+func (s *PassphraseSealer) Open(sealed []byte) ([]byte, error) {
+	headerLength := 1 + saltLength + chacha20poly1305.NonceSizeX
+	if len(sealed) < headerLength+chacha20poly1305.Overhead || sealed[0] != passphraseFormat {
+		return nil, ErrCorrupt
+	}
+	salt, nonce := sealed[1:1+saltLength], sealed[1+saltLength:headerLength]
+
+	key, err := s.key(salt)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, sealed[headerLength:], sealed[:1+saltLength])
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return plaintext, nil
+}
+
+// Zero overwrites the copy of the passphrase. The sealer cannot be used
+// afterwards.
+func (s *PassphraseSealer) Zero() {
+	Zero(s.passphrase)
+	s.passphrase = nil
+}
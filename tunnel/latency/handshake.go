@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package latency
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"hash"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+)
+
+// WireGuard message types and sizes.
+const (
+	messageInitiationType  = 1
+	messageResponseType    = 2
+	messageCookieReplyType = 3
+
+	messageInitiationSize  = 148
+	messageResponseSize    = 92
+	messageCookieReplySize = 64
+)
+
+const (
+	noiseConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	wgIdentifier      = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	wgLabelMAC1       = "mac1----"
+
+	// tai64nBase is the TAI64 label of the Unix epoch.
+	tai64nBase = 0x400000000000000a
+)
+
+func newBlake2s() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+func mixHash(h *[blake2s.Size]byte, data []byte) {
+	*h = blake2s.Sum256(append(h[:], data...))
+}
+
+func hmacBlake2s(key, data []byte) []byte {
+	mac := hmac.New(newBlake2s, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// kdf2 derives two keys from the chaining key and input, as in the Noise
+// HKDF.
+func kdf2(chainingKey *[blake2s.Size]byte, input []byte) (next [blake2s.Size]byte, key [chacha20poly1305.KeySize]byte) {
+	prk := hmacBlake2s(chainingKey[:], input)
+	t1 := hmacBlake2s(prk, []byte{1})
+	t2 := hmacBlake2s(prk, append(t1, 2))
+	copy(next[:], t1)
+	copy(key[:], t2)
+	return
+}
+
+func seal(key *[chacha20poly1305.KeySize]byte, plaintext []byte, h *[blake2s.Size]byte) []byte {
+	aead, _ := chacha20poly1305.New(key[:])
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Seal(nil, nonce[:], plaintext, h[:])
+}
+
+func sharedSecret(private, public *keys.Key) []byte {
+	var shared [keys.KeyLength]byte
+	curve25519.ScalarMult(&shared, (*[keys.KeyLength]byte)(private), (*[keys.KeyLength]byte)(public))
+	return shared[:]
+}
+
+func tai64n(t time.Time) []byte {
+	var b [12]byte
+	binary.BigEndian.PutUint64(b[:], tai64nBase+uint64(t.Unix()))
+	binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+	return b[:]
+}
+
+// Initiation returns a handshake initiation from the static private key to
+// the peer with the given public key. The peer only answers when it knows
+// the public key of the initiator, and the timestamp is newer than that of
+// the last initiation it accepted from it.
+func Initiation(private, peer *keys.Key, sender uint32, now time.Time) ([]byte, error) {
+	ephemeral, err := keys.NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	defer ephemeral.Zero()
+
+	msg := make([]byte, messageInitiationSize)
+	binary.LittleEndian.PutUint32(msg[0:], messageInitiationType)
+	binary.LittleEndian.PutUint32(msg[4:], sender)
+
+	chainingKey := blake2s.Sum256([]byte(noiseConstruction))
+	h := chainingKey
+	mixHash(&h, []byte(wgIdentifier))
+	mixHash(&h, peer[:])
+
+	ephemeralPublic := ephemeral.Public()
+	copy(msg[8:40], ephemeralPublic[:])
+	chainingKey, _ = kdf2(&chainingKey, ephemeralPublic[:])
+	mixHash(&h, ephemeralPublic[:])
+
+	chainingKey, key := kdf2(&chainingKey, sharedSecret(ephemeral, peer))
+	static := seal(&key, private.Public()[:], &h)
+	copy(msg[40:88], static)
+	mixHash(&h, static)
+
+	_, key = kdf2(&chainingKey, sharedSecret(private, peer))
+	timestamp := seal(&key, tai64n(now), &h)
+	copy(msg[88:116], timestamp)
+
+	mac1Key := blake2s.Sum256(append([]byte(wgLabelMAC1), peer[:]...))
+	mac, _ := blake2s.New128(mac1Key[:])
+	mac.Write(msg[:116])
+	copy(msg[116:132], mac.Sum(nil))
+	return msg, nil
+}
+
+// isReply is whether msg answers the initiation from sender. A cookie reply
+// is sent instead of a response by peers under load, and is as good for
+// timing.
+func isReply(msg []byte, sender uint32) bool {
+	if len(msg) < 8 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(msg) {
+	case messageResponseType:
+		return len(msg) == messageResponseSize && binary.LittleEndian.Uint32(msg[8:]) == sender
+	case messageCookieReplyType:
+		return len(msg) == messageCookieReplySize && binary.LittleEndian.Uint32(msg[4:]) == sender
+	}
+	return false
+}
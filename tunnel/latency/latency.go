@@ -0,0 +1,216 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package latency measures the round trip time to WireGuard servers with
+// handshake initiations, to find the fastest one.
+package latency
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/guardian"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+)
+
+const (
+	// DefaultConcurrency is the number of targets probed at once.
+	DefaultConcurrency = 8
+
+	// DefaultTimeout is the time a target has to answer.
+	DefaultTimeout = 2 * time.Second
+)
+
+var (
+	ErrNoReply       = errors.New("The server did not answer the handshake")
+	ErrInvalidTarget = errors.New("The server has no valid endpoint or public key")
+)
+
+// Target is a server to probe.
+type Target struct {
+	Hostname  string
+	Endpoint  string
+	PublicKey keys.Key
+}
+
+// TargetFromServer returns a target for a server, at the lowest of its ports.
+func TargetFromServer(server *guardian.Server) (Target, error) {
+	ports, err := server.Ports()
+	if err != nil || len(ports) == 0 || net.ParseIP(server.Ipv4AddrIn) == nil {
+		return Target{}, ErrInvalidTarget
+	}
+	publicKey, err := keys.NewKeyFromString(server.PublicKey)
+	if err != nil {
+		return Target{}, ErrInvalidTarget
+	}
+	lowest := ports[0].From
+	for _, r := range ports[1:] {
+		if r.From < lowest {
+			lowest = r.From
+		}
+	}
+	return Target{
+		Hostname:  server.Hostname,
+		Endpoint:  net.JoinHostPort(server.Ipv4AddrIn, strconv.Itoa(int(lowest))),
+		PublicKey: *publicKey,
+	}, nil
+}
+
+// Result is the round trip time to a target, or why it could not be
+// measured.
+type Result struct {
+	Hostname string        `json:"hostname"`
+	Endpoint string        `json:"endpoint"`
+	RTT      time.Duration `json:"-"`
+	RTTMs    float64       `json:"rtt_ms"`
+	Err      error         `json:"-"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Prober sends handshake initiations to targets. Servers only answer
+// initiations from a private key they know, so PrivateKey has to be the key
+// of a registered device.
+//
+// A server that accepts an initiation roams the peer to the address it came
+// from, so targets should not include the server of a connected tunnel that
+// uses the same key.
+type Prober struct {
+	PrivateKey *keys.Key
+
+	// Concurrency and Timeout override DefaultConcurrency and DefaultTimeout.
+	Concurrency int
+	Timeout     time.Duration
+}
+
+// Probe probes every target, at most Concurrency at a time, and returns the
+// results ranked from the fastest. Targets that did not answer come last, in
+// their original order. Cancelling ctx fails the targets that were not
+// probed yet.
+func (p *Prober) Probe(ctx context.Context, targets []Target) []Result {
+	concurrency := p.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	results := make([]Result, len(targets))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range targets {
+		results[i] = Result{Hostname: targets[i].Hostname, Endpoint: targets[i].Endpoint}
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			targetCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			results[i].RTT, results[i].Err = p.probe(targetCtx, &targets[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range results {
+		if results[i].Err != nil {
+			results[i].RTT = 0
+			results[i].Error = results[i].Err.Error()
+		} else {
+			results[i].RTTMs = float64(results[i].RTT) / float64(time.Millisecond)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if (results[i].Err == nil) != (results[j].Err == nil) {
+			return results[i].Err == nil
+		}
+		return results[i].Err == nil && results[i].RTT < results[j].RTT
+	})
+	return results
+}
+
+// ProbeServers probes servers at the lowest of their ports. Servers without
+// a valid endpoint come last.
+func (p *Prober) ProbeServers(ctx context.Context, servers []guardian.Server) []Result {
+	var targets []Target
+	var invalid []Result
+	for i := range servers {
+		target, err := TargetFromServer(&servers[i])
+		if err != nil {
+			invalid = append(invalid, Result{Hostname: servers[i].Hostname, Err: err, Error: err.Error()})
+			continue
+		}
+		targets = append(targets, target)
+	}
+	return append(p.Probe(ctx, targets), invalid...)
+}
+
+func (p *Prober) probe(ctx context.Context, target *Target) (time.Duration, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", target.Endpoint)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	sender := binary.LittleEndian.Uint32(b[:])
+	initiation, err := Initiation(p.PrivateKey, &target.PublicKey, sender, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	// Unblock the read when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	start := time.Now()
+	if _, err := conn.Write(initiation); err != nil {
+		return 0, err
+	}
+	reply := make([]byte, messageResponseSize+1)
+	for {
+		n, err := conn.Read(reply)
+		if ctx.Err() == context.DeadlineExceeded {
+			return 0, ErrNoReply
+		} else if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err != nil {
+			// Errors such as ICMP port unreachable are reported on the
+			// next read, so keep waiting for a reply until the deadline
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if isReply(reply[:n], sender) {
+			return time.Since(start), nil
+		}
+	}
+}
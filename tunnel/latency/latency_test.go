@@ -0,0 +1,282 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package latency
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/guardian"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/internal/wgtest"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+)
+
+// responder answers initiations with a response after a delay, without
+// checking them.
+type responder struct {
+	conn  *net.UDPConn
+	delay time.Duration
+
+	active    *int32
+	maxActive *int32
+	wg        sync.WaitGroup
+}
+
+func newResponder(t *testing.T, delay time.Duration, active, maxActive *int32) *responder {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &responder{conn: conn, delay: delay, active: active, maxActive: maxActive}
+	go r.serve()
+	return r
+}
+
+func (r *responder) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n != messageInitiationSize {
+			continue
+		}
+		sender := binary.LittleEndian.Uint32(buf[4:])
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			if r.active != nil {
+				active := atomic.AddInt32(r.active, 1)
+				for {
+					max := atomic.LoadInt32(r.maxActive)
+					if active <= max || atomic.CompareAndSwapInt32(r.maxActive, max, active) {
+						break
+					}
+				}
+			}
+			time.Sleep(r.delay)
+			response := make([]byte, messageResponseSize)
+			binary.LittleEndian.PutUint32(response, messageResponseType)
+			binary.LittleEndian.PutUint32(response[8:], sender)
+
+			// The probe may start the next handshake as soon as it reads
+			// the response, so this one must not count as active by then
+			if r.active != nil {
+				atomic.AddInt32(r.active, -1)
+			}
+			r.conn.WriteToUDP(response, addr)
+		}()
+	}
+}
+
+func (r *responder) target(name string) Target {
+	return Target{Hostname: name, Endpoint: r.conn.LocalAddr().String()}
+}
+
+func (r *responder) Close() {
+	r.conn.Close()
+	r.wg.Wait()
+}
+
+func newPrivateKey(t *testing.T) *keys.Key {
+	key, err := keys.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHandshakeWithDevice(t *testing.T) {
+	d, err := wgtest.NewDevice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	known := newPrivateKey(t)
+	if err := d.Set(fmt.Sprintf("public_key=%s\nallowed_ip=10.0.0.2/32\n", wgtest.HexKey(known.Public()))); err != nil {
+		t.Fatal(err)
+	}
+	target := Target{Hostname: "device", Endpoint: d.Endpoint(), PublicKey: *d.PublicKey()}
+
+	prober := &Prober{PrivateKey: known, Timeout: 2 * time.Second}
+	results := prober.Probe(context.Background(), []Target{target})
+	if results[0].Err != nil || results[0].RTT <= 0 || results[0].RTTMs <= 0 {
+		t.Fatalf("Unexpected result %+v", results[0])
+	}
+
+	// A second probe has a newer timestamp and is answered too, once the
+	// flood protection of 50 initiations per second allows
+	time.Sleep(50 * time.Millisecond)
+	results = prober.Probe(context.Background(), []Target{target})
+	if results[0].Err != nil {
+		t.Fatalf("Unexpected result %+v for a second probe", results[0])
+	}
+
+	// Devices ignore keys they do not know
+	prober = &Prober{PrivateKey: newPrivateKey(t), Timeout: 200 * time.Millisecond}
+	results = prober.Probe(context.Background(), []Target{target})
+	if results[0].Err != ErrNoReply || results[0].Error != ErrNoReply.Error() {
+		t.Fatalf("Unexpected result %+v with an unknown key", results[0])
+	}
+}
+
+func TestRanking(t *testing.T) {
+	var targets []Target
+	for i, delay := range []time.Duration{120, 20, 200, 60} {
+		r := newResponder(t, delay*time.Millisecond, nil, nil)
+		defer r.Close()
+		targets = append(targets, r.target(fmt.Sprintf("server%d", i)))
+	}
+	// Nothing listens on the port of a closed responder
+	closed := newResponder(t, 0, nil, nil)
+	closed.Close()
+	targets = append([]Target{closed.target("closed")}, targets...)
+
+	prober := &Prober{PrivateKey: newPrivateKey(t), Timeout: time.Second}
+	start := time.Now()
+	results := prober.Probe(context.Background(), targets)
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Fatalf("Probes did not run in parallel, took %v", elapsed)
+	}
+
+	expected := []string{"server1", "server3", "server0", "server2", "closed"}
+	for i, name := range expected {
+		if results[i].Hostname != name {
+			t.Fatalf("Expected %s at rank %d, got %+v", name, i, results)
+		}
+	}
+	for _, result := range results[:4] {
+		if result.Err != nil || result.RTT < 20*time.Millisecond {
+			t.Fatalf("Unexpected result %+v", result)
+		}
+	}
+	if results[4].Err != ErrNoReply || results[4].RTT != 0 {
+		t.Fatalf("Unexpected result %+v for a closed port", results[4])
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	var active, maxActive int32
+	var targets []Target
+	for i := 0; i < 6; i++ {
+		r := newResponder(t, 50*time.Millisecond, &active, &maxActive)
+		defer r.Close()
+		targets = append(targets, r.target(fmt.Sprintf("server%d", i)))
+	}
+
+	prober := &Prober{PrivateKey: newPrivateKey(t), Concurrency: 2, Timeout: time.Second}
+	results := prober.Probe(context.Background(), targets)
+	for _, result := range results {
+		if result.Err != nil {
+			t.Fatalf("Unexpected result %+v", result)
+		}
+	}
+	if max := atomic.LoadInt32(&maxActive); max > 2 || max == 0 {
+		t.Fatalf("Expected at most 2 probes at once, got %d", max)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	r := newResponder(t, time.Second, nil, nil)
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	prober := &Prober{PrivateKey: newPrivateKey(t), Concurrency: 1, Timeout: 5 * time.Second}
+	results := prober.Probe(ctx, []Target{r.target("first"), r.target("second")})
+	for _, result := range results {
+		if result.Err == nil {
+			t.Fatalf("Unexpected result %+v after cancellation", result)
+		}
+	}
+}
+
+func TestProbeServers(t *testing.T) {
+	r := newResponder(t, 0, nil, nil)
+	defer r.Close()
+	addr := r.conn.LocalAddr().(*net.UDPAddr)
+	key := newPrivateKey(t).Public().String()
+
+	servers := []guardian.Server{
+		{Hostname: "invalid", Ipv4AddrIn: "127.0.0.1", PublicKey: key},
+		{Hostname: "valid", Ipv4AddrIn: "127.0.0.1", PublicKey: key, PortRanges: [][]int{{addr.Port, addr.Port}}},
+	}
+	prober := &Prober{PrivateKey: newPrivateKey(t), Timeout: time.Second}
+	results := prober.ProbeServers(context.Background(), servers)
+	if len(results) != 2 || results[0].Hostname != "valid" || results[0].Err != nil {
+		t.Fatalf("Unexpected results %+v", results)
+	}
+	if results[1].Hostname != "invalid" || results[1].Err != ErrInvalidTarget || results[1].Error == "" {
+		t.Fatalf("Unexpected result %+v for an invalid server", results[1])
+	}
+}
+
+func TestIsReply(t *testing.T) {
+	response := make([]byte, messageResponseSize)
+	binary.LittleEndian.PutUint32(response, messageResponseType)
+	binary.LittleEndian.PutUint32(response[8:], 42)
+	cookie := make([]byte, messageCookieReplySize)
+	binary.LittleEndian.PutUint32(cookie, messageCookieReplyType)
+	binary.LittleEndian.PutUint32(cookie[4:], 42)
+
+	tests := []struct {
+		name  string
+		msg   []byte
+		reply bool
+	}{
+		{"Response", response, true},
+		{"Cookie reply", cookie, true},
+		{"Other sender", response, false},
+		{"Short", response[:40], false},
+		{"Initiation", make([]byte, messageInitiationSize), false},
+	}
+	for _, test := range tests {
+		sender := uint32(42)
+		if test.name == "Other sender" {
+			sender = 43
+		}
+		if isReply(test.msg, sender) != test.reply {
+			t.Errorf("%s: expected %v", test.name, test.reply)
+		}
+	}
+}
+
+func TestTargetFromServer(t *testing.T) {
+	key := newPrivateKey(t).Public()
+	server := &guardian.Server{
+		Hostname:   "us1-wireguard",
+		Ipv4AddrIn: "192.0.2.1",
+		PublicKey:  key.String(),
+		PortRanges: [][]int{{53, 53}, {4000, 33433}, {34000, 51820}},
+	}
+	target, err := TargetFromServer(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Hostname != "us1-wireguard" || target.Endpoint != "192.0.2.1:53" || target.PublicKey != *key {
+		t.Fatalf("Unexpected target %+v", target)
+	}
+
+	for _, modify := range []func(*guardian.Server){
+		func(s *guardian.Server) { s.Ipv4AddrIn = "us1.example.com" },
+		func(s *guardian.Server) { s.PublicKey = "" },
+		func(s *guardian.Server) { s.PortRanges = nil },
+	} {
+		invalid := *server
+		modify(&invalid)
+		if _, err := TargetFromServer(&invalid); err != ErrInvalidTarget {
+			t.Errorf("Expected ErrInvalidTarget for %+v, got %v", invalid, err)
+		}
+	}
+}
@@ -6,159 +6,1025 @@
 package main
 
 import (
-	"crypto/rand"
-	"errors"
-	"fmt"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"encoding/json"
 	"io/ioutil"
 	"log"
-	"net"
-	"net/http"
+	"os"
 	"path/filepath"
-	"strings"
+	"sync"
+	"time"
 	"unsafe"
 
 	"C"
 
-	"golang.org/x/crypto/curve25519"
 	"golang.org/x/sys/windows"
 
 	"golang.zx2c4.com/wireguard/windows/conf"
+	"golang.zx2c4.com/wireguard/windows/services"
 	"golang.zx2c4.com/wireguard/windows/tunnel"
-	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 	"golang.zx2c4.com/wireguard/windows/tunnel/firewall"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/cidr"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/connectivity"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/contentsig"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/dnsleak"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/exitcode"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/guardian"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/health"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keystore"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/latency"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/reconfig"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/ringlog"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/routes"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/servers"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/stats"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/uapi"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/wgconfig"
 )
 
 func marshalCSharpStringPointerToString(str16 *uint16) string {
 	return windows.UTF16ToString((*[(1 << 30) - 1]uint16)(unsafe.Pointer(str16))[:])
 }
 
-//export WireGuardTunnelService
-func WireGuardTunnelService(confFile16 *uint16) bool {
-	confFile := marshalCSharpStringPointerToString(confFile16)
+func marshalCSharpByteArrayToSlice(buf *byte, length uint32) []byte {
+	if buf == nil || length == 0 {
+		return nil
+	}
+	return (*[(1 << 30) - 1]byte)(unsafe.Pointer(buf))[:length:length]
+}
+
+func marshalStringToCSharpBuffer(str string, buf16 *uint16, length uint32) {
+	if buf16 == nil || length == 0 {
+		return
+	}
+	buf := (*[(1 << 30) - 1]uint16)(unsafe.Pointer(buf16))[:length:length]
+	str16 := windows.StringToUTF16(str)
+	if len(str16) > len(buf) {
+		str16 = str16[:len(buf)-1]
+		str16 = append(str16, 0)
+	}
+	copy(buf, str16)
+}
+
+var tunnelLog = ringlog.NewLogger(ringlog.DefaultCapacity)
+
+var (
+	tunnelLogFollowerMutex sync.Mutex
+	tunnelLogFollower      *ringlog.Follower
+)
+
+func init() {
+	// The tunnel service replaces this with the ringlogger of wireguard-windows
+	log.SetOutput(tunnelLog)
+	log.SetFlags(0)
+}
+
+var (
+	lastTunnelErrorMutex sync.Mutex
+	lastTunnelError      error
+)
+
+func setLastTunnelError(err error) int32 {
+	lastTunnelErrorMutex.Lock()
+	defer lastTunnelErrorMutex.Unlock()
+	lastTunnelError = err
+	return int32(exitcode.FromError(err))
+}
+
+func prepareTunnelService(confFile string) {
 	tunnel.UseFixedGUIDInsteadOfDeterministic = true
 	firewall.ExemptBuiltinAdministrators = true
 
 	conf.PresetRootDirectory(filepath.Dir(confFile))
+}
+
+// runTunnelService runs the tunnel of a loaded config from runFile, with
+// started running alongside it. It returns once both have stopped. When
+// started fails, the service is stopped, and its error is returned unless
+// the tunnel failed by itself.
+func runTunnelService(name string, confFile string, runFile string, config *conf.Config, started func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	go monitorTunnelHealth(ctx, name, confFile, config)
+	done := make(chan struct{})
+	var startedErr error
+	go func() {
+		defer close(done)
+		if started == nil {
+			return
+		}
+		startedErr = started(ctx)
+		if startedErr != nil && ctx.Err() == nil {
+			log.Printf("Stopping tunnel service: %v", startedErr)
+			if err := stopService(name); err != nil {
+				log.Printf("Unable to stop tunnel service: %v", err)
+			}
+		}
+	}()
+	err := tunnel.Run(runFile)
+	if err == nil {
+		err = serviceExitError(name)
+	}
+	cancel()
+	<-done
+	if err == nil {
+		err = startedErr
+	}
+	return err
+}
+
+// stopService asks the service control manager to stop the tunnel service of
+// name, which runs in this process.
+func stopService(name string) error {
+	serviceName, err := services.ServiceNameOfTunnel(name)
+	if err != nil {
+		return err
+	}
+	manager, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_CONNECT)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseServiceHandle(manager)
+	serviceName16, err := windows.UTF16PtrFromString(serviceName)
+	if err != nil {
+		return err
+	}
+	service, err := windows.OpenService(manager, serviceName16, windows.SERVICE_STOP)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseServiceHandle(service)
+	var status windows.SERVICE_STATUS
+	return windows.ControlService(service, windows.SERVICE_CONTROL_STOP, &status)
+}
 
-	err := tunnel.Run(confFile)
+// serviceExitError returns the error that the tunnel service of name reported
+// to the service control manager when it stopped.
+func serviceExitError(name string) error {
+	serviceName, err := services.ServiceNameOfTunnel(name)
+	if err != nil {
+		log.Printf("Unable to query tunnel service exit code: %v", err)
+		return nil
+	}
+	win32ExitCode, serviceSpecificExitCode, err := exitcode.QueryServiceStatus(serviceName)
+	if err != nil {
+		log.Printf("Unable to query tunnel service exit code: %v", err)
+		return nil
+	}
+	return exitcode.FromServiceStatus(win32ExitCode, serviceSpecificExitCode)
+}
+
+//export WireGuardTunnelService
+func WireGuardTunnelService(confFile16 *uint16) int32 {
+	confFile := marshalCSharpStringPointerToString(confFile16)
+	prepareTunnelService(confFile)
+
+	// Catch configuration errors here, as the service only reports them to
+	// the service control manager
+	name, err := conf.NameFromPath(confFile)
+	var config *conf.Config
+	if err == nil {
+		config, err = conf.LoadFromPath(confFile)
+	}
+	if err != nil {
+		err = exitcode.Wrap(exitcode.ErrorLoadConfiguration, err)
+	} else {
+		err = runTunnelService(name, confFile, confFile, config, nil)
+	}
 	if err != nil {
 		log.Printf("Tunnel service error: %v", err)
 	}
 
-	return err == nil
+	return setLastTunnelError(err)
 }
 
-//export WireGuardGenerateKeypair
-func WireGuardGenerateKeypair(publicKey *byte, privateKey *byte) {
-	publicKeyArray := (*[32]byte)(unsafe.Pointer(publicKey))
-	privateKeyArray := (*[32]byte)(unsafe.Pointer(privateKey))
+//export WireGuardTunnelServiceWithKeyRef
+func WireGuardTunnelServiceWithKeyRef(confFile16 *uint16, keyRef16 *uint16) int32 {
+	// The config file has no private key, and the service loads it from the
+	// key store next to the config, which it can open as SYSTEM. The tunnel
+	// runs from a copy of the config with a placeholder private key, which is
+	// replaced over UAPI once the tunnel is up, so the real key never touches
+	// disk. There is no variant taking the config as a buffer: the service
+	// control manager starts this process with only its command line, so a
+	// buffer from the UI could only reach it through a file or another
+	// channel, and the config holds no secret once the key is out of it
+	confFile := marshalCSharpStringPointerToString(confFile16)
+	prepareTunnelService(confFile)
+	var keyRef string
+	if keyRef16 != nil {
+		keyRef = marshalCSharpStringPointerToString(keyRef16)
+	}
 
-	n, err := rand.Read(privateKeyArray[:])
-	if err != nil || n != len(privateKeyArray) {
-		panic("Unable to generate random bytes")
+	name, err := conf.NameFromPath(confFile)
+	var buf []byte
+	if err == nil {
+		buf, err = ioutil.ReadFile(confFile)
+	}
+	var config, placeholder *wgconfig.Config
+	if err == nil {
+		config, err = wgconfig.Load(buf, keystore.NewDPAPIStore(keyStoreDirectory(confFile)), keyRef)
+	}
+	if err == nil {
+		defer config.Zero()
+		placeholder, err = config.WithPlaceholderKey()
+	}
+	runFile := runningConfigPath(confFile)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(runFile), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(runFile, []byte(placeholder.WgQuick()), 0600)
+	}
+	var serviceConfig *conf.Config
+	if err == nil {
+		serviceConfig, err = placeholder.Conf(name)
+	}
+	if err != nil {
+		err = exitcode.Wrap(exitcode.ErrorLoadConfiguration, err)
+	} else {
+		// The tunnel is up with the placeholder key, which no server knows, so
+		// failing to install the real one fails the tunnel
+		err = runTunnelService(name, confFile, runFile, serviceConfig, func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, privateKeyInstallTimeout)
+			defer cancel()
+			reconfigurer := &reconfig.Reconfigurer{Client: uapi.NewPipeClient(name)}
+			if err := reconfigurer.InstallPrivateKey(ctx, &placeholder.Interface.PrivateKey, &config.Interface.PrivateKey); err != nil {
+				return exitcode.Wrap(exitcode.ErrorLoadConfiguration, err)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		log.Printf("Tunnel service error: %v", err)
 	}
 
-	privateKeyArray[0] &= 248
-	privateKeyArray[31] = (privateKeyArray[31] & 127) | 64
+	return setLastTunnelError(err)
+}
 
-	curve25519.ScalarBaseMult(publicKeyArray, privateKeyArray)
+// runningConfigPath returns where the tunnel of a config without a private
+// key runs from. The file keeps the name of the config, which names the
+// tunnel and its service.
+func runningConfigPath(confFile string) string {
+	return filepath.Join(filepath.Dir(confFile), "Running", filepath.Base(confFile))
 }
 
-func findPhysicalDefaultRoute() (winipcfg.LUID, net.IP, error) {
-	r, err := winipcfg.GetIPForwardTable2(windows.AF_INET)
+// privateKeyInstallTimeout is how long a tunnel started from memory has to
+// come up before its private key is installed.
+const privateKeyInstallTimeout = 30 * time.Second
+
+func monitorTunnelHealth(ctx context.Context, name string, confFile string, config *conf.Config) {
+	options, err := health.LoadOptions(health.OptionsPath(confFile, name))
+	if err != nil {
+		log.Printf("Invalid tunnel health options: %v", err)
+		return
+	}
+	if options.Disabled || len(config.Peers) == 0 {
+		return
+	}
+	monitor, err := options.Monitor(uapi.NewPipeClient(name), config.Peers[0].Endpoint.Host, health.DefaultInterfaceBinder(routes.NewTable()))
 	if err != nil {
-		return 0, nil, err
+		log.Printf("Unable to monitor tunnel health: %v", err)
+		return
+	}
+	monitor.OnChange = func(status health.Status) {
+		log.Printf("Tunnel is %v: last handshake %v ago, %d gateway pings missed", status.State, status.HandshakeAge.Round(time.Second), status.PingFailures)
+	}
+	monitor.OnRecovery = func(action health.Action, err error) {
+		if err != nil {
+			log.Printf("Tunnel recovery action %q failed: %v", action, err)
+		} else {
+			log.Printf("Tunnel recovery action %q applied", action)
+		}
 	}
 
-	lowestMetric := ^uint32(0)
+	// Check the tunnel as soon as the physical network changes, rather than
+	// waiting for the handshake to go stale
+	if watcher, err := networkWatcher(); err != nil {
+		log.Printf("Unable to watch network changes: %v", err)
+	} else {
+		wake := make(chan struct{}, 1)
+		defer watcher.Subscribe(func(state *routes.NetworkState) {
+			log.Printf("Physical network changed, checking tunnel")
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		})()
+		monitor.Wake = wake
+	}
+	monitor.Run(ctx)
+}
 
-	var nextHop net.IP
-	var luid winipcfg.LUID
-	for i := range r {
-		if r[i].DestinationPrefix.PrefixLength != 0 {
-			continue
-		}
-		ifrow, err := r[i].InterfaceLUID.Interface()
-		if err != nil || ifrow.OperStatus != winipcfg.IfOperStatusUp || ifrow.MediaType == winipcfg.NdisMediumIP {
-			continue
+var (
+	networkWatcherMutex sync.Mutex
+	networkWatcherValue *routes.Watcher
+)
+
+// networkWatcher returns the watcher of the system route table, which is
+// shared by the tunnel and the exports below.
+func networkWatcher() (*routes.Watcher, error) {
+	networkWatcherMutex.Lock()
+	defer networkWatcherMutex.Unlock()
+	if networkWatcherValue == nil {
+		watcher, err := routes.NewWatcher(routes.NewTable(), routes.NotifyChanges, 0)
+		if err != nil {
+			return nil, err
 		}
-		if r[i].Metric < lowestMetric {
-			lowestMetric = r[i].Metric
-			nextHop = r[i].NextHop.IP()
-			luid = r[i].InterfaceLUID
+		networkWatcherValue = watcher
+	}
+	return networkWatcherValue, nil
+}
+
+//export WireGuardTunnelLastError
+func WireGuardTunnelLastError(message16 *uint16, messageLength uint32) int32 {
+	lastTunnelErrorMutex.Lock()
+	defer lastTunnelErrorMutex.Unlock()
+	if lastTunnelError != nil {
+		marshalStringToCSharpBuffer(lastTunnelError.Error(), message16, messageLength)
+	} else {
+		marshalStringToCSharpBuffer("", message16, messageLength)
+	}
+	return int32(exitcode.FromError(lastTunnelError))
+}
+
+func marshalCSharpKeyPointer(key *byte) *keys.Key {
+	return (*keys.Key)(unsafe.Pointer(key))
+}
+
+//export WireGuardGenerateKeypair
+func WireGuardGenerateKeypair(publicKey *byte, privateKey *byte) bool {
+	key, err := keys.NewPrivateKey()
+	if err != nil {
+		log.Printf("Unable to generate private key: %v", err)
+		return false
+	}
+	defer key.Zero()
+
+	*marshalCSharpKeyPointer(privateKey) = *key
+	*marshalCSharpKeyPointer(publicKey) = *key.Public()
+	return true
+}
+
+//export WireGuardGeneratePresharedKey
+func WireGuardGeneratePresharedKey(presharedKey *byte) bool {
+	key, err := keys.NewPresharedKey()
+	if err != nil {
+		log.Printf("Unable to generate preshared key: %v", err)
+		return false
+	}
+	defer key.Zero()
+
+	*marshalCSharpKeyPointer(presharedKey) = *key
+	return true
+}
+
+//export WireGuardDerivePublicKey
+func WireGuardDerivePublicKey(privateKey *byte, publicKey *byte) bool {
+	key := marshalCSharpKeyPointer(privateKey)
+	if key.IsZero() {
+		return false
+	}
+
+	*marshalCSharpKeyPointer(publicKey) = *key.Public()
+	return true
+}
+
+//export WireGuardEncodeKey
+func WireGuardEncodeKey(key *byte, encoded16 *uint16, encodedLength uint32) bool {
+	encoded := marshalCSharpKeyPointer(key).String()
+	if encodedLength <= uint32(len(encoded)) {
+		return false
+	}
+
+	marshalStringToCSharpBuffer(encoded, encoded16, encodedLength)
+	return true
+}
+
+//export WireGuardDecodeKey
+func WireGuardDecodeKey(encoded16 *uint16, key *byte) bool {
+	decoded, err := keys.NewKeyFromString(marshalCSharpStringPointerToString(encoded16))
+	if err != nil {
+		return false
+	}
+	defer decoded.Zero()
+
+	*marshalCSharpKeyPointer(key) = *decoded
+	return true
+}
+
+var (
+	keyStoreMutex sync.Mutex
+	keyStore      keystore.Store
+)
+
+// keyStoreDirectory keeps keys next to the tunnel configs, so that the
+// client and the tunnel service find the same store.
+func keyStoreDirectory(confFile string) string {
+	return filepath.Join(filepath.Dir(confFile), "Keys")
+}
+
+func openedKeyStore() keystore.Store {
+	keyStoreMutex.Lock()
+	defer keyStoreMutex.Unlock()
+	return keyStore
+}
+
+//export OpenKeyStore
+func OpenKeyStore(confFile16 *uint16) bool {
+	dir := keyStoreDirectory(marshalCSharpStringPointerToString(confFile16))
+	if err := keystore.CreateDPAPIStoreDir(dir); err != nil {
+		log.Printf("Unable to create key store: %v", err)
+		return false
+	}
+
+	keyStoreMutex.Lock()
+	defer keyStoreMutex.Unlock()
+	keyStore = keystore.NewDPAPIStore(dir)
+	return true
+}
+
+func storePrivateKey(account16 *uint16, key *keys.Key, ref16 *uint16, refLength uint32) bool {
+	store := openedKeyStore()
+	if store == nil {
+		log.Printf("Key store is not open")
+		return false
+	}
+	ref, err := store.Put(marshalCSharpStringPointerToString(account16), key)
+	if err != nil {
+		log.Printf("Unable to store private key: %v", err)
+		return false
+	}
+	if refLength <= uint32(len(ref.String())) {
+		store.Delete(ref)
+		return false
+	}
+
+	marshalStringToCSharpBuffer(ref.String(), ref16, refLength)
+	return true
+}
+
+//export GenerateStoredKeypair
+func GenerateStoredKeypair(account16 *uint16, publicKey *byte, ref16 *uint16, refLength uint32) bool {
+	key, err := keys.NewPrivateKey()
+	if err != nil {
+		log.Printf("Unable to generate private key: %v", err)
+		return false
+	}
+	defer key.Zero()
+
+	if !storePrivateKey(account16, key, ref16, refLength) {
+		return false
+	}
+	*marshalCSharpKeyPointer(publicKey) = *key.Public()
+	return true
+}
+
+//export StorePrivateKey
+func StorePrivateKey(account16 *uint16, privateKey *byte, ref16 *uint16, refLength uint32) bool {
+	key := marshalCSharpKeyPointer(privateKey)
+	if key.IsZero() {
+		return false
+	}
+	return storePrivateKey(account16, key, ref16, refLength)
+}
+
+func loadStoredKey(ref16 *uint16) *keys.Key {
+	store := openedKeyStore()
+	if store == nil {
+		log.Printf("Key store is not open")
+		return nil
+	}
+	key, err := keystore.Load(store, marshalCSharpStringPointerToString(ref16))
+	if err != nil {
+		log.Printf("Unable to load private key: %v", err)
+		return nil
+	}
+	return key
+}
+
+//export DeriveStoredPublicKey
+func DeriveStoredPublicKey(ref16 *uint16, publicKey *byte) bool {
+	key := loadStoredKey(ref16)
+	if key == nil {
+		return false
+	}
+	defer key.Zero()
+
+	*marshalCSharpKeyPointer(publicKey) = *key.Public()
+	return true
+}
+
+//export DeleteStoredKey
+func DeleteStoredKey(ref16 *uint16) bool {
+	store := openedKeyStore()
+	if store == nil {
+		return false
+	}
+	ref, err := keystore.ParseRef(marshalCSharpStringPointerToString(ref16))
+	if err == nil {
+		err = store.Delete(ref)
+	}
+	if err != nil {
+		log.Printf("Unable to delete private key: %v", err)
+		return false
+	}
+	return true
+}
+
+//export WireGuardBuildConfig
+func WireGuardBuildConfig(server16 *uint16, device16 *uint16, privateKey *byte, allowedIPs16 *uint16, port uint16, ipv6 bool, config16 *uint16, configLength uint32) bool {
+	options := &wgconfig.Options{
+		PrivateKey: marshalCSharpKeyPointer(privateKey),
+		AllowedIPs: marshalCSharpStringPointerToString(allowedIPs16),
+		Port:       int(port),
+		IPv6:       ipv6,
+	}
+	if err := json.Unmarshal([]byte(marshalCSharpStringPointerToString(server16)), &options.Server); err != nil {
+		log.Printf("Invalid server: %v", err)
+		return false
+	}
+	if err := json.Unmarshal([]byte(marshalCSharpStringPointerToString(device16)), &options.Device); err != nil {
+		log.Printf("Invalid device: %v", err)
+		return false
+	}
+
+	config, err := wgconfig.Build(options)
+	if err != nil {
+		log.Printf("Invalid config: %v", err)
+		return false
+	}
+	defer config.Zero()
+
+	text := config.WgQuick()
+	if configLength <= uint32(len(text)) {
+		return false
+	}
+
+	marshalStringToCSharpBuffer(text, config16, configLength)
+	return true
+}
+
+//export WriteTunnelHealthOptions
+func WriteTunnelHealthOptions(confFile16 *uint16, server16 *uint16) bool {
+	confFile := marshalCSharpStringPointerToString(confFile16)
+	name, err := conf.NameFromPath(confFile)
+	if err != nil {
+		log.Printf("Invalid config path: %v", err)
+		return false
+	}
+	var server guardian.Server
+	if err := json.Unmarshal([]byte(marshalCSharpStringPointerToString(server16)), &server); err != nil {
+		log.Printf("Invalid server: %v", err)
+		return false
+	}
+
+	// Options that were set by hand are kept
+	path := health.OptionsPath(confFile, name)
+	options, err := health.LoadOptions(path)
+	if err != nil {
+		log.Printf("Invalid tunnel health options: %v", err)
+		return false
+	}
+	options.SetServer(&server)
+	if err := options.Save(path); err != nil {
+		log.Printf("Unable to write tunnel health options: %v", err)
+		return false
+	}
+	return true
+}
+
+var serverSelector = servers.NewSelector(randomSeed())
+
+func randomSeed() int64 {
+	var seed [8]byte
+	if _, err := cryptorand.Read(seed[:]); err != nil {
+		log.Printf("Unable to seed server selection: %v", err)
+	}
+	return int64(binary.LittleEndian.Uint64(seed[:]))
+}
+
+//export SelectServer
+func SelectServer(serverList16 *uint16, country16 *uint16, city16 *uint16, selection16 *uint16, selectionLength uint32) bool {
+	var list guardian.ServerList
+	if err := json.Unmarshal([]byte(marshalCSharpStringPointerToString(serverList16)), &list); err != nil {
+		log.Printf("Invalid server list: %v", err)
+		return false
+	}
+
+	selection, err := serverSelector.Select(&list, marshalCSharpStringPointerToString(country16), marshalCSharpStringPointerToString(city16))
+	if err != nil {
+		log.Printf("Server selection error: %v", err)
+		return false
+	}
+
+	js, err := json.Marshal(selection)
+	if err != nil || selectionLength <= uint32(len(js)) {
+		return false
+	}
+
+	marshalStringToCSharpBuffer(string(js), selection16, selectionLength)
+	return true
+}
+
+//export ReportServerFailure
+func ReportServerFailure(hostname16 *uint16) {
+	serverSelector.Fail(marshalCSharpStringPointerToString(hostname16))
+}
+
+//export SeedServerSelection
+func SeedServerSelection(seed int64) {
+	serverSelector.Seed(seed)
+	serverSelector.Reset()
+}
+
+var (
+	tunnelMonitorsMutex sync.Mutex
+	tunnelMonitors      = make(map[string]*stats.Monitor)
+)
+
+func tunnelMonitor(tunnelName string) *stats.Monitor {
+	tunnelMonitorsMutex.Lock()
+	defer tunnelMonitorsMutex.Unlock()
+	monitor := tunnelMonitors[tunnelName]
+	if monitor == nil {
+		monitor = stats.NewMonitor(stats.NewPipeSource(tunnelName))
+		tunnelMonitors[tunnelName] = monitor
+	}
+	return monitor
+}
+
+//export GetTunnelStatistics
+func GetTunnelStatistics(tunnelName16 *uint16, statistics16 *uint16, statisticsLength uint32) bool {
+	peers, err := tunnelMonitor(marshalCSharpStringPointerToString(tunnelName16)).Sample()
+	if err != nil {
+		log.Printf("Unable to read tunnel statistics: %v", err)
+		return false
+	}
+	if peers == nil {
+		peers = []stats.Peer{}
+	}
+
+	js, err := json.Marshal(peers)
+	if err != nil || statisticsLength <= uint32(len(js)) {
+		return false
+	}
+
+	marshalStringToCSharpBuffer(string(js), statistics16, statisticsLength)
+	return true
+}
+
+//export SetTunnelStatisticsWindow
+func SetTunnelStatisticsWindow(tunnelName16 *uint16, windowMs uint32, samples uint32) {
+	tunnelMonitor(marshalCSharpStringPointerToString(tunnelName16)).SetWindow(time.Duration(windowMs)*time.Millisecond, int(samples))
+}
+
+//export GetTunnelConfiguration
+func GetTunnelConfiguration(tunnelName16 *uint16, configuration16 *uint16, configurationLength uint32) bool {
+	device, err := uapi.NewPipeClient(marshalCSharpStringPointerToString(tunnelName16)).Get()
+	if err != nil {
+		log.Printf("Unable to get tunnel configuration: %v", err)
+		return false
+	}
+	device.Zero()
+	device.PrivateKey = nil
+	for i := range device.Peers {
+		device.Peers[i].PresharedKey = nil
+	}
+
+	js, err := json.Marshal(device)
+	if err != nil || configurationLength <= uint32(len(js)) {
+		return false
+	}
+
+	marshalStringToCSharpBuffer(string(js), configuration16, configurationLength)
+	return true
+}
+
+//export SetTunnelConfiguration
+func SetTunnelConfiguration(tunnelName16 *uint16, configuration16 *uint16) bool {
+	var config uapi.Config
+	if err := json.Unmarshal([]byte(marshalCSharpStringPointerToString(configuration16)), &config); err != nil {
+		log.Printf("Unable to parse tunnel configuration: %v", err)
+		return false
+	}
+	defer func() {
+		if config.PrivateKey != nil {
+			config.PrivateKey.Zero()
 		}
+	}()
+	if err := uapi.NewPipeClient(marshalCSharpStringPointerToString(tunnelName16)).Set(&config); err != nil {
+		log.Printf("Unable to set tunnel configuration: %v", err)
+		return false
 	}
+	return true
+}
 
-	if len(nextHop) == 0 {
-		return 0, nil, errors.New("Unable to find default route")
+//export RankServers
+func RankServers(servers16 *uint16, privateKey *byte, concurrency uint32, timeoutMs uint32, results16 *uint16, resultsLength uint32) bool {
+	var candidates []guardian.Server
+	if err := json.Unmarshal([]byte(marshalCSharpStringPointerToString(servers16)), &candidates); err != nil {
+		log.Printf("Invalid servers: %v", err)
+		return false
+	}
+	key := *marshalCSharpKeyPointer(privateKey)
+	defer key.Zero()
+	if key.IsZero() {
+		return false
 	}
 
-	return luid, nextHop, nil
+	prober := &latency.Prober{
+		PrivateKey:  &key,
+		Concurrency: int(concurrency),
+		Timeout:     time.Duration(timeoutMs) * time.Millisecond,
+	}
+	results := prober.ProbeServers(context.Background(), candidates)
+	if results == nil {
+		results = []latency.Result{}
+	}
+
+	js, err := json.Marshal(results)
+	if err != nil || resultsLength <= uint32(len(js)) {
+		return false
+	}
+
+	marshalStringToCSharpBuffer(string(js), results16, resultsLength)
+	return true
+}
+
+var tunnelReconfigurationMutex sync.Mutex
+
+func reconfigureTunnel(tunnelName16 *uint16, change *reconfig.Change, deadlineMs uint32) bool {
+	tunnelReconfigurationMutex.Lock()
+	defer tunnelReconfigurationMutex.Unlock()
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if deadlineMs > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(deadlineMs)*time.Millisecond)
+	}
+	defer cancel()
+
+	reconfigurer := &reconfig.Reconfigurer{Client: uapi.NewPipeClient(marshalCSharpStringPointerToString(tunnelName16))}
+	if err := reconfigurer.Apply(ctx, change); err != nil {
+		log.Printf("Unable to reconfigure tunnel: %v", err)
+		return false
+	}
+	return true
+}
+
+//export SwitchTunnelServer
+func SwitchTunnelServer(tunnelName16 *uint16, publicKey *byte, endpoint16 *uint16, deadlineMs uint32) bool {
+	key := *marshalCSharpKeyPointer(publicKey)
+	if key.IsZero() {
+		return false
+	}
+	return reconfigureTunnel(tunnelName16, &reconfig.Change{
+		PublicKey: &key,
+		Endpoint:  marshalCSharpStringPointerToString(endpoint16),
+	}, deadlineMs)
+}
+
+//export RotateTunnelPrivateKey
+func RotateTunnelPrivateKey(tunnelName16 *uint16, privateKey *byte, deadlineMs uint32) bool {
+	key := *marshalCSharpKeyPointer(privateKey)
+	defer key.Zero()
+	if key.IsZero() {
+		return false
+	}
+	return reconfigureTunnel(tunnelName16, &reconfig.Change{PrivateKey: &key}, deadlineMs)
+}
+
+//export SetTunnelAllowedIPs
+func SetTunnelAllowedIPs(tunnelName16 *uint16, allowedIPs16 *uint16) bool {
+	ipnets, err := wgconfig.ParseAllowedIPs(marshalCSharpStringPointerToString(allowedIPs16))
+	if err != nil {
+		log.Printf("Invalid allowed IPs: %v", err)
+		return false
+	}
+	allowedIPs := make([]uapi.AllowedIP, len(ipnets))
+	for i := range ipnets {
+		allowedIPs[i] = uapi.AllowedIP{IPNet: ipnets[i]}
+	}
+	return reconfigureTunnel(tunnelName16, &reconfig.Change{AllowedIPs: allowedIPs}, 0)
+}
+
+//export ComputeAllowedIPs
+func ComputeAllowedIPs(excluded16 *uint16, excludeLocalNetworks bool, allowedIPs16 *uint16, allowedIPsLength uint32) bool {
+	excluded, err := cidr.Parse(marshalCSharpStringPointerToString(excluded16))
+	if err != nil {
+		log.Printf("Invalid excluded prefixes: %v", err)
+		return false
+	}
+	if excludeLocalNetworks {
+		excluded = append(excluded, cidr.LocalNetworks...)
+	}
+	allowed, err := cidr.AllowedIPs(excluded)
+	if err != nil {
+		log.Printf("Unable to compute allowed IPs: %v", err)
+		return false
+	}
+
+	text := cidr.Join(allowed)
+	if allowedIPsLength <= uint32(len(text)) {
+		return false
+	}
+
+	marshalStringToCSharpBuffer(text, allowedIPs16, allowedIPsLength)
+	return true
+}
+
+func testOutsideConnectivity(ip16 *uint16, host16 *uint16, url16 *uint16, expectedTestResult16 *uint16) *connectivity.Result {
+	ctx, cancel := context.WithTimeout(context.Background(), connectivity.DefaultProbeTimeout)
+	defer cancel()
+
+	prober := &connectivity.Prober{Routes: connectivity.NewRouteTable(routes.NewTable())}
+	return prober.Test(ctx, connectivity.Probe{
+		IP:       marshalCSharpStringPointerToString(ip16),
+		Host:     marshalCSharpStringPointerToString(host16),
+		URL:      marshalCSharpStringPointerToString(url16),
+		Expected: marshalCSharpStringPointerToString(expectedTestResult16),
+	})
 }
 
 //export TestOutsideConnectivity
 func TestOutsideConnectivity(ip16 *uint16, host16 *uint16, url16 *uint16, expectedTestResult16 *uint16) int32 {
-	ip := marshalCSharpStringPointerToString(ip16)
-	host := marshalCSharpStringPointerToString(host16)
-	url := marshalCSharpStringPointerToString(url16)
-	expectedTestResult := marshalCSharpStringPointerToString(expectedTestResult16)
+	return testOutsideConnectivity(ip16, host16, url16, expectedTestResult16).Legacy()
+}
+
+//export TestOutsideConnectivityDetailed
+func TestOutsideConnectivityDetailed(ip16 *uint16, host16 *uint16, url16 *uint16, expectedTestResult16 *uint16, detail16 *uint16, detailLength uint32) int32 {
+	result := testOutsideConnectivity(ip16, host16, url16, expectedTestResult16)
+	marshalStringToCSharpBuffer(result.JSON(), detail16, detailLength)
+	return int32(result.Code)
+}
 
-	// Attempt to locate a default route
-	luid, nextHop, err := findPhysicalDefaultRoute()
+//export DetectCaptivePortal
+func DetectCaptivePortal(targets16 *uint16, quorum int32, detail16 *uint16, detailLength uint32) int32 {
+	detector := &connectivity.Detector{
+		Prober: &connectivity.Prober{Routes: connectivity.NewRouteTable(routes.NewTable())},
+		Quorum: int(quorum),
+	}
+	err := json.Unmarshal([]byte(marshalCSharpStringPointerToString(targets16)), &detector.Targets)
+	if err != nil || len(detector.Targets) == 0 {
+		log.Printf("Invalid captive portal targets: %v", err)
+		return connectivity.LegacyNoConnectivity
+	}
+
+	verdict := detector.Detect(context.Background())
+	marshalStringToCSharpBuffer(verdict.JSON(), detail16, detailLength)
+	return verdict.Status
+}
+
+//export CheckDNSLeaks
+func CheckDNSLeaks(zone16 *uint16, queries uint32, timeoutMs uint32, report16 *uint16, reportLength uint32) bool {
+	if queries > dnsleak.MaxQueries {
+		queries = dnsleak.MaxQueries
+	}
+	checker := &dnsleak.Checker{
+		Zone:    marshalCSharpStringPointerToString(zone16),
+		Queries: int(queries),
+		Timeout: time.Duration(timeoutMs) * time.Millisecond,
+	}
+	report, err := checker.Check(context.Background())
 	if err != nil {
-		return -1
+		log.Printf("DNS leak check failed: %v", err)
+		if report == nil {
+			return false
+		}
 	}
 
-	destination := net.IPNet{IP: net.ParseIP(ip), Mask: net.IPv4Mask(255, 255, 255, 255)}
-	err = luid.AddRoute(destination, nextHop, 0)
+	js, err := json.Marshal(report)
+	if err != nil || reportLength <= uint32(len(js)) {
+		return false
+	}
+
+	marshalStringToCSharpBuffer(string(js), report16, reportLength)
+	return true
+}
 
-	// Check for errors, and check if route already exists
-	if err != nil && err != windows.ERROR_OBJECT_ALREADY_EXISTS {
-		return -1
+//export GetNetworkState
+func GetNetworkState(state16 *uint16, stateLength uint32) bool {
+	watcher, err := networkWatcher()
+	if err != nil {
+		log.Printf("Unable to watch network changes: %v", err)
+		return false
 	}
-	defer luid.DeleteRoute(destination, nextHop)
+	return marshalNetworkState(watcher.State(), state16, stateLength)
+}
 
-	// Attempt to setup a new GET request
-	req, err := http.NewRequest("GET", fmt.Sprintf(url, ip), nil)
+//export WaitForNetworkChange
+func WaitForNetworkChange(timeoutMs uint32, state16 *uint16, stateLength uint32) bool {
+	// Returns the new state once the physical default route, its interface
+	// or its address changes, such as when moving from Wi-Fi to Ethernet, so
+	// the client can recheck the tunnel and captive portals
+	watcher, err := networkWatcher()
 	if err != nil {
-		return -1
+		log.Printf("Unable to watch network changes: %v", err)
+		return false
 	}
+	changes := make(chan *routes.NetworkState, 1)
+	unsubscribe := watcher.Subscribe(func(state *routes.NetworkState) {
+		select {
+		case changes <- state:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	select {
+	case state := <-changes:
+		return marshalNetworkState(state, state16, stateLength)
+	case <-time.After(time.Duration(timeoutMs) * time.Millisecond):
+		return false
+	}
+}
 
-	// Redirects should be treated as an assumption that a captive portal is available
-	redirected := false
-	client := &http.Client{
-		CheckRedirect: func(r *http.Request, via []*http.Request) error {
-			redirected = true
-			return errors.New("Redirect detected.")
-		},
+func marshalNetworkState(state *routes.NetworkState, state16 *uint16, stateLength uint32) bool {
+	js, err := json.Marshal(state)
+	if err != nil || stateLength <= uint32(len(js)) {
+		return false
 	}
 
-	// Set the host header and try to retrieve the supplied URL
-	req.Host = host
-	resp, err := client.Do(req)
+	marshalStringToCSharpBuffer(string(js), state16, stateLength)
+	return true
+}
 
-	if redirected {
-		// We were redirected!
-		return 0
+//export VerifyContentSignature
+func VerifyContentSignature(body *byte, bodyLength uint32, contentSignature16 *uint16, chain16 *uint16, rootFingerprint16 *uint16) bool {
+	if contentSignature16 == nil || rootFingerprint16 == nil {
+		log.Printf("Content signature error: missing signature or root fingerprint")
+		return false
 	}
+	verifier := &contentsig.Verifier{RootFingerprint: marshalCSharpStringPointerToString(rootFingerprint16)}
 
+	// A null or empty chain means that the chain is fetched from the x5u in
+	// the header
+	var chain []byte
+	if chain16 != nil {
+		chain = []byte(marshalCSharpStringPointerToString(chain16))
+	}
+	err := verifier.Verify(
+		marshalCSharpByteArrayToSlice(body, bodyLength),
+		marshalCSharpStringPointerToString(contentSignature16),
+		chain,
+	)
 	if err != nil {
-		return -1
+		log.Printf("Content signature error: %v", err)
 	}
 
-	// Read response from the body
-	text, err := ioutil.ReadAll(resp.Body)
+	return err == nil
+}
+
+//export OpenTunnelLog
+func OpenTunnelLog(confFile16 *uint16) bool {
+	conf.PresetRootDirectory(filepath.Dir(marshalCSharpStringPointerToString(confFile16)))
+	logFile, err := conf.LogFile(false)
 	if err != nil {
-		return -1
+		log.Printf("Unable to find tunnel log: %v", err)
+		return false
+	}
+	follower, err := ringlog.NewFollower(logFile)
+	if err != nil {
+		log.Printf("Unable to open tunnel log: %v", err)
+		return false
 	}
 
-	// Compare retrieved body contents to expected contents
-	compareTestResult := strings.ReplaceAll(strings.ReplaceAll(string(text), "\n", ""), "\r", "")
-	if compareTestResult == expectedTestResult {
-		return 1
-	} else {
-		return 0
+	tunnelLogFollowerMutex.Lock()
+	defer tunnelLogFollowerMutex.Unlock()
+	if tunnelLogFollower != nil {
+		tunnelLogFollower.Close()
+	}
+	tunnelLogFollower = follower
+	return true
+}
+
+//export ReadTunnelLog
+func ReadTunnelLog(cursor uint64, lines16 *uint16, linesLength uint32) uint64 {
+	if lines16 == nil || linesLength == 0 {
+		return cursor
 	}
+
+	tunnelLogFollowerMutex.Lock()
+	if tunnelLogFollower != nil {
+		tunnelLogFollower.CopyTo(tunnelLog)
+	}
+	tunnelLogFollowerMutex.Unlock()
+
+	lines, next := tunnelLog.ReadLines(cursor, int(linesLength)-1)
+	marshalStringToCSharpBuffer(lines, lines16, linesLength)
+	return next
+}
+
+//export SetTunnelLogLevel
+func SetTunnelLogLevel(level int32) bool {
+	if !ringlog.Level(level).Valid() {
+		return false
+	}
+
+	tunnelLog.SetLevel(ringlog.Level(level))
+	return true
 }
 
 func main() {}
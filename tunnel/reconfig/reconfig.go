@@ -0,0 +1,241 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package reconfig applies changes to the peer of a running tunnel, and
+// rolls them back when the peer does not handshake.
+package reconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/uapi"
+)
+
+const (
+	// DefaultHandshakeTimeout is the time a changed peer has to handshake
+	// when the context has no deadline. It allows for the retries of
+	// wireguard-go, which resends initiations every 5 seconds.
+	DefaultHandshakeTimeout = 15 * time.Second
+
+	// DefaultPollInterval is how often the tunnel is polled for a handshake.
+	DefaultPollInterval = 100 * time.Millisecond
+
+	// probeKeepalive is the keepalive interval that makes the peer handshake
+	// straight away, when it has none.
+	probeKeepalive = 1
+)
+
+var (
+	ErrNoChange    = errors.New("The change is empty")
+	ErrNoPeer      = errors.New("The tunnel has no peer")
+	ErrManyPeers   = errors.New("The tunnel has more than one peer")
+	ErrNoHandshake = errors.New("The peer did not handshake before the deadline")
+	ErrUnknownKey  = errors.New("The tunnel has neither the placeholder nor the private key")
+)
+
+// Change is a delta to the configuration of a tunnel with a single peer.
+// Nil and empty fields are left unchanged.
+type Change struct {
+	// PrivateKey rotates the private key of the interface.
+	PrivateKey *keys.Key
+
+	// PublicKey replaces the peer, as when switching servers. The new peer
+	// keeps the endpoint, allowed IPs and keepalive of the old one unless they
+	// are changed too.
+	PublicKey *keys.Key
+
+	Endpoint   string
+	AllowedIPs []uapi.AllowedIP
+}
+
+// needsHandshake is whether the change makes a new session, which has to be
+// confirmed by a handshake.
+func (c *Change) needsHandshake() bool {
+	return c.PrivateKey != nil || c.PublicKey != nil || c.Endpoint != ""
+}
+
+// Reconfigurer applies changes to a tunnel.
+type Reconfigurer struct {
+	Client *uapi.Client
+
+	// PollInterval overrides DefaultPollInterval.
+	PollInterval time.Duration
+}
+
+// Apply applies a change with a single set operation. Changing keys or the
+// endpoint replaces the peer, so that it has to handshake, and the previous
+// configuration is restored if it does not before the deadline of ctx, or
+// DefaultHandshakeTimeout. Changing only the allowed IPs is applied in
+// place.
+func (r *Reconfigurer) Apply(ctx context.Context, change *Change) error {
+	if change.PrivateKey == nil && change.PublicKey == nil && change.Endpoint == "" && change.AllowedIPs == nil {
+		return ErrNoChange
+	}
+
+	snapshot, err := r.Client.Get()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Zero()
+	if len(snapshot.Peers) == 0 {
+		return ErrNoPeer
+	}
+	if len(snapshot.Peers) > 1 {
+		return ErrManyPeers
+	}
+	old := &snapshot.Peers[0]
+
+	if !change.needsHandshake() {
+		return r.Client.UpdatePeer(uapi.PeerConfig{
+			PublicKey:         old.PublicKey,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        change.AllowedIPs,
+		})
+	}
+
+	peer := peerConfig(old)
+	if change.PublicKey != nil {
+		peer.PublicKey = *change.PublicKey
+		peer.PresharedKey = nil
+	}
+	if change.Endpoint != "" {
+		peer.Endpoint = change.Endpoint
+	}
+	if change.AllowedIPs != nil {
+		peer.AllowedIPs = change.AllowedIPs
+	}
+	keepalive := *peer.PersistentKeepaliveInterval
+	if keepalive == 0 {
+		probe := uint16(probeKeepalive)
+		peer.PersistentKeepaliveInterval = &probe
+	}
+
+	// Replacing the peer drops its sessions, and a new peer with a keepalive
+	// sends an initiation straight away
+	err = r.Client.Set(&uapi.Config{
+		PrivateKey:   change.PrivateKey,
+		ReplacePeers: true,
+		Peers:        []uapi.PeerConfig{peer},
+	})
+	if err == nil {
+		err = r.waitForHandshake(ctx, &peer.PublicKey)
+	}
+	if err != nil {
+		if rollbackErr := r.restore(snapshot); rollbackErr != nil {
+			return fmt.Errorf("%v, and rolling back failed: %w", err, rollbackErr)
+		}
+		return err
+	}
+
+	if keepalive == 0 {
+		return r.Client.UpdatePeer(uapi.PeerConfig{PublicKey: peer.PublicKey, PersistentKeepaliveInterval: &keepalive})
+	}
+	return nil
+}
+
+func peerConfig(peer *uapi.Peer) uapi.PeerConfig {
+	keepalive := peer.PersistentKeepaliveInterval
+	return uapi.PeerConfig{
+		PublicKey:                   peer.PublicKey,
+		PresharedKey:                peer.PresharedKey,
+		Endpoint:                    peer.Endpoint,
+		PersistentKeepaliveInterval: &keepalive,
+		AllowedIPs:                  peer.AllowedIPs,
+	}
+}
+
+func (r *Reconfigurer) restore(snapshot *uapi.Device) error {
+	peers := make([]uapi.PeerConfig, len(snapshot.Peers))
+	for i := range snapshot.Peers {
+		peers[i] = peerConfig(&snapshot.Peers[i])
+	}
+	return r.Client.Set(&uapi.Config{
+		PrivateKey:   snapshot.PrivateKey,
+		ReplacePeers: true,
+		Peers:        peers,
+	})
+}
+
+func (r *Reconfigurer) waitForHandshake(ctx context.Context, publicKey *keys.Key) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultHandshakeTimeout)
+		defer cancel()
+	}
+	interval := r.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		device, err := r.Client.Get()
+		if err != nil {
+			return err
+		}
+		device.Zero()
+		for _, peer := range device.Peers {
+			if peer.PublicKey == *publicKey && !peer.LastHandshake.IsZero() {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return ErrNoHandshake
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// InstallPrivateKey replaces the placeholder private key of a tunnel that is
+// starting with the real one, so that the real key is never in its config
+// file. It waits until the tunnel answers with the placeholder, as the key
+// would otherwise be overwritten when the tunnel applies its config, and
+// gives up when ctx is done.
+func (r *Reconfigurer) InstallPrivateKey(ctx context.Context, placeholder *keys.Key, key *keys.Key) error {
+	interval := r.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// Errors are expected until the tunnel listens
+		device, err := r.Client.Get()
+		if err == nil {
+			current := device.PrivateKey
+			installed := current != nil && *current == *key
+			pending := current != nil && *current == *placeholder
+			device.Zero()
+			switch {
+			case installed:
+				return nil
+			case pending:
+				return r.Client.Set(&uapi.Config{PrivateKey: key})
+			case current != nil:
+				return ErrUnknownKey
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return fmt.Errorf("%w: %v", ctx.Err(), err)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
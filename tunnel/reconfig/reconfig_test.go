@@ -0,0 +1,308 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package reconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/internal/wgtest"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/uapi"
+)
+
+type testTunnel struct {
+	client, server *wgtest.Device
+	reconfigurer   *Reconfigurer
+}
+
+func newTestTunnel(t *testing.T) *testTunnel {
+	client := newDevice(t)
+	server := newDevice(t)
+	if err := wgtest.Connect(client, server); err != nil {
+		t.Fatal(err)
+	}
+	return &testTunnel{
+		client:       client,
+		server:       server,
+		reconfigurer: &Reconfigurer{Client: &uapi.Client{Dial: client.Dial}, PollInterval: 10 * time.Millisecond},
+	}
+}
+
+func (tt *testTunnel) Close() {
+	tt.client.Close()
+	tt.server.Close()
+}
+
+func newDevice(t *testing.T) *wgtest.Device {
+	d, err := wgtest.NewDevice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// accept makes server a peer of the client, routing 10.0.0.1 to it.
+func accept(t *testing.T, server *wgtest.Device, clientKey *keys.Key) {
+	if err := server.Set(fmt.Sprintf("public_key=%s\nallowed_ip=10.0.0.1/32\n", wgtest.HexKey(clientKey))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ping sends a packet from the client through the tunnel, and returns whether
+// server received it.
+func ping(client, server *wgtest.Device) bool {
+	client.TUN.Outbound <- wgtest.Ping(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+	select {
+	case <-server.TUN.Inbound:
+		return true
+	case <-time.After(5 * time.Second):
+		return false
+	}
+}
+
+func (tt *testTunnel) peer(t *testing.T) *uapi.Peer {
+	device, err := tt.reconfigurer.Client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(device.Peers) != 1 {
+		t.Fatalf("Expected 1 peer, got %d", len(device.Peers))
+	}
+	return &device.Peers[0]
+}
+
+func (tt *testTunnel) apply(timeout time.Duration, change *Change) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return tt.reconfigurer.Apply(ctx, change)
+}
+
+func TestSwitchServer(t *testing.T) {
+	tt := newTestTunnel(t)
+	defer tt.Close()
+	if !ping(tt.client, tt.server) {
+		t.Fatal("Tunnel does not work before the switch")
+	}
+
+	next := newDevice(t)
+	defer next.Close()
+	accept(t, next, tt.client.PublicKey())
+
+	err := tt.apply(5*time.Second, &Change{PublicKey: next.PublicKey(), Endpoint: next.Endpoint()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := tt.peer(t)
+	if peer.PublicKey != *next.PublicKey() || peer.Endpoint != next.Endpoint() || peer.LastHandshake.IsZero() {
+		t.Fatalf("Unexpected peer %+v after the switch", peer)
+	}
+	if peer.PersistentKeepaliveInterval != 0 {
+		t.Fatalf("Keepalive %d was not restored", peer.PersistentKeepaliveInterval)
+	}
+	if len(peer.AllowedIPs) != 1 || peer.AllowedIPs[0].String() != "10.0.0.2/32" {
+		t.Fatalf("Allowed IPs %v were not kept", peer.AllowedIPs)
+	}
+	if !ping(tt.client, next) {
+		t.Fatal("Tunnel does not work after the switch")
+	}
+}
+
+func TestSwitchServerRollback(t *testing.T) {
+	tt := newTestTunnel(t)
+	defer tt.Close()
+	before := tt.peer(t)
+
+	// This server does not know the client
+	next := newDevice(t)
+	defer next.Close()
+
+	err := tt.apply(300*time.Millisecond, &Change{PublicKey: next.PublicKey(), Endpoint: next.Endpoint()})
+	if err != ErrNoHandshake {
+		t.Fatalf("Expected ErrNoHandshake, got %v", err)
+	}
+	after := tt.peer(t)
+	if after.PublicKey != before.PublicKey || after.Endpoint != before.Endpoint || len(after.AllowedIPs) != 1 || after.PersistentKeepaliveInterval != 0 {
+		t.Fatalf("Peer %+v was not rolled back to %+v", after, before)
+	}
+	if !ping(tt.client, tt.server) {
+		t.Fatal("Tunnel does not work after the rollback")
+	}
+}
+
+func TestRotatePrivateKey(t *testing.T) {
+	tt := newTestTunnel(t)
+	defer tt.Close()
+
+	key, err := keys.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accept(t, tt.server, key.Public())
+
+	if err := tt.apply(5*time.Second, &Change{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	device, err := tt.reconfigurer.Client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *device.PrivateKey != *key {
+		t.Fatal("Private key was not rotated")
+	}
+	if !ping(tt.client, tt.server) {
+		t.Fatal("Tunnel does not work after the rotation")
+	}
+
+	// A key the server does not know is rolled back
+	unknown, err := keys.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.apply(300*time.Millisecond, &Change{PrivateKey: unknown}); err != ErrNoHandshake {
+		t.Fatalf("Expected ErrNoHandshake, got %v", err)
+	}
+	device, err = tt.reconfigurer.Client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *device.PrivateKey != *key {
+		t.Fatal("Private key was not rolled back")
+	}
+}
+
+func TestChangeEndpointRollback(t *testing.T) {
+	tt := newTestTunnel(t)
+	defer tt.Close()
+
+	// Nothing listens on the port of a closed device
+	closed := newDevice(t)
+	closed.Close()
+
+	err := tt.apply(300*time.Millisecond, &Change{Endpoint: closed.Endpoint()})
+	if err != ErrNoHandshake {
+		t.Fatalf("Expected ErrNoHandshake, got %v", err)
+	}
+	if peer := tt.peer(t); peer.Endpoint != tt.server.Endpoint() {
+		t.Fatalf("Endpoint %s was not rolled back", peer.Endpoint)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := tt.reconfigurer.Apply(ctx, &Change{Endpoint: closed.Endpoint()}); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if peer := tt.peer(t); peer.Endpoint != tt.server.Endpoint() {
+		t.Fatalf("Endpoint %s was not rolled back", peer.Endpoint)
+	}
+}
+
+func TestChangeAllowedIPs(t *testing.T) {
+	tt := newTestTunnel(t)
+	defer tt.Close()
+
+	var allowedIPs []uapi.AllowedIP
+	for _, cidr := range []string{"0.0.0.0/1", "128.0.0.0/1", "::/0"} {
+		ip, err := uapi.ParseAllowedIP(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allowedIPs = append(allowedIPs, ip)
+	}
+	if err := tt.reconfigurer.Apply(context.Background(), &Change{AllowedIPs: allowedIPs}); err != nil {
+		t.Fatal(err)
+	}
+	peer := tt.peer(t)
+	if len(peer.AllowedIPs) != 3 || peer.AllowedIPs[0].String() != "0.0.0.0/1" || peer.PublicKey != *tt.server.PublicKey() {
+		t.Fatalf("Unexpected peer %+v", peer)
+	}
+	if !peer.LastHandshake.IsZero() {
+		t.Fatal("Changing allowed IPs made a handshake")
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tt := newTestTunnel(t)
+	defer tt.Close()
+
+	if err := tt.reconfigurer.Apply(context.Background(), &Change{}); err != ErrNoChange {
+		t.Fatalf("Expected ErrNoChange, got %v", err)
+	}
+	if err := tt.reconfigurer.Apply(context.Background(), &Change{Endpoint: "vpn.example.com:51820"}); err != uapi.ErrInvalidEndpoint {
+		t.Fatalf("Expected ErrInvalidEndpoint, got %v", err)
+	}
+
+	other := newDevice(t)
+	defer other.Close()
+	accept(t, tt.client, other.PublicKey())
+	if err := tt.reconfigurer.Apply(context.Background(), &Change{Endpoint: other.Endpoint()}); err != ErrManyPeers {
+		t.Fatalf("Expected ErrManyPeers, got %v", err)
+	}
+
+	if err := tt.client.Set("replace_peers=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.reconfigurer.Apply(context.Background(), &Change{Endpoint: other.Endpoint()}); err != ErrNoPeer {
+		t.Fatalf("Expected ErrNoPeer, got %v", err)
+	}
+}
+
+func TestInstallPrivateKey(t *testing.T) {
+	tt := newTestTunnel(t)
+	defer tt.Close()
+	placeholder := tt.client.PrivateKey
+	key, err := keys.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accept(t, tt.server, key.Public())
+
+	// The tunnel does not listen straight away
+	var listening int32
+	reconfigurer := &Reconfigurer{
+		Client: &uapi.Client{Dial: func() (io.ReadWriteCloser, error) {
+			if atomic.LoadInt32(&listening) == 0 {
+				return nil, errors.New("Pipe not found")
+			}
+			return tt.client.Dial()
+		}},
+		PollInterval: 10 * time.Millisecond,
+	}
+	time.AfterFunc(50*time.Millisecond, func() { atomic.StoreInt32(&listening, 1) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := reconfigurer.InstallPrivateKey(ctx, &placeholder, key); err != nil {
+		t.Fatal(err)
+	}
+	if !ping(tt.client, tt.server) {
+		t.Fatal("Tunnel does not work with the installed key")
+	}
+	if err := reconfigurer.InstallPrivateKey(ctx, &placeholder, key); err != nil {
+		t.Fatalf("Installing the key again failed: %v", err)
+	}
+
+	other, err := keys.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reconfigurer.InstallPrivateKey(ctx, other, other); err != ErrUnknownKey {
+		t.Fatalf("Expected ErrUnknownKey, got %v", err)
+	}
+
+	atomic.StoreInt32(&listening, 0)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := reconfigurer.InstallPrivateKey(ctx, &placeholder, key); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a deadline error, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package ringlog
+
+import (
+	"sync"
+
+	"golang.zx2c4.com/wireguard/windows/ringlogger"
+)
+
+// Follower copies the lines of a wireguard-windows ringlogger file, such as
+// the log of the tunnel service, into a Logger.
+type Follower struct {
+	mu     sync.Mutex
+	rl     *ringlogger.Ringlogger
+	cursor uint32
+}
+
+// NewFollower opens the ringlogger file at path.
+func NewFollower(path string) (*Follower, error) {
+	rl, err := ringlogger.NewRinglogger(path, "GUI")
+	if err != nil {
+		return nil, err
+	}
+	return &Follower{rl: rl, cursor: ringlogger.CursorAll}, nil
+}
+
+// CopyTo appends the lines written since the last call to l, keeping their
+// timestamps.
+func (f *Follower) CopyTo(l *Logger) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lines, next := f.rl.FollowFromCursor(f.cursor)
+	f.cursor = next
+	for _, line := range lines {
+		level, message := ParseLine(line.Line)
+		l.Append(line.Stamp, level, message)
+	}
+}
+
+// Close unmaps the ringlogger file.
+func (f *Follower) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rl.Close()
+}
@@ -0,0 +1,229 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package ringlog is a fixed size in-memory log that can be read
+// incrementally with a cursor.
+package ringlog
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Level is the severity of an entry.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+var levelNames = [...]string{"DEBUG", "INFO", "WARNING", "ERROR"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("LEVEL(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// Valid reports whether l is a known level.
+func (l Level) Valid() bool {
+	return l >= LevelDebug && l <= LevelError
+}
+
+// DefaultCapacity is the number of entries kept by the tunnel log, which is
+// the same as the wireguard-windows ringlogger.
+const DefaultCapacity = 2048
+
+// TimeFormat is the format of the timestamp of a line.
+const TimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// Entry is a log entry. Cursor increases by one for every entry written.
+type Entry struct {
+	Cursor  uint64
+	Time    time.Time
+	Level   Level
+	Message string
+}
+
+// String returns the entry as a timestamped line, without a newline.
+func (e *Entry) String() string {
+	return fmt.Sprintf("%s [%s] %s", e.Time.UTC().Format(TimeFormat), e.Level, e.Message)
+}
+
+// Logger is a ring buffer of entries. It is safe for concurrent use.
+type Logger struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    uint64
+	level   Level
+	now     func() time.Time
+}
+
+// NewLogger returns a logger that keeps the last capacity entries at or
+// above LevelInfo.
+func NewLogger(capacity int) *Logger {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Logger{
+		entries: make([]Entry, capacity),
+		level:   LevelInfo,
+		now:     time.Now,
+	}
+}
+
+// SetLevel sets the lowest level that is kept. Entries below it are dropped
+// when they are written.
+func (l *Logger) SetLevel(level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+}
+
+// Level returns the lowest level that is kept.
+func (l *Logger) Level() Level {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.level
+}
+
+// Append adds an entry with the given time.
+func (l *Logger) Append(t time.Time, level Level, message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.level {
+		return
+	}
+	l.entries[l.next%uint64(len(l.entries))] = Entry{Cursor: l.next, Time: t, Level: level, Message: message}
+	l.next++
+}
+
+// Log adds an entry with the current time.
+func (l *Logger) Log(level Level, message string) {
+	l.Append(l.now(), level, message)
+}
+
+// Logf formats and adds an entry with the current time.
+func (l *Logger) Logf(level Level, format string, args ...interface{}) {
+	l.Log(level, fmt.Sprintf(format, args...))
+}
+
+// Write adds an entry for every line of p, so that the logger can be the
+// output of a log.Logger. The level of each line is parsed with ParseLine.
+func (l *Logger) Write(p []byte) (int, error) {
+	t := l.now()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\r\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		level, message := ParseLine(line)
+		l.Append(t, level, message)
+	}
+	return len(p), nil
+}
+
+// Cursor returns the cursor of the next entry to be written.
+func (l *Logger) Cursor() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next
+}
+
+// Since returns the entries from cursor onwards, and the cursor to pass to
+// read the entries that follow. Entries that were overwritten are skipped, so
+// a cursor of 0 returns everything that is still in the buffer.
+func (l *Logger) Since(cursor uint64) ([]Entry, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if oldest := l.oldest(); cursor < oldest {
+		cursor = oldest
+	}
+	if cursor >= l.next {
+		return nil, l.next
+	}
+	entries := make([]Entry, 0, l.next-cursor)
+	for c := cursor; c < l.next; c++ {
+		entries = append(entries, l.entries[c%uint64(len(l.entries))])
+	}
+	return entries, l.next
+}
+
+func (l *Logger) oldest() uint64 {
+	if l.next < uint64(len(l.entries)) {
+		return 0
+	}
+	return l.next - uint64(len(l.entries))
+}
+
+// ReadLines returns the entries from cursor onwards as newline terminated
+// lines, stopping before the text would be longer than max bytes, and the
+// cursor of the first entry that was not returned. An entry that is longer
+// than max on its own is truncated, so that readers always make progress.
+func (l *Logger) ReadLines(cursor uint64, max int) (string, uint64) {
+	entries, next := l.Since(cursor)
+	var b strings.Builder
+	for i := range entries {
+		line := entries[i].String() + "\n"
+		if b.Len()+len(line) > max {
+			if b.Len() > 0 || max < 1 {
+				return b.String(), entries[i].Cursor
+			}
+			return truncate(line, max-1) + "\n", entries[i].Cursor + 1
+		}
+		b.WriteString(line)
+	}
+	return b.String(), next
+}
+
+// truncate shortens s to at most n bytes without splitting a UTF-8 sequence.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+var levelPrefixes = []struct {
+	prefix string
+	level  Level
+}{
+	{"DEBUG: ", LevelDebug},
+	{"INFO: ", LevelInfo},
+	{"WARNING: ", LevelWarning},
+	{"ERROR: ", LevelError},
+}
+
+// ParseLine returns the level and message of a line in the format written by
+// wireguard-go loggers, where the level prefix may follow bracketed tags, such
+// as "[TUN] ERROR: message". Lines without a level are LevelInfo. The tags are
+// kept, and the level prefix is removed.
+func ParseLine(line string) (Level, string) {
+	rest := line
+	for strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "] ")
+		if end < 0 {
+			break
+		}
+		rest = rest[end+2:]
+	}
+	for _, p := range levelPrefixes {
+		if strings.HasPrefix(rest, p.prefix) {
+			tags := line[:len(line)-len(rest)]
+			return p.level, tags + rest[len(p.prefix):]
+		}
+	}
+	return LevelInfo, line
+}
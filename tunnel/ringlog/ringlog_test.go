@@ -0,0 +1,192 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package ringlog
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLogger(capacity int) *Logger {
+	l := NewLogger(capacity)
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+	l.now = func() time.Time { return stamp }
+	return l
+}
+
+func messages(entries []Entry) []string {
+	m := make([]string, len(entries))
+	for i := range entries {
+		m[i] = entries[i].Message
+	}
+	return m
+}
+
+func TestSince(t *testing.T) {
+	l := newTestLogger(4)
+	if entries, next := l.Since(0); len(entries) != 0 || next != 0 {
+		t.Fatalf("Unexpected entries %v in an empty log, next %d", entries, next)
+	}
+
+	for i := 0; i < 3; i++ {
+		l.Logf(LevelInfo, "line %d", i)
+	}
+	entries, next := l.Since(0)
+	if got := strings.Join(messages(entries), ","); got != "line 0,line 1,line 2" || next != 3 {
+		t.Fatalf("Unexpected entries %q, next %d", got, next)
+	}
+	if entries, _ := l.Since(next); len(entries) != 0 {
+		t.Fatalf("Unexpected entries %v after the last cursor", entries)
+	}
+
+	// Wrap around, overwriting line 0 to 2
+	for i := 3; i < 7; i++ {
+		l.Logf(LevelInfo, "line %d", i)
+	}
+	entries, next = l.Since(1)
+	if got := strings.Join(messages(entries), ","); got != "line 3,line 4,line 5,line 6" || next != 7 {
+		t.Fatalf("Unexpected entries %q after wrapping, next %d", got, next)
+	}
+	if entries[0].Cursor != 3 || entries[3].Cursor != 6 {
+		t.Fatalf("Unexpected cursors %d and %d", entries[0].Cursor, entries[3].Cursor)
+	}
+	entries, _ = l.Since(5)
+	if got := strings.Join(messages(entries), ","); got != "line 5,line 6" {
+		t.Fatalf("Unexpected entries %q", got)
+	}
+	if entries, next := l.Since(100); len(entries) != 0 || next != 7 {
+		t.Fatalf("Unexpected entries %v for a future cursor, next %d", entries, next)
+	}
+}
+
+func TestLevel(t *testing.T) {
+	l := newTestLogger(8)
+	l.Log(LevelDebug, "dropped")
+	l.Log(LevelInfo, "info")
+	l.SetLevel(LevelError)
+	if l.Level() != LevelError {
+		t.Fatal("Level was not set")
+	}
+	l.Log(LevelWarning, "dropped")
+	l.Log(LevelError, "error")
+	l.SetLevel(LevelDebug)
+	l.Log(LevelDebug, "debug")
+
+	entries, _ := l.Since(0)
+	if got := strings.Join(messages(entries), ","); got != "info,error,debug" {
+		t.Fatalf("Unexpected entries %q", got)
+	}
+	if LevelWarning.String() != "WARNING" || Level(9).Valid() || Level(9).String() != "LEVEL(9)" {
+		t.Fatal("Unexpected level names")
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		level   Level
+		message string
+	}{
+		{"plain", LevelInfo, "plain"},
+		{"DEBUG: peer(abcd) - Sending keepalive", LevelDebug, "peer(abcd) - Sending keepalive"},
+		{"[TUN] [Mozilla VPN] ERROR: Failed to read packet", LevelError, "[TUN] [Mozilla VPN] Failed to read packet"},
+		{"[TUN] WARNING: slow", LevelWarning, "[TUN] slow"},
+		{"[TUN] Starting", LevelInfo, "[TUN] Starting"},
+		{"[unterminated DEBUG: x", LevelInfo, "[unterminated DEBUG: x"},
+		{"message with ERROR: inside", LevelInfo, "message with ERROR: inside"},
+	}
+	for _, test := range tests {
+		level, message := ParseLine(test.line)
+		if level != test.level || message != test.message {
+			t.Errorf("ParseLine(%q) = %v %q, expected %v %q", test.line, level, message, test.level, test.message)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	l := newTestLogger(8)
+	l.SetLevel(LevelDebug)
+	logger := log.New(l, "", 0)
+	logger.Print("INFO: first")
+	logger.Print("DEBUG: second\nthird\r\n\n")
+
+	entries, _ := l.Since(0)
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	want := []string{
+		"2020-01-02T03:04:05.000006Z [INFO] first",
+		"2020-01-02T03:04:05.000006Z [DEBUG] second",
+		"2020-01-02T03:04:05.000006Z [INFO] third",
+	}
+	for i := range entries {
+		if entries[i].String() != want[i] {
+			t.Errorf("Unexpected line %q, expected %q", entries[i].String(), want[i])
+		}
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	l := newTestLogger(8)
+	for i := 0; i < 3; i++ {
+		l.Logf(LevelInfo, "line %d", i)
+	}
+	line := "2020-01-02T03:04:05.000006Z [INFO] line 0\n"
+
+	text, next := l.ReadLines(0, 2*len(line)+1)
+	if text != line+strings.Replace(line, "line 0", "line 1", 1) || next != 2 {
+		t.Fatalf("Unexpected text %q, next %d", text, next)
+	}
+	text, next = l.ReadLines(next, 1<<20)
+	if text != strings.Replace(line, "line 0", "line 2", 1) || next != 3 {
+		t.Fatalf("Unexpected text %q, next %d", text, next)
+	}
+
+	// A line that does not fit on its own is truncated rather than stalling
+	// the reader
+	if text, next = l.ReadLines(0, len(line)-1); text != line[:len(line)-2]+"\n" || next != 1 {
+		t.Fatalf("Unexpected text %q, next %d when no line fits", text, next)
+	}
+	if text, next = l.ReadLines(0, 0); text != "" || next != 0 {
+		t.Fatalf("Unexpected text %q, next %d without room", text, next)
+	}
+	l.Logf(LevelInfo, "line \u00e9")
+	if text, next = l.ReadLines(3, len(line)); text != line[:len(line)-2]+"\n" || next != 4 {
+		t.Fatalf("Unexpected text %q, next %d when truncating a multibyte character", text, next)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	l := NewLogger(64)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				fmt.Fprintf(l, "writer %d line %d\n", i, j)
+			}
+		}(i)
+	}
+	var cursor uint64
+	for i := 0; i < 100; i++ {
+		entries, next := l.Since(cursor)
+		for j := 1; j < len(entries); j++ {
+			if entries[j].Cursor != entries[j-1].Cursor+1 {
+				t.Fatal("Entries are not contiguous")
+			}
+		}
+		cursor = next
+	}
+	wg.Wait()
+	if l.Cursor() != 800 {
+		t.Fatalf("Expected 800 entries to be written, got %d", l.Cursor())
+	}
+}
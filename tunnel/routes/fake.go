@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"net"
+	"sync"
+)
+
+// FakeTable is an in-memory Table for tests.
+type FakeTable struct {
+	mu         sync.Mutex
+	routes     []Route
+	interfaces map[uint64]Interface
+	addresses  []Address
+}
+
+// NewFakeTable returns an empty in-memory table.
+func NewFakeTable() *FakeTable {
+	return &FakeTable{interfaces: make(map[uint64]Interface)}
+}
+
+// SetInterface adds or replaces an interface.
+func (f *FakeTable) SetInterface(iface Interface) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.interfaces[iface.LUID] = iface
+}
+
+// AddAddress assigns an address to an interface.
+func (f *FakeTable) AddAddress(luid uint64, ip net.IP) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.addresses = append(f.addresses, Address{LUID: luid, IP: ip})
+}
+
+// AddRouteWithMetric adds a route with the given metric.
+func (f *FakeTable) AddRouteWithMetric(luid uint64, destination net.IPNet, nextHop net.IP, metric uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.find(luid, destination, nextHop) >= 0 {
+		return ErrExists
+	}
+	f.routes = append(f.routes, Route{Destination: destination, NextHop: nextHop, LUID: luid, Metric: metric})
+	return nil
+}
+
+// HasRoute reports whether a route to destination exists on an interface.
+func (f *FakeTable) HasRoute(luid uint64, destination net.IPNet, nextHop net.IP) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.find(luid, destination, nextHop) >= 0
+}
+
+func (f *FakeTable) find(luid uint64, destination net.IPNet, nextHop net.IP) int {
+	for i, route := range f.routes {
+		if route.LUID == luid && route.Destination.String() == destination.String() && route.NextHop.Equal(nextHop) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *FakeTable) Routes(family Family) ([]Route, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var routes []Route
+	for _, route := range f.routes {
+		if FamilyOf(route.Destination.IP) == family {
+			routes = append(routes, route)
+		}
+	}
+	return routes, nil
+}
+
+func (f *FakeTable) Interface(luid uint64) (*Interface, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	iface, ok := f.interfaces[luid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &iface, nil
+}
+
+func (f *FakeTable) Addresses(family Family) ([]Address, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var addresses []Address
+	for _, address := range f.addresses {
+		if FamilyOf(address.IP) == family {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses, nil
+}
+
+func (f *FakeTable) AddRoute(luid uint64, destination net.IPNet, nextHop net.IP) error {
+	return f.AddRouteWithMetric(luid, destination, nextHop, 0)
+}
+
+func (f *FakeTable) DeleteRoute(luid uint64, destination net.IPNet, nextHop net.IP) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := f.find(luid, destination, nextHop)
+	if i < 0 {
+		return ErrNotFound
+	}
+	f.routes = append(f.routes[:i], f.routes[i+1:]...)
+	return nil
+}
@@ -0,0 +1,260 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+type netlinkTable struct{}
+
+// NewTable returns a table backed by rtnetlink. Interfaces are identified by
+// their index.
+func NewTable() Table {
+	return netlinkTable{}
+}
+
+func netlinkFamily(family Family) int {
+	if family == IPv6 {
+		return syscall.AF_INET6
+	}
+	return syscall.AF_INET
+}
+
+// dump returns the messages of a netlink dump request.
+func dump(request int, family int) ([]syscall.NetlinkMessage, error) {
+	rib, err := syscall.NetlinkRIB(request, family)
+	if err != nil {
+		return nil, err
+	}
+	return syscall.ParseNetlinkMessage(rib)
+}
+
+func attributes(m *syscall.NetlinkMessage) map[uint16][]byte {
+	attrs, err := syscall.ParseNetlinkRouteAttr(m)
+	if err != nil {
+		return nil
+	}
+	values := make(map[uint16][]byte, len(attrs))
+	for _, attr := range attrs {
+		values[attr.Attr.Type] = attr.Value
+	}
+	return values
+}
+
+func (netlinkTable) Routes(family Family) ([]Route, error) {
+	msgs, err := dump(syscall.RTM_GETROUTE, netlinkFamily(family))
+	if err != nil {
+		return nil, err
+	}
+	size := net.IPv4len * 8
+	if family == IPv6 {
+		size = net.IPv6len * 8
+	}
+
+	var routes []Route
+	for i := range msgs {
+		if msgs[i].Header.Type != syscall.RTM_NEWROUTE || len(msgs[i].Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		rtm := (*syscall.RtMsg)(unsafe.Pointer(&msgs[i].Data[0]))
+		attrs := attributes(&msgs[i])
+		table := uint32(rtm.Table)
+		if value, ok := attrs[syscall.RTA_TABLE]; ok && len(value) == 4 {
+			table = nativeEndian.Uint32(value)
+		}
+		if table != syscall.RT_TABLE_MAIN || rtm.Type != syscall.RTN_UNICAST {
+			continue
+		}
+		oif, ok := attrs[syscall.RTA_OIF]
+		if !ok || len(oif) != 4 {
+			// Multipath routes have no single interface
+			continue
+		}
+
+		route := Route{LUID: uint64(nativeEndian.Uint32(oif))}
+		route.Destination.Mask = net.CIDRMask(int(rtm.Dst_len), size)
+		route.Destination.IP = make(net.IP, size/8)
+		if dst, ok := attrs[syscall.RTA_DST]; ok {
+			copy(route.Destination.IP, dst)
+		}
+		if gateway, ok := attrs[syscall.RTA_GATEWAY]; ok {
+			route.NextHop = net.IP(gateway)
+		}
+		if priority, ok := attrs[syscall.RTA_PRIORITY]; ok && len(priority) == 4 {
+			route.Metric = nativeEndian.Uint32(priority)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func (netlinkTable) Interface(luid uint64) (*Interface, error) {
+	msgs, err := dump(syscall.RTM_GETLINK, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		if msgs[i].Header.Type != syscall.RTM_NEWLINK || len(msgs[i].Data) < syscall.SizeofIfInfomsg {
+			continue
+		}
+		ifim := (*syscall.IfInfomsg)(unsafe.Pointer(&msgs[i].Data[0]))
+		if uint64(ifim.Index) != luid {
+			continue
+		}
+		return &Interface{
+			LUID:  luid,
+			Up:    ifim.Flags&syscall.IFF_UP != 0 && ifim.Flags&syscall.IFF_RUNNING != 0,
+			Index: uint32(ifim.Index),
+
+			// Layer 3 devices, such as TUN and WireGuard, have no link layer
+			// address type
+			Tunnel: ifim.Type == syscall.ARPHRD_NONE,
+		}, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (netlinkTable) Addresses(family Family) ([]Address, error) {
+	msgs, err := dump(syscall.RTM_GETADDR, netlinkFamily(family))
+	if err != nil {
+		return nil, err
+	}
+	var addresses []Address
+	for i := range msgs {
+		if msgs[i].Header.Type != syscall.RTM_NEWADDR || len(msgs[i].Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		ifam := (*syscall.IfAddrmsg)(unsafe.Pointer(&msgs[i].Data[0]))
+		attrs := attributes(&msgs[i])
+		// IFA_LOCAL is the address of point to point interfaces, whose
+		// IFA_ADDRESS is the address of the other end
+		ip, ok := attrs[syscall.IFA_LOCAL]
+		if !ok {
+			ip, ok = attrs[syscall.IFA_ADDRESS]
+		}
+		if ok {
+			addresses = append(addresses, Address{LUID: uint64(ifam.Index), IP: net.IP(ip)})
+		}
+	}
+	return addresses, nil
+}
+
+func (netlinkTable) AddRoute(luid uint64, destination net.IPNet, nextHop net.IP) error {
+	err := changeRoute(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, luid, destination, nextHop)
+	if err == syscall.EEXIST {
+		return ErrExists
+	}
+	return err
+}
+
+func (netlinkTable) DeleteRoute(luid uint64, destination net.IPNet, nextHop net.IP) error {
+	err := changeRoute(syscall.RTM_DELROUTE, 0, luid, destination, nextHop)
+	if err == syscall.ESRCH {
+		return ErrNotFound
+	}
+	return err
+}
+
+var nativeEndian = func() binary.ByteOrder {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+func appendAttribute(b []byte, attrType uint16, value []byte) []byte {
+	length := syscall.SizeofRtAttr + len(value)
+	attr := make([]byte, (length+syscall.RTA_ALIGNTO-1)&^(syscall.RTA_ALIGNTO-1))
+	nativeEndian.PutUint16(attr[0:], uint16(length))
+	nativeEndian.PutUint16(attr[2:], attrType)
+	copy(attr[syscall.SizeofRtAttr:], value)
+	return append(b, attr...)
+}
+
+func changeRoute(msgType uint16, flags uint16, luid uint64, destination net.IPNet, nextHop net.IP) error {
+	family, ip := syscall.AF_INET, destination.IP.To4()
+	if ip == nil {
+		family, ip = syscall.AF_INET6, destination.IP.To16()
+	}
+	ones, _ := destination.Mask.Size()
+
+	rtm := syscall.RtMsg{
+		Family:   uint8(family),
+		Dst_len:  uint8(ones),
+		Table:    syscall.RT_TABLE_MAIN,
+		Protocol: syscall.RTPROT_BOOT,
+		Scope:    syscall.RT_SCOPE_UNIVERSE,
+		Type:     syscall.RTN_UNICAST,
+	}
+	var gateway net.IP
+	if nextHop != nil && !nextHop.IsUnspecified() {
+		if gateway = nextHop.To4(); family == syscall.AF_INET6 || gateway == nil {
+			gateway = nextHop.To16()
+		}
+	} else {
+		rtm.Scope = syscall.RT_SCOPE_LINK
+	}
+
+	payload := (*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&rtm))[:]
+	payload = appendAttribute(append([]byte(nil), payload...), syscall.RTA_DST, ip)
+	if gateway != nil {
+		payload = appendAttribute(payload, syscall.RTA_GATEWAY, gateway)
+	}
+	oif := make([]byte, 4)
+	nativeEndian.PutUint32(oif, uint32(luid))
+	payload = appendAttribute(payload, syscall.RTA_OIF, oif)
+
+	return netlinkRequest(msgType, flags, payload)
+}
+
+// netlinkRequest sends a request and waits for its acknowledgement.
+func netlinkRequest(msgType uint16, flags uint16, payload []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	const seq = 1
+	msg := make([]byte, syscall.NLMSG_HDRLEN+len(payload))
+	nativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:], msgType)
+	nativeEndian.PutUint16(msg[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags)
+	nativeEndian.PutUint32(msg[8:], seq)
+	copy(msg[syscall.NLMSG_HDRLEN:], payload)
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != syscall.NLMSG_ERROR || len(m.Data) < 4 {
+				continue
+			}
+			if errno := int32(nativeEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNetlinkDefaultRoute(t *testing.T) {
+	table := NewTable()
+	route, err := DefaultRoute(table, IPv4)
+	if err == ErrNoDefaultRoute {
+		t.Skip("No IPv4 default route")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	iface, err := table.Interface(route.LUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !iface.Up || iface.Tunnel {
+		t.Fatalf("Unexpected default route interface %+v", iface)
+	}
+	if _, err := DefaultRouteAddress(table, IPv4); err != nil && err != ErrNoAddress {
+		t.Fatal(err)
+	}
+}
+
+func TestNetlinkChangeRoute(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip(err)
+	}
+	table := NewTable()
+	destination := mustCIDR("198.51.100.7/32")
+	luid := uint64(lo.Index)
+
+	changes := make(chan struct{}, 16)
+	stop, err := NotifyChanges(func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	if err := table.AddRoute(luid, destination, nil); errors.Is(err, os.ErrPermission) {
+		t.Skip("Changing routes needs CAP_NET_ADMIN")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer table.DeleteRoute(luid, destination, nil)
+
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("No notification for the new route")
+	}
+	routes, err := table.Routes(IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, route := range routes {
+		found = found || (route.LUID == luid && route.Destination.String() == destination.String())
+	}
+	if !found {
+		t.Fatalf("Route %s not in %v", destination.String(), routes)
+	}
+
+	if err := table.AddRoute(luid, destination, nil); err != ErrExists {
+		t.Fatalf("Expected ErrExists, got %v", err)
+	}
+	if err := table.DeleteRoute(luid, destination, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.DeleteRoute(luid, destination, nil); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func rtnetlinkGroup(group uint32) uint32 {
+	return 1 << (group - 1)
+}
+
+// NotifyChanges calls callback from another goroutine whenever a route,
+// interface or address changes, until stop is called.
+func NotifyChanges(callback func()) (stop func() error, err error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	groups := rtnetlinkGroup(syscall.RTNLGRP_LINK) |
+		rtnetlinkGroup(syscall.RTNLGRP_IPV4_IFADDR) |
+		rtnetlinkGroup(syscall.RTNLGRP_IPV4_ROUTE) |
+		rtnetlinkGroup(syscall.RTNLGRP_IPV6_IFADDR) |
+		rtnetlinkGroup(syscall.RTNLGRP_IPV6_ROUTE)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// A non-blocking file uses the runtime poller, so closing it stops the
+	// read below
+	file := os.NewFile(uintptr(fd), "rtnetlink")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, syscall.Getpagesize())
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				if errors.Is(err, syscall.ENOBUFS) {
+					// Notifications were dropped, which is a change too
+					callback()
+					continue
+				}
+				return
+			}
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil || len(msgs) == 0 {
+				continue
+			}
+			callback()
+		}
+	}()
+
+	return func() error {
+		err := file.Close()
+		<-done
+		return err
+	}, nil
+}
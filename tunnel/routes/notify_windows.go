@@ -0,0 +1,48 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+// NotifyChanges calls callback from a system thread whenever a route,
+// interface or address changes, until stop is called. The callback must not
+// block.
+func NotifyChanges(callback func()) (stop func() error, err error) {
+	routeCallback, err := winipcfg.RegisterRouteChangeCallback(func(notificationType winipcfg.MibNotificationType, route *winipcfg.MibIPforwardRow2) {
+		callback()
+	})
+	if err != nil {
+		return nil, err
+	}
+	interfaceCallback, err := winipcfg.RegisterInterfaceChangeCallback(func(notificationType winipcfg.MibNotificationType, iface *winipcfg.MibIPInterfaceRow) {
+		callback()
+	})
+	if err != nil {
+		routeCallback.Unregister()
+		return nil, err
+	}
+	addressCallback, err := winipcfg.RegisterUnicastAddressChangeCallback(func(notificationType winipcfg.MibNotificationType, addr *winipcfg.MibUnicastIPAddressRow) {
+		callback()
+	})
+	if err != nil {
+		interfaceCallback.Unregister()
+		routeCallback.Unregister()
+		return nil, err
+	}
+
+	return func() error {
+		err := addressCallback.Unregister()
+		if unregisterErr := interfaceCallback.Unregister(); err == nil {
+			err = unregisterErr
+		}
+		if unregisterErr := routeCallback.Unregister(); err == nil {
+			err = unregisterErr
+		}
+		return err
+	}, nil
+}
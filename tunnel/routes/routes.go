@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package routes abstracts the system routing table, and holds the policy
+// used to pick the physical default route out of it.
+package routes
+
+import (
+	"errors"
+	"net"
+	"sort"
+)
+
+// Family is an IP address family.
+type Family int
+
+const (
+	IPv4 Family = 4
+	IPv6 Family = 6
+)
+
+// FamilyOf returns the address family of ip.
+func FamilyOf(ip net.IP) Family {
+	if ip.To4() != nil {
+		return IPv4
+	}
+	return IPv6
+}
+
+var (
+	ErrNoDefaultRoute = errors.New("Unable to find default route")
+	ErrNoAddress      = errors.New("Unable to find an address on the default route interface")
+	ErrExists         = errors.New("Route already exists")
+	ErrNotFound       = errors.New("Route or interface not found")
+)
+
+// Route is a row of the routing table.
+type Route struct {
+	Destination net.IPNet
+	NextHop     net.IP
+	LUID        uint64
+	Metric      uint32
+}
+
+// Interface is the state of a network interface that routing cares about.
+type Interface struct {
+	LUID uint64
+	Up   bool
+
+	// Index is the interface index, which sockets are bound with.
+	Index uint32
+
+	// Tunnel is set for layer 3 interfaces, such as Wintun, which Windows
+	// reports with the NdisMediumIP media type.
+	Tunnel bool
+}
+
+// Address is a unicast address assigned to an interface.
+type Address struct {
+	LUID uint64
+	IP   net.IP
+}
+
+// Table is a routing table backend.
+type Table interface {
+	Routes(family Family) ([]Route, error)
+	Interface(luid uint64) (*Interface, error)
+	Addresses(family Family) ([]Address, error)
+
+	// AddRoute returns ErrExists if the route is already present.
+	AddRoute(luid uint64, destination net.IPNet, nextHop net.IP) error
+	DeleteRoute(luid uint64, destination net.IPNet, nextHop net.IP) error
+}
+
+// DefaultRoute returns the physical default route of family. Only routes with
+// a prefix length of 0 on interfaces that are up are considered, and tunnel
+// interfaces are skipped so that the result stays the same while the VPN is
+// connected. The route with the lowest metric wins, and ties go to the
+// interface with the lowest LUID, so that the result does not depend on the
+// order of the table.
+func DefaultRoute(t Table, family Family) (*Route, error) {
+	r, err := t.Routes(family)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []Route
+	for i := range r {
+		if ones, _ := r[i].Destination.Mask.Size(); ones != 0 {
+			continue
+		}
+		iface, err := t.Interface(r[i].LUID)
+		if err != nil || !iface.Up || iface.Tunnel {
+			continue
+		}
+		candidates = append(candidates, r[i])
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoDefaultRoute
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Metric != candidates[j].Metric {
+			return candidates[i].Metric < candidates[j].Metric
+		}
+		return candidates[i].LUID < candidates[j].LUID
+	})
+	return &candidates[0], nil
+}
+
+// DefaultInterface returns the interface of the physical default route of
+// family.
+func DefaultInterface(t Table, family Family) (*Interface, error) {
+	route, err := DefaultRoute(t, family)
+	if err != nil {
+		return nil, err
+	}
+	return t.Interface(route.LUID)
+}
+
+// DefaultRouteAddress returns the first address of family assigned to the
+// interface of the physical default route. Link-local addresses are skipped,
+// as they are not reachable from other hosts.
+func DefaultRouteAddress(t Table, family Family) (net.IP, error) {
+	route, err := DefaultRoute(t, family)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := t.Addresses(family)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if addr.LUID == route.LUID && !addr.IP.IsLinkLocalUnicast() {
+			return addr.IP, nil
+		}
+	}
+	return nil, ErrNoAddress
+}
@@ -0,0 +1,155 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"net"
+	"testing"
+)
+
+func mustCIDR(cidr string) net.IPNet {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return *ipnet
+}
+
+type fakeRoute struct {
+	luid        uint64
+	destination string
+	nextHop     string
+	metric      uint32
+}
+
+func newTable(interfaces []Interface, routes []fakeRoute) *FakeTable {
+	table := NewFakeTable()
+	for _, iface := range interfaces {
+		table.SetInterface(iface)
+	}
+	for _, route := range routes {
+		table.AddRouteWithMetric(route.luid, mustCIDR(route.destination), net.ParseIP(route.nextHop), route.metric)
+	}
+	return table
+}
+
+func TestDefaultRoute(t *testing.T) {
+	ethernet := Interface{LUID: 1, Up: true}
+	wifi := Interface{LUID: 2, Up: true}
+	down := Interface{LUID: 3}
+	wintun := Interface{LUID: 4, Up: true, Tunnel: true}
+	interfaces := []Interface{ethernet, wifi, down, wintun}
+
+	tests := []struct {
+		name    string
+		routes  []fakeRoute
+		family  Family
+		luid    uint64
+		nextHop string
+	}{
+		{"Lowest metric wins", []fakeRoute{
+			{2, "0.0.0.0/0", "192.168.1.1", 50},
+			{1, "0.0.0.0/0", "10.0.0.1", 25},
+		}, IPv4, 1, "10.0.0.1"},
+		{"Non default prefixes are ignored", []fakeRoute{
+			{1, "10.0.0.0/8", "10.0.0.1", 0},
+			{2, "0.0.0.0/0", "192.168.1.1", 50},
+		}, IPv4, 2, "192.168.1.1"},
+		{"Interfaces that are down are skipped", []fakeRoute{
+			{3, "0.0.0.0/0", "172.16.0.1", 0},
+			{2, "0.0.0.0/0", "192.168.1.1", 50},
+		}, IPv4, 2, "192.168.1.1"},
+		{"Tunnel interfaces are skipped", []fakeRoute{
+			{4, "0.0.0.0/0", "10.64.0.1", 0},
+			{2, "0.0.0.0/0", "192.168.1.1", 50},
+		}, IPv4, 2, "192.168.1.1"},
+		{"Unknown interfaces are skipped", []fakeRoute{
+			{9, "0.0.0.0/0", "10.99.0.1", 0},
+			{2, "0.0.0.0/0", "192.168.1.1", 50},
+		}, IPv4, 2, "192.168.1.1"},
+		{"Ties go to the lowest LUID", []fakeRoute{
+			{2, "0.0.0.0/0", "192.168.1.1", 25},
+			{1, "0.0.0.0/0", "10.0.0.1", 25},
+		}, IPv4, 1, "10.0.0.1"},
+		{"IPv6 routes are separate", []fakeRoute{
+			{1, "0.0.0.0/0", "10.0.0.1", 0},
+			{2, "::/0", "fe80::1", 50},
+		}, IPv6, 2, "fe80::1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route, err := DefaultRoute(newTable(interfaces, test.routes), test.family)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if route.LUID != test.luid || !route.NextHop.Equal(net.ParseIP(test.nextHop)) {
+				t.Fatalf("Unexpected route %v via %v", route.LUID, route.NextHop)
+			}
+		})
+	}
+
+	t.Run("No usable default route", func(t *testing.T) {
+		table := newTable(interfaces, []fakeRoute{
+			{3, "0.0.0.0/0", "172.16.0.1", 0},
+			{4, "0.0.0.0/0", "10.64.0.1", 0},
+			{1, "0.0.0.0/0", "10.0.0.1", 0},
+		})
+		if _, err := DefaultRoute(table, IPv6); err != ErrNoDefaultRoute {
+			t.Fatalf("Expected ErrNoDefaultRoute, got %v", err)
+		}
+	})
+}
+
+func TestDefaultRouteAddress(t *testing.T) {
+	table := newTable([]Interface{{LUID: 1, Up: true}, {LUID: 2, Up: true}}, []fakeRoute{
+		{1, "0.0.0.0/0", "10.0.0.1", 10},
+		{1, "::/0", "fe80::1", 10},
+		{2, "0.0.0.0/0", "192.168.1.1", 50},
+	})
+	table.AddAddress(2, net.ParseIP("192.168.1.20"))
+	table.AddAddress(1, net.ParseIP("169.254.10.10"))
+	table.AddAddress(1, net.ParseIP("10.0.0.20"))
+	table.AddAddress(1, net.ParseIP("fe80::20"))
+
+	ip, err := DefaultRouteAddress(table, IPv4)
+	if err != nil || !ip.Equal(net.ParseIP("10.0.0.20")) {
+		t.Fatalf("Unexpected address %v: %v", ip, err)
+	}
+	if _, err := DefaultRouteAddress(table, IPv6); err != ErrNoAddress {
+		t.Fatalf("Expected ErrNoAddress, got %v", err)
+	}
+}
+
+func TestDefaultInterface(t *testing.T) {
+	table := newTable([]Interface{{LUID: 1, Up: true, Index: 7}, {LUID: 2, Up: true, Index: 3, Tunnel: true}}, []fakeRoute{
+		{1, "0.0.0.0/0", "10.0.0.1", 50},
+		{2, "0.0.0.0/0", "10.64.0.1", 0},
+	})
+	iface, err := DefaultInterface(table, IPv4)
+	if err != nil || iface.Index != 7 {
+		t.Fatalf("Unexpected interface %+v: %v", iface, err)
+	}
+	if _, err := DefaultInterface(table, IPv6); err != ErrNoDefaultRoute {
+		t.Fatalf("Expected ErrNoDefaultRoute, got %v", err)
+	}
+}
+
+func TestFakeTable(t *testing.T) {
+	table := NewFakeTable()
+	destination := mustCIDR("192.0.2.1/32")
+	if err := table.AddRoute(1, destination, net.ParseIP("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.AddRoute(1, destination, net.ParseIP("10.0.0.1")); err != ErrExists {
+		t.Fatalf("Expected ErrExists, got %v", err)
+	}
+	if err := table.DeleteRoute(1, destination, net.ParseIP("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.DeleteRoute(1, destination, net.ParseIP("10.0.0.1")); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultDebounce is how long the network has to be quiet after a change
+// before it is looked at, so that flapping links are reported once.
+const DefaultDebounce = 500 * time.Millisecond
+
+// DefaultRouteState is the physical default route of a family, and the
+// address of its interface, as DefaultRoute and DefaultRouteAddress find
+// them.
+type DefaultRouteState struct {
+	LUID    uint64 `json:"luid"`
+	NextHop net.IP `json:"next_hop,omitempty"`
+	Metric  uint32 `json:"metric"`
+
+	// Address is nil when the interface has no usable address yet.
+	Address net.IP `json:"address,omitempty"`
+}
+
+func (s *DefaultRouteState) equal(other *DefaultRouteState) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+	return s.LUID == other.LUID && s.NextHop.Equal(other.NextHop) && s.Metric == other.Metric && s.Address.Equal(other.Address)
+}
+
+// NetworkState is the physical default route of each family, or nil for
+// families without one.
+type NetworkState struct {
+	IPv4 *DefaultRouteState `json:"ipv4"`
+	IPv6 *DefaultRouteState `json:"ipv6"`
+}
+
+// Equal reports whether two states have the same routes and addresses.
+func (s *NetworkState) Equal(other *NetworkState) bool {
+	return s.IPv4.equal(other.IPv4) && s.IPv6.equal(other.IPv6)
+}
+
+func defaultRouteState(t Table, family Family) (*DefaultRouteState, error) {
+	route, err := DefaultRoute(t, family)
+	if err == ErrNoDefaultRoute {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &DefaultRouteState{LUID: route.LUID, NextHop: route.NextHop, Metric: route.Metric}
+	state.Address, err = DefaultRouteAddress(t, family)
+	if err != nil && err != ErrNoAddress {
+		return nil, err
+	}
+	return state, nil
+}
+
+// CurrentNetworkState returns the network state of a table.
+func CurrentNetworkState(t Table) (*NetworkState, error) {
+	var state NetworkState
+	var err error
+	if state.IPv4, err = defaultRouteState(t, IPv4); err != nil {
+		return nil, err
+	}
+	if state.IPv6, err = defaultRouteState(t, IPv6); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Watcher tells subscribers when the network state changes, such as when
+// the system moves from Wi-Fi to Ethernet.
+type Watcher struct {
+	table    Table
+	debounce time.Duration
+	stop     func() error
+
+	// updateMutex serializes updates, so subscribers see states in order
+	updateMutex sync.Mutex
+
+	mutex       sync.Mutex
+	state       *NetworkState
+	timer       *time.Timer
+	closed      bool
+	subscribers map[int]func(*NetworkState)
+	nextID      int
+}
+
+// NotifyFunc registers a callback for changes to the table, as
+// NotifyChanges does for the system table.
+type NotifyFunc func(callback func()) (stop func() error, err error)
+
+// NewWatcher watches a table for changes that notify reports. A zero
+// debounce is DefaultDebounce.
+func NewWatcher(table Table, notify NotifyFunc, debounce time.Duration) (*Watcher, error) {
+	if debounce <= 0 {
+		debounce = DefaultDebounce
+	}
+	w := &Watcher{
+		table:       table,
+		debounce:    debounce,
+		subscribers: make(map[int]func(*NetworkState)),
+	}
+	var err error
+	if w.state, err = CurrentNetworkState(table); err != nil {
+		return nil, err
+	}
+	if w.stop, err = notify(w.changed); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// State returns the last known network state.
+func (w *Watcher) State() *NetworkState {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.state
+}
+
+// Subscribe calls callback with the new state after each change, until
+// unsubscribe is called. Callbacks must not block.
+func (w *Watcher) Subscribe(callback func(*NetworkState)) (unsubscribe func()) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	id := w.nextID
+	w.nextID++
+	w.subscribers[id] = callback
+	return func() {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		delete(w.subscribers, id)
+	}
+}
+
+// changed restarts the debounce timer.
+func (w *Watcher) changed() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.debounce, w.update)
+	} else {
+		w.timer.Reset(w.debounce)
+	}
+}
+
+func (w *Watcher) update() {
+	w.updateMutex.Lock()
+	defer w.updateMutex.Unlock()
+
+	// Keep the last state when the table cannot be read, and wait for the
+	// next change
+	state, err := CurrentNetworkState(w.table)
+	if err != nil {
+		return
+	}
+
+	w.mutex.Lock()
+	if w.closed || state.Equal(w.state) {
+		w.mutex.Unlock()
+		return
+	}
+	w.state = state
+	subscribers := make([]func(*NetworkState), 0, len(w.subscribers))
+	for _, subscriber := range w.subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+	w.mutex.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber(state)
+	}
+}
+
+// Close stops watching. Subscribers are not called after it returns.
+func (w *Watcher) Close() error {
+	err := w.stop()
+	w.mutex.Lock()
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.mutex.Unlock()
+
+	// Wait for an update in progress
+	w.updateMutex.Lock()
+	w.updateMutex.Unlock()
+	return err
+}
@@ -0,0 +1,152 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNotifier hands the callback of a watcher to the test.
+type fakeNotifier struct {
+	mutex    sync.Mutex
+	callback func()
+	stopped  bool
+}
+
+func (f *fakeNotifier) notify(callback func()) (func() error, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.callback = callback
+	return func() error {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		f.stopped = true
+		return nil
+	}, nil
+}
+
+func (f *fakeNotifier) changed() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.stopped {
+		f.callback()
+	}
+}
+
+func expectNoState(t *testing.T, states <-chan *NetworkState, wait time.Duration) {
+	select {
+	case state := <-states:
+		t.Fatalf("Unexpected state %+v", state)
+	case <-time.After(wait):
+	}
+}
+
+func expectStateOf(t *testing.T, states <-chan *NetworkState) *NetworkState {
+	select {
+	case state := <-states:
+		return state
+	case <-time.After(time.Second):
+		t.Fatal("No state change")
+		return nil
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	wifi := Interface{LUID: 2, Up: true}
+	table := newTable([]Interface{{LUID: 1, Up: true}, wifi}, []fakeRoute{
+		{2, "0.0.0.0/0", "192.168.1.1", 50},
+	})
+	table.AddAddress(2, net.ParseIP("192.168.1.20"))
+
+	notifier := &fakeNotifier{}
+	w, err := NewWatcher(table, notifier.notify, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if state := w.State(); state.IPv4 == nil || state.IPv4.LUID != 2 || !state.IPv4.Address.Equal(net.ParseIP("192.168.1.20")) || state.IPv6 != nil {
+		t.Fatalf("Unexpected initial state %+v", state)
+	}
+
+	states := make(chan *NetworkState, 8)
+	unsubscribe := w.Subscribe(func(state *NetworkState) { states <- state })
+
+	// Moving from Wi-Fi to Ethernet is reported once, after the burst of
+	// changes that goes with it
+	table.AddRouteWithMetric(1, mustCIDR("0.0.0.0/0"), net.ParseIP("10.0.0.1"), 25)
+	notifier.changed()
+	table.AddAddress(1, net.ParseIP("10.0.0.20"))
+	notifier.changed()
+	state := expectStateOf(t, states)
+	if state.IPv4.LUID != 1 || !state.IPv4.NextHop.Equal(net.ParseIP("10.0.0.1")) || !state.IPv4.Address.Equal(net.ParseIP("10.0.0.20")) {
+		t.Fatalf("Unexpected state %+v", state.IPv4)
+	}
+	expectNoState(t, states, 100*time.Millisecond)
+
+	// A link that flaps within the debounce is not a change
+	table.SetInterface(Interface{LUID: 1})
+	notifier.changed()
+	time.Sleep(10 * time.Millisecond)
+	table.SetInterface(Interface{LUID: 1, Up: true})
+	notifier.changed()
+	expectNoState(t, states, 150*time.Millisecond)
+
+	// Changes that leave the default route alone are not reported
+	table.AddRouteWithMetric(2, mustCIDR("192.168.1.0/24"), nil, 0)
+	notifier.changed()
+	expectNoState(t, states, 150*time.Millisecond)
+
+	// Losing the default route is
+	table.DeleteRoute(1, mustCIDR("0.0.0.0/0"), net.ParseIP("10.0.0.1"))
+	table.DeleteRoute(2, mustCIDR("0.0.0.0/0"), net.ParseIP("192.168.1.1"))
+	notifier.changed()
+	if state := expectStateOf(t, states); state.IPv4 != nil {
+		t.Fatalf("Unexpected state %+v", state.IPv4)
+	}
+
+	unsubscribe()
+	table.AddRoute(2, mustCIDR("0.0.0.0/0"), net.ParseIP("192.168.1.1"))
+	notifier.changed()
+	expectNoState(t, states, 150*time.Millisecond)
+	if state := w.State(); state.IPv4 == nil || state.IPv4.LUID != 2 {
+		t.Fatalf("Unexpected state %+v after unsubscribing", state)
+	}
+}
+
+func TestWatcherClose(t *testing.T) {
+	table := newTable([]Interface{{LUID: 1, Up: true}}, nil)
+	notifier := &fakeNotifier{}
+	w, err := NewWatcher(table, notifier.notify, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make(chan *NetworkState, 1)
+	w.Subscribe(func(state *NetworkState) { states <- state })
+
+	table.AddRoute(1, mustCIDR("::/0"), net.ParseIP("fe80::1"))
+	notifier.changed()
+	w.Close()
+	if !notifier.stopped {
+		t.Fatal("Notifications were not stopped")
+	}
+	expectNoState(t, states, 100*time.Millisecond)
+}
+
+func TestNetworkStateJSON(t *testing.T) {
+	state := &NetworkState{IPv4: &DefaultRouteState{LUID: 1, NextHop: net.ParseIP("10.0.0.1"), Metric: 25, Address: net.ParseIP("10.0.0.20")}}
+	js, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"ipv4":{"luid":1,"next_hop":"10.0.0.1","metric":25,"address":"10.0.0.20"},"ipv6":null}`
+	if string(js) != expected {
+		t.Fatalf("Expected %s, got %s", expected, js)
+	}
+}
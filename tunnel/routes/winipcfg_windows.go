@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package routes
+
+import (
+	"net"
+
+	"golang.org/x/sys/windows"
+
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+type winipcfgTable struct{}
+
+// NewTable returns a table backed by the Windows IP helper API.
+func NewTable() Table {
+	return winipcfgTable{}
+}
+
+func addressFamily(family Family) winipcfg.AddressFamily {
+	if family == IPv6 {
+		return windows.AF_INET6
+	}
+	return windows.AF_INET
+}
+
+func (winipcfgTable) Routes(family Family) ([]Route, error) {
+	r, err := winipcfg.GetIPForwardTable2(addressFamily(family))
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]Route, 0, len(r))
+	for i := range r {
+		routes = append(routes, Route{
+			Destination: r[i].DestinationPrefix.IPNet(),
+			NextHop:     r[i].NextHop.IP(),
+			LUID:        uint64(r[i].InterfaceLUID),
+			Metric:      r[i].Metric,
+		})
+	}
+	return routes, nil
+}
+
+func (winipcfgTable) Interface(luid uint64) (*Interface, error) {
+	ifrow, err := winipcfg.LUID(luid).Interface()
+	if err != nil {
+		return nil, err
+	}
+	return &Interface{
+		LUID:   luid,
+		Up:     ifrow.OperStatus == winipcfg.IfOperStatusUp,
+		Index:  ifrow.InterfaceIndex,
+		Tunnel: ifrow.MediaType == winipcfg.NdisMediumIP,
+	}, nil
+}
+
+func (winipcfgTable) Addresses(family Family) ([]Address, error) {
+	addrs, err := winipcfg.GetUnicastIPAddressTable(addressFamily(family))
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]Address, 0, len(addrs))
+	for i := range addrs {
+		addresses = append(addresses, Address{LUID: uint64(addrs[i].InterfaceLUID), IP: addrs[i].Address.IP()})
+	}
+	return addresses, nil
+}
+
+func (winipcfgTable) AddRoute(luid uint64, destination net.IPNet, nextHop net.IP) error {
+	err := winipcfg.LUID(luid).AddRoute(destination, nextHop, 0)
+	if err == windows.ERROR_OBJECT_ALREADY_EXISTS {
+		return ErrExists
+	}
+	return err
+}
+
+func (winipcfgTable) DeleteRoute(luid uint64, destination net.IPNet, nextHop net.IP) error {
+	err := winipcfg.LUID(luid).DeleteRoute(destination, nextHop)
+	if err == windows.ERROR_NOT_FOUND {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,238 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package servers picks the server and port to connect to from the Guardian
+// server list.
+package servers
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/guardian"
+)
+
+// DefaultCooldown is how long a server that failed is skipped for.
+const DefaultCooldown = 5 * time.Minute
+
+var (
+	ErrNoLocation = errors.New("Unable to find the requested country or city")
+	ErrNoServers  = errors.New("No servers are available in the requested country or city")
+)
+
+// Selection is a server picked by a Selector.
+type Selection struct {
+	Country  string          `json:"country"`
+	City     string          `json:"city"`
+	Server   guardian.Server `json:"server"`
+	Port     int             `json:"port"`
+	Endpoint string          `json:"endpoint"`
+}
+
+// Selector picks servers by weighted random choice, skipping servers that
+// failed recently. It is safe for concurrent use.
+type Selector struct {
+	// Cooldown is how long a failed server is skipped for.
+	Cooldown time.Duration
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	now    func() time.Time
+	failed map[string]time.Time
+}
+
+// NewSelector returns a selector seeded with seed, so that the same sequence
+// of calls gives the same selections.
+func NewSelector(seed int64) *Selector {
+	return &Selector{
+		Cooldown: DefaultCooldown,
+		rand:     rand.New(rand.NewSource(seed)),
+		now:      time.Now,
+		failed:   make(map[string]time.Time),
+	}
+}
+
+// Seed resets the random source of the selector.
+func (s *Selector) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rand.Seed(seed)
+}
+
+// Fail marks a server as failed, so that it is skipped until the cooldown
+// expires.
+func (s *Selector) Fail(hostname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed[hostname] = s.now()
+}
+
+// Reset forgets all failures.
+func (s *Selector) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = make(map[string]time.Time)
+}
+
+func (s *Selector) coolingDown(hostname string) bool {
+	failed, ok := s.failed[hostname]
+	if !ok {
+		return false
+	}
+	if s.now().Sub(failed) >= s.Cooldown {
+		delete(s.failed, hostname)
+		return false
+	}
+	return true
+}
+
+func matches(name, code, want string) bool {
+	return strings.EqualFold(code, want) || strings.EqualFold(name, want)
+}
+
+type candidate struct {
+	country *guardian.Country
+	city    *guardian.City
+	server  *guardian.Server
+}
+
+// candidates returns the servers of a city, or of a whole country when city
+// is empty. Countries and cities are matched by code or name. Only servers
+// with IncludeInCountry are picked for a whole country.
+func candidates(list *guardian.ServerList, country, city string) ([]candidate, error) {
+	var found bool
+	var c []candidate
+	for i := range list.Countries {
+		co := &list.Countries[i]
+		if !matches(co.Name, co.Code, country) {
+			continue
+		}
+		for j := range co.Cities {
+			ci := &co.Cities[j]
+			if city != "" && !matches(ci.Name, ci.Code, city) {
+				continue
+			}
+			found = true
+			for k := range ci.Servers {
+				if city == "" && !ci.Servers[k].IncludeInCountry {
+					continue
+				}
+				c = append(c, candidate{co, ci, &ci.Servers[k]})
+			}
+		}
+	}
+	if !found {
+		return nil, ErrNoLocation
+	}
+	if len(c) == 0 {
+		return nil, ErrNoServers
+	}
+	return c, nil
+}
+
+// Select picks a server in a city, or in a whole country when city is empty,
+// with a probability proportional to its weight, and a random port in its
+// port ranges. Servers without a valid endpoint or port ranges are skipped.
+// If every server is cooling down, the cooldown is ignored, as connecting to
+// a server that failed is better than not connecting at all.
+func (s *Selector) Select(list *guardian.ServerList, country, city string) (*Selection, error) {
+	c, err := candidates(list, country, city)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var usable, available []candidate
+	for _, candidate := range c {
+		if net.ParseIP(candidate.server.Ipv4AddrIn).To4() == nil {
+			continue
+		}
+		if _, err := candidate.server.Ports(); err != nil {
+			continue
+		}
+		usable = append(usable, candidate)
+		if !s.coolingDown(candidate.server.Hostname) {
+			available = append(available, candidate)
+		}
+	}
+	if len(usable) == 0 {
+		return nil, ErrNoServers
+	}
+	if len(available) == 0 {
+		available = usable
+	}
+
+	picked := available[s.pick(available)]
+	port, err := s.port(picked.server)
+	if err != nil {
+		return nil, err
+	}
+	return &Selection{
+		Country:  picked.country.Code,
+		City:     picked.city.Code,
+		Server:   *picked.server,
+		Port:     port,
+		Endpoint: net.JoinHostPort(picked.server.Ipv4AddrIn, strconv.Itoa(port)),
+	}, nil
+}
+
+// pick returns the index of a candidate chosen by weight. Servers with a
+// weight of zero or less are only picked if no server has a weight.
+func (s *Selector) pick(c []candidate) int {
+	total := 0
+	for _, candidate := range c {
+		if candidate.server.Weight > 0 {
+			total += candidate.server.Weight
+		}
+	}
+	if total == 0 {
+		return s.rand.Intn(len(c))
+	}
+	r := s.rand.Intn(total)
+	for i, candidate := range c {
+		if candidate.server.Weight <= 0 {
+			continue
+		}
+		if r < candidate.server.Weight {
+			return i
+		}
+		r -= candidate.server.Weight
+	}
+	return len(c) - 1
+}
+
+// Port returns a random port in the port ranges of server. Every port is
+// equally likely, so larger ranges are picked more often.
+func (s *Selector) Port(server *guardian.Server) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.port(server)
+}
+
+func (s *Selector) port(server *guardian.Server) (int, error) {
+	ranges, err := server.Ports()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, r := range ranges {
+		total += r.Size()
+	}
+	n := s.rand.Intn(total)
+	for _, r := range ranges {
+		if n < r.Size() {
+			return int(r.From) + n, nil
+		}
+		n -= r.Size()
+	}
+	return int(ranges[len(ranges)-1].To), nil
+}
@@ -0,0 +1,199 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package servers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/guardian"
+)
+
+const draws = 100000
+
+func loadServerList(t *testing.T) *guardian.ServerList {
+	b, err := ioutil.ReadFile("testdata/servers.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list guardian.ServerList
+	if err := json.Unmarshal(b, &list); err != nil {
+		t.Fatal(err)
+	}
+	return &list
+}
+
+// chiSquared returns the chi-squared statistic of the observed counts
+// against the expected shares.
+func chiSquared(observed map[string]int, expected map[string]float64, n int) float64 {
+	var x2 float64
+	for key, share := range expected {
+		e := share * float64(n)
+		d := float64(observed[key]) - e
+		x2 += d * d / e
+	}
+	return x2
+}
+
+func TestSelectWeights(t *testing.T) {
+	list := loadServerList(t)
+	tests := []struct {
+		name     string
+		country  string
+		city     string
+		expected map[string]float64
+	}{
+		{"Country", "au", "", map[string]float64{"au3-wireguard": 0.1, "au4-wireguard": 0.3, "au10-wireguard": 0.6}},
+		{"City", "Australia", "mel", map[string]float64{"au3-wireguard": 0.2, "au4-wireguard": 0.6, "au5-wireguard": 0.2}},
+		{"No weights", "CA", "Toronto", map[string]float64{"ca1-wireguard": 0.5, "ca2-wireguard": 0.5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selector := NewSelector(1)
+			observed := make(map[string]int)
+			for i := 0; i < draws; i++ {
+				selection, err := selector.Select(list, test.country, test.city)
+				if err != nil {
+					t.Fatal(err)
+				}
+				observed[selection.Server.Hostname]++
+			}
+			for hostname := range observed {
+				if _, ok := test.expected[hostname]; !ok {
+					t.Fatalf("Unexpected server %s was selected", hostname)
+				}
+			}
+			// 13.82 is the 99.9th percentile with 2 degrees of freedom, and
+			// is stricter than needed with fewer.
+			if x2 := chiSquared(observed, test.expected, draws); x2 > 13.82 {
+				t.Fatalf("Selections %v do not match weights %v (chi-squared %.2f)", observed, test.expected, x2)
+			}
+		})
+	}
+}
+
+func TestSelectPorts(t *testing.T) {
+	server := &loadServerList(t).Countries[0].Cities[0].Servers[0]
+	ranges, err := server.Ports()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selector := NewSelector(1)
+	observed := make(map[string]int)
+	for i := 0; i < draws; i++ {
+		port, err := selector.Port(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case ranges[0].Contains(port):
+			observed["first"]++
+		case ranges[1].Contains(port):
+			observed["second"]++
+		case ranges[2].Contains(port):
+			observed["third"]++
+		default:
+			t.Fatalf("Port %d is outside of the port ranges", port)
+		}
+	}
+
+	total := float64(ranges[0].Size() + ranges[1].Size() + ranges[2].Size())
+	expected := map[string]float64{
+		"first":  float64(ranges[0].Size()) / total,
+		"second": float64(ranges[1].Size()) / total,
+		"third":  float64(ranges[2].Size()) / total,
+	}
+	if x2 := chiSquared(observed, expected, draws); x2 > 13.82 {
+		t.Fatalf("Ports %v are not uniform over the port ranges (chi-squared %.2f)", observed, x2)
+	}
+}
+
+func TestSelectSeed(t *testing.T) {
+	list := loadServerList(t)
+	a, b := NewSelector(42), NewSelector(42)
+	for i := 0; i < 100; i++ {
+		x, err := a.Select(list, "au", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		y, err := b.Select(list, "au", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x.Endpoint != y.Endpoint {
+			t.Fatalf("Selections with the same seed differ: %s and %s", x.Endpoint, y.Endpoint)
+		}
+	}
+}
+
+func TestSelectCooldown(t *testing.T) {
+	list := loadServerList(t)
+	now := time.Unix(1577836800, 0)
+	selector := NewSelector(1)
+	selector.now = func() time.Time { return now }
+
+	selector.Fail("au10-wireguard")
+	for i := 0; i < 1000; i++ {
+		selection, err := selector.Select(list, "au", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selection.Server.Hostname == "au10-wireguard" {
+			t.Fatal("A server that is cooling down was selected")
+		}
+	}
+
+	now = now.Add(DefaultCooldown)
+	var selected bool
+	for i := 0; i < 1000 && !selected; i++ {
+		selection, err := selector.Select(list, "au", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		selected = selection.Server.Hostname == "au10-wireguard"
+	}
+	if !selected {
+		t.Fatal("A server was not selected again after its cooldown")
+	}
+
+	// When every server failed, the cooldown is ignored
+	selector.Fail("ca1-wireguard")
+	selector.Fail("ca2-wireguard")
+	if _, err := selector.Select(list, "ca", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	selector.Reset()
+	if len(selector.failed) != 0 {
+		t.Fatal("Failures were not reset")
+	}
+}
+
+func TestSelectErrors(t *testing.T) {
+	list := loadServerList(t)
+	if _, err := NewSelector(1).Select(list, "de", ""); err != ErrNoLocation {
+		t.Fatalf("Expected ErrNoLocation, got %v", err)
+	}
+	if _, err := NewSelector(1).Select(list, "au", "bne"); err != ErrNoLocation {
+		t.Fatalf("Expected ErrNoLocation, got %v", err)
+	}
+
+	list.Countries[0].Cities[1].Servers = list.Countries[0].Cities[1].Servers[1:]
+	if _, err := NewSelector(1).Select(list, "au", "syd"); err != ErrNoServers {
+		t.Fatalf("Expected ErrNoServers for servers without an endpoint, got %v", err)
+	}
+
+	for i := range list.Countries[0].Cities[0].Servers {
+		list.Countries[0].Cities[0].Servers[i].IncludeInCountry = false
+	}
+	list.Countries[0].Cities[1].Servers = nil
+	if _, err := NewSelector(1).Select(list, "au", ""); err != ErrNoServers {
+		t.Fatalf("Expected ErrNoServers when no server is included in the country, got %v", err)
+	}
+}
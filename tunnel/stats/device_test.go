@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package stats
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/internal/wgtest"
+)
+
+func TestMonitorDevice(t *testing.T) {
+	a, err := wgtest.NewDevice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := wgtest.NewDevice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := wgtest.Connect(a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMonitor(&UAPISource{Dial: a.Dial})
+	peers, err := m.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].PublicKey != b.PublicKey().String() || peers[0].TxBytes != 0 || !peers[0].LastHandshake.IsZero() {
+		t.Fatalf("Unexpected peers %+v before any traffic", peers)
+	}
+
+	for i := 0; i < 10; i++ {
+		a.TUN.Outbound <- wgtest.Ping(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 1000)
+		select {
+		case <-b.TUN.Inbound:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Packet did not go through the tunnel")
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	peers, err = m.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := peers[0]
+	if peer.Endpoint != b.Endpoint() {
+		t.Fatalf("Unexpected endpoint %s", peer.Endpoint)
+	}
+	if peer.TxBytes < 10*1028 || peer.RxBytes == 0 {
+		t.Fatalf("Unexpected counters %+v", peer)
+	}
+	if peer.LastHandshake.IsZero() || time.Since(peer.LastHandshake) > time.Minute {
+		t.Fatalf("Unexpected handshake time %v", peer.LastHandshake)
+	}
+	if peer.TxRate <= 0 {
+		t.Fatalf("Unexpected throughput %+v", peer)
+	}
+	if len(m.History(peer.PublicKey)) != 2 {
+		t.Fatal("Samples were not recorded")
+	}
+}
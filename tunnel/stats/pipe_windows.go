@@ -0,0 +1,15 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package stats
+
+import (
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/uapi"
+)
+
+// NewPipeSource returns a source that reads the UAPI named pipe of a tunnel.
+func NewPipeSource(tunnelName string) *UAPISource {
+	return &UAPISource{Dial: uapi.PipeDialer(tunnelName)}
+}
@@ -0,0 +1,201 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package stats samples the transfer counters of a tunnel and computes the
+// throughput of each peer.
+package stats
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/uapi"
+)
+
+const (
+	// DefaultWindow is the window throughput is averaged over.
+	DefaultWindow = 2 * time.Second
+
+	// DefaultCapacity is the number of samples kept per peer.
+	DefaultCapacity = 120
+)
+
+// Peer is the state of a peer of the tunnel. Rates are in bytes per second.
+type Peer struct {
+	PublicKey     string    `json:"public_key"`
+	Endpoint      string    `json:"endpoint,omitempty"`
+	RxBytes       uint64    `json:"rx_bytes"`
+	TxBytes       uint64    `json:"tx_bytes"`
+	LastHandshake time.Time `json:"last_handshake"`
+	RxRate        float64   `json:"rx_rate"`
+	TxRate        float64   `json:"tx_rate"`
+}
+
+// Source returns the current counters of every peer. Rates are ignored.
+type Source interface {
+	Peers() ([]Peer, error)
+}
+
+// UAPISource reads counters with a UAPI get operation.
+type UAPISource struct {
+	// Dial connects to the UAPI handler of the tunnel.
+	Dial func() (io.ReadWriteCloser, error)
+}
+
+func (s *UAPISource) Peers() ([]Peer, error) {
+	client := uapi.Client{Dial: s.Dial}
+	device, err := client.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer device.Zero()
+	peers := make([]Peer, len(device.Peers))
+	for i := range device.Peers {
+		peer := &device.Peers[i]
+		peers[i] = Peer{
+			PublicKey:     peer.PublicKey.String(),
+			Endpoint:      peer.Endpoint,
+			RxBytes:       peer.RxBytes,
+			TxBytes:       peer.TxBytes,
+			LastHandshake: peer.LastHandshake,
+		}
+	}
+	return peers, nil
+}
+
+// Sample is the counters of a peer at a point in time.
+type Sample struct {
+	Time    time.Time `json:"time"`
+	RxBytes uint64    `json:"rx_bytes"`
+	TxBytes uint64    `json:"tx_bytes"`
+}
+
+type history struct {
+	samples []Sample
+	next    int
+	count   int
+}
+
+func (h *history) add(s Sample) {
+	h.samples[h.next] = s
+	h.next = (h.next + 1) % len(h.samples)
+	if h.count < len(h.samples) {
+		h.count++
+	}
+}
+
+// at returns the i-th newest sample, starting from 0.
+func (h *history) at(i int) *Sample {
+	return &h.samples[(h.next-1-i+2*len(h.samples))%len(h.samples)]
+}
+
+// Monitor samples a source and keeps a ring buffer of samples for every peer.
+// It is safe for concurrent use.
+type Monitor struct {
+	source Source
+
+	mu       sync.Mutex
+	window   time.Duration
+	capacity int
+	peers    map[string]*history
+	now      func() time.Time
+}
+
+// NewMonitor returns a monitor of source with the default window and
+// capacity.
+func NewMonitor(source Source) *Monitor {
+	return &Monitor{
+		source:   source,
+		window:   DefaultWindow,
+		capacity: DefaultCapacity,
+		peers:    make(map[string]*history),
+		now:      time.Now,
+	}
+}
+
+// SetWindow sets the window throughput is averaged over, and the number of
+// samples kept per peer. Changing the capacity drops the samples.
+func (m *Monitor) SetWindow(window time.Duration, capacity int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if window > 0 {
+		m.window = window
+	}
+	if capacity > 1 && capacity != m.capacity {
+		m.capacity = capacity
+		m.peers = make(map[string]*history)
+	}
+}
+
+// Sample reads the counters from the source, records them, and returns every
+// peer with its throughput over the window. Peers that are gone are
+// forgotten, and the history of a peer is restarted when its counters go
+// backwards, which happens when it is replaced.
+func (m *Monitor) Sample() ([]Peer, error) {
+	peers, err := m.source.Peers()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	seen := make(map[string]bool, len(peers))
+	for i := range peers {
+		peer := &peers[i]
+		seen[peer.PublicKey] = true
+		h := m.peers[peer.PublicKey]
+		if h == nil || (h.count > 0 && (h.at(0).RxBytes > peer.RxBytes || h.at(0).TxBytes > peer.TxBytes)) {
+			h = &history{samples: make([]Sample, m.capacity)}
+			m.peers[peer.PublicKey] = h
+		}
+		h.add(Sample{Time: now, RxBytes: peer.RxBytes, TxBytes: peer.TxBytes})
+		peer.RxRate, peer.TxRate = h.rate(m.window)
+	}
+	for key := range m.peers {
+		if !seen[key] {
+			delete(m.peers, key)
+		}
+	}
+	return peers, nil
+}
+
+// rate returns the throughput between the newest sample and the oldest one
+// that is within window of it. With only one sample in the window, the
+// sample before it is used, so that slow polling still gives a rate.
+func (h *history) rate(window time.Duration) (rx, tx float64) {
+	if h.count < 2 {
+		return 0, 0
+	}
+	newest := h.at(0)
+	oldest := h.at(1)
+	for i := 2; i < h.count; i++ {
+		if newest.Time.Sub(h.at(i).Time) > window {
+			break
+		}
+		oldest = h.at(i)
+	}
+	elapsed := newest.Time.Sub(oldest.Time).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return float64(newest.RxBytes-oldest.RxBytes) / elapsed, float64(newest.TxBytes-oldest.TxBytes) / elapsed
+}
+
+// History returns the samples of a peer, oldest first.
+func (m *Monitor) History(publicKey string) []Sample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.peers[publicKey]
+	if h == nil {
+		return nil
+	}
+	samples := make([]Sample, h.count)
+	for i := range samples {
+		samples[i] = *h.at(h.count - 1 - i)
+	}
+	return samples
+}
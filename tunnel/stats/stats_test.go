@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package stats
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeSource struct {
+	peers []Peer
+	err   error
+}
+
+func (f *fakeSource) Peers() ([]Peer, error) {
+	peers := make([]Peer, len(f.peers))
+	copy(peers, f.peers)
+	return peers, f.err
+}
+
+func TestMonitor(t *testing.T) {
+	source := &fakeSource{peers: []Peer{{PublicKey: "a"}, {PublicKey: "b"}}}
+	now := time.Unix(1577836800, 0)
+	m := NewMonitor(source)
+	m.now = func() time.Time { return now }
+	m.SetWindow(2*time.Second, 8)
+
+	sample := func() []Peer {
+		peers, err := m.Sample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return peers
+	}
+	advance := func(rx, tx uint64) {
+		now = now.Add(time.Second)
+		source.peers[0].RxBytes += rx
+		source.peers[0].TxBytes += tx
+	}
+
+	if peers := sample(); peers[0].RxRate != 0 || peers[0].TxRate != 0 {
+		t.Fatalf("Unexpected rate %+v from a single sample", peers[0])
+	}
+	advance(1000, 100)
+	if peers := sample(); peers[0].RxRate != 1000 || peers[0].TxRate != 100 {
+		t.Fatalf("Unexpected rate %+v", peers[0])
+	}
+	advance(3000, 100)
+	if peers := sample(); peers[0].RxRate != 2000 || peers[0].TxRate != 100 {
+		t.Fatalf("Unexpected rate %+v averaged over 2 seconds", peers[0])
+	}
+	advance(0, 0)
+	if peers := sample(); peers[0].RxRate != 1500 || peers[1].RxRate != 0 {
+		t.Fatalf("Unexpected rates %+v outside the window", peers)
+	}
+
+	// Slow polling still gives a rate
+	now = now.Add(10 * time.Second)
+	source.peers[0].RxBytes += 10000
+	if peers := sample(); peers[0].RxRate != 1000 {
+		t.Fatalf("Unexpected rate %+v with a single sample in the window", peers[0])
+	}
+	if history := m.History("a"); len(history) != 5 || history[0].RxBytes != 0 || history[4].RxBytes != 14000 {
+		t.Fatalf("Unexpected history %+v", history)
+	}
+
+	// Counters that go backwards restart the history
+	source.peers[0].RxBytes = 10
+	advance(0, 0)
+	if peers := sample(); peers[0].RxRate != 0 || len(m.History("a")) != 1 {
+		t.Fatalf("History was not restarted: %+v", peers[0])
+	}
+
+	source.peers = source.peers[:1]
+	sample()
+	if m.History("b") != nil {
+		t.Fatal("A removed peer was not forgotten")
+	}
+
+	source.err = errors.New("Pipe closed")
+	if _, err := m.Sample(); err != source.err {
+		t.Fatalf("Expected the source error, got %v", err)
+	}
+}
+
+func TestHistoryWraps(t *testing.T) {
+	source := &fakeSource{peers: []Peer{{PublicKey: "a"}}}
+	now := time.Unix(1577836800, 0)
+	m := NewMonitor(source)
+	m.now = func() time.Time { return now }
+	m.SetWindow(time.Minute, 3)
+	for i := 0; i < 5; i++ {
+		source.peers[0].TxBytes = uint64(i * 100)
+		if _, err := m.Sample(); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+	history := m.History("a")
+	if len(history) != 3 || history[0].TxBytes != 200 || history[2].TxBytes != 400 {
+		t.Fatalf("Unexpected history %+v", history)
+	}
+	source.peers[0].TxBytes = 500
+	peers, _ := m.Sample()
+	if peers[0].TxRate != 100 {
+		t.Fatalf("Unexpected rate %+v", peers[0])
+	}
+}
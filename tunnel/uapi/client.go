@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package uapi
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+)
+
+// Client runs operations on the UAPI handler of a tunnel, one connection per
+// operation.
+type Client struct {
+	// Dial connects to the UAPI handler of the tunnel.
+	Dial func() (io.ReadWriteCloser, error)
+}
+
+// Get returns the state of the device. Callers should Zero it when done.
+func (c *Client) Get() (*Device, error) {
+	conn, err := c.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "get=1\n\n"); err != nil {
+		return nil, err
+	}
+	return ParseGet(conn)
+}
+
+// Set applies config to the device.
+func (c *Client) Set(config *Config) error {
+	body, err := config.Serialize()
+	if err != nil {
+		return err
+	}
+	conn, err := c.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "set=1\n"+body+"\n"); err != nil {
+		return err
+	}
+	return ReadErrno(bufio.NewReader(conn))
+}
+
+// AddPeer adds a peer, or replaces the settings of an existing one.
+func (c *Client) AddPeer(peer PeerConfig) error {
+	peer.Remove = false
+	peer.UpdateOnly = false
+	return c.Set(&Config{Peers: []PeerConfig{peer}})
+}
+
+// UpdatePeer changes the settings of a peer, and does nothing if it does not
+// exist.
+func (c *Client) UpdatePeer(peer PeerConfig) error {
+	peer.Remove = false
+	peer.UpdateOnly = true
+	return c.Set(&Config{Peers: []PeerConfig{peer}})
+}
+
+// RemovePeer removes a peer.
+func (c *Client) RemovePeer(publicKey *keys.Key) error {
+	return c.Set(&Config{Peers: []PeerConfig{{PublicKey: *publicKey, Remove: true}}})
+}
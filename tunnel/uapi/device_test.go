@@ -0,0 +1,166 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package uapi
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/internal/wgtest"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+)
+
+func newDevice(t *testing.T) (*wgtest.Device, *Client) {
+	d, err := wgtest.NewDevice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, &Client{Dial: d.Dial}
+}
+
+func TestDeviceRoundTrip(t *testing.T) {
+	d, client := newDevice(t)
+	defer d.Close()
+
+	privateKey, err := keys.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey, err := keys.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	presharedKey, err := keys.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepalive := uint16(25)
+	port := uint16(0)
+	peer := PeerConfig{
+		PublicKey:                   *peerKey.Public(),
+		PresharedKey:                presharedKey,
+		Endpoint:                    "127.0.0.1:51820",
+		PersistentKeepaliveInterval: &keepalive,
+		AllowedIPs:                  mustAllowedIPs(t, "10.64.0.1/32", "fc00:bbbb:bbbb:bb01::1/128"),
+	}
+	if err := client.Set(&Config{PrivateKey: privateKey, ListenPort: &port, ReplacePeers: true, Peers: []PeerConfig{peer}}); err != nil {
+		t.Fatal(err)
+	}
+
+	device, err := client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.PrivateKey == nil || *device.PrivateKey != *privateKey || device.ListenPort == 0 {
+		t.Fatalf("Unexpected device %+v", device)
+	}
+	if len(device.Peers) != 1 {
+		t.Fatalf("Expected 1 peer, got %d", len(device.Peers))
+	}
+	got := device.Peers[0]
+	if got.PublicKey != peer.PublicKey || got.PresharedKey == nil || *got.PresharedKey != *presharedKey {
+		t.Fatalf("Unexpected peer keys %+v", got)
+	}
+	if got.Endpoint != peer.Endpoint || got.PersistentKeepaliveInterval != 25 || got.ProtocolVersion != 1 {
+		t.Fatalf("Unexpected peer %+v", got)
+	}
+	if len(got.AllowedIPs) != 2 || got.AllowedIPs[0].String() != "10.64.0.1/32" || got.AllowedIPs[1].String() != "fc00:bbbb:bbbb:bb01::1/128" {
+		t.Fatalf("Unexpected allowed IPs %v", got.AllowedIPs)
+	}
+
+	// Updates leave the other settings alone
+	update := PeerConfig{PublicKey: peer.PublicKey, Endpoint: "[::1]:51821", ReplaceAllowedIPs: true, AllowedIPs: mustAllowedIPs(t, "0.0.0.0/0")}
+	if err := client.UpdatePeer(update); err != nil {
+		t.Fatal(err)
+	}
+	device, err = client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = device.Peers[0]
+	if got.Endpoint != "[::1]:51821" || got.PersistentKeepaliveInterval != 25 || len(got.AllowedIPs) != 1 || got.AllowedIPs[0].String() != "0.0.0.0/0" {
+		t.Fatalf("Unexpected updated peer %+v", got)
+	}
+
+	// Updating a peer that does not exist does not add it
+	other, err := keys.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.UpdatePeer(PeerConfig{PublicKey: *other.Public()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddPeer(PeerConfig{PublicKey: *other.Public(), AllowedIPs: mustAllowedIPs(t, "10.0.0.0/8")}); err != nil {
+		t.Fatal(err)
+	}
+	device, err = client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(device.Peers) != 2 {
+		t.Fatalf("Expected 2 peers, got %d", len(device.Peers))
+	}
+
+	if err := client.RemovePeer(&peer.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	device, err = client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(device.Peers) != 1 || device.Peers[0].PublicKey != *other.Public() {
+		t.Fatalf("Unexpected peers %+v after removal", device.Peers)
+	}
+}
+
+func TestDeviceErrno(t *testing.T) {
+	d, _ := newDevice(t)
+	defer d.Close()
+
+	for _, operation := range []string{"private_key=zz\n", "listen_port=x\n", "mtu=1420\n", "allowed_ip=10.0.0.0/8\n"} {
+		conn, err := d.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(conn, "set=1\n"+operation+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		err = ReadErrno(bufio.NewReader(conn))
+		conn.Close()
+		if e, ok := err.(*Error); !ok || e.Errno != ErrnoInvalid {
+			t.Errorf("Expected errno %d for %q, got %v", ErrnoInvalid, operation, err)
+		}
+	}
+}
+
+func TestDeviceHandshake(t *testing.T) {
+	a, client := newDevice(t)
+	defer a.Close()
+	b, _ := newDevice(t)
+	defer b.Close()
+	if err := wgtest.Connect(a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	a.TUN.Outbound <- wgtest.Ping(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+	select {
+	case <-b.TUN.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Packet did not go through the tunnel")
+	}
+
+	device, err := client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := device.Peers[0]
+	if peer.LastHandshake.IsZero() || peer.TxBytes == 0 || peer.RxBytes == 0 {
+		t.Fatalf("Unexpected peer %+v after a handshake", peer)
+	}
+}
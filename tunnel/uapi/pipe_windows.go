@@ -0,0 +1,24 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package uapi
+
+import (
+	"io"
+	"os"
+)
+
+// PipeDialer returns a dialer for the UAPI named pipe of a tunnel.
+func PipeDialer(tunnelName string) func() (io.ReadWriteCloser, error) {
+	path := `\\.\pipe\ProtectedPrefix\Administrators\WireGuard\` + tunnelName
+	return func() (io.ReadWriteCloser, error) {
+		return os.OpenFile(path, os.O_RDWR, 0)
+	}
+}
+
+// NewPipeClient returns a client of the UAPI named pipe of a tunnel.
+func NewPipeClient(tunnelName string) *Client {
+	return &Client{Dial: PipeDialer(tunnelName)}
+}
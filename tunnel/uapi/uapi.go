@@ -0,0 +1,327 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package uapi serializes and parses the WireGuard cross-platform userspace
+// API, and talks it to a tunnel.
+package uapi
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+)
+
+// Errno values returned by wireguard-go.
+const (
+	ErrnoIO        = -5
+	ErrnoInvalid   = -22
+	ErrnoProtocol  = -71
+	ErrnoPortInUse = -98
+)
+
+var (
+	ErrMalformed       = errors.New("Malformed UAPI response")
+	ErrInvalidEndpoint = errors.New("Endpoints must be an IP address and a port")
+)
+
+// Error is a non-zero errno returned by an operation.
+type Error struct {
+	Errno int64
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("UAPI error %d", e.Errno)
+}
+
+// AllowedIP is a CIDR that is text in JSON.
+type AllowedIP struct {
+	net.IPNet
+}
+
+// ParseAllowedIP parses a CIDR, clearing its host bits.
+func ParseAllowedIP(cidr string) (AllowedIP, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return AllowedIP{}, err
+	}
+	return AllowedIP{*ipnet}, nil
+}
+
+func (a AllowedIP) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *AllowedIP) UnmarshalText(text []byte) error {
+	parsed, err := ParseAllowedIP(string(text))
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// Device is the state of a device returned by a get operation.
+type Device struct {
+	PrivateKey *keys.Key `json:"private_key,omitempty"`
+	ListenPort uint16    `json:"listen_port,omitempty"`
+	FwMark     uint32    `json:"fwmark,omitempty"`
+	Peers      []Peer    `json:"peers"`
+}
+
+// Peer is the state of a peer returned by a get operation.
+type Peer struct {
+	PublicKey                   keys.Key    `json:"public_key"`
+	PresharedKey                *keys.Key   `json:"preshared_key,omitempty"`
+	ProtocolVersion             int         `json:"protocol_version"`
+	Endpoint                    string      `json:"endpoint,omitempty"`
+	LastHandshake               time.Time   `json:"last_handshake"`
+	TxBytes                     uint64      `json:"tx_bytes"`
+	RxBytes                     uint64      `json:"rx_bytes"`
+	PersistentKeepaliveInterval uint16      `json:"persistent_keepalive_interval"`
+	AllowedIPs                  []AllowedIP `json:"allowed_ips"`
+}
+
+// Config is a set operation. Nil and zero fields are left unchanged.
+type Config struct {
+	PrivateKey   *keys.Key    `json:"private_key,omitempty"`
+	ListenPort   *uint16      `json:"listen_port,omitempty"`
+	FwMark       *uint32      `json:"fwmark,omitempty"`
+	ReplacePeers bool         `json:"replace_peers,omitempty"`
+	Peers        []PeerConfig `json:"peers,omitempty"`
+}
+
+// PeerConfig adds, updates or removes a peer in a set operation.
+type PeerConfig struct {
+	PublicKey keys.Key `json:"public_key"`
+
+	// Remove removes the peer, and the other fields are ignored.
+	Remove bool `json:"remove,omitempty"`
+
+	// UpdateOnly only changes the peer if it already exists.
+	UpdateOnly bool `json:"update_only,omitempty"`
+
+	PresharedKey                *keys.Key   `json:"preshared_key,omitempty"`
+	Endpoint                    string      `json:"endpoint,omitempty"`
+	PersistentKeepaliveInterval *uint16     `json:"persistent_keepalive_interval,omitempty"`
+	ReplaceAllowedIPs           bool        `json:"replace_allowed_ips,omitempty"`
+	AllowedIPs                  []AllowedIP `json:"allowed_ips,omitempty"`
+}
+
+func hexKey(k *keys.Key) string {
+	return hex.EncodeToString(k[:])
+}
+
+func parseHexKey(s string) (*keys.Key, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != keys.KeyLength {
+		return nil, ErrMalformed
+	}
+	k := new(keys.Key)
+	copy(k[:], b)
+	return k, nil
+}
+
+func validEndpoint(endpoint string) bool {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	if zone := strings.IndexByte(host, '%'); zone >= 0 {
+		host = host[:zone]
+	}
+	_, err = strconv.ParseUint(port, 10, 16)
+	return err == nil && net.ParseIP(host) != nil
+}
+
+// Serialize returns the body of the set operation, without the set=1 line
+// and the blank line that ends it.
+func (c *Config) Serialize() (string, error) {
+	var b strings.Builder
+	// Peers are removed first, so that changing the private key does not
+	// expire the sessions of peers that are going away
+	if c.ReplacePeers {
+		b.WriteString("replace_peers=true\n")
+	}
+	if c.PrivateKey != nil {
+		fmt.Fprintf(&b, "private_key=%s\n", hexKey(c.PrivateKey))
+	}
+	if c.ListenPort != nil {
+		fmt.Fprintf(&b, "listen_port=%d\n", *c.ListenPort)
+	}
+	if c.FwMark != nil {
+		fmt.Fprintf(&b, "fwmark=%d\n", *c.FwMark)
+	}
+	for i := range c.Peers {
+		peer := &c.Peers[i]
+		fmt.Fprintf(&b, "public_key=%s\n", hexKey(&peer.PublicKey))
+		if peer.Remove {
+			b.WriteString("remove=true\n")
+			continue
+		}
+		if peer.UpdateOnly {
+			b.WriteString("update_only=true\n")
+		}
+		if peer.PresharedKey != nil {
+			fmt.Fprintf(&b, "preshared_key=%s\n", hexKey(peer.PresharedKey))
+		}
+		if peer.Endpoint != "" {
+			if !validEndpoint(peer.Endpoint) {
+				return "", ErrInvalidEndpoint
+			}
+			fmt.Fprintf(&b, "endpoint=%s\n", peer.Endpoint)
+		}
+		if peer.PersistentKeepaliveInterval != nil {
+			fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", *peer.PersistentKeepaliveInterval)
+		}
+		if peer.ReplaceAllowedIPs {
+			b.WriteString("replace_allowed_ips=true\n")
+		}
+		for _, ip := range peer.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", ip.String())
+		}
+	}
+	return b.String(), nil
+}
+
+// ReadErrno reads the errno line that ends a response, and returns an *Error
+// if it is not zero.
+func ReadErrno(r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	return parseErrno(strings.TrimSuffix(line, "\n"))
+}
+
+func parseErrno(line string) error {
+	if !strings.HasPrefix(line, "errno=") {
+		return ErrMalformed
+	}
+	errno, err := strconv.ParseInt(strings.TrimPrefix(line, "errno="), 10, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+	if errno != 0 {
+		return &Error{errno}
+	}
+	return nil
+}
+
+// ParseGet parses the response to a get operation, up to and including the
+// errno line.
+func ParseGet(r io.Reader) (*Device, error) {
+	device := &Device{}
+	var peer *Peer
+	var handshakeSec, handshakeNsec int64
+	flush := func() {
+		if peer != nil && (handshakeSec != 0 || handshakeNsec != 0) {
+			peer.LastHandshake = time.Unix(handshakeSec, handshakeNsec)
+		}
+		handshakeSec, handshakeNsec = 0, 0
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "errno=") {
+			flush()
+			if err := parseErrno(line); err != nil {
+				return nil, err
+			}
+			return device, nil
+		}
+		equals := strings.IndexByte(line, '=')
+		if equals < 0 {
+			return nil, ErrMalformed
+		}
+		key, value := line[:equals], line[equals+1:]
+
+		if key == "public_key" {
+			flush()
+			k, err := parseHexKey(value)
+			if err != nil {
+				return nil, err
+			}
+			device.Peers = append(device.Peers, Peer{PublicKey: *k})
+			peer = &device.Peers[len(device.Peers)-1]
+			continue
+		}
+
+		var err error
+		if peer == nil {
+			switch key {
+			case "private_key":
+				device.PrivateKey, err = parseHexKey(value)
+			case "listen_port":
+				var port uint64
+				port, err = strconv.ParseUint(value, 10, 16)
+				device.ListenPort = uint16(port)
+			case "fwmark":
+				var mark uint64
+				mark, err = strconv.ParseUint(value, 10, 32)
+				device.FwMark = uint32(mark)
+			default:
+				err = ErrMalformed
+			}
+		} else {
+			switch key {
+			case "preshared_key":
+				var k *keys.Key
+				if k, err = parseHexKey(value); err == nil && !k.IsZero() {
+					peer.PresharedKey = k
+				}
+			case "protocol_version":
+				peer.ProtocolVersion, err = strconv.Atoi(value)
+			case "endpoint":
+				peer.Endpoint = value
+			case "last_handshake_time_sec":
+				handshakeSec, err = strconv.ParseInt(value, 10, 64)
+			case "last_handshake_time_nsec":
+				handshakeNsec, err = strconv.ParseInt(value, 10, 64)
+			case "tx_bytes":
+				peer.TxBytes, err = strconv.ParseUint(value, 10, 64)
+			case "rx_bytes":
+				peer.RxBytes, err = strconv.ParseUint(value, 10, 64)
+			case "persistent_keepalive_interval":
+				var interval uint64
+				interval, err = strconv.ParseUint(value, 10, 16)
+				peer.PersistentKeepaliveInterval = uint16(interval)
+			case "allowed_ip":
+				var ip AllowedIP
+				ip, err = ParseAllowedIP(value)
+				peer.AllowedIPs = append(peer.AllowedIPs, ip)
+			default:
+				err = ErrMalformed
+			}
+		}
+		if err != nil {
+			return nil, ErrMalformed
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrMalformed
+}
+
+// Zero overwrites the keys of the device.
+func (d *Device) Zero() {
+	if d.PrivateKey != nil {
+		d.PrivateKey.Zero()
+	}
+	for i := range d.Peers {
+		if d.Peers[i].PresharedKey != nil {
+			d.Peers[i].PresharedKey.Zero()
+		}
+	}
+}
@@ -0,0 +1,235 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package uapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+)
+
+const getResponse = `private_key=e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a
+listen_port=12912
+fwmark=51820
+public_key=b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33
+preshared_key=188515093e952f5f22e865cef3012e72f8b5f0b598ac0309d5dacce3b70fcf52
+protocol_version=1
+endpoint=[abcd:23::33%2]:51820
+last_handshake_time_sec=1577836800
+last_handshake_time_nsec=500
+tx_bytes=38333
+rx_bytes=2224
+persistent_keepalive_interval=25
+allowed_ip=192.168.4.4/32
+allowed_ip=fd00::/64
+public_key=58402e695ba1772b1cc9309755f043251ea77fdcf10fbe63989ceb7e19321376
+preshared_key=0000000000000000000000000000000000000000000000000000000000000000
+protocol_version=1
+last_handshake_time_sec=0
+last_handshake_time_nsec=0
+tx_bytes=0
+rx_bytes=0
+persistent_keepalive_interval=0
+errno=0
+
+`
+
+func mustKey(t *testing.T, hex string) *keys.Key {
+	k, err := parseHexKey(hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func mustAllowedIPs(t *testing.T, cidrs ...string) []AllowedIP {
+	ips := make([]AllowedIP, len(cidrs))
+	for i, cidr := range cidrs {
+		ip, err := ParseAllowedIP(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips[i] = ip
+	}
+	return ips
+}
+
+func TestParseGet(t *testing.T) {
+	device, err := ParseGet(strings.NewReader(getResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *device.PrivateKey != *mustKey(t, "e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a") {
+		t.Fatal("Unexpected private key")
+	}
+	if device.ListenPort != 12912 || device.FwMark != 51820 || len(device.Peers) != 2 {
+		t.Fatalf("Unexpected device %+v", device)
+	}
+	first := device.Peers[0]
+	if first.PublicKey.String() != "uFmW/sycfx/G0lcqdu2hHVm80gvo5UOxXOS9hajnWjM=" || first.Endpoint != "[abcd:23::33%2]:51820" {
+		t.Fatalf("Unexpected peer %+v", first)
+	}
+	if first.PresharedKey == nil || first.ProtocolVersion != 1 || first.PersistentKeepaliveInterval != 25 {
+		t.Fatalf("Unexpected peer settings %+v", first)
+	}
+	if first.RxBytes != 2224 || first.TxBytes != 38333 || !first.LastHandshake.Equal(time.Unix(1577836800, 500)) {
+		t.Fatalf("Unexpected counters %+v", first)
+	}
+	if len(first.AllowedIPs) != 2 || first.AllowedIPs[0].String() != "192.168.4.4/32" || first.AllowedIPs[1].String() != "fd00::/64" {
+		t.Fatalf("Unexpected allowed IPs %v", first.AllowedIPs)
+	}
+	second := device.Peers[1]
+	if !second.LastHandshake.IsZero() || second.PresharedKey != nil || second.AllowedIPs != nil {
+		t.Fatalf("Unexpected peer %+v", second)
+	}
+
+	device.Zero()
+	if !device.PrivateKey.IsZero() || !first.PresharedKey.IsZero() {
+		t.Fatal("Keys were not zeroed")
+	}
+}
+
+func TestParseGetErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		errno    int64
+	}{
+		{"Errno", "errno=-22\n\n", ErrnoInvalid},
+		{"Errno after peers", "public_key=b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33\nerrno=-5\n\n", ErrnoIO},
+		{"No errno", "public_key=b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33\n", 0},
+		{"Invalid errno", "errno=x\n\n", 0},
+		{"Missing equals", "public_key\nerrno=0\n\n", 0},
+		{"Short key", "public_key=b859\nerrno=0\n\n", 0},
+		{"Counter before peer", "rx_bytes=1\nerrno=0\n\n", 0},
+		{"Unknown key", "listen_port=1\nmtu=1420\nerrno=0\n\n", 0},
+		{"Invalid counter", "public_key=b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33\nrx_bytes=-1\nerrno=0\n\n", 0},
+		{"Invalid allowed IP", "public_key=b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33\nallowed_ip=10.0.0.1\nerrno=0\n\n", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseGet(strings.NewReader(test.response))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if test.errno != 0 {
+				if e, ok := err.(*Error); !ok || e.Errno != test.errno {
+					t.Fatalf("Expected errno %d, got %v", test.errno, err)
+				}
+			} else if err != ErrMalformed {
+				t.Fatalf("Expected ErrMalformed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReadErrno(t *testing.T) {
+	if err := ReadErrno(bufio.NewReader(strings.NewReader("errno=0\n\n"))); err != nil {
+		t.Fatal(err)
+	}
+	err := ReadErrno(bufio.NewReader(strings.NewReader("errno=-98\n\n")))
+	if e, ok := err.(*Error); !ok || e.Errno != ErrnoPortInUse {
+		t.Fatalf("Expected errno %d, got %v", ErrnoPortInUse, err)
+	}
+	if err := ReadErrno(bufio.NewReader(strings.NewReader("listen_port=1\n"))); err != ErrMalformed {
+		t.Fatalf("Expected ErrMalformed, got %v", err)
+	}
+}
+
+func TestSerialize(t *testing.T) {
+	port := uint16(51820)
+	mark := uint32(0)
+	keepalive := uint16(25)
+	privateKey := mustKey(t, "e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a")
+	first := mustKey(t, "b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33")
+	second := mustKey(t, "58402e695ba1772b1cc9309755f043251ea77fdcf10fbe63989ceb7e19321376")
+	config := &Config{
+		PrivateKey:   privateKey,
+		ListenPort:   &port,
+		FwMark:       &mark,
+		ReplacePeers: true,
+		Peers: []PeerConfig{
+			{
+				PublicKey:                   *first,
+				UpdateOnly:                  true,
+				PresharedKey:                new(keys.Key),
+				Endpoint:                    "[abcd:23::33%2]:51820",
+				PersistentKeepaliveInterval: &keepalive,
+				ReplaceAllowedIPs:           true,
+				AllowedIPs:                  mustAllowedIPs(t, "0.0.0.0/0", "::/0"),
+			},
+			{
+				PublicKey:  *second,
+				Remove:     true,
+				Endpoint:   "ignored",
+				AllowedIPs: mustAllowedIPs(t, "10.0.0.1/32"),
+			},
+		},
+	}
+	expected := `replace_peers=true
+private_key=e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a
+listen_port=51820
+fwmark=0
+public_key=b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33
+update_only=true
+preshared_key=0000000000000000000000000000000000000000000000000000000000000000
+endpoint=[abcd:23::33%2]:51820
+persistent_keepalive_interval=25
+replace_allowed_ips=true
+allowed_ip=0.0.0.0/0
+allowed_ip=::/0
+public_key=58402e695ba1772b1cc9309755f043251ea77fdcf10fbe63989ceb7e19321376
+remove=true
+`
+	serialized, err := config.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serialized != expected {
+		t.Fatalf("Unexpected serialization:\n%s", serialized)
+	}
+
+	if serialized, err := (&Config{}).Serialize(); err != nil || serialized != "" {
+		t.Fatalf("Unexpected serialization %q, %v of an empty config", serialized, err)
+	}
+
+	for _, endpoint := range []string{"vpn.example.com:51820", "10.0.0.1", "10.0.0.1:65536", "10.0.0.1\nremove=true:1"} {
+		config := &Config{Peers: []PeerConfig{{PublicKey: *first, Endpoint: endpoint}}}
+		if _, err := config.Serialize(); err != ErrInvalidEndpoint {
+			t.Errorf("Expected ErrInvalidEndpoint for %q, got %v", endpoint, err)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	device, err := ParseGet(strings.NewReader(getResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.PrivateKey = nil
+	b, err := json.Marshal(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "private_key") || !strings.Contains(string(b), `"allowed_ips":["192.168.4.4/32","fd00::/64"]`) {
+		t.Fatalf("Unexpected JSON %s", b)
+	}
+
+	var config Config
+	if err := json.Unmarshal([]byte(`{"peers":[{"public_key":"uFmW/sycfx/G0lcqdu2hHVm80gvo5UOxXOS9hajnWjM=","endpoint":"10.0.0.1:51820","allowed_ips":["10.64.0.1/8"]}]}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Peers) != 1 || config.Peers[0].PublicKey != device.Peers[0].PublicKey || config.Peers[0].AllowedIPs[0].String() != "10.0.0.0/8" {
+		t.Fatalf("Unexpected config %+v", config)
+	}
+	if err := json.Unmarshal([]byte(`{"peers":[{"public_key":"uFmW","allowed_ips":[]}]}`), &config); err == nil {
+		t.Fatal("Expected an error for an invalid key")
+	}
+}
@@ -0,0 +1,16 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package wgconfig
+
+import (
+	"golang.zx2c4.com/wireguard/windows/conf"
+)
+
+// Conf returns the config as a conf.Config for the tunnel service, going
+// through the same parser that reads config files.
+func (c *Config) Conf(name string) (*conf.Config, error) {
+	return conf.FromWgQuick(c.WgQuick(), name)
+}
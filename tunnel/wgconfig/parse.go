@@ -0,0 +1,243 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package wgconfig
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keystore"
+)
+
+var (
+	ErrInvalidSyntax   = errors.New("Config lines must be a [Section] or a Key = Value")
+	ErrUnknownField    = errors.New("Config has an unknown section or field")
+	ErrInvalidSections = errors.New("Config must have an [Interface] and exactly one [Peer]")
+	ErrKeyConflict     = errors.New("Config must not have a private key when a key reference is given")
+)
+
+// decodeKey decodes a base64 key without making a string of it, so that a
+// private key only exists in buffers that can be zeroed.
+func decodeKey(b64 []byte) (*keys.Key, error) {
+	if len(b64) != base64.StdEncoding.EncodedLen(keys.KeyLength) {
+		return nil, keys.ErrInvalidKey
+	}
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(b64)))
+	defer func() {
+		for i := range decoded {
+			decoded[i] = 0
+		}
+	}()
+	n, err := base64.StdEncoding.Strict().Decode(decoded, b64)
+	if err != nil || n != keys.KeyLength {
+		return nil, keys.ErrInvalidKey
+	}
+	key := new(keys.Key)
+	copy(key[:], decoded)
+	return key, nil
+}
+
+func splitList(value []byte) []string {
+	var items []string
+	for _, item := range strings.Split(string(value), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseEndpoint(value string) (Endpoint, error) {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil || net.ParseIP(host) == nil {
+		return Endpoint{}, ErrInvalidEndpoint
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return Endpoint{}, ErrInvalidEndpoint
+	}
+	return Endpoint{Host: net.ParseIP(host).String(), Port: uint16(p)}, nil
+}
+
+// Parse parses and validates a config in the wg-quick format written by
+// WgQuick. Lines are read from the buffer in place, so the caller can zero it
+// afterwards. A config without a PrivateKey parses, so that the key can come
+// from a key store, and Validate checks it is set before use.
+func Parse(text []byte) (config *Config, err error) {
+	var c Config
+	defer func() {
+		if err != nil {
+			c.Zero()
+		}
+	}()
+	var section string
+	peers := 0
+	for n, line := range bytes.Split(text, []byte("\n")) {
+		if i := bytes.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.ToLower(string(bytes.TrimSpace(line[1 : len(line)-1])))
+			switch section {
+			case "interface":
+			case "peer":
+				peers++
+			default:
+				return nil, fmt.Errorf("Line %d: %w", n+1, ErrUnknownField)
+			}
+			continue
+		}
+
+		equals := bytes.IndexByte(line, '=')
+		if equals < 0 || section == "" {
+			return nil, fmt.Errorf("Line %d: %w", n+1, ErrInvalidSyntax)
+		}
+		field := section + "." + strings.ToLower(string(bytes.TrimSpace(line[:equals])))
+		value := bytes.TrimSpace(line[equals+1:])
+		if err := c.set(field, value); err != nil {
+			return nil, fmt.Errorf("Line %d: %w", n+1, err)
+		}
+	}
+	if peers != 1 {
+		return nil, ErrInvalidSections
+	}
+
+	if err := c.validate(false); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Load parses a config buffer and zeroes it. When keyRef is set, the private
+// key is loaded from the store instead of the config. The returned config is
+// validated, and the caller zeroes it when done.
+func Load(buf []byte, store keystore.Store, keyRef string) (*Config, error) {
+	config, err := Parse(buf)
+	keystore.Zero(buf)
+	if err != nil {
+		return nil, err
+	}
+	if keyRef != "" {
+		if !config.Interface.PrivateKey.IsZero() {
+			config.Zero()
+			return nil, ErrKeyConflict
+		}
+		key, err := keystore.Load(store, keyRef)
+		if err != nil {
+			return nil, err
+		}
+		config.Interface.PrivateKey = *key
+		key.Zero()
+	}
+	if err := config.Validate(); err != nil {
+		config.Zero()
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *Config) set(field string, value []byte) error {
+	switch field {
+	case "interface.privatekey":
+		key, err := decodeKey(value)
+		if err != nil || key.IsZero() {
+			return ErrInvalidPrivateKey
+		}
+		c.Interface.PrivateKey = *key
+		key.Zero()
+	case "interface.address":
+		for _, item := range splitList(value) {
+			address, err := parseAddress(item, false)
+			if err != nil {
+				address, err = parseAddress(item, true)
+			}
+			if err != nil {
+				return err
+			}
+			c.Interface.Addresses = append(c.Interface.Addresses, *address)
+		}
+	case "interface.dns":
+		for _, item := range splitList(value) {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return ErrInvalidDNS
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			c.Interface.DNS = append(c.Interface.DNS, ip)
+		}
+	case "peer.publickey":
+		key, err := decodeKey(value)
+		if err != nil || key.IsZero() {
+			return ErrInvalidPublicKey
+		}
+		c.Peer.PublicKey = *key
+	case "peer.allowedips":
+		allowed, err := ParseAllowedIPs(string(value))
+		if err != nil {
+			return err
+		}
+		c.Peer.AllowedIPs = append(c.Peer.AllowedIPs, allowed...)
+	case "peer.endpoint":
+		endpoint, err := parseEndpoint(string(value))
+		if err != nil {
+			return err
+		}
+		c.Peer.Endpoint = endpoint
+	default:
+		return ErrUnknownField
+	}
+	return nil
+}
+
+// Validate checks that the config is complete and can start a tunnel.
+func (c *Config) Validate() error {
+	return c.validate(true)
+}
+
+func (c *Config) validate(needPrivateKey bool) error {
+	if needPrivateKey && c.Interface.PrivateKey.IsZero() {
+		return ErrInvalidPrivateKey
+	}
+	if len(c.Interface.Addresses) == 0 {
+		return ErrInvalidAddress
+	}
+	if c.Peer.PublicKey.IsZero() {
+		return ErrInvalidPublicKey
+	}
+	if len(c.Peer.AllowedIPs) == 0 {
+		return ErrInvalidAllowedIPs
+	}
+	if c.Peer.Endpoint.Host == "" {
+		return ErrInvalidEndpoint
+	}
+	return nil
+}
+
+// WithPlaceholderKey returns a copy of the config with a new random private
+// key in place of the real one, for the config file that starts the tunnel
+// service before the real key is installed.
+func (c *Config) WithPlaceholderKey() (*Config, error) {
+	key, err := keys.NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	placeholder := *c
+	placeholder.Interface.PrivateKey = *key
+	key.Zero()
+	return &placeholder, nil
+}
@@ -0,0 +1,238 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package wgconfig
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keystore"
+)
+
+func TestParseGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.conf"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No golden configs: %v", err)
+	}
+	for _, file := range files {
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := Parse(text)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if err := config.Validate(); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if config.WgQuick() != string(text) {
+			t.Fatalf("%s does not round trip:\n%s", file, config.WgQuick())
+		}
+	}
+}
+
+func TestParseBuild(t *testing.T) {
+	built, err := Build(&Options{Server: testServer(), Device: testDevice(), PrivateKey: testPrivateKey(), IPv6: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Parse([]byte(built.WgQuick()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, built) {
+		t.Fatalf("Expected %+v, got %+v", built, parsed)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	text := `# Comments and blank lines are skipped
+
+[interface]
+address = 10.99.0.2/32
+Address = fc00:bbbb:bbbb:bb01::2/128 # IPv6
+DNS=10.64.0.1
+
+  [Peer]
+PublicKey = 3p6r7rR4vTAXXXrNw7RJ/NWJ/d9IxjdqnuZiKgDp8ks=
+AllowedIPs = 0.0.0.0/0
+AllowedIPs = ::/0
+Endpoint = [2001:db8::10]:51820
+`
+	config, err := Parse([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Interface.Addresses) != 2 || len(config.Peer.AllowedIPs) != 2 {
+		t.Fatalf("Lists were not merged: %+v", config)
+	}
+	if config.Peer.Endpoint.String() != "[2001:db8::10]:51820" {
+		t.Fatalf("Unexpected endpoint %s", config.Peer.Endpoint.String())
+	}
+
+	// The private key can come from elsewhere
+	if !config.Interface.PrivateKey.IsZero() {
+		t.Fatal("Unexpected private key")
+	}
+	if err := config.Validate(); err != ErrInvalidPrivateKey {
+		t.Fatalf("Expected ErrInvalidPrivateKey, got %v", err)
+	}
+	config.Interface.PrivateKey = *testPrivateKey()
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	valid := testdataConfig(t)
+	tests := []struct {
+		name string
+		text string
+		err  error
+	}{
+		{"Empty", "", ErrInvalidSections},
+		{"No peer", strings.Split(valid, "[Peer]")[0], ErrInvalidSections},
+		{"Two peers", valid + "\n[Peer]\n", ErrInvalidSections},
+		{"Field before section", "Address = 10.0.0.1\n" + valid, ErrInvalidSyntax},
+		{"No equals", strings.Replace(valid, "DNS = ", "DNS ", 1), ErrInvalidSyntax},
+		{"Unknown section", valid + "[Other]\n", ErrUnknownField},
+		{"Unknown field", strings.Replace(valid, "DNS", "PostUp", 1), ErrUnknownField},
+		{"Short private key", strings.Replace(valid, "PrivateKey = ", "PrivateKey = A", 1), ErrInvalidPrivateKey},
+		{"Zero private key", replaceField(valid, "PrivateKey", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="), ErrInvalidPrivateKey},
+		{"Invalid public key", replaceField(valid, "PublicKey", "not a key"), ErrInvalidPublicKey},
+		{"Invalid address", replaceField(valid, "Address", "10.99.0.256/32"), ErrInvalidAddress},
+		{"Invalid DNS", replaceField(valid, "DNS", "gateway"), ErrInvalidDNS},
+		{"Invalid AllowedIPs", replaceField(valid, "AllowedIPs", "everything"), ErrInvalidAllowedIPs},
+		{"Hostname endpoint", replaceField(valid, "Endpoint", "us1-wireguard:4000"), ErrInvalidEndpoint},
+		{"Zero port", replaceField(valid, "Endpoint", "192.0.2.10:0"), ErrInvalidEndpoint},
+		{"Missing endpoint", replaceField(valid, "Endpoint", ""), ErrInvalidEndpoint},
+		{"Missing address", strings.Replace(valid, "Address", "# Address", 1), ErrInvalidAddress},
+		{"Missing public key", strings.Replace(valid, "PublicKey", "# PublicKey", 1), ErrInvalidPublicKey},
+		{"Missing AllowedIPs", strings.Replace(valid, "AllowedIPs", "# AllowedIPs", 1), ErrInvalidAllowedIPs},
+		{"Missing endpoint line", strings.Replace(valid, "Endpoint", "# Endpoint", 1), ErrInvalidEndpoint},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Parse([]byte(test.text)); !errors.Is(err, test.err) {
+				t.Fatalf("Expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func testdataConfig(t *testing.T) string {
+	text, err := ioutil.ReadFile(filepath.Join("testdata", "default.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(text)
+}
+
+// replaceField replaces the value of the first line of a field.
+func replaceField(text, field, value string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, field+" = ") {
+			lines[i] = field + " = " + value
+			break
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestWithPlaceholderKey(t *testing.T) {
+	config, err := Build(&Options{Server: testServer(), Device: testDevice(), PrivateKey: testPrivateKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeholder, err := config.WithPlaceholderKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if placeholder.Interface.PrivateKey == config.Interface.PrivateKey || placeholder.Interface.PrivateKey.IsZero() {
+		t.Fatal("Placeholder key is not a new key")
+	}
+	if config.Interface.PrivateKey != *testPrivateKey() {
+		t.Fatal("Config was changed")
+	}
+	if strings.Contains(placeholder.WgQuick(), testPrivateKey().String()) {
+		t.Fatal("Placeholder config contains the private key")
+	}
+}
+
+// plainSealer stores keys as they are, which is enough to test loading.
+type plainSealer struct{}
+
+func (plainSealer) Seal(plaintext []byte) ([]byte, error) {
+	return append([]byte(nil), plaintext...), nil
+}
+
+func (plainSealer) Open(sealed []byte) ([]byte, error) {
+	return append([]byte(nil), sealed...), nil
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := keystore.NewFileStore(dir, plainSealer{})
+	ref, err := store.Put("user@example.com", testPrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withKey := testdataConfig(t)
+	withoutKey := strings.Replace(withKey, "PrivateKey", "# PrivateKey", 1)
+	tests := []struct {
+		name   string
+		text   string
+		keyRef string
+		err    error
+	}{
+		{"Key in config", withKey, "", nil},
+		{"Key in store", withoutKey, ref.String(), nil},
+		{"Latest key in store", withoutKey, "user@example.com", nil},
+		{"No key", withoutKey, "", ErrInvalidPrivateKey},
+		{"Both keys", withKey, ref.String(), ErrKeyConflict},
+		{"Unknown account", withoutKey, "other@example.com", keystore.ErrNotFound},
+		{"Invalid reference", withoutKey, "user@example.com#x", keystore.ErrInvalidRef},
+		{"Invalid config", strings.Replace(withoutKey, "Endpoint", "# Endpoint", 1), ref.String(), ErrInvalidEndpoint},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := []byte(test.text)
+			config, err := Load(buf, store, test.keyRef)
+			for _, b := range buf {
+				if b != 0 {
+					t.Fatal("Buffer was not zeroed")
+				}
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Expected %v, got %v", test.err, err)
+			}
+			if err == nil && config.Interface.PrivateKey != *testPrivateKey() {
+				t.Fatal("Wrong private key")
+			}
+		})
+	}
+
+	var zero keys.Key
+	if _, err := store.Put("zero@example.com", &zero); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load([]byte(withoutKey), store, "zero@example.com"); err != ErrInvalidPrivateKey {
+		t.Fatalf("Expected ErrInvalidPrivateKey for a zero stored key, got %v", err)
+	}
+}
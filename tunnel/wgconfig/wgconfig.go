@@ -0,0 +1,260 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+// Package wgconfig builds the WireGuard configuration of the tunnel from a
+// Guardian server list entry and the registered device.
+package wgconfig
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/guardian"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+)
+
+// DefaultAllowedIPs routes all traffic through the tunnel.
+const DefaultAllowedIPs = "0.0.0.0/0, ::/0"
+
+var (
+	ErrInvalidPrivateKey = errors.New("Private key is missing")
+	ErrInvalidPublicKey  = errors.New("Server public key is invalid")
+	ErrKeyMismatch       = errors.New("Device public key does not match the private key")
+	ErrInvalidEndpoint   = errors.New("Server endpoint must be an IPv4 address")
+	ErrInvalidPort       = errors.New("Port is not in the server port ranges")
+	ErrInvalidAddress    = errors.New("Device address is invalid")
+	ErrInvalidDNS        = errors.New("Server gateway must be an IPv4 address")
+	ErrInvalidAllowedIPs = errors.New("AllowedIPs must be a non-empty list of CIDRs")
+)
+
+// Options are the inputs of Build.
+type Options struct {
+	Server     guardian.Server
+	Device     guardian.Device
+	PrivateKey *keys.Key
+
+	// AllowedIPs is a comma separated list of CIDRs. DefaultAllowedIPs is
+	// used when it is empty.
+	AllowedIPs string
+
+	// Port is the endpoint port. When zero, the lowest port of the server
+	// port ranges is used, so that the output only depends on the inputs.
+	Port int
+
+	// IPv6 adds the IPv6 address of the device to the interface.
+	IPv6 bool
+}
+
+// Interface is the [Interface] section of a config.
+type Interface struct {
+	PrivateKey keys.Key
+	Addresses  []net.IPNet
+	DNS        []net.IP
+}
+
+// Peer is the [Peer] section of a config.
+type Peer struct {
+	PublicKey  keys.Key
+	AllowedIPs []net.IPNet
+	Endpoint   Endpoint
+}
+
+// Endpoint is the address of a peer.
+type Endpoint struct {
+	Host string
+	Port uint16
+}
+
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(int(e.Port)))
+}
+
+// Config is a validated tunnel configuration with a single peer.
+type Config struct {
+	Interface Interface
+	Peer      Peer
+}
+
+// Build validates opts and returns the configuration of the tunnel.
+func Build(opts *Options) (*Config, error) {
+	if opts.PrivateKey == nil || opts.PrivateKey.IsZero() {
+		return nil, ErrInvalidPrivateKey
+	}
+	publicKey, err := keys.NewKeyFromString(opts.Server.PublicKey)
+	if err != nil || publicKey.IsZero() {
+		return nil, ErrInvalidPublicKey
+	}
+	if opts.Device.Pubkey != "" && opts.Device.Pubkey != opts.PrivateKey.Public().String() {
+		return nil, ErrKeyMismatch
+	}
+
+	endpoint := net.ParseIP(opts.Server.Ipv4AddrIn)
+	if endpoint == nil || endpoint.To4() == nil {
+		return nil, ErrInvalidEndpoint
+	}
+	port, err := selectPort(&opts.Server, opts.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	dns := net.ParseIP(opts.Server.Ipv4Gateway)
+	if dns == nil || dns.To4() == nil {
+		return nil, ErrInvalidDNS
+	}
+
+	address, err := parseAddress(opts.Device.Ipv4Address, false)
+	if err != nil {
+		return nil, err
+	}
+	addresses := []net.IPNet{*address}
+	if opts.IPv6 {
+		address, err := parseAddress(opts.Device.Ipv6Address, true)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, *address)
+	}
+
+	allowedIPs := opts.AllowedIPs
+	if strings.TrimSpace(allowedIPs) == "" {
+		allowedIPs = DefaultAllowedIPs
+	}
+	allowed, err := ParseAllowedIPs(allowedIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Config{
+		Interface: Interface{
+			PrivateKey: *opts.PrivateKey,
+			Addresses:  addresses,
+			DNS:        []net.IP{dns.To4()},
+		},
+		Peer: Peer{
+			PublicKey:  *publicKey,
+			AllowedIPs: allowed,
+			Endpoint:   Endpoint{Host: endpoint.To4().String(), Port: uint16(port)},
+		},
+	}, nil
+}
+
+func selectPort(server *guardian.Server, port int) (int, error) {
+	ranges, err := server.Ports()
+	if err != nil {
+		return 0, err
+	}
+	if port == 0 {
+		port = int(ranges[0].From)
+		for _, r := range ranges[1:] {
+			if int(r.From) < port {
+				port = int(r.From)
+			}
+		}
+		return port, nil
+	}
+	for _, r := range ranges {
+		if r.Contains(port) {
+			return port, nil
+		}
+	}
+	return 0, ErrInvalidPort
+}
+
+// parseAddress accepts an address with or without a prefix length, and keeps
+// the host part, as the Guardian API may return a mask that is bigger than a
+// single IP.
+func parseAddress(s string, ipv6 bool) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	var ip net.IP
+	var mask net.IPMask
+	if strings.Contains(s, "/") {
+		var ipnet *net.IPNet
+		var err error
+		ip, ipnet, err = net.ParseCIDR(s)
+		if err != nil {
+			return nil, ErrInvalidAddress
+		}
+		mask = ipnet.Mask
+	} else {
+		ip = net.ParseIP(s)
+	}
+	if ip == nil || (ip.To4() == nil) != ipv6 {
+		return nil, ErrInvalidAddress
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if mask == nil {
+		mask = net.CIDRMask(len(ip)*8, len(ip)*8)
+	}
+	return &net.IPNet{IP: ip, Mask: mask}, nil
+}
+
+// ParseAllowedIPs parses a comma separated list of CIDRs. Host bits are
+// cleared and duplicates are dropped, keeping the order of the list.
+func ParseAllowedIPs(s string) ([]net.IPNet, error) {
+	var allowed []net.IPNet
+	seen := make(map[string]bool)
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, ErrInvalidAllowedIPs
+		}
+		if seen[ipnet.String()] {
+			continue
+		}
+		seen[ipnet.String()] = true
+		allowed = append(allowed, *ipnet)
+	}
+	if len(allowed) == 0 {
+		return nil, ErrInvalidAllowedIPs
+	}
+	return allowed, nil
+}
+
+func joinIPNets(ipnets []net.IPNet) string {
+	s := make([]string, len(ipnets))
+	for i := range ipnets {
+		s[i] = ipnets[i].String()
+	}
+	return strings.Join(s, ", ")
+}
+
+func joinIPs(ips []net.IP) string {
+	s := make([]string, len(ips))
+	for i := range ips {
+		s[i] = ips[i].String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// WgQuick returns the config in the wg-quick format read by the tunnel
+// service. The output only depends on the config.
+func (c *Config) WgQuick() string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", c.Interface.PrivateKey.String())
+	fmt.Fprintf(&b, "Address = %s\n", joinIPNets(c.Interface.Addresses))
+	if len(c.Interface.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", joinIPs(c.Interface.DNS))
+	}
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", c.Peer.PublicKey.String())
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", joinIPNets(c.Peer.AllowedIPs))
+	fmt.Fprintf(&b, "Endpoint = %s\n", c.Peer.Endpoint.String())
+	return b.String()
+}
+
+// Zero overwrites the private key of the config.
+func (c *Config) Zero() {
+	c.Interface.PrivateKey.Zero()
+}
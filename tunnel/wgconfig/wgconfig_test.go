@@ -0,0 +1,144 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019 Edge Security LLC. All Rights Reserved.
+ */
+
+package wgconfig
+
+import (
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/guardian"
+	"github.com/mozilla-services/guardian-vpn-windows/tunnel/keys"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func testPrivateKey() *keys.Key {
+	var key keys.Key
+	b, _ := hex.DecodeString("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	copy(key[:], b)
+	return &key
+}
+
+func testServer() guardian.Server {
+	return guardian.Server{
+		Hostname:         "us1-wireguard",
+		Ipv4AddrIn:       "192.0.2.10",
+		Weight:           100,
+		IncludeInCountry: true,
+		PublicKey:        "3p6r7rR4vTAXXXrNw7RJ/NWJ/d9IxjdqnuZiKgDp8ks=",
+		PortRanges:       [][]int{{53, 53}, {4000, 33433}, {34000, 34999}},
+		Ipv4Gateway:      "10.64.0.1",
+		Ipv6Gateway:      "fc00:bbbb:bbbb:bb01::1",
+	}
+}
+
+func testDevice() guardian.Device {
+	return guardian.Device{
+		Name:        "Test device",
+		Pubkey:      testPrivateKey().Public().String(),
+		Ipv4Address: "10.99.0.2/32",
+		Ipv6Address: "fc00:bbbb:bbbb:bb01::2/128",
+	}
+}
+
+func TestBuildGolden(t *testing.T) {
+	tests := []struct {
+		name    string
+		options func(*Options)
+	}{
+		{"default", func(o *Options) {}},
+		{"ipv6", func(o *Options) { o.IPv6 = true }},
+		{"local", func(o *Options) {
+			o.AllowedIPs = "0.0.0.0/1, 128.0.0.0/1, ::/1, 8000::/1"
+			o.Port = 34512
+		}},
+		{"normalized", func(o *Options) {
+			o.Server.PortRanges = [][]int{{33433, 4000}, {1194}}
+			o.Device.Ipv4Address = "10.99.0.2"
+			o.Device.Ipv6Address = "fc00:bbbb:bbbb:bb01::2/64"
+			o.AllowedIPs = "0.0.0.0/0,::0/0, 0.0.0.0/0, 10.1.2.3/8"
+			o.IPv6 = true
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := &Options{Server: testServer(), Device: testDevice(), PrivateKey: testPrivateKey()}
+			test.options(options)
+			config, err := Build(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := config.WgQuick()
+
+			golden := filepath.Join("testdata", test.name+".conf")
+			if *update {
+				if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Fatalf("Config does not match %s:\n%s", golden, got)
+			}
+
+			again, err := Build(options)
+			if err != nil || again.WgQuick() != got {
+				t.Fatal("Build is not deterministic")
+			}
+		})
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		options func(*Options)
+		err     error
+	}{
+		{"Missing private key", func(o *Options) { o.PrivateKey = nil }, ErrInvalidPrivateKey},
+		{"Zero private key", func(o *Options) { o.PrivateKey = new(keys.Key) }, ErrInvalidPrivateKey},
+		{"Invalid server key", func(o *Options) { o.Server.PublicKey = "not a key" }, ErrInvalidPublicKey},
+		{"Key mismatch", func(o *Options) { o.Device.Pubkey = o.Server.PublicKey }, ErrKeyMismatch},
+		{"Missing endpoint", func(o *Options) { o.Server.Ipv4AddrIn = "" }, ErrInvalidEndpoint},
+		{"IPv6 endpoint", func(o *Options) { o.Server.Ipv4AddrIn = "2001:db8::1" }, ErrInvalidEndpoint},
+		{"No port ranges", func(o *Options) { o.Server.PortRanges = nil }, guardian.ErrInvalidPortRanges},
+		{"Empty port range", func(o *Options) { o.Server.PortRanges = [][]int{{}} }, guardian.ErrInvalidPortRanges},
+		{"Port out of bounds", func(o *Options) { o.Server.PortRanges = [][]int{{0, 65536}} }, guardian.ErrInvalidPortRanges},
+		{"Port outside ranges", func(o *Options) { o.Port = 3999 }, ErrInvalidPort},
+		{"Invalid gateway", func(o *Options) { o.Server.Ipv4Gateway = "fc00::1" }, ErrInvalidDNS},
+		{"Invalid IPv4 address", func(o *Options) { o.Device.Ipv4Address = "10.99.0.256/32" }, ErrInvalidAddress},
+		{"IPv6 in IPv4 address", func(o *Options) { o.Device.Ipv4Address = "fc00::2/128" }, ErrInvalidAddress},
+		{"Missing IPv6 address", func(o *Options) { o.IPv6 = true; o.Device.Ipv6Address = "" }, ErrInvalidAddress},
+		{"Invalid AllowedIPs", func(o *Options) { o.AllowedIPs = "0.0.0.0/0, everything" }, ErrInvalidAllowedIPs},
+		{"Empty AllowedIPs", func(o *Options) { o.AllowedIPs = " , " }, ErrInvalidAllowedIPs},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := &Options{Server: testServer(), Device: testDevice(), PrivateKey: testPrivateKey()}
+			test.options(options)
+			if _, err := Build(options); err != test.err {
+				t.Fatalf("Expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestZero(t *testing.T) {
+	config, err := Build(&Options{Server: testServer(), Device: testDevice(), PrivateKey: testPrivateKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Zero()
+	if !config.Interface.PrivateKey.IsZero() {
+		t.Fatal("Private key was not zeroed")
+	}
+}
@@ -52,7 +52,7 @@ namespace FirefoxPrivateNetwork
                 }
             }
 
-            if (args.Count() == 2)
+            if (args.Count() == 2 || args.Count() == 3)
             {
                 // Run the tunnel service, skip the UI
                 if (args.First().ToLower() == "tunnel")
@@ -124,15 +124,18 @@ namespace FirefoxPrivateNetwork
         /// <param name="args">
         /// Argument 0: "tunnel" keyword
         /// Argument 1: Path to the configuration file.
+        /// Argument 2 (optional): Key store reference of the private key, when the configuration file has none.
+        /// The service then loads the key from the key store next to the configuration file.
         /// </param>
         private static void RunTunnelService(string[] args)
         {
             var configFilePath = args[1];
+            var keyRef = args.ElementAtOrDefault(2);
 
             try
             {
-                var error = Tunnel.TunnelService(configFilePath);
-                Environment.Exit(0);
+                var error = Tunnel.TunnelService(configFilePath, keyRef);
+                Environment.Exit((int)error);
             }
             catch (Exception e)
             {
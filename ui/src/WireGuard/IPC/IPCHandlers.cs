@@ -122,7 +122,16 @@ namespace FirefoxPrivateNetwork.WireGuard
                     return;
                 }
 
-                var serviceStartResult = Service.InstallAndRun("\"" + System.AppDomain.CurrentDomain.BaseDirectory + System.AppDomain.CurrentDomain.FriendlyName + "\"" + " tunnel " + "\"" + configFilePath + "\"");
+                var servicePath = "\"" + System.AppDomain.CurrentDomain.BaseDirectory + System.AppDomain.CurrentDomain.FriendlyName + "\"" + " tunnel " + "\"" + configFilePath + "\"";
+
+                // The tunnel service loads the private key from the key store by its reference
+                string keyRef = cmd["key_ref"].FirstOrDefault();
+                if (!string.IsNullOrEmpty(keyRef))
+                {
+                    servicePath += " \"" + keyRef + "\"";
+                }
+
+                var serviceStartResult = Service.InstallAndRun(servicePath);
                 if (serviceStartResult.Success)
                 {
                     return;
@@ -6,6 +6,7 @@ using System;
 using System.IO.Pipes;
 using System.Linq;
 using System.Runtime.InteropServices;
+using System.Text;
 
 namespace FirefoxPrivateNetwork.WireGuard
 {
@@ -44,40 +45,72 @@ namespace FirefoxPrivateNetwork.WireGuard
         /// Main WireGuard Tunnel Service endpoint within tunnel.dll, calling this will initiate a WireGuard service.
         /// </summary>
         /// <param name="configurationFilename">Path to the filename which will be used for this tunnel instance.</param>
-        /// <returns>Returns true when the service completes successfully.</returns>
+        /// <returns>Returns ErrorSuccess when the service completes successfully, or the category of the failure otherwise.</returns>
         [DllImport("tunnel.dll", EntryPoint = "WireGuardTunnelService", CallingConvention = CallingConvention.Cdecl)]
-        public static extern bool WireGuardTunnelService([MarshalAs(UnmanagedType.LPWStr)] string configurationFilename);
+        public static extern WireGuardTunnelExitCodes WireGuardTunnelService([MarshalAs(UnmanagedType.LPWStr)] string configurationFilename);
+
+        /// <summary>
+        /// WireGuard Tunnel Service endpoint within tunnel.dll for configuration files without a private key.
+        /// </summary>
+        /// <param name="configurationFilename">Path to the filename which will be used for this tunnel instance.</param>
+        /// <param name="keyRef">Key store reference of the private key, which the service loads from the key store next to the configuration file.</param>
+        /// <returns>Returns ErrorSuccess when the service completes successfully, or the category of the failure otherwise.</returns>
+        [DllImport("tunnel.dll", EntryPoint = "WireGuardTunnelServiceWithKeyRef", CallingConvention = CallingConvention.Cdecl)]
+        public static extern WireGuardTunnelExitCodes WireGuardTunnelServiceWithKeyRef([MarshalAs(UnmanagedType.LPWStr)] string configurationFilename, [MarshalAs(UnmanagedType.LPWStr)] string keyRef);
+
+        /// <summary>
+        /// Retrieves the error of the last tunnel service run.
+        /// </summary>
+        /// <param name="message">Buffer receiving the error message, empty if there was no error.</param>
+        /// <param name="messageLength">Length of the message buffer in characters.</param>
+        /// <returns>Exit code of the last tunnel service run.</returns>
+        [DllImport("tunnel.dll", EntryPoint = "WireGuardTunnelLastError", CallingConvention = CallingConvention.Cdecl)]
+        public static extern WireGuardTunnelExitCodes WireGuardTunnelLastError([MarshalAs(UnmanagedType.LPWStr)] StringBuilder message, uint messageLength);
 
         /// <summary>
         /// TunnelService thread, harnesses Tunnel.dll and initiates the WireGuard tunneling service.
         /// Called from Main.cs when the exe is run with the "tunnel" parameter.
         /// </summary>
         /// <param name="confFilePath">Path to the WireGuard config file to use, containing keys, IPs and everything else.</param>
-        /// <returns>True on successful startup of the tunnel service, false otherwise.</returns>
-        public static bool TunnelService(string confFilePath)
+        /// <param name="keyRef">Key store reference of the private key when the config file has none, or null.</param>
+        /// <returns>ErrorSuccess on successful startup of the tunnel service, the category of the failure otherwise.</returns>
+        public static WireGuardTunnelExitCodes TunnelService(string confFilePath, string keyRef = null)
         {
             try
             {
                 ErrorHandling.DebugLogger.LogDebugMsg("Attempting to start tunnel service");
-                return WireGuardTunnelService(confFilePath);
+                var exitCode = string.IsNullOrEmpty(keyRef) ? WireGuardTunnelService(confFilePath) : WireGuardTunnelServiceWithKeyRef(confFilePath, keyRef);
+                if (exitCode != WireGuardTunnelExitCodes.ErrorSuccess)
+                {
+                    var message = new StringBuilder(1024);
+                    WireGuardTunnelLastError(message, (uint)message.Capacity);
+                    ErrorHandling.ErrorHandler.Handle(string.Concat("Tunnel service failed with ", exitCode.ToString(), ": ", message.ToString()), ErrorHandling.LogLevel.Error);
+                }
+
+                return exitCode;
             }
             catch (ExternalException e)
             {
                 ErrorHandling.ErrorHandler.Handle(e, ErrorHandling.LogLevel.Error);
             }
 
-            return false;
+            return WireGuardTunnelExitCodes.ErrorWin32;
         }
 
         /// <summary>
         /// Saves a config file to the users' AppData folder and sends a connect command to the Broker.
         /// </summary>
+        /// <param name="keyRef">Key store reference of the private key, for a config file without one.</param>
         /// <returns>True if successfully sent connection command.</returns>
-        public bool Connect()
+        public bool Connect(string keyRef = null)
         {
             var configFilePath = ProductConstants.FirefoxPrivateNetworkConfFile;
             var connectMessage = new IPCMessage(IPCCommand.IpcConnect);
             connectMessage.AddAttribute("config", configFilePath);
+            if (!string.IsNullOrEmpty(keyRef))
+            {
+                connectMessage.AddAttribute("key_ref", keyRef);
+            }
 
             var writeToPipeResult = brokerIPC.WriteToPipe(connectMessage);
             if (writeToPipeResult)